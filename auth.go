@@ -0,0 +1,137 @@
+package ds2bq
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"google.golang.org/appengine/user"
+)
+
+// Authorizer decides whether the request to an endpoint of ds2bq is allowed.
+// Authorize returns nil if allowed, or an error that is responded, e.g. with status 401 or 403.
+type Authorizer interface {
+	Authorize(c context.Context, r *http.Request) error
+}
+
+// AuthorizerFunc is an adapter to use a function as Authorizer.
+type AuthorizerFunc func(c context.Context, r *http.Request) error
+
+// Authorize calls f(c, r).
+func (f AuthorizerFunc) Authorize(c context.Context, r *http.Request) error {
+	return f(c, r)
+}
+
+// AllowAll returns Authorizer that allows any request.
+func AllowAll() Authorizer {
+	return AuthorizerFunc(func(c context.Context, r *http.Request) error {
+		return nil
+	})
+}
+
+// AdminAuthorizer returns Authorizer that allows the administrator of the app signed in with Google account.
+func AdminAuthorizer() Authorizer {
+	return AuthorizerFunc(func(c context.Context, r *http.Request) error {
+		if !user.IsAdmin(c) {
+			return newHTTPError(http.StatusForbidden, "administrator is required")
+		}
+		return nil
+	})
+}
+
+// CronAuthorizer returns Authorizer that allows requests from App Engine cron.
+// App Engine removes X-AppEngine-Cron header of requests from outside of the app.
+func CronAuthorizer() Authorizer {
+	return AuthorizerFunc(func(c context.Context, r *http.Request) error {
+		if r.Header.Get("X-AppEngine-Cron") != "true" {
+			return newHTTPError(http.StatusForbidden, "cron request is required")
+		}
+		return nil
+	})
+}
+
+// TaskqueueAuthorizer returns Authorizer that allows requests from the queues of App Engine Task Queue,
+// or from any queue if queueNames is empty.
+// App Engine removes X-AppEngine-QueueName header of requests from outside of the app.
+func TaskqueueAuthorizer(queueNames ...string) Authorizer {
+	return AuthorizerFunc(func(c context.Context, r *http.Request) error {
+		queueName := r.Header.Get("X-AppEngine-QueueName")
+		if queueName == "" {
+			return newHTTPError(http.StatusForbidden, "task queue request is required")
+		}
+		if len(queueNames) == 0 {
+			return nil
+		}
+		for _, v := range queueNames {
+			if isInTaskqueue(r, v) {
+				return nil
+			}
+		}
+		return newHTTPError(http.StatusForbidden, "task of queue %s is not allowed", queueName)
+	})
+}
+
+// OIDCAuthorizer returns Authorizer that allows requests with Google-signed OIDC token verified by v,
+// sent by Cloud Scheduler, Cloud Tasks or Pub/Sub push.
+func OIDCAuthorizer(v *OIDCVerifier) Authorizer {
+	return AuthorizerFunc(func(c context.Context, r *http.Request) error {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			return newHTTPError(http.StatusUnauthorized, "bearer token is required")
+		}
+		_, err := v.Verify(c, strings.TrimPrefix(auth, "Bearer "))
+		if err != nil {
+			return newHTTPError(http.StatusUnauthorized, "%s", err)
+		}
+		return nil
+	})
+}
+
+// AnyAuthorizer returns Authorizer that allows requests allowed by any of authorizers.
+func AnyAuthorizer(authorizers ...Authorizer) Authorizer {
+	return AuthorizerFunc(func(c context.Context, r *http.Request) error {
+		var msgs []string
+		for _, a := range authorizers {
+			err := a.Authorize(c, r)
+			if err == nil {
+				return nil
+			}
+			msgs = append(msgs, err.Error())
+		}
+		return newHTTPError(http.StatusForbidden, "%s", strings.Join(msgs, "; "))
+	})
+}
+
+// defaultAPIAuthorizer allows administrators and cron.
+func defaultAPIAuthorizer() Authorizer {
+	return AnyAuthorizer(AdminAuthorizer(), CronAuthorizer())
+}
+
+// defaultTaskAuthorizer allows tasks of any queue.
+func defaultTaskAuthorizer() Authorizer {
+	return TaskqueueAuthorizer()
+}
+
+// authorize returns the error of a if the request is not allowed.
+// The error is *httpError with status 403 unless a returns *httpError.
+func authorize(c context.Context, r *http.Request, a Authorizer) error {
+	err := a.Authorize(c, r)
+	if err == nil {
+		return nil
+	}
+	logWarning(c, "ds2bq: request is not authorized", F("path", r.URL.Path), F(FieldError, err))
+	if _, ok := err.(*httpError); !ok {
+		err = newHTTPError(http.StatusForbidden, "%s", err)
+	}
+	return err
+}
+
+// serveAuthorized writes the error response and reports false if the request is not allowed.
+func serveAuthorized(c context.Context, w http.ResponseWriter, r *http.Request, a Authorizer) bool {
+	err := authorize(c, r, a)
+	if err != nil {
+		writeError(w, err)
+		return false
+	}
+	return true
+}
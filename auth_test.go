@@ -0,0 +1,86 @@
+package ds2bq
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTaskqueueAuthorizer(t *testing.T) {
+	for i, tc := range []struct {
+		queueNames []string
+		header     string
+		ok         bool
+	}{
+		{nil, "", false},
+		{nil, "default", true},
+		{[]string{"datastore-to-bq"}, "datastore-to-bq", true},
+		{[]string{"datastore-to-bq"}, "default", false},
+		{[]string{"datastore-to-bq"}, "", false},
+	} {
+		r := httptest.NewRequest("POST", "/tq/gcs/object-to-bq", nil)
+		if tc.header != "" {
+			r.Header.Set("X-AppEngine-QueueName", tc.header)
+		}
+
+		err := TaskqueueAuthorizer(tc.queueNames...).Authorize(context.Background(), r)
+		if tc.ok && err != nil {
+			t.Errorf("%02d: unexpected error %s", i, err)
+		} else if !tc.ok && err == nil {
+			t.Errorf("%02d: expected error", i)
+		}
+	}
+}
+
+func TestCronAuthorizer(t *testing.T) {
+	r := httptest.NewRequest("GET", "/tq/datastore-management/delete-old-backups", nil)
+	if err := CronAuthorizer().Authorize(context.Background(), r); err == nil {
+		t.Error("expected error")
+	}
+
+	r.Header.Set("X-AppEngine-Cron", "true")
+	if err := CronAuthorizer().Authorize(context.Background(), r); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAnyAuthorizer(t *testing.T) {
+	a := AnyAuthorizer(CronAuthorizer(), TaskqueueAuthorizer())
+
+	r := httptest.NewRequest("GET", "/tq/datastore-management/delete-old-backups", nil)
+	err := a.Authorize(context.Background(), r)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if e, g := http.StatusForbidden, err.(*httpError).StatusCode(); e != g {
+		t.Errorf("expected %d; got %d", e, g)
+	}
+
+	r.Header.Set("X-AppEngine-QueueName", "default")
+	if err := a.Authorize(context.Background(), r); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOIDCAuthorizer(t *testing.T) {
+	key := newTestOIDCKey(t, "key1")
+	a := OIDCAuthorizer(&OIDCVerifier{
+		Audience: "https://example.appspot.com/tq/gcs/object-to-bq",
+		JWKS:     key.jwks(t),
+	})
+
+	r := httptest.NewRequest("POST", "/tq/gcs/object-to-bq", nil)
+	err := a.Authorize(context.Background(), r)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if e, g := http.StatusUnauthorized, err.(*httpError).StatusCode(); e != g {
+		t.Errorf("expected %d; got %d", e, g)
+	}
+
+	r.Header.Set("Authorization", "Bearer "+key.sign(t, testOIDCClaims()))
+	if err := a.Authorize(context.Background(), r); err != nil {
+		t.Error(err)
+	}
+}
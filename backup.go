@@ -0,0 +1,141 @@
+package ds2bq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/favclip/ds2bq/backupfile"
+	"google.golang.org/api/storage/v1"
+)
+
+// Backup is the backup of a kind on GCS, Datastore Admin backup or managed export.
+type Backup struct {
+	Req *GCSObjectToBQJobReq
+	// TypeInfo is the type info of the kind in .backup_info file. it is nil for managed export.
+	TypeInfo *AEBackupEntityTypeInfo
+	// Kinds is all kinds in the backup. it is nil for managed export.
+	Kinds []string
+
+	sts   *storage.Service
+	files [][2]string // bucket and object name of output files.
+}
+
+// OpenBackup reads the metadata file of req and returns Backup.
+func OpenBackup(c context.Context, req *GCSObjectToBQJobReq) (*Backup, error) {
+	sts, err := newStorageService(c)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Backup{Req: req, sts: sts}
+	switch {
+	case strings.HasSuffix(req.FilePath, ".backup_info"):
+		err = b.readBackupInfo(c)
+	case strings.HasSuffix(req.FilePath, ".export_metadata"):
+		err = b.listExportFiles(c)
+	default:
+		err = fmt.Errorf("ds2bq: unexpected backup file %s", req.FilePath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func (b *Backup) readBackupInfo(c context.Context) error {
+	r, err := openObject(c, b.sts, b.Req.Bucket, b.Req.FilePath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	info, err := backupfile.ReadBackupInfo(r)
+	if err != nil {
+		return err
+	}
+	if e := info.Information(); e != nil {
+		for _, v := range e.Values("kinds") {
+			if kind, ok := v.(string); ok {
+				b.Kinds = append(b.Kinds, kind)
+			}
+		}
+	}
+	for _, file := range info.Files() {
+		bucket, name, err := parseGSPath(file)
+		if err != nil {
+			return err
+		}
+		b.files = append(b.files, [2]string{bucket, name})
+	}
+	for _, e := range info.Entities {
+		if e.Key == nil || e.Key.Kind() != "_AE_Backup_Information_Kind_Type_Info" {
+			continue
+		}
+		p := e.Property("entity_type_info")
+		if p == nil {
+			continue
+		}
+		v, ok := p.Value.(string)
+		if !ok {
+			continue
+		}
+		typeInfo := &AEBackupEntityTypeInfo{}
+		if err := json.Unmarshal([]byte(v), typeInfo); err != nil {
+			return err
+		}
+		if typeInfo.Kind == b.Req.KindName {
+			b.TypeInfo = typeInfo
+		}
+	}
+
+	return nil
+}
+
+func (b *Backup) listExportFiles(c context.Context) error {
+	names, err := listObjects(c, b.sts, b.Req.Bucket, path.Dir(b.Req.FilePath)+"/output-")
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		b.files = append(b.files, [2]string{b.Req.Bucket, name})
+	}
+	return nil
+}
+
+// Each calls f for each entity in the output files of the backup.
+func (b *Backup) Each(c context.Context, f func(e *backupfile.Entity) error) error {
+	for _, file := range b.files {
+		err := b.eachInFile(c, file[0], file[1], f)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Backup) eachInFile(c context.Context, bucket, name string, f func(e *backupfile.Entity) error) error {
+	r, err := openObject(c, b.sts, bucket, name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	er := backupfile.NewEntityReader(r)
+	for {
+		e, err := er.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("ds2bq: failed to read gs://%s/%s: %s", bucket, name, err)
+		}
+		err = f(e)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package ds2bq
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/mjibson/goon"
+	"google.golang.org/appengine/datastore"
+)
+
+// backupDeletionBatchSize is the number of entities removed by a DeleteMulti, the limit of Datastore.
+const backupDeletionBatchSize = 500
+
+// backupDeletionBatchesPerTask is the number of batches in a task, the rest is removed by the next task.
+const backupDeletionBatchesPerTask = 20
+
+// backupDeletionRetention is the duration that BackupDeletion is kept after the last progress.
+// The finished deletion is kept for a while, so that the retried task does not delete the backup again.
+const backupDeletionRetention = 7 * 24 * time.Hour
+
+type managementBackupDeletionURLOption struct {
+	APIBackupDeletionURL string
+}
+
+func (o *managementBackupDeletionURLOption) implements(s *datastoreManagementService) {
+	if v := o.APIBackupDeletionURL; v != "" {
+		s.APIBackupDeletionURL = v
+	}
+}
+
+// ManagementWithBackupDeletionURL provides API endpoint URL that returns the progress of removing a backup.
+func ManagementWithBackupDeletionURL(apiBackupDeletionURL string) ManagementOption {
+	return &managementBackupDeletionURLOption{
+		APIBackupDeletionURL: apiBackupDeletionURL,
+	}
+}
+
+// BackupDeletionState is the state of BackupDeletion.
+type BackupDeletionState string
+
+// BackupDeletionState values.
+const (
+	BackupDeletionStateDeleting BackupDeletionState = "deleting"
+	BackupDeletionStateDone     BackupDeletionState = "done"
+)
+
+// BackupDeletion is the progress of removing the backup information and related entities.
+// Entities are removed in batches through the cursor, so the failed task resumes from the last batch.
+type BackupDeletion struct {
+	Kind      string              `goon:"kind,DS2BQBackupDeletion" json:"-"`
+	ID        string              `datastore:"-" goon:"id" json:"id"` // encoded key of _AE_Backup_Information.
+	RootKey   string              `json:"rootKey"`
+	Cursor    string              `datastore:",noindex" json:"-"`
+	Deleted   int                 `json:"deleted"`
+	Batches   int                 `json:"batches"`
+	State     BackupDeletionState `json:"state"`
+	CreatedAt time.Time           `json:"createdAt"`
+	UpdatedAt time.Time           `json:"updatedAt"`
+	ExpireAt  time.Time           `json:"expireAt"`
+}
+
+// GetOrCreateBackupDeletion returns BackupDeletion of the ID of deletion, or puts deletion if not exists.
+func (store *AEDatastoreStore) GetOrCreateBackupDeletion(c context.Context, deletion *BackupDeletion) (*BackupDeletion, error) {
+	g := goon.FromContext(c)
+	err := g.RunInTransaction(func(tg *goon.Goon) error {
+		current := &BackupDeletion{ID: deletion.ID}
+		err := tg.Get(current)
+		if err == nil {
+			deletion = current
+			return nil
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		now := time.Now()
+		deletion.CreatedAt = now
+		deletion.UpdatedAt = now
+		deletion.ExpireAt = now.Add(backupDeletionRetention)
+		_, err = tg.Put(deletion)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return deletion, nil
+}
+
+// PutBackupDeletion saves the progress.
+func (store *AEDatastoreStore) PutBackupDeletion(c context.Context, deletion *BackupDeletion) error {
+	g := goon.FromContext(c)
+	deletion.UpdatedAt = time.Now()
+	deletion.ExpireAt = deletion.UpdatedAt.Add(backupDeletionRetention)
+	_, err := g.Put(deletion)
+	return err
+}
+
+// GetBackupDeletion returns BackupDeletion of the encoded key of the backup information, or nil if not exists.
+func (store *AEDatastoreStore) GetBackupDeletion(c context.Context, id string) (*BackupDeletion, error) {
+	g := goon.FromContext(c)
+	deletion := &BackupDeletion{ID: id}
+	err := g.Get(deletion)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return deletion, nil
+}
+
+// PurgeBackupDeletions removes a batch of BackupDeletion expired at now, the rest is removed by the next call.
+func (store *AEDatastoreStore) PurgeBackupDeletions(c context.Context, now time.Time) (int, error) {
+	g := goon.FromContext(c)
+	q := datastore.NewQuery(g.Kind(&BackupDeletion{})).Filter("ExpireAt <", now).KeysOnly().Limit(backupDeletionBatchSize)
+	keys, err := g.GetAll(q, nil)
+	if err != nil {
+		return 0, err
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	return len(keys), g.DeleteMulti(keys)
+}
+
+// backupRootKey returns the key of _AE_DatastoreAdmin_Operation that the backup belongs to.
+func backupRootKey(key *datastore.Key) (*datastore.Key, error) {
+	if key.Kind() != "_AE_Backup_Information" {
+		return nil, fmt.Errorf("invalid kind: %s", key.Kind())
+	}
+	if key.Parent() != nil {
+		return key.Parent(), nil
+	}
+	return key, nil
+}
+
+// deleteBackupBatch removes a batch of entities under rootKey from cursor.
+// It returns the cursor of the next batch, and the number of removed entities.
+// The cursor is empty if no entity is left.
+func (store *AEDatastoreStore) deleteBackupBatch(c context.Context, rootKey *datastore.Key, cursor string, limit int) (string, int, error) {
+	g := goon.FromContext(c)
+
+	q := datastore.NewQuery("").Ancestor(rootKey).KeysOnly().Limit(limit)
+	if cursor != "" {
+		cur, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return "", 0, err
+		}
+		q = q.Start(cur)
+	}
+
+	var keys []*datastore.Key
+	it := g.Run(q)
+	for {
+		key, err := it.Next(nil)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			return "", 0, err
+		}
+		logDebug(c, "ds2bq: remove target key", F("key", key.String()))
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return "", 0, nil
+	}
+
+	err := g.DeleteMulti(keys)
+	if err != nil {
+		return "", 0, err
+	}
+	if len(keys) < limit {
+		return "", len(keys), nil
+	}
+
+	cur, err := it.Cursor()
+	if err != nil {
+		return "", 0, err
+	}
+	return cur.String(), len(keys), nil
+}
+
+// deleteBackupBatches removes batches of the backup up to maxBatches, and records the progress after each batch.
+// It returns the progress, that is done if no entity is left, and reports whether it is done by this call.
+func (store *AEDatastoreStore) deleteBackupBatches(c context.Context, key *datastore.Key, maxBatches int) (*BackupDeletion, bool, error) {
+	rootKey, err := backupRootKey(key)
+	if err != nil {
+		return nil, false, err
+	}
+
+	deletion, err := store.GetOrCreateBackupDeletion(c, &BackupDeletion{
+		ID:      key.Encode(),
+		RootKey: rootKey.String(),
+		State:   BackupDeletionStateDeleting,
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if deletion.State == BackupDeletionStateDone {
+		return deletion, false, nil
+	}
+
+	logInfo(c, "ds2bq: remove backup", F(FieldBackupKey, key.String()), F("rootKey", rootKey.String()), F("deleted", deletion.Deleted))
+
+	for i := 0; i < maxBatches; i++ {
+		cursor, n, err := store.deleteBackupBatch(c, rootKey, deletion.Cursor, backupDeletionBatchSize)
+		if err != nil {
+			return nil, false, err
+		}
+		deletion.Cursor = cursor
+		deletion.Deleted += n
+		deletion.Batches++
+		if cursor == "" {
+			deletion.State = BackupDeletionStateDone
+		}
+		err = store.PutBackupDeletion(c, deletion)
+		if err != nil {
+			return nil, false, err
+		}
+		if deletion.State == BackupDeletionStateDone {
+			return deletion, true, nil
+		}
+	}
+
+	return deletion, false, nil
+}
@@ -0,0 +1,144 @@
+package ds2bq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/favclip/testerator"
+	"google.golang.org/appengine/datastore"
+)
+
+type testBackupEntity struct {
+	Name string
+}
+
+func TestAEDatastoreStore_deleteBackupBatches(t *testing.T) {
+	_, c, err := testerator.SpinUp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testerator.SpinDown()
+
+	rootKey := datastore.NewKey(c, "_AE_DatastoreAdmin_Operation", "", 1, nil)
+	key := datastore.NewKey(c, "_AE_Backup_Information", "", 2, rootKey)
+	keys := []*datastore.Key{rootKey, key}
+	for i := 0; i < 1198; i++ {
+		keys = append(keys, datastore.NewKey(c, "_AE_Backup_Information_Kind_Files", "", int64(i+1), key))
+	}
+	entities := make([]*testBackupEntity, len(keys))
+	for i := range entities {
+		entities[i] = &testBackupEntity{Name: "backup"}
+	}
+	for i := 0; i < len(keys); i += backupDeletionBatchSize {
+		j := i + backupDeletionBatchSize
+		if j > len(keys) {
+			j = len(keys)
+		}
+		if _, err := datastore.PutMulti(c, keys[i:j], entities[i:j]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store := &AEDatastoreStore{}
+	deletion, finished, err := store.deleteBackupBatches(c, key, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if finished {
+		t.Errorf("expected not to be finished")
+	}
+	if e, g := BackupDeletionStateDeleting, deletion.State; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	if e, g := 1000, deletion.Deleted; e != g {
+		t.Errorf("expected %d; got %d", e, g)
+	}
+
+	// the next task resumes from the recorded cursor.
+	deletion, finished, err = store.deleteBackupBatches(c, key, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !finished {
+		t.Errorf("expected to be finished")
+	}
+	if e, g := 1200, deletion.Deleted; e != g {
+		t.Errorf("expected %d; got %d", e, g)
+	}
+	if e, g := 3, deletion.Batches; e != g {
+		t.Errorf("expected %d; got %d", e, g)
+	}
+
+	left, err := datastore.NewQuery("").Ancestor(rootKey).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := 0, len(left); e != g {
+		t.Errorf("expected %d; got %d", e, g)
+	}
+
+	// retry of the finished task does nothing.
+	_, finished, err = store.deleteBackupBatches(c, key, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if finished {
+		t.Errorf("expected not to be finished again")
+	}
+}
+
+func TestAEDatastoreStore_PurgeBackupDeletions(t *testing.T) {
+	_, c, err := testerator.SpinUp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testerator.SpinDown()
+
+	store := &AEDatastoreStore{}
+	for _, id := range []string{"a", "b"} {
+		if err := store.PutBackupDeletion(c, &BackupDeletion{ID: id, State: BackupDeletionStateDone}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := store.PurgeBackupDeletions(c, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := 0, n; e != g {
+		t.Errorf("expected %d; got %d", e, g)
+	}
+
+	n, err = store.PurgeBackupDeletions(c, time.Now().Add(backupDeletionRetention+time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := 2, n; e != g {
+		t.Errorf("expected %d; got %d", e, g)
+	}
+
+	deletion, err := store.GetBackupDeletion(c, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deletion != nil {
+		t.Errorf("expected to be purged; got %+v", deletion)
+	}
+}
+
+func TestBackupRootKey(t *testing.T) {
+	_, c, err := testerator.SpinUp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testerator.SpinDown()
+
+	rootKey := datastore.NewKey(c, "_AE_DatastoreAdmin_Operation", "", 1, nil)
+	key := datastore.NewKey(c, "_AE_Backup_Information", "", 2, rootKey)
+	if g, err := backupRootKey(key); err != nil || !g.Equal(rootKey) {
+		t.Errorf("expected %s; got %s, %v", rootKey, g, err)
+	}
+	if _, err := backupRootKey(rootKey); err == nil {
+		t.Errorf("expected error for kind %s", rootKey.Kind())
+	}
+}
@@ -0,0 +1,681 @@
+package ds2bq
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mjibson/goon"
+	"google.golang.org/api/storage/v1"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// BackupReconciliation is the settings of cross-checking Datastore Admin backup information against objects in the bucket.
+//
+// A reconciliation pages through the backup information first, and records the directories of their files.
+// Then it pages through the objects in the bucket, and looks up the recorded directories of each page.
+// Run one reconciliation at a time, the next run replaces the directories recorded by the former run.
+type BackupReconciliation struct {
+	// BucketName of the backups. required.
+	BucketName string
+	// Prefix of the objects of the backups in the bucket.
+	Prefix string
+	// GracePeriod is the age under which backups and objects are not reported as orphans,
+	// because they may belong to a backup in progress. default is 24h.
+	GracePeriod time.Duration
+}
+
+// defaultBackupReconciliationGracePeriod is the GracePeriod if it is not specified.
+const defaultBackupReconciliationGracePeriod = 24 * time.Hour
+
+// backupReconciliationPageSize is the number of objects reconciled by a request.
+const backupReconciliationPageSize = 1000
+
+// backupReconciliationBackupPageSize is the number of backup information reconciled by a request.
+const backupReconciliationBackupPageSize = 20
+
+func (r *BackupReconciliation) gracePeriod() time.Duration {
+	if r.GracePeriod > 0 {
+		return r.GracePeriod
+	}
+	return defaultBackupReconciliationGracePeriod
+}
+
+// Reasons of OrphanBackup.
+const (
+	OrphanBackupReasonNoParent     = "no_parent"
+	OrphanBackupReasonMissingFiles = "missing_files"
+)
+
+// OrphanBackup is the backup information whose files are not in the bucket, or that has no parent operation.
+// Deleting is true if the task that removes the backup information is added.
+type OrphanBackup struct {
+	Key          string    `json:"key"`
+	Name         string    `json:"name"`
+	CompleteTime time.Time `json:"completeTime"`
+	Reason       string    `json:"reason"`
+	MissingFiles []string  `json:"missingFiles,omitempty"`
+	Deleting     bool      `json:"deleting"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// OrphanObject is the object of Datastore Admin backup that no backup information refers.
+// Deleting is true if the task that deletes the object is added.
+type OrphanObject struct {
+	Name     string `json:"name"`
+	Deleting bool   `json:"deleting"`
+	Error    string `json:"error,omitempty"`
+}
+
+// BackupReconciliationReport is the result of a page of reconciliation.
+// Backups is the number of backup information in the page, and Objects is the number of objects in the page.
+type BackupReconciliationReport struct {
+	BucketName    string          `json:"bucketName"`
+	Prefix        string          `json:"prefix"`
+	Delete        bool            `json:"delete"`
+	Cursor        string          `json:"cursor,omitempty"`
+	NextCursor    string          `json:"nextCursor,omitempty"`
+	Backups       int             `json:"backups"`
+	Objects       int             `json:"objects"`
+	OrphanBackups []*OrphanBackup `json:"orphanBackups"`
+	OrphanObjects []*OrphanObject `json:"orphanObjects"`
+}
+
+type managementBackupReconciliationOption struct {
+	BackupReconciliation *BackupReconciliation
+}
+
+func (o *managementBackupReconciliationOption) implements(s *datastoreManagementService) {
+	s.BackupReconciliation = o.BackupReconciliation
+}
+
+// ManagementWithBackupReconciliation provides the settings of reconciliation between backup information and objects.
+// The endpoints that report and delete orphans are registered only if this option is used.
+func ManagementWithBackupReconciliation(r *BackupReconciliation) ManagementOption {
+	return &managementBackupReconciliationOption{
+		BackupReconciliation: r,
+	}
+}
+
+type managementBackupReconciliationURLOption struct {
+	APIReconcileBackupsURL string
+	DeleteOrphanObjectsURL string
+}
+
+func (o *managementBackupReconciliationURLOption) implements(s *datastoreManagementService) {
+	if v := o.APIReconcileBackupsURL; v != "" {
+		s.APIReconcileBackupsURL = v
+	}
+	if v := o.DeleteOrphanObjectsURL; v != "" {
+		s.DeleteOrphanObjectsURL = v
+	}
+}
+
+// ManagementWithBackupReconciliationURL provides API endpoint URL that reports orphans, and deletes them with delete=true,
+// and the task endpoint URL that deletes orphan objects.
+func ManagementWithBackupReconciliationURL(apiReconcileBackupsURL, deleteOrphanObjectsURL string) ManagementOption {
+	return &managementBackupReconciliationURLOption{
+		APIReconcileBackupsURL: apiReconcileBackupsURL,
+		DeleteOrphanObjectsURL: deleteOrphanObjectsURL,
+	}
+}
+
+// reconcileBackup is the backup information and its files.
+type reconcileBackup struct {
+	Key      *datastore.Key
+	Info     *AEBackupInformation
+	NoParent bool
+	// InFlight is true if the backup may be still written, it is never reported as an orphan.
+	InFlight bool
+	// Objects are names of the .backup_info files and output files in the bucket.
+	Objects []string
+}
+
+// reconcileObject is the object in the bucket.
+type reconcileObject struct {
+	Name    string
+	Updated time.Time
+}
+
+// reconcileDirectory is a directory of the bucket that backup information refers to, recorded by a reconciliation.
+// Objects of a page are looked up by the keys of their directories, not by reading all backup information.
+type reconcileDirectory struct {
+	Kind string `goon:"kind,DS2BQReconcileDirectory" json:"-"`
+	// ID is the bucket and the directory like bucket/path/, the directory of the root is empty.
+	ID string `datastore:"-" goon:"id"`
+	// RunAt is the time that the reconciliation recording the directory started at.
+	RunAt time.Time
+	// Names are base names of the objects in the directory that backup information refers to.
+	Names []string `datastore:",noindex"`
+	// InFlight is true if objects under the directory may belong to a backup in flight.
+	InFlight bool `datastore:",noindex"`
+}
+
+func reconcileDirectoryID(bucket, dir string) string {
+	return bucket + "/" + dir
+}
+
+// objectDir returns the directory of the object like path/, or empty for the root.
+func objectDir(name string) string {
+	i := strings.LastIndex(name, "/")
+	return name[:i+1]
+}
+
+// parentDirs returns the directory of the object and its parents from the root.
+func parentDirs(name string) []string {
+	dirs := []string{""}
+	for i, r := range name {
+		if r == '/' {
+			dirs = append(dirs, name[:i+1])
+		}
+	}
+	return dirs
+}
+
+// reconcileCursor is the position of the next page.
+// Pages of backup information go first, then pages of objects.
+type reconcileCursor struct {
+	RunAt time.Time `json:"runAt"`
+	// BackupCursor is the Datastore cursor of the next page of backup information.
+	BackupCursor string `json:"backupCursor,omitempty"`
+	// Objects is true on pages of objects.
+	Objects   bool   `json:"objects,omitempty"`
+	PageToken string `json:"pageToken,omitempty"`
+}
+
+func (cur *reconcileCursor) encode() string {
+	b, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeReconcileCursor decodes the cursor, or returns the cursor of the first page of a new run if s is empty.
+func decodeReconcileCursor(s string) (*reconcileCursor, error) {
+	if s == "" {
+		// Datastore keeps microseconds.
+		return &reconcileCursor{RunAt: time.Now().Truncate(time.Microsecond)}, nil
+	}
+	cur := &reconcileCursor{}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, newHTTPError(http.StatusBadRequest, "ds2bq: invalid cursor %s", s)
+	}
+	if err := json.Unmarshal(b, cur); err != nil || cur.RunAt.IsZero() {
+		return nil, newHTTPError(http.StatusBadRequest, "ds2bq: invalid cursor %s", s)
+	}
+	return cur, nil
+}
+
+// backupObjects returns the objects of the backup information in the bucket.
+func backupObjects(bucket string, info *AEBackupInformation) []string {
+	var names []string
+	for _, gsPath := range backupFilePaths(info) {
+		b, name, err := parseGSPath(gsPath)
+		if err == nil && b == bucket {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// backupFilePaths returns GCS paths like /gs/bucket/object of the .backup_info files and output files of the backup information.
+// .backup_info files of kinds are next to the .backup_info file of the backup like <id>.<Kind>.backup_info.
+func backupFilePaths(info *AEBackupInformation) []string {
+	var paths []string
+	if info.GSHandle != "" {
+		paths = append(paths, info.GSHandle)
+		base := strings.TrimSuffix(info.GSHandle, ".backup_info")
+		for _, kind := range info.Kinds {
+			paths = append(paths, base+"."+kind+".backup_info")
+		}
+	}
+	for _, files := range info.AEBackupInformationKindFilesList {
+		paths = append(paths, files.Files...)
+	}
+	return paths
+}
+
+// isAdminBackupObject reports whether the object looks like a file of Datastore Admin backup, not managed export.
+func isAdminBackupObject(name string) bool {
+	for _, v := range strings.Split(path.Dir(name), "/") {
+		if strings.HasPrefix(v, "kind_") || v == "all_namespaces" || strings.HasPrefix(v, "namespace_") {
+			return false
+		}
+	}
+	base := path.Base(name)
+	return strings.HasSuffix(base, ".backup_info") || strings.HasPrefix(base, "output-")
+}
+
+// reconcileBackupOrphans returns orphans of the backups, exists reports objects in the directories of the backups.
+// Backups in flight are not reported, and only files with the prefix are checked.
+func reconcileBackupOrphans(backups []*reconcileBackup, exists map[string]bool, prefix string) []*OrphanBackup {
+	var orphans []*OrphanBackup
+	for _, b := range backups {
+		if b.InFlight {
+			continue
+		}
+		var missing []string
+		for _, name := range b.Objects {
+			if strings.HasPrefix(name, prefix) && !exists[name] {
+				missing = append(missing, name)
+			}
+		}
+
+		orphan := &OrphanBackup{
+			Key:          b.Key.Encode(),
+			Name:         b.Info.Name,
+			CompleteTime: b.Info.CompleteTime,
+			MissingFiles: missing,
+		}
+		switch {
+		case b.NoParent:
+			orphan.Reason = OrphanBackupReasonNoParent
+		case len(missing) != 0:
+			orphan.Reason = OrphanBackupReasonMissingFiles
+		default:
+			continue
+		}
+		orphans = append(orphans, orphan)
+	}
+	return orphans
+}
+
+// reconcileDirectories returns the directories of the objects of the backups by the directory.
+// Directories of backups in flight, and the destination of them, are in flight.
+func reconcileDirectories(bucket string, backups []*reconcileBackup) map[string]*reconcileDirectory {
+	dirs := make(map[string]*reconcileDirectory)
+	dirOf := func(dir string) *reconcileDirectory {
+		d, ok := dirs[dir]
+		if !ok {
+			d = &reconcileDirectory{ID: reconcileDirectoryID(bucket, dir)}
+			dirs[dir] = d
+		}
+		return d
+	}
+	for _, b := range backups {
+		for _, name := range b.Objects {
+			d := dirOf(objectDir(name))
+			d.Names = appendUniqueString(d.Names, path.Base(name))
+			d.InFlight = d.InFlight || b.InFlight
+		}
+		if !b.InFlight {
+			continue
+		}
+		if bucketName, name, err := parseGSPath(b.Info.Destination); err == nil && bucketName == bucket {
+			dirOf(strings.TrimSuffix(name, "/") + "/").InFlight = true
+		}
+	}
+	return dirs
+}
+
+func appendUniqueString(list []string, s string) []string {
+	if containsString(list, s) {
+		return list
+	}
+	return append(list, s)
+}
+
+// reconcileObjectOrphans returns orphans of the objects, dirs are recorded directories by the directory.
+// Objects updated after cutoff or under directories in flight are not reported.
+func reconcileObjectOrphans(objects []*reconcileObject, dirs map[string]*reconcileDirectory, cutoff time.Time) []*OrphanObject {
+	var orphans []*OrphanObject
+	for _, obj := range objects {
+		if !isAdminBackupObject(obj.Name) || obj.Updated.After(cutoff) {
+			continue
+		}
+		inFlight := false
+		for _, dir := range parentDirs(obj.Name) {
+			if d := dirs[dir]; d != nil && d.InFlight {
+				inFlight = true
+			}
+		}
+		if d := dirs[objectDir(obj.Name)]; inFlight || (d != nil && containsString(d.Names, path.Base(obj.Name))) {
+			continue
+		}
+		orphans = append(orphans, &OrphanObject{Name: obj.Name})
+	}
+	sort.Slice(orphans, func(i, j int) bool { return orphans[i].Name < orphans[j].Name })
+	return orphans
+}
+
+// listReconcileBackups returns a page of backup information with the files in the bucket from cursor,
+// and the cursor of the next page. The cursor is empty on the last page.
+// A backup is in flight if it is not completed, its operation is not finished, or it started after cutoff.
+func (store *AEDatastoreStore) listReconcileBackups(c context.Context, bucket string, cutoff time.Time, cursor string) ([]*reconcileBackup, string, error) {
+	g := goon.FromContext(c)
+
+	q := newAEBackupInformationQueryBuilder().Query().Limit(backupReconciliationBackupPageSize)
+	if cursor != "" {
+		cur, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return nil, "", newHTTPError(http.StatusBadRequest, "ds2bq: invalid cursor %s", cursor)
+		}
+		q = q.Start(cur)
+	}
+
+	var backups []*reconcileBackup
+	n := 0
+	it := g.Run(q)
+	for {
+		info := &AEBackupInformation{}
+		key, err := it.Next(info)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			return nil, "", err
+		}
+		n++
+		if bucketName, _, err := parseGSPath(info.GSHandle); err == nil && bucketName != bucket {
+			// backup of another bucket.
+			continue
+		}
+
+		_, err = g.GetAll(newAEBackupInformationKindFilesQueryBuilder().Ancestor(key).Query(), &info.AEBackupInformationKindFilesList)
+		if err != nil {
+			return nil, "", err
+		}
+		noParent := key.Parent() == nil
+		inFlight := info.CompleteTime.IsZero() || info.StartTime.After(cutoff)
+		if !inFlight && !noParent {
+			op := &AEDatastoreAdminOperation{ID: key.Parent().IntID()}
+			err = g.Get(op)
+			if err == nil {
+				inFlight = op.Status == aeOperationStatusCreated || op.Status == aeOperationStatusActive
+			} else if err != datastore.ErrNoSuchEntity {
+				return nil, "", err
+			}
+		}
+		backups = append(backups, &reconcileBackup{
+			Key:      key,
+			Info:     info,
+			NoParent: noParent,
+			InFlight: inFlight,
+			Objects:  backupObjects(bucket, info),
+		})
+	}
+	if n < backupReconciliationBackupPageSize {
+		return backups, "", nil
+	}
+
+	cur, err := it.Cursor()
+	if err != nil {
+		return nil, "", err
+	}
+	return backups, cur.String(), nil
+}
+
+// putReconcileDirectories records the directories for the run, merged with the directories recorded by former pages of the run.
+func (store *AEDatastoreStore) putReconcileDirectories(c context.Context, runAt time.Time, dirs map[string]*reconcileDirectory) error {
+	if len(dirs) == 0 {
+		return nil
+	}
+	g := goon.FromContext(c)
+
+	var recorded, list []*reconcileDirectory
+	for _, d := range dirs {
+		recorded = append(recorded, d)
+		list = append(list, &reconcileDirectory{ID: d.ID})
+	}
+	err := g.GetMulti(list)
+	merr, ok := err.(appengine.MultiError)
+	if err != nil && !ok {
+		return err
+	}
+	for i, current := range list {
+		if ok && merr[i] != nil && merr[i] != datastore.ErrNoSuchEntity {
+			return merr[i]
+		}
+		d := recorded[i]
+		if (ok && merr[i] == datastore.ErrNoSuchEntity) || !current.RunAt.Equal(runAt) {
+			// recorded by the former run.
+			current.Names = nil
+			current.InFlight = false
+		}
+		for _, name := range d.Names {
+			current.Names = appendUniqueString(current.Names, name)
+		}
+		current.InFlight = current.InFlight || d.InFlight
+		current.RunAt = runAt
+	}
+	_, err = g.PutMulti(list)
+	return err
+}
+
+// getReconcileDirectories returns the directories recorded by the run by the directory.
+func (store *AEDatastoreStore) getReconcileDirectories(c context.Context, bucket string, runAt time.Time, dirNames []string) (map[string]*reconcileDirectory, error) {
+	dirs := make(map[string]*reconcileDirectory)
+	if len(dirNames) == 0 {
+		return dirs, nil
+	}
+	g := goon.FromContext(c)
+
+	list := make([]*reconcileDirectory, len(dirNames))
+	for i, dir := range dirNames {
+		list[i] = &reconcileDirectory{ID: reconcileDirectoryID(bucket, dir)}
+	}
+	err := g.GetMulti(list)
+	merr, ok := err.(appengine.MultiError)
+	if err != nil && !ok {
+		return nil, err
+	}
+	for i, d := range list {
+		if ok && merr[i] == datastore.ErrNoSuchEntity {
+			continue
+		} else if ok && merr[i] != nil {
+			return nil, merr[i]
+		}
+		if d.RunAt.Equal(runAt) {
+			dirs[dirNames[i]] = d
+		}
+	}
+	return dirs, nil
+}
+
+// purgeReconcileDirectories removes a batch of directories recorded by former runs. The rest is removed by the next run.
+func (store *AEDatastoreStore) purgeReconcileDirectories(c context.Context, runAt time.Time) (int, error) {
+	g := goon.FromContext(c)
+	q := datastore.NewQuery(g.Kind(&reconcileDirectory{})).Filter("RunAt <", runAt).KeysOnly().Limit(backupDeletionBatchSize)
+	keys, err := g.GetAll(q, nil)
+	if err != nil {
+		return 0, err
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	return len(keys), g.DeleteMulti(keys)
+}
+
+// listReconcileObjects returns a page of the objects in the bucket from pageToken, and the token of the next page.
+// The token is empty on the last page.
+func listReconcileObjects(c context.Context, sts *storage.Service, bucket, prefix, pageToken string) ([]*reconcileObject, string, error) {
+	call := sts.Objects.List(bucket).Prefix(prefix).Fields("nextPageToken", "items(name,updated)").MaxResults(backupReconciliationPageSize)
+	if pageToken != "" {
+		call = call.PageToken(pageToken)
+	}
+	objs, err := call.Context(c).Do()
+	if err != nil {
+		return nil, "", err
+	}
+
+	var objects []*reconcileObject
+	for _, obj := range objs.Items {
+		updated, err := time.Parse(time.RFC3339, obj.Updated)
+		if err != nil {
+			return nil, "", err
+		}
+		objects = append(objects, &reconcileObject{Name: obj.Name, Updated: updated})
+	}
+	return objects, objs.NextPageToken, nil
+}
+
+// reconcileBackups reports orphans in a page of backup information or objects of the bucket from cursor,
+// and adds tasks that delete them if del is true. The report has the cursor of the next page unless it is the last page.
+// Failures of adding the tasks are recorded in the report, not returned.
+func reconcileBackups(c context.Context, r *BackupReconciliation, del bool, cursor, queueName, deleteBackupURL, deleteOrphanObjectsURL string) (*BackupReconciliationReport, error) {
+	cur, err := decodeReconcileCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+	sts, err := newStorageService(c)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &BackupReconciliationReport{
+		BucketName: r.BucketName,
+		Prefix:     r.Prefix,
+		Delete:     del,
+		Cursor:     cursor,
+	}
+	cutoff := time.Now().Add(-r.gracePeriod())
+	store := &AEDatastoreStore{}
+
+	if !cur.Objects {
+		backups, next, err := store.listReconcileBackups(c, r.BucketName, cutoff, cur.BackupCursor)
+		if err != nil {
+			return nil, err
+		}
+		dirs := reconcileDirectories(r.BucketName, backups)
+		err = store.putReconcileDirectories(c, cur.RunAt, dirs)
+		if err != nil {
+			return nil, err
+		}
+
+		// directories that have files to check, a directory is listed once even if backups share it.
+		checked := make(map[string]bool)
+		for _, b := range backups {
+			for _, name := range b.Objects {
+				if !b.InFlight && strings.HasPrefix(name, r.Prefix) {
+					checked[objectDir(name)] = true
+				}
+			}
+		}
+		exists := make(map[string]bool)
+		for dir := range checked {
+			names, err := listDirectoryObjects(c, sts, r.BucketName, dir)
+			if err != nil {
+				return nil, err
+			}
+			for _, name := range names {
+				exists[name] = true
+			}
+		}
+
+		report.Backups = len(backups)
+		report.OrphanBackups = reconcileBackupOrphans(backups, exists, r.Prefix)
+		nextCur := &reconcileCursor{RunAt: cur.RunAt, BackupCursor: next, Objects: next == ""}
+		report.NextCursor = nextCur.encode()
+		deleteOrphanBackups(c, report.OrphanBackups, del, queueName, deleteBackupURL)
+		return report, nil
+	}
+
+	objects, next, err := listReconcileObjects(c, sts, r.BucketName, r.Prefix, cur.PageToken)
+	if err != nil {
+		return nil, err
+	}
+	var dirNames []string
+	seen := make(map[string]bool)
+	for _, obj := range objects {
+		for _, dir := range parentDirs(obj.Name) {
+			if !seen[dir] {
+				seen[dir] = true
+				dirNames = append(dirNames, dir)
+			}
+		}
+	}
+	dirs, err := store.getReconcileDirectories(c, r.BucketName, cur.RunAt, dirNames)
+	if err != nil {
+		return nil, err
+	}
+
+	report.Objects = len(objects)
+	report.OrphanObjects = reconcileObjectOrphans(objects, dirs, cutoff)
+	if next != "" {
+		nextCur := &reconcileCursor{RunAt: cur.RunAt, Objects: true, PageToken: next}
+		report.NextCursor = nextCur.encode()
+	} else if n, err := store.purgeReconcileDirectories(c, cur.RunAt); err != nil {
+		logWarning(c, "ds2bq: failed to purge directories of former reconciliations", F(FieldError, err))
+	} else if n != 0 {
+		logInfo(c, "ds2bq: directories of former reconciliations purged", F("directories", n))
+	}
+	deleteOrphanObjects(c, r.BucketName, report.OrphanObjects, del, queueName, deleteOrphanObjectsURL)
+	return report, nil
+}
+
+// deleteOrphanBackups adds the tasks that remove the backup information of orphans in batches, if del is true.
+func deleteOrphanBackups(c context.Context, orphans []*OrphanBackup, del bool, queueName, deleteBackupURL string) {
+	for _, orphan := range orphans {
+		fields := []Field{F(FieldBackupKey, orphan.Key), F("reason", orphan.Reason), F("missingFiles", len(orphan.MissingFiles))}
+		if !del {
+			logInfo(c, "ds2bq: orphan backup information", fields...)
+			continue
+		}
+		key, err := datastore.DecodeKey(orphan.Key)
+		if err == nil {
+			err = addDeleteBackupTask(c, queueName, deleteBackupURL, key)
+		}
+		if err != nil {
+			orphan.Error = err.Error()
+			logWarning(c, "ds2bq: failed to add the task that removes orphan backup information", append(fields, F(FieldError, err))...)
+			continue
+		}
+		orphan.Deleting = true
+		logInfo(c, "ds2bq: orphan backup information is being removed", fields...)
+	}
+}
+
+// OrphanObjectsDeleteReq provides request of deleting orphan objects of the bucket.
+type OrphanObjectsDeleteReq struct {
+	BucketName string   `json:"bucketName"`
+	Names      []string `json:"names"`
+}
+
+// deleteOrphanObjects adds the task that deletes orphan objects, if del is true.
+func deleteOrphanObjects(c context.Context, bucket string, orphans []*OrphanObject, del bool, queueName, deleteOrphanObjectsURL string) {
+	req := &OrphanObjectsDeleteReq{BucketName: bucket}
+	for _, orphan := range orphans {
+		if !del {
+			logInfo(c, "ds2bq: orphan backup object", F(FieldBucket, bucket), F(FieldObject, orphan.Name))
+			continue
+		}
+		req.Names = append(req.Names, orphan.Name)
+	}
+	if len(req.Names) == 0 {
+		return
+	}
+
+	_, err := addJSONTask(c, "", deleteOrphanObjectsURL, queueName, req, 0)
+	for _, orphan := range orphans {
+		if err != nil {
+			orphan.Error = err.Error()
+		} else {
+			orphan.Deleting = true
+		}
+	}
+	if err != nil {
+		logWarning(c, "ds2bq: failed to add the task that deletes orphan backup objects", F(FieldBucket, bucket), F("objects", len(req.Names)), F(FieldError, err))
+		return
+	}
+	logInfo(c, "ds2bq: orphan backup objects are being deleted", F(FieldBucket, bucket), F("objects", len(req.Names)))
+}
+
+// deleteObjects deletes the objects of req. Objects already deleted by the former try of the task are ignored.
+func deleteObjects(c context.Context, req *OrphanObjectsDeleteReq) error {
+	sts, err := newStorageService(c)
+	if err != nil {
+		return err
+	}
+	for _, name := range req.Names {
+		err := sts.Objects.Delete(req.BucketName, name).Context(c).Do()
+		if err != nil && !isNotFound(err) {
+			return err
+		}
+		logInfo(c, "ds2bq: orphan backup object deleted", F(FieldBucket, req.BucketName), F(FieldObject, name))
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package ds2bq
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/favclip/testerator"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestReconcileBackupOrphans(t *testing.T) {
+	_, c, err := testerator.SpinUp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testerator.SpinDown()
+
+	rootKey := datastore.NewKey(c, "_AE_DatastoreAdmin_Operation", "", 1, nil)
+	complete := &AEBackupInformation{
+		GSHandle: "/gs/backup/a.backup_info",
+		Kinds:    []string{"Article"},
+		AEBackupInformationKindFilesList: []*AEBackupInformationKindFiles{
+			{Files: []string{"/gs/backup/output-1"}},
+		},
+	}
+	missing := &AEBackupInformation{
+		GSHandle: "/gs/backup/b.backup_info",
+		Kinds:    []string{"User"},
+	}
+	backups := []*reconcileBackup{
+		{
+			Key:     datastore.NewKey(c, "_AE_Backup_Information", "", 1, rootKey),
+			Info:    complete,
+			Objects: backupObjects("backup", complete),
+		},
+		{
+			Key:     datastore.NewKey(c, "_AE_Backup_Information", "", 2, rootKey),
+			Info:    missing,
+			Objects: backupObjects("backup", missing),
+		},
+		{
+			Key:      datastore.NewKey(c, "_AE_Backup_Information", "", 3, nil),
+			Info:     &AEBackupInformation{},
+			NoParent: true,
+		},
+		{
+			Key:      datastore.NewKey(c, "_AE_Backup_Information", "", 4, rootKey),
+			Info:     &AEBackupInformation{GSHandle: "/gs/backup/d.backup_info"},
+			InFlight: true,
+			Objects:  []string{"d.backup_info"},
+		},
+	}
+	exists := make(map[string]bool)
+	for _, name := range []string{"a.backup_info", "a.Article.backup_info", "output-1", "b.backup_info"} {
+		exists[name] = true
+	}
+
+	orphans := reconcileBackupOrphans(backups, exists, "")
+
+	if e, g := 2, len(orphans); e != g {
+		t.Fatalf("expected %d; got %d", e, g)
+	}
+	if e, g := OrphanBackupReasonMissingFiles, orphans[0].Reason; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	if e, g := "[b.User.backup_info]", fmt.Sprint(orphans[0].MissingFiles); e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	if e, g := OrphanBackupReasonNoParent, orphans[1].Reason; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+
+	// files out of the prefix are not checked.
+	if e, g := 1, len(reconcileBackupOrphans(backups, nil, "x/")); e != g {
+		t.Errorf("expected %d; got %d", e, g)
+	}
+}
+
+func TestReconcileObjectOrphans(t *testing.T) {
+	backups := []*reconcileBackup{
+		{
+			Info:    &AEBackupInformation{},
+			Objects: []string{"a.backup_info", "a.Article.backup_info", "output-1", "b.backup_info"},
+		},
+		{
+			Info:     &AEBackupInformation{Destination: "/gs/backup/running"},
+			InFlight: true,
+			Objects:  []string{"d/d.backup_info"},
+		},
+	}
+	dirs := reconcileDirectories("backup", backups)
+	if e, g := "backup/d/", dirs["d/"].ID; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+
+	cutoff := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	var objects []*reconcileObject
+	for _, name := range []string{
+		"a.backup_info",
+		"a.Article.backup_info",
+		"output-1",
+		"output-2",
+		"c.Item.backup_info",
+		"2017-11-14T06:47:01_23208/all_namespaces/kind_Item/output-0",
+		"running/job/output-4",
+		"d/output-5",
+	} {
+		objects = append(objects, &reconcileObject{Name: name, Updated: cutoff.Add(-time.Hour)})
+	}
+	// object in the grace period.
+	objects = append(objects, &reconcileObject{Name: "output-3", Updated: cutoff.Add(time.Hour)})
+
+	orphans := reconcileObjectOrphans(objects, dirs, cutoff)
+
+	var names []string
+	for _, o := range orphans {
+		names = append(names, o.Name)
+	}
+	if e, g := "[c.Item.backup_info output-2]", fmt.Sprint(names); e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+}
+
+func TestParentDirs(t *testing.T) {
+	if e, g := `["" "a/" "a/b/"]`, fmt.Sprintf("%q", parentDirs("a/b/output-1")); e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	if e, g := "a/b/", objectDir("a/b/output-1"); e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	if e, g := "", objectDir("output-1"); e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+}
+
+func TestReconcileDirectories(t *testing.T) {
+	_, c, err := testerator.SpinUp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testerator.SpinDown()
+
+	store := &AEDatastoreStore{}
+	former := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	run := former.Add(24 * time.Hour)
+
+	err = store.putReconcileDirectories(c, former, map[string]*reconcileDirectory{
+		"a/": {ID: "backup/a/", Names: []string{"output-0"}, InFlight: true},
+		"b/": {ID: "backup/b/", Names: []string{"output-0"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// pages of the run, names of the former run are dropped.
+	for _, name := range []string{"output-1", "output-2"} {
+		err = store.putReconcileDirectories(c, run, map[string]*reconcileDirectory{
+			"a/": {ID: "backup/a/", Names: []string{name}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dirs, err := store.getReconcileDirectories(c, "backup", run, []string{"", "a/", "b/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := 1, len(dirs); e != g {
+		t.Fatalf("expected %d; got %d", e, g)
+	}
+	if e, g := "[output-1 output-2]", fmt.Sprint(dirs["a/"].Names); e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	if dirs["a/"].InFlight {
+		t.Error("expected not in flight")
+	}
+
+	n, err := store.purgeReconcileDirectories(c, run)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := 1, n; e != g {
+		t.Errorf("expected %d; got %d", e, g)
+	}
+}
+
+func TestReconcileCursor(t *testing.T) {
+	runAt := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	cursor := (&reconcileCursor{RunAt: runAt, Objects: true, PageToken: "token"}).encode()
+	cur, err := decodeReconcileCursor(cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := "token", cur.PageToken; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	if !cur.Objects || !cur.RunAt.Equal(runAt) {
+		t.Errorf("unexpected cursor %#v", cur)
+	}
+	cur, err = decodeReconcileCursor("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cur.RunAt.IsZero() || cur.Objects {
+		t.Errorf("unexpected cursor %#v", cur)
+	}
+	if _, err := decodeReconcileCursor("!"); err == nil {
+		t.Errorf("expected error")
+	}
+}
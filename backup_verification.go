@@ -0,0 +1,578 @@
+package ds2bq
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/favclip/ds2bq/backupfile"
+	"github.com/mjibson/goon"
+	"google.golang.org/api/storage/v1"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// BackupVerificationState is the state of BackupVerification.
+type BackupVerificationState string
+
+// BackupVerificationState values.
+const (
+	BackupVerificationStateVerified BackupVerificationState = "verified"
+	BackupVerificationStateCorrupt  BackupVerificationState = "corrupt"
+)
+
+// Reasons of BackupFileProblem.
+const (
+	BackupFileProblemMissing  = "missing"
+	BackupFileProblemEmpty    = "empty"
+	BackupFileProblemNoFiles  = "no_files"
+	BackupFileProblemChecksum = "checksum_mismatch"
+	BackupFileProblemCorrupt  = "corrupt_metadata"
+)
+
+// VerifiedFile is the file of the backup and its checksums in GCS.
+// It is saved as a child of BackupVerification, so that the verification does not grow with the files.
+type VerifiedFile struct {
+	Kind      string         `goon:"kind,DS2BQVerifiedFile" json:"-"`
+	ParentKey *datastore.Key `datastore:"-" goon:"parent" json:"-"`
+	Path      string         `datastore:"-" goon:"id" json:"path"` // like /gs/bucket/object
+	Size      int64          `datastore:",noindex" json:"size"`
+	MD5       string         `datastore:",noindex" json:"md5Hash"`
+	CRC32C    string         `datastore:",noindex" json:"crc32c"`
+}
+
+// BackupFileProblem is the file of the backup that is not intact.
+type BackupFileProblem struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+// BackupVerification is the result of checking files of the backup.
+// Files are saved as child entities, and up to backupVerificationMaxProblems problems are saved with the counts.
+type BackupVerification struct {
+	Kind string `goon:"kind,DS2BQBackupVerification" json:"-"`
+	// ID is the encoded key of _AE_Backup_Information, or the path of the managed export like /gs/bucket/prefix.
+	ID           string                  `datastore:"-" goon:"id" json:"id"`
+	Source       string                  `json:"source"`
+	CompleteTime time.Time               `json:"completeTime"`
+	State        BackupVerificationState `json:"state"`
+	Files        []*VerifiedFile         `datastore:"-" json:"files,omitempty"`
+	FileCount    int                     `datastore:",noindex" json:"fileCount"`
+	Problems     []BackupFileProblem     `datastore:",noindex" json:"problems,omitempty"`
+	ProblemCount int                     `datastore:",noindex" json:"problemCount"`
+	VerifiedAt   time.Time               `json:"verifiedAt"`
+}
+
+// backupVerificationMaxProblems is the number of problems saved with the verification.
+const backupVerificationMaxProblems = 100
+
+// NewestVerifiedBackup is the newest verified backup of the source.
+// It is updated with BackupVerification, so that the newest one is found without scanning all verifications.
+type NewestVerifiedBackup struct {
+	Kind string `goon:"kind,DS2BQNewestVerifiedBackup" json:"-"`
+	// ID is the source of backups.
+	ID           string    `datastore:"-" goon:"id" json:"id"`
+	BackupID     string    `json:"backupId"`
+	CompleteTime time.Time `json:"completeTime"`
+}
+
+type managementVerificationURLOption struct {
+	VerifyBackupURL string
+}
+
+func (o *managementVerificationURLOption) implements(s *datastoreManagementService) {
+	if v := o.VerifyBackupURL; v != "" {
+		s.VerifyBackupURL = v
+	}
+}
+
+// ManagementWithVerificationURL provides endpoint URL that verifies files of the backup.
+func ManagementWithVerificationURL(verifyBackupURL string) ManagementOption {
+	return &managementVerificationURLOption{
+		VerifyBackupURL: verifyBackupURL,
+	}
+}
+
+type managementRequireVerifiedBackupOption struct{}
+
+func (o *managementRequireVerifiedBackupOption) implements(s *datastoreManagementService) {
+	s.RequireVerifiedBackup = true
+}
+
+// ManagementWithVerifiedBackupRequired provides that old backups are removed only if a newer backup is verified.
+func ManagementWithVerifiedBackupRequired() ManagementOption {
+	return &managementRequireVerifiedBackupOption{}
+}
+
+// GetBackupVerification returns the verification of the backup, or nil if it is never verified.
+func (store *AEDatastoreStore) GetBackupVerification(c context.Context, id string) (*BackupVerification, error) {
+	g := goon.FromContext(c)
+	v := &BackupVerification{ID: id}
+	err := g.Get(v)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// getVerifiedFiles returns the files saved with the verification.
+func (store *AEDatastoreStore) getVerifiedFiles(c context.Context, v *BackupVerification) ([]*VerifiedFile, error) {
+	g := goon.FromContext(c)
+	q := datastore.NewQuery(g.Kind(&VerifiedFile{})).Ancestor(g.Key(v))
+	var files []*VerifiedFile
+	_, err := g.GetAll(q, &files)
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// unverifiedBackupKeys returns keys of the backup information that are never verified.
+func (store *AEDatastoreStore) unverifiedBackupKeys(c context.Context, keys []*datastore.Key) ([]*datastore.Key, error) {
+	g := goon.FromContext(c)
+	list := make([]*BackupVerification, len(keys))
+	for i, key := range keys {
+		list[i] = &BackupVerification{ID: key.Encode()}
+	}
+	err := g.GetMulti(list)
+	if err == nil {
+		return nil, nil
+	}
+	merr, ok := err.(appengine.MultiError)
+	if !ok {
+		return nil, err
+	}
+	var unverified []*datastore.Key
+	for i, err := range merr {
+		if err == datastore.ErrNoSuchEntity {
+			unverified = append(unverified, keys[i])
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return unverified, nil
+}
+
+// PutBackupVerification saves the result of verification with its files, and updates NewestVerifiedBackup of the source.
+// The files are saved before the verification, the retried task overwrites them.
+func (store *AEDatastoreStore) PutBackupVerification(c context.Context, v *BackupVerification) error {
+	g := goon.FromContext(c)
+	key := g.Key(v)
+	for _, f := range v.Files {
+		f.ParentKey = key
+	}
+	if len(v.Files) != 0 {
+		if _, err := g.PutMulti(v.Files); err != nil {
+			return err
+		}
+	}
+	return g.RunInTransaction(func(tg *goon.Goon) error {
+		newest := &NewestVerifiedBackup{ID: v.Source}
+		err := tg.Get(newest)
+		switch {
+		case err == datastore.ErrNoSuchEntity:
+			// NewestVerifiedBackupTime finds it by scanning.
+		case err != nil:
+			return err
+		case v.State == BackupVerificationStateVerified && v.CompleteTime.After(newest.CompleteTime):
+			newest.BackupID = v.ID
+			newest.CompleteTime = v.CompleteTime
+			if _, err := tg.Put(newest); err != nil {
+				return err
+			}
+		case v.State != BackupVerificationStateVerified && v.ID == newest.BackupID:
+			// the newest one turns out corrupt, NewestVerifiedBackupTime finds the next by scanning.
+			if err := tg.Delete(tg.Key(newest)); err != nil {
+				return err
+			}
+		}
+		_, err = tg.Put(v)
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+}
+
+// NewestVerifiedBackupTime returns CompleteTime of the newest verified backup of the source, or zero.
+// Verifications are scanned only if NewestVerifiedBackup of the source is not recorded yet.
+func (store *AEDatastoreStore) NewestVerifiedBackupTime(c context.Context, source string) (time.Time, error) {
+	g := goon.FromContext(c)
+
+	newest := &NewestVerifiedBackup{ID: source}
+	err := g.Get(newest)
+	if err == nil {
+		return newest.CompleteTime, nil
+	} else if err != datastore.ErrNoSuchEntity {
+		return time.Time{}, err
+	}
+
+	scanned, err := store.scanNewestVerifiedBackup(c, source)
+	if err != nil {
+		return time.Time{}, err
+	}
+	err = g.RunInTransaction(func(tg *goon.Goon) error {
+		current := &NewestVerifiedBackup{ID: source}
+		err := tg.Get(current)
+		if err == nil {
+			// recorded by a verification after scanning.
+			scanned = current
+			return nil
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		_, err = tg.Put(scanned)
+		return err
+	}, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return scanned.CompleteTime, nil
+}
+
+// scanNewestVerifiedBackup finds the newest verified backup of the source from all verifications.
+// It avoids a composite index by filtering with equality only.
+func (store *AEDatastoreStore) scanNewestVerifiedBackup(c context.Context, source string) (*NewestVerifiedBackup, error) {
+	g := goon.FromContext(c)
+
+	q := datastore.NewQuery(g.Kind(&BackupVerification{})).
+		Filter("Source =", source).
+		Filter("State =", string(BackupVerificationStateVerified))
+	var list []*BackupVerification
+	_, err := g.GetAll(q, &list)
+	if err != nil {
+		return nil, err
+	}
+
+	newest := &NewestVerifiedBackup{ID: source}
+	for _, v := range list {
+		if v.CompleteTime.After(newest.CompleteTime) {
+			newest.BackupID = v.ID
+			newest.CompleteTime = v.CompleteTime
+		}
+	}
+	return newest, nil
+}
+
+// verifyObjects checks that the objects of paths exist with non-zero size, and records their checksums.
+// objects are the attributes of the existing objects by path.
+func verifyObjects(paths []string, objects map[string]*storage.Object) ([]*VerifiedFile, []BackupFileProblem) {
+	if len(paths) == 0 {
+		return nil, []BackupFileProblem{{Reason: BackupFileProblemNoFiles}}
+	}
+
+	var files []*VerifiedFile
+	var problems []BackupFileProblem
+	for _, p := range paths {
+		obj, ok := objects[p]
+		if !ok {
+			problems = append(problems, BackupFileProblem{Path: p, Reason: BackupFileProblemMissing})
+			continue
+		}
+		if obj.Size == 0 {
+			problems = append(problems, BackupFileProblem{Path: p, Reason: BackupFileProblemEmpty})
+			continue
+		}
+		files = append(files, &VerifiedFile{
+			Path:   p,
+			Size:   int64(obj.Size),
+			MD5:    obj.Md5Hash,
+			CRC32C: obj.Crc32c,
+		})
+	}
+	return files, problems
+}
+
+// compareChecksums compares checksums of the files with the previous verification.
+// The files whose checksums are changed keep the previous checksums, so that they are reported again.
+func compareChecksums(files, previous []*VerifiedFile) ([]*VerifiedFile, []BackupFileProblem) {
+	recorded := make(map[string]*VerifiedFile)
+	for _, f := range previous {
+		recorded[f.Path] = f
+	}
+
+	var problems []BackupFileProblem
+	for i, f := range files {
+		r, ok := recorded[f.Path]
+		if !ok {
+			continue
+		}
+		if r.MD5 != f.MD5 || r.CRC32C != f.CRC32C {
+			problems = append(problems, BackupFileProblem{Path: f.Path, Reason: BackupFileProblemChecksum})
+			files[i] = r
+		}
+	}
+	return files, problems
+}
+
+// newBackupVerification returns the verification of the files.
+// Up to backupVerificationMaxProblems problems are kept.
+func newBackupVerification(id, source string, completeTime time.Time, files []*VerifiedFile, problems []BackupFileProblem) *BackupVerification {
+	v := &BackupVerification{
+		ID:           id,
+		Source:       source,
+		CompleteTime: completeTime,
+		State:        BackupVerificationStateVerified,
+		Files:        files,
+		FileCount:    len(files),
+		Problems:     problems,
+		ProblemCount: len(problems),
+		VerifiedAt:   time.Now(),
+	}
+	if len(problems) > backupVerificationMaxProblems {
+		v.Problems = problems[:backupVerificationMaxProblems]
+	}
+	if len(problems) != 0 {
+		v.State = BackupVerificationStateCorrupt
+	}
+	return v
+}
+
+// getObjects returns the attributes of the existing objects of paths by path.
+// The directories of the paths are listed with the checksums, not the objects one by one.
+func getObjects(c context.Context, sts *storage.Service, paths []string) (map[string]*storage.Object, error) {
+	wanted := make(map[string]bool)
+	var dirs [][2]string
+	listed := make(map[[2]string]bool)
+	for _, p := range paths {
+		bucket, name, err := parseGSPath(p)
+		if err != nil {
+			continue
+		}
+		wanted[p] = true
+		dir := [2]string{bucket, objectDir(name)}
+		if !listed[dir] {
+			listed[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+
+	objects := make(map[string]*storage.Object)
+	for _, dir := range dirs {
+		call := sts.Objects.List(dir[0]).Prefix(dir[1]).Delimiter("/").Fields("nextPageToken", "items(bucket,name,size,md5Hash,crc32c)")
+		err := call.Pages(c, func(objs *storage.Objects) error {
+			for _, obj := range objs.Items {
+				if p := fmt.Sprintf("/gs/%s/%s", dir[0], obj.Name); wanted[p] {
+					objects[p] = obj
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return objects, nil
+}
+
+// verifyAEBackup checks the .backup_info files and output files of the backup information of key.
+// The key has no parent if the backup has no operation.
+func verifyAEBackup(c context.Context, sts *storage.Service, key *datastore.Key) (*BackupVerification, error) {
+	if key.Kind() != "_AE_Backup_Information" || key.IntID() == 0 {
+		return nil, newHTTPError(http.StatusBadRequest, "ds2bq: invalid key of backup information: %s", key.String())
+	}
+
+	store := &AEDatastoreStore{}
+	info, err := store.GetAEBackupInformation(c, key.Parent(), key.IntID())
+	if err != nil {
+		return nil, err
+	}
+
+	paths := backupFilePaths(info)
+	objects, err := getObjects(c, sts, paths)
+	if err != nil {
+		return nil, err
+	}
+
+	files, problems := verifyObjects(paths, objects)
+	return newBackupVerification(key.Encode(), BackupSourceDatastoreAdmin, info.CompleteTime, files, problems), nil
+}
+
+// exportMetadataFiles returns the names of the files listed in the export metadata of name.
+// .overall_export_metadata lists .export_metadata files of kinds, and .export_metadata lists output files.
+// The names in the metadata are relative to the directory of the metadata, or full paths like gs://bucket/object.
+func exportMetadataFiles(name string, md *backupfile.ExportMetadata) []string {
+	dir := path.Dir(name)
+	seen := make(map[string]bool)
+	var files []string
+	for _, v := range md.Strings() {
+		base := path.Base(v)
+		if !strings.HasSuffix(base, ".export_metadata") && !strings.HasPrefix(base, "output-") {
+			continue
+		}
+		file := path.Join(dir, v)
+		if strings.HasPrefix(v, "gs://") {
+			parts := strings.SplitN(strings.TrimPrefix(v, "gs://"), "/", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			file = parts[1]
+		}
+		if !seen[file] {
+			seen[file] = true
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// crc32cChecksum returns the CRC32C checksum in the format of GCS object attributes.
+func crc32cChecksum(h hash.Hash32) string {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, h.Sum32())
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// readExportMetadataFiles reads the export metadata object, and returns the names of the files listed in it.
+// The CRC32C checksum of the content is compared with the object, the problem is returned if it does not match or can not be read.
+func readExportMetadataFiles(c context.Context, sts *storage.Service, obj *storage.Object) ([]string, *BackupFileProblem, error) {
+	p := fmt.Sprintf("/gs/%s/%s", obj.Bucket, obj.Name)
+	r, err := openObject(c, sts, obj.Bucket, obj.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+
+	h := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	md, err := backupfile.ReadExportMetadata(io.TeeReader(r, h))
+	if err != nil {
+		return nil, &BackupFileProblem{Path: p, Reason: BackupFileProblemCorrupt}, nil
+	}
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, nil, err
+	}
+	if obj.Crc32c != "" && obj.Crc32c != crc32cChecksum(h) {
+		return nil, &BackupFileProblem{Path: p, Reason: BackupFileProblemChecksum}, nil
+	}
+	return exportMetadataFiles(obj.Name, md), nil, nil
+}
+
+// verifyExport checks the files of the managed export under the prefix like 2017-11-14T06:47:01_23208.
+// The .overall_export_metadata is required, since it is written after all kinds are exported.
+// The .export_metadata files listed in it, and the output files listed in them are checked.
+func verifyExport(c context.Context, sts *storage.Service, bucket, prefix string) (*BackupVerification, error) {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return nil, fmt.Errorf("ds2bq: prefix of export is required")
+	}
+	overall := fmt.Sprintf("%s/%s.overall_export_metadata", prefix, path.Base(prefix))
+
+	var problems []BackupFileProblem
+	paths := []string{fmt.Sprintf("/gs/%s/%s", bucket, overall)}
+	objects := make(map[string]*storage.Object)
+	metadata := []string{overall}
+	for i := 0; i < len(metadata); i++ {
+		p := fmt.Sprintf("/gs/%s/%s", bucket, metadata[i])
+		obj, err := sts.Objects.Get(bucket, metadata[i]).Context(c).Do()
+		if isNotFound(err) {
+			// reported as missing.
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		objects[p] = obj
+
+		names, problem, err := readExportMetadataFiles(c, sts, obj)
+		if err != nil {
+			return nil, err
+		}
+		if problem != nil {
+			problems = append(problems, *problem)
+			continue
+		}
+		if i == 0 && len(names) == 0 {
+			problems = append(problems, BackupFileProblem{Path: p, Reason: BackupFileProblemNoFiles})
+		}
+
+		var outputs []string
+		for _, name := range names {
+			if strings.HasSuffix(name, ".export_metadata") {
+				paths = append(paths, fmt.Sprintf("/gs/%s/%s", bucket, name))
+				metadata = append(metadata, name)
+				continue
+			}
+			outputs = append(outputs, fmt.Sprintf("/gs/%s/%s", bucket, name))
+		}
+		found, err := getObjects(c, sts, outputs)
+		if err != nil {
+			return nil, err
+		}
+		for p, obj := range found {
+			objects[p] = obj
+		}
+		paths = append(paths, outputs...)
+	}
+
+	files, objectProblems := verifyObjects(paths, objects)
+	id := fmt.Sprintf("/gs/%s/%s", bucket, prefix)
+	return newBackupVerification(id, BackupSourceDatastoreExport, exportTime(prefix), files, append(problems, objectProblems...)), nil
+}
+
+// BackupVerificationReq provides request of verifying the backup.
+// Key is the encoded key of _AE_Backup_Information, or Bucket and Prefix are of the managed export.
+type BackupVerificationReq struct {
+	Key    string `json:"key"`
+	Bucket string `json:"bucket"`
+	Prefix string `json:"prefix"`
+}
+
+// verifyBackup verifies the backup of req, and saves the result.
+func verifyBackup(c context.Context, req *BackupVerificationReq) (*BackupVerification, error) {
+	sts, err := newStorageService(c)
+	if err != nil {
+		return nil, err
+	}
+
+	var v *BackupVerification
+	switch {
+	case req.Key != "":
+		key, err := datastore.DecodeKey(req.Key)
+		if err != nil {
+			return nil, err
+		}
+		v, err = verifyAEBackup(c, sts, key)
+		if err != nil {
+			return nil, err
+		}
+	case req.Bucket != "" && req.Prefix != "":
+		v, err = verifyExport(c, sts, req.Bucket, req.Prefix)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("ds2bq: key, or bucket and prefix are required")
+	}
+
+	store := &AEDatastoreStore{}
+	previous, err := store.GetBackupVerification(c, v.ID)
+	if err != nil {
+		return nil, err
+	}
+	if previous != nil {
+		previousFiles, err := store.getVerifiedFiles(c, previous)
+		if err != nil {
+			return nil, err
+		}
+		files, problems := compareChecksums(v.Files, previousFiles)
+		v = newBackupVerification(v.ID, v.Source, v.CompleteTime, files, append(v.Problems, problems...))
+	}
+
+	err = store.PutBackupVerification(c, v)
+	if err != nil {
+		return nil, err
+	}
+
+	if v.State == BackupVerificationStateCorrupt {
+		logError(c, "ds2bq: backup is corrupt", F("backupID", v.ID), F("problems", v.ProblemCount), F("firstProblem", v.Problems[0].Reason+" "+v.Problems[0].Path))
+	} else {
+		logInfo(c, "ds2bq: backup verified", F("backupID", v.ID), F("files", v.FileCount))
+	}
+	return v, nil
+}
@@ -0,0 +1,187 @@
+package ds2bq
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/favclip/ds2bq/backupfile"
+	"github.com/favclip/testerator"
+	"google.golang.org/api/storage/v1"
+)
+
+func TestVerifyObjects(t *testing.T) {
+	paths := []string{"/gs/backup/a.backup_info", "/gs/backup/output-0", "/gs/backup/output-1"}
+	objects := map[string]*storage.Object{
+		"/gs/backup/a.backup_info": {Size: 100, Md5Hash: "md5", Crc32c: "crc"},
+		"/gs/backup/output-1":      {Size: 0},
+	}
+
+	files, problems := verifyObjects(paths, objects)
+	if e, g := 1, len(files); e != g {
+		t.Fatalf("expected %d; got %d", e, g)
+	}
+	if e, g := "md5", files[0].MD5; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	if e, g := 2, len(problems); e != g {
+		t.Fatalf("expected %d; got %d", e, g)
+	}
+	if e, g := BackupFileProblemMissing, problems[0].Reason; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	if e, g := BackupFileProblemEmpty, problems[1].Reason; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+
+	v := newBackupVerification("id", BackupSourceDatastoreAdmin, time.Now(), files, problems)
+	if e, g := BackupVerificationStateCorrupt, v.State; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+
+	_, problems = verifyObjects(nil, objects)
+	if e, g := BackupFileProblemNoFiles, problems[0].Reason; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+}
+
+func TestAEDatastoreStore_NewestVerifiedBackupTime(t *testing.T) {
+	_, c, err := testerator.SpinUp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testerator.SpinDown()
+
+	base := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := &AEDatastoreStore{}
+	for i, v := range []*BackupVerification{
+		{ID: "a", Source: BackupSourceDatastoreAdmin, State: BackupVerificationStateVerified, CompleteTime: base},
+		{ID: "b", Source: BackupSourceDatastoreAdmin, State: BackupVerificationStateCorrupt, CompleteTime: base.Add(48 * time.Hour)},
+		{ID: "c", Source: BackupSourceDatastoreAdmin, State: BackupVerificationStateVerified, CompleteTime: base.Add(24 * time.Hour)},
+		{ID: "d", Source: BackupSourceDatastoreExport, State: BackupVerificationStateVerified, CompleteTime: base.Add(72 * time.Hour)},
+	} {
+		if err := store.PutBackupVerification(c, v); err != nil {
+			t.Fatalf("#%d: %s", i, err)
+		}
+	}
+
+	newest, err := store.NewestVerifiedBackupTime(c, BackupSourceDatastoreAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := base.Add(24*time.Hour), newest; !e.Equal(g) {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+
+	// the newest is recorded without scanning.
+	newer := &BackupVerification{ID: "e", Source: BackupSourceDatastoreAdmin, State: BackupVerificationStateVerified, CompleteTime: base.Add(96 * time.Hour)}
+	if err := store.PutBackupVerification(c, newer); err != nil {
+		t.Fatal(err)
+	}
+	newest, err = store.NewestVerifiedBackupTime(c, BackupSourceDatastoreAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := newer.CompleteTime, newest; !e.Equal(g) {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+
+	// the newest turns out corrupt.
+	newer.State = BackupVerificationStateCorrupt
+	if err := store.PutBackupVerification(c, newer); err != nil {
+		t.Fatal(err)
+	}
+	newest, err = store.NewestVerifiedBackupTime(c, BackupSourceDatastoreAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := base.Add(24*time.Hour), newest; !e.Equal(g) {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+}
+
+func TestAEDatastoreStore_PutBackupVerification(t *testing.T) {
+	_, c, err := testerator.SpinUp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testerator.SpinDown()
+
+	var files []*VerifiedFile
+	var problems []BackupFileProblem
+	for i := 0; i < backupVerificationMaxProblems+1; i++ {
+		files = append(files, &VerifiedFile{Path: fmt.Sprintf("/gs/backup/output-%d", i), MD5: "md5"})
+		problems = append(problems, BackupFileProblem{Path: fmt.Sprintf("/gs/backup/missing-%d", i), Reason: BackupFileProblemMissing})
+	}
+	store := &AEDatastoreStore{}
+	err = store.PutBackupVerification(c, newBackupVerification("id", BackupSourceDatastoreAdmin, time.Now(), files, problems))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := store.GetBackupVerification(c, "id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := backupVerificationMaxProblems, len(v.Problems); e != g {
+		t.Errorf("expected %d; got %d", e, g)
+	}
+	if e, g := backupVerificationMaxProblems+1, v.ProblemCount; e != g {
+		t.Errorf("expected %d; got %d", e, g)
+	}
+	saved, err := store.getVerifiedFiles(c, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := len(files), len(saved); e != g {
+		t.Fatalf("expected %d; got %d", e, g)
+	}
+	if e, g := v.FileCount, len(saved); e != g {
+		t.Errorf("expected %d; got %d", e, g)
+	}
+}
+
+func TestCompareChecksums(t *testing.T) {
+	previous := []*VerifiedFile{
+		{Path: "/gs/backup/output-0", MD5: "md5-0", CRC32C: "crc-0"},
+		{Path: "/gs/backup/output-1", MD5: "md5-1", CRC32C: "crc-1"},
+	}
+	files := []*VerifiedFile{
+		{Path: "/gs/backup/output-0", MD5: "md5-0", CRC32C: "crc-0"},
+		{Path: "/gs/backup/output-1", MD5: "md5-x", CRC32C: "crc-x"},
+		{Path: "/gs/backup/output-2", MD5: "md5-2", CRC32C: "crc-2"},
+	}
+
+	files, problems := compareChecksums(files, previous)
+	if e, g := 1, len(problems); e != g {
+		t.Fatalf("expected %d; got %d", e, g)
+	}
+	if e, g := "/gs/backup/output-1", problems[0].Path; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	if e, g := BackupFileProblemChecksum, problems[0].Reason; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	if e, g := "md5-1", files[1].MD5; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+}
+
+func TestExportMetadataFiles(t *testing.T) {
+	var record []byte
+	for _, v := range []string{
+		"all_namespaces/kind_Article/all_namespaces_kind_Article.export_metadata",
+		"Article",
+		"output-0",
+		"gs://backup/2017-11-14T06:47:01_23208/all_namespaces/kind_User/all_namespaces_kind_User.export_metadata",
+	} {
+		record = append(record, 0x0a, byte(len(v)))
+		record = append(record, v...)
+	}
+	md := &backupfile.ExportMetadata{Records: [][]byte{record}}
+
+	files := exportMetadataFiles("2017-11-14T06:47:01_23208/2017-11-14T06:47:01_23208.overall_export_metadata", md)
+	if e, g := "[2017-11-14T06:47:01_23208/all_namespaces/kind_Article/all_namespaces_kind_Article.export_metadata 2017-11-14T06:47:01_23208/output-0 2017-11-14T06:47:01_23208/all_namespaces/kind_User/all_namespaces_kind_User.export_metadata]", fmt.Sprint(files); e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+}
@@ -0,0 +1,341 @@
+package backupfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "update fixture files in testdata")
+
+// protoBuf encodes protocol buffers for fixtures.
+type protoBuf struct {
+	bytes.Buffer
+}
+
+func (b *protoBuf) tag(number, wireType int) {
+	b.uvarint(uint64(number<<3 | wireType))
+}
+
+func (b *protoBuf) uvarint(v uint64) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	b.Write(buf[:binary.PutUvarint(buf, v)])
+}
+
+func (b *protoBuf) varint(number int, v uint64) {
+	b.tag(number, wireVarint)
+	b.uvarint(v)
+}
+
+func (b *protoBuf) bytes(number int, v []byte) {
+	b.tag(number, wireBytes)
+	b.uvarint(uint64(len(v)))
+	b.Write(v)
+}
+
+func (b *protoBuf) double(number int, v float64) {
+	b.tag(number, wireFixed64)
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, math.Float64bits(v))
+	b.Write(buf)
+}
+
+func (b *protoBuf) group(number int, f func(g *protoBuf)) {
+	b.tag(number, wireStartGroup)
+	f(b)
+	b.tag(number, wireEndGroup)
+}
+
+func encodeReference(k *Key) []byte {
+	b := &protoBuf{}
+	b.bytes(13, []byte(k.App))
+	if k.Namespace != "" {
+		b.bytes(20, []byte(k.Namespace))
+	}
+	path := &protoBuf{}
+	for _, e := range k.Path {
+		path.group(1, func(g *protoBuf) {
+			g.bytes(2, []byte(e.Kind))
+			if e.Name != "" {
+				g.bytes(4, []byte(e.Name))
+			} else {
+				g.varint(3, uint64(e.ID))
+			}
+		})
+	}
+	b.bytes(14, path.Bytes())
+	return b.Bytes()
+}
+
+func encodeProperty(name string, meaning int, multiple bool, value func(v *protoBuf)) []byte {
+	b := &protoBuf{}
+	if meaning != 0 {
+		b.varint(1, uint64(meaning))
+	}
+	b.bytes(3, []byte(name))
+	if multiple {
+		b.varint(4, 1)
+	} else {
+		b.varint(4, 0)
+	}
+	v := &protoBuf{}
+	value(v)
+	b.bytes(5, v.Bytes())
+	return b.Bytes()
+}
+
+func encodeEntity(key *Key, properties ...[]byte) []byte {
+	b := &protoBuf{}
+	b.bytes(13, encodeReference(key))
+	// odd properties are written as raw_property (unindexed).
+	for i, p := range properties {
+		if i%2 == 0 {
+			b.bytes(14, p)
+		} else {
+			b.bytes(15, p)
+		}
+	}
+	return b.Bytes()
+}
+
+var fixtureTime = time.Date(2017, 11, 14, 6, 47, 1, 123000, time.UTC)
+
+func articleEntity(id int64) []byte {
+	return encodeEntity(
+		&Key{App: "s~example", Path: []*PathElement{{Kind: "User", Name: "alice"}, {Kind: "Article", ID: id}}},
+		encodeProperty("Title", 0, false, func(v *protoBuf) { v.bytes(3, []byte("Hello")) }),
+		encodeProperty("Body", MeaningText, false, func(v *protoBuf) { v.bytes(3, []byte("long text")) }),
+		encodeProperty("Views", 0, false, func(v *protoBuf) { v.varint(1, uint64(id*10)) }),
+		encodeProperty("Published", 0, false, func(v *protoBuf) { v.varint(2, 1) }),
+		encodeProperty("CreatedAt", MeaningGDWhen, false, func(v *protoBuf) {
+			v.varint(1, uint64(fixtureTime.UnixNano()/1e3))
+		}),
+		encodeProperty("Score", 0, false, func(v *protoBuf) { v.double(4, 4.5) }),
+		encodeProperty("Tags", 0, true, func(v *protoBuf) { v.bytes(3, []byte("go")) }),
+		encodeProperty("Tags", 0, true, func(v *protoBuf) { v.bytes(3, []byte("datastore")) }),
+		encodeProperty("Location", MeaningGeoRSSPoint, false, func(v *protoBuf) {
+			v.group(5, func(g *protoBuf) {
+				g.double(6, 35.6)
+				g.double(7, 139.7)
+			})
+		}),
+		encodeProperty("Author", 0, false, func(v *protoBuf) {
+			v.group(12, func(g *protoBuf) {
+				g.bytes(13, []byte("s~example"))
+				g.group(14, func(p *protoBuf) {
+					p.bytes(15, []byte("User"))
+					p.bytes(17, []byte("alice"))
+				})
+			})
+		}),
+		encodeProperty("Thumbnail", MeaningBlob, false, func(v *protoBuf) { v.bytes(3, []byte{0, 1, 2}) }),
+		encodeProperty("Deleted", 0, false, func(v *protoBuf) {}),
+	)
+}
+
+func writeFixture(t *testing.T, name string, records ...[]byte) {
+	buf := &bytes.Buffer{}
+	w := NewRecordWriter(buf)
+	for _, record := range records {
+		if err := w.Write(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join("testdata", name), buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	os.Exit(m.Run())
+}
+
+func TestUpdateFixtures(t *testing.T) {
+	if !*update {
+		t.SkipNow()
+	}
+
+	writeFixture(t, "output-0", articleEntity(1), articleEntity(2))
+
+	backupKey := &Key{App: "s~example", Path: []*PathElement{{Kind: "_AE_DatastoreAdmin_Operation", ID: 1}, {Kind: "_AE_Backup_Information", ID: 2}}}
+	writeFixture(t, "backup.Article.backup_info",
+		[]byte("1"),
+		encodeEntity(backupKey,
+			encodeProperty("name", 0, false, func(v *protoBuf) { v.bytes(3, []byte("daily")) }),
+			encodeProperty("kinds", 0, true, func(v *protoBuf) { v.bytes(3, []byte("Article")) }),
+		),
+		encodeEntity(&Key{App: "s~example", Path: append(backupKey.Path, &PathElement{Kind: "_AE_Backup_Information_Kind_Files", Name: "Article"})},
+			encodeProperty("files", 0, true, func(v *protoBuf) { v.bytes(3, []byte("/gs/bucket/daily/output-0")) }),
+			encodeProperty("files", 0, true, func(v *protoBuf) { v.bytes(3, []byte("/gs/bucket/daily/output-1")) }),
+		),
+	)
+}
+
+func TestEntityReader(t *testing.T) {
+	f, err := os.Open("testdata/output-0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	r := NewEntityReader(f)
+	var entities []*Entity
+	for {
+		e, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		entities = append(entities, e)
+	}
+	if len(entities) != 2 {
+		t.Fatalf("unexpected len %d", len(entities))
+	}
+
+	e := entities[1]
+	if e, g := `/User,"alice"/Article,2`, e.Key.String(); e != g {
+		t.Errorf("expected key %s; got %s", e, g)
+	}
+	if e, g := "Article", e.Key.Kind(); e != g {
+		t.Errorf("expected kind %s; got %s", e, g)
+	}
+
+	for _, test := range []struct {
+		name    string
+		want    interface{}
+		noIndex bool
+	}{
+		{name: "Title", want: "Hello"},
+		{name: "Body", want: "long text", noIndex: true},
+		{name: "Views", want: int64(20)},
+		{name: "Published", want: true, noIndex: true},
+		{name: "CreatedAt", want: fixtureTime},
+		{name: "Score", want: 4.5, noIndex: true},
+		{name: "Location", want: GeoPoint{Lat: 35.6, Lng: 139.7}},
+		{name: "Author", want: &Key{App: "s~example", Path: []*PathElement{{Kind: "User", Name: "alice"}}}, noIndex: true},
+		{name: "Thumbnail", want: []byte{0, 1, 2}},
+		{name: "Deleted", want: nil, noIndex: true},
+	} {
+		p := e.Property(test.name)
+		if p == nil {
+			t.Errorf("property %s not found", test.name)
+			continue
+		}
+		if !reflect.DeepEqual(test.want, p.Value) {
+			t.Errorf("expected %s %#v; got %#v", test.name, test.want, p.Value)
+		}
+		if test.noIndex != p.NoIndex {
+			t.Errorf("expected %s noIndex %t; got %t", test.name, test.noIndex, p.NoIndex)
+		}
+	}
+
+	if e, g := []interface{}{"go", "datastore"}, e.Values("Tags"); !reflect.DeepEqual(e, g) {
+		t.Errorf("expected Tags %#v; got %#v", e, g)
+	}
+}
+
+func TestReadBackupInfo(t *testing.T) {
+	f, err := os.Open("testdata/backup.Article.backup_info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	info, err := ReadBackupInfo(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := "1", info.Version; e != g {
+		t.Errorf("expected version %s; got %s", e, g)
+	}
+	if e, g := "daily", info.Information().Property("name").Value; e != g {
+		t.Errorf("expected name %v; got %v", e, g)
+	}
+	if e, g := []string{"/gs/bucket/daily/output-0", "/gs/bucket/daily/output-1"}, info.Files(); !reflect.DeepEqual(e, g) {
+		t.Errorf("expected files %#v; got %#v", e, g)
+	}
+}
+
+func TestRecordReader_multiBlock(t *testing.T) {
+	records := [][]byte{
+		bytes.Repeat([]byte("a"), 10),
+		bytes.Repeat([]byte("b"), blockSize*2+100),
+		bytes.Repeat([]byte("c"), blockSize-headerSize*3-10-2), // leaves a trailer shorter than header
+		bytes.Repeat([]byte("d"), 1),
+	}
+
+	buf := &bytes.Buffer{}
+	w := NewRecordWriter(buf)
+	for _, record := range records {
+		if err := w.Write(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := NewRecordReader(bytes.NewReader(buf.Bytes()))
+	for i, want := range records {
+		got, err := r.Next()
+		if err != nil {
+			t.Fatalf("%02d: %s", i, err)
+		}
+		if !bytes.Equal(want, got) {
+			t.Errorf("%02d: unexpected record, len %d; want len %d", i, len(got), len(want))
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("expected EOF; got %v", err)
+	}
+}
+
+func TestReadExportMetadata_recordsInBlocks(t *testing.T) {
+	// full chunk records in the first and the second block.
+	records := [][]byte{
+		bytes.Repeat([]byte("a"), blockSize-headerSize),
+		bytes.Repeat([]byte("b"), 100),
+	}
+
+	buf := &bytes.Buffer{}
+	w := NewRecordWriter(buf)
+	for _, record := range records {
+		if err := w.Write(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	md, err := ReadExportMetadata(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := len(records), len(md.Records); e != g {
+		t.Fatalf("expected %d records; got %d", e, g)
+	}
+	for i, want := range records {
+		if !bytes.Equal(want, md.Records[i]) {
+			t.Errorf("%02d: record is overwritten, got %q...", i, md.Records[i][:10])
+		}
+	}
+}
+
+func TestRecordReader_corrupted(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := NewRecordWriter(buf).Write([]byte("record")); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	b[len(b)-1] = 'x'
+
+	_, err := NewRecordReader(bytes.NewReader(b)).Next()
+	if err != ErrCorrupted {
+		t.Errorf("expected ErrCorrupted; got %v", err)
+	}
+}
@@ -0,0 +1,318 @@
+package backupfile
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// Meanings of property value in datastore_v3.
+const (
+	MeaningGDWhen      = 7
+	MeaningGDEmail     = 8
+	MeaningGeoRSSPoint = 9
+	MeaningBlob        = 14
+	MeaningText        = 15
+	MeaningByteString  = 16
+	MeaningIndexValue  = 18
+	MeaningEntityProto = 19
+	MeaningEmptyList   = 24
+)
+
+// Entity is an entity decoded from EntityProto.
+type Entity struct {
+	Key        *Key
+	Properties []*Property
+}
+
+// Property returns the first property named name, or nil.
+func (e *Entity) Property(name string) *Property {
+	for _, p := range e.Properties {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// Values returns all values of the properties named name.
+// Multiple valued property is stored as properties that have same name.
+func (e *Entity) Values(name string) []interface{} {
+	var vs []interface{}
+	for _, p := range e.Properties {
+		if p.Name == name {
+			vs = append(vs, p.Value)
+		}
+	}
+	return vs
+}
+
+// Property is a property of Entity.
+//
+// Value is one of nil, int64, bool, string, float64, []byte, time.Time, GeoPoint, User, *Key and *Entity.
+type Property struct {
+	Name     string
+	Value    interface{}
+	Meaning  int
+	Multiple bool
+	NoIndex  bool
+}
+
+// Key is a key of Entity.
+type Key struct {
+	App       string
+	Namespace string
+	Path      []*PathElement
+}
+
+// PathElement is an element of Key path.
+type PathElement struct {
+	Kind string
+	ID   int64
+	Name string
+}
+
+// Kind returns the kind of the key.
+func (k *Key) Kind() string {
+	if len(k.Path) == 0 {
+		return ""
+	}
+	return k.Path[len(k.Path)-1].Kind
+}
+
+// ID returns the integer ID of the key.
+func (k *Key) ID() int64 {
+	if len(k.Path) == 0 {
+		return 0
+	}
+	return k.Path[len(k.Path)-1].ID
+}
+
+// Name returns the string ID of the key.
+func (k *Key) Name() string {
+	if len(k.Path) == 0 {
+		return ""
+	}
+	return k.Path[len(k.Path)-1].Name
+}
+
+// String returns a string representation of the key like /Parent,1/Child,"name".
+func (k *Key) String() string {
+	buf := &bytes.Buffer{}
+	for _, e := range k.Path {
+		buf.WriteString("/")
+		buf.WriteString(e.Kind)
+		buf.WriteString(",")
+		if e.Name != "" {
+			buf.WriteString(strconv.Quote(e.Name))
+		} else {
+			buf.WriteString(strconv.FormatInt(e.ID, 10))
+		}
+	}
+	return buf.String()
+}
+
+// GeoPoint is a geographical point.
+type GeoPoint struct {
+	Lat float64
+	Lng float64
+}
+
+// User is a user value of App Engine.
+type User struct {
+	Email      string
+	AuthDomain string
+	Nickname   string
+	GaiaID     int64
+}
+
+// EntityReader reads entities from output-N file of backups and exports.
+type EntityReader struct {
+	rr *RecordReader
+}
+
+// NewEntityReader returns EntityReader that reads from r.
+func NewEntityReader(r io.Reader) *EntityReader {
+	return &EntityReader{rr: NewRecordReader(r)}
+}
+
+// Next returns the next entity. It returns io.EOF when no more entities.
+func (er *EntityReader) Next() (*Entity, error) {
+	record, err := er.rr.Next()
+	if err != nil {
+		return nil, err
+	}
+	return DecodeEntity(record)
+}
+
+// DecodeEntity decodes EntityProto of datastore_v3.
+func DecodeEntity(b []byte) (*Entity, error) {
+	fields, err := decodeProto(b)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Entity{}
+	for _, f := range fields {
+		switch f.Number {
+		case 13: // key
+			e.Key, err = decodeReference(f.Bytes)
+			if err != nil {
+				return nil, err
+			}
+		case 14, 15: // property, raw_property
+			p, err := decodeProperty(f.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			p.NoIndex = f.Number == 15
+			e.Properties = append(e.Properties, p)
+		}
+	}
+	return e, nil
+}
+
+func decodeReference(b []byte) (*Key, error) {
+	fields, err := decodeProto(b)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &Key{}
+	for _, f := range fields {
+		switch f.Number {
+		case 13: // app
+			k.App = f.String()
+		case 20: // name_space
+			k.Namespace = f.String()
+		case 14: // path
+			path, err := decodeProto(f.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			for _, pf := range path {
+				if pf.Number == 1 && pf.WireType == wireStartGroup {
+					k.Path = append(k.Path, decodePathElement(pf.Group, 2, 3, 4))
+				}
+			}
+		}
+	}
+	return k, nil
+}
+
+func decodePathElement(fields []protoField, kindNumber, idNumber, nameNumber int) *PathElement {
+	e := &PathElement{}
+	for _, f := range fields {
+		switch f.Number {
+		case kindNumber:
+			e.Kind = f.String()
+		case idNumber:
+			e.ID = int64(f.Varint)
+		case nameNumber:
+			e.Name = f.String()
+		}
+	}
+	return e
+}
+
+func decodeProperty(b []byte) (*Property, error) {
+	fields, err := decodeProto(b)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Property{}
+	var value []protoField
+	for _, f := range fields {
+		switch f.Number {
+		case 1: // meaning
+			p.Meaning = int(f.Varint)
+		case 3: // name
+			p.Name = f.String()
+		case 4: // multiple
+			p.Multiple = f.Varint != 0
+		case 5: // value
+			value, err = decodeProto(f.Bytes)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	p.Value, err = decodePropertyValue(value, p.Meaning)
+	if err != nil {
+		return nil, fmt.Errorf("backupfile: property %s: %s", p.Name, err)
+	}
+	return p, nil
+}
+
+func decodePropertyValue(fields []protoField, meaning int) (interface{}, error) {
+	for _, f := range fields {
+		switch f.Number {
+		case 1: // int64Value
+			if meaning == MeaningGDWhen {
+				usec := int64(f.Varint)
+				return time.Unix(usec/1e6, (usec%1e6)*1e3).UTC(), nil
+			}
+			return int64(f.Varint), nil
+		case 2: // booleanValue
+			return f.Varint != 0, nil
+		case 3: // stringValue
+			switch meaning {
+			case MeaningBlob, MeaningByteString:
+				return f.Bytes, nil
+			case MeaningEntityProto:
+				return DecodeEntity(f.Bytes)
+			default:
+				return f.String(), nil
+			}
+		case 4: // doubleValue
+			return f.float64(), nil
+		case 5: // PointValue
+			pt := GeoPoint{}
+			for _, g := range f.Group {
+				switch g.Number {
+				case 6:
+					pt.Lat = g.float64()
+				case 7:
+					pt.Lng = g.float64()
+				}
+			}
+			return pt, nil
+		case 8: // UserValue
+			u := User{}
+			for _, g := range f.Group {
+				switch g.Number {
+				case 9:
+					u.Email = g.String()
+				case 10:
+					u.AuthDomain = g.String()
+				case 11:
+					u.Nickname = g.String()
+				case 18:
+					u.GaiaID = int64(g.Varint)
+				}
+			}
+			return u, nil
+		case 12: // ReferenceValue
+			k := &Key{}
+			for _, g := range f.Group {
+				switch g.Number {
+				case 13:
+					k.App = g.String()
+				case 20:
+					k.Namespace = g.String()
+				case 14:
+					k.Path = append(k.Path, decodePathElement(g.Group, 15, 16, 17))
+				}
+			}
+			return k, nil
+		}
+	}
+	if meaning == MeaningEmptyList {
+		return []interface{}{}, nil
+	}
+	return nil, nil
+}
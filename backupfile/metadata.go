@@ -0,0 +1,134 @@
+package backupfile
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// BackupInfo is the content of .backup_info file of Datastore Admin backup.
+type BackupInfo struct {
+	Version  string
+	Entities []*Entity
+}
+
+// ReadBackupInfo reads .backup_info file.
+// The file has a version record and EntityProto records of _AE_Backup_Information and its children.
+func ReadBackupInfo(r io.Reader) (*BackupInfo, error) {
+	rr := NewRecordReader(r)
+	version, err := rr.Next()
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+
+	info := &BackupInfo{Version: string(version)}
+	for {
+		record, err := rr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		e, err := DecodeEntity(record)
+		if err != nil {
+			return nil, err
+		}
+		info.Entities = append(info.Entities, e)
+	}
+	return info, nil
+}
+
+// Information returns the _AE_Backup_Information entity, or nil.
+func (info *BackupInfo) Information() *Entity {
+	for _, e := range info.Entities {
+		if e.Key != nil && e.Key.Kind() == "_AE_Backup_Information" {
+			return e
+		}
+	}
+	return nil
+}
+
+// Files returns GCS paths of output files in _AE_Backup_Information_Kind_Files entities.
+// Paths are like /gs/bucket/object.
+func (info *BackupInfo) Files() []string {
+	var files []string
+	for _, e := range info.Entities {
+		if e.Key == nil || e.Key.Kind() != "_AE_Backup_Information_Kind_Files" {
+			continue
+		}
+		for _, v := range e.Values("files") {
+			if s, ok := v.(string); ok {
+				files = append(files, s)
+			}
+		}
+	}
+	return files
+}
+
+// ExportMetadata is the content of .export_metadata or .overall_export_metadata file of managed export.
+//
+// The schema of the records is not published, so ExportMetadata holds raw records
+// and Strings extracts printable string fields (kinds, namespaces and file names) on best effort.
+type ExportMetadata struct {
+	Records [][]byte
+}
+
+// ReadExportMetadata reads .export_metadata or .overall_export_metadata file.
+func ReadExportMetadata(r io.Reader) (*ExportMetadata, error) {
+	rr := NewRecordReader(r)
+	md := &ExportMetadata{}
+	for {
+		record, err := rr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		md.Records = append(md.Records, record)
+	}
+	if len(md.Records) == 0 {
+		return nil, fmt.Errorf("backupfile: no records in export metadata")
+	}
+	return md, nil
+}
+
+// Strings returns printable string fields in all records, in order of appearance.
+func (md *ExportMetadata) Strings() []string {
+	var ss []string
+	for _, record := range md.Records {
+		fields, err := decodeProto(record)
+		if err != nil {
+			continue
+		}
+		ss = appendStrings(ss, fields)
+	}
+	return ss
+}
+
+func appendStrings(ss []string, fields []protoField) []string {
+	for _, f := range fields {
+		switch f.WireType {
+		case wireBytes:
+			if nested, err := decodeProto(f.Bytes); err == nil && len(nested) != 0 && !isPrintable(f.Bytes) {
+				ss = appendStrings(ss, nested)
+			} else if isPrintable(f.Bytes) && len(f.Bytes) != 0 {
+				ss = append(ss, string(f.Bytes))
+			}
+		case wireStartGroup:
+			ss = appendStrings(ss, f.Group)
+		}
+	}
+	return ss
+}
+
+func isPrintable(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	return strings.IndexFunc(string(b), func(r rune) bool {
+		return r < 0x20 || r == 0x7f
+	}) == -1
+}
@@ -0,0 +1,100 @@
+package backupfile
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Wire types of protocol buffers.
+const (
+	wireVarint     = 0
+	wireFixed64    = 1
+	wireBytes      = 2
+	wireStartGroup = 3
+	wireEndGroup   = 4
+	wireFixed32    = 5
+)
+
+// protoField is a field decoded from protocol buffers wire format.
+type protoField struct {
+	Number   int
+	WireType int
+	Varint   uint64 // wireVarint, wireFixed64 and wireFixed32
+	Bytes    []byte // wireBytes
+	Group    []protoField
+}
+
+func (f protoField) float64() float64 {
+	return math.Float64frombits(f.Varint)
+}
+
+func (f protoField) String() string {
+	return string(f.Bytes)
+}
+
+// decodeProto decodes b into fields. Groups are decoded recursively.
+func decodeProto(b []byte) ([]protoField, error) {
+	fields, _, err := decodeProtoUntil(b, 0)
+	return fields, err
+}
+
+// decodeProtoUntil decodes b until the end group of endNumber, or end of b if endNumber is 0.
+func decodeProtoUntil(b []byte, endNumber int) ([]protoField, []byte, error) {
+	var fields []protoField
+	for len(b) != 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, nil, ErrCorrupted
+		}
+		b = b[n:]
+
+		f := protoField{Number: int(tag >> 3), WireType: int(tag & 7)}
+		switch f.WireType {
+		case wireVarint:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return nil, nil, ErrCorrupted
+			}
+			f.Varint = v
+			b = b[n:]
+		case wireFixed64:
+			if len(b) < 8 {
+				return nil, nil, ErrCorrupted
+			}
+			f.Varint = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case wireFixed32:
+			if len(b) < 4 {
+				return nil, nil, ErrCorrupted
+			}
+			f.Varint = uint64(binary.LittleEndian.Uint32(b))
+			b = b[4:]
+		case wireBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return nil, nil, ErrCorrupted
+			}
+			f.Bytes = b[n : n+int(l)]
+			b = b[n+int(l):]
+		case wireStartGroup:
+			group, rest, err := decodeProtoUntil(b, f.Number)
+			if err != nil {
+				return nil, nil, err
+			}
+			f.Group = group
+			b = rest
+		case wireEndGroup:
+			if f.Number != endNumber {
+				return nil, nil, ErrCorrupted
+			}
+			return fields, b, nil
+		default:
+			return nil, nil, ErrCorrupted
+		}
+		fields = append(fields, f)
+	}
+	if endNumber != 0 {
+		return nil, nil, ErrCorrupted
+	}
+	return fields, nil, nil
+}
@@ -0,0 +1,212 @@
+// Package backupfile reads files of Datastore Admin backups and managed exports.
+//
+// Both of them are written in LevelDB log format, a sequence of records in 32KiB blocks.
+// output-N files contain serialized EntityProto (datastore_v3) records,
+// and .backup_info files contain a version record followed by EntityProto of backup information.
+package backupfile
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	blockSize  = 32 * 1024
+	headerSize = 7
+)
+
+// Types of LevelDB log record chunk.
+const (
+	chunkZero   = 0
+	chunkFull   = 1
+	chunkFirst  = 2
+	chunkMiddle = 3
+	chunkLast   = 4
+)
+
+// ErrCorrupted means the file is not in LevelDB log format or broken.
+var ErrCorrupted = errors.New("backupfile: corrupted record")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func maskCRC(c uint32) uint32 {
+	return ((c >> 15) | (c << 17)) + 0xa282ead8
+}
+
+func chunkCRC(typ byte, data []byte) uint32 {
+	c := crc32.Update(0, crcTable, []byte{typ})
+	return maskCRC(crc32.Update(c, crcTable, data))
+}
+
+// RecordReader reads records of LevelDB log format.
+type RecordReader struct {
+	r     io.Reader
+	block []byte
+	pos   int
+	eof   bool
+}
+
+// NewRecordReader returns RecordReader that reads from r.
+func NewRecordReader(r io.Reader) *RecordReader {
+	return &RecordReader{r: r}
+}
+
+// Next returns the next record. It returns io.EOF when no more records.
+// The record is not shared with the internal buffer, so it stays valid after following calls.
+func (rr *RecordReader) Next() ([]byte, error) {
+	var record []byte
+	inFragment := false
+	for {
+		typ, data, err := rr.nextChunk()
+		if err == io.EOF && inFragment {
+			return nil, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch typ {
+		case chunkFull:
+			if inFragment {
+				return nil, ErrCorrupted
+			}
+			return append([]byte(nil), data...), nil
+		case chunkFirst:
+			if inFragment {
+				return nil, ErrCorrupted
+			}
+			record = append(record[:0], data...)
+			inFragment = true
+		case chunkMiddle:
+			if !inFragment {
+				return nil, ErrCorrupted
+			}
+			record = append(record, data...)
+		case chunkLast:
+			if !inFragment {
+				return nil, ErrCorrupted
+			}
+			return append(record, data...), nil
+		default:
+			return nil, ErrCorrupted
+		}
+	}
+}
+
+func (rr *RecordReader) nextChunk() (byte, []byte, error) {
+	for {
+		if len(rr.block)-rr.pos < headerSize {
+			if err := rr.readBlock(); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+
+		header := rr.block[rr.pos : rr.pos+headerSize]
+		checksum := binary.LittleEndian.Uint32(header[0:4])
+		length := int(binary.LittleEndian.Uint16(header[4:6]))
+		typ := header[6]
+
+		if typ == chunkZero && length == 0 {
+			// rest of block is zero filled.
+			rr.pos = len(rr.block)
+			continue
+		}
+		if rr.pos+headerSize+length > len(rr.block) {
+			return 0, nil, ErrCorrupted
+		}
+
+		data := rr.block[rr.pos+headerSize : rr.pos+headerSize+length]
+		rr.pos += headerSize + length
+		if chunkCRC(typ, data) != checksum {
+			return 0, nil, ErrCorrupted
+		}
+		return typ, data, nil
+	}
+}
+
+func (rr *RecordReader) readBlock() error {
+	if rr.eof {
+		return io.EOF
+	}
+	if rr.block == nil {
+		rr.block = make([]byte, blockSize)
+	}
+	n, err := io.ReadFull(rr.r, rr.block[:blockSize])
+	if err == io.EOF {
+		rr.eof = true
+		return io.EOF
+	} else if err == io.ErrUnexpectedEOF {
+		rr.eof = true
+	} else if err != nil {
+		return err
+	}
+	rr.block = rr.block[:n]
+	rr.pos = 0
+	return nil
+}
+
+// RecordWriter writes records in LevelDB log format.
+type RecordWriter struct {
+	w      io.Writer
+	offset int // offset in current block
+}
+
+// NewRecordWriter returns RecordWriter that writes to w.
+func NewRecordWriter(w io.Writer) *RecordWriter {
+	return &RecordWriter{w: w}
+}
+
+// Write writes a record.
+func (rw *RecordWriter) Write(record []byte) error {
+	first := true
+	for {
+		left := blockSize - rw.offset
+		if left < headerSize {
+			if _, err := rw.w.Write(make([]byte, left)); err != nil {
+				return err
+			}
+			rw.offset = 0
+			left = blockSize
+		}
+
+		avail := left - headerSize
+		n := len(record)
+		last := true
+		if n > avail {
+			n = avail
+			last = false
+		}
+
+		var typ byte
+		switch {
+		case first && last:
+			typ = chunkFull
+		case first:
+			typ = chunkFirst
+		case last:
+			typ = chunkLast
+		default:
+			typ = chunkMiddle
+		}
+
+		header := make([]byte, headerSize)
+		binary.LittleEndian.PutUint32(header[0:4], chunkCRC(typ, record[:n]))
+		binary.LittleEndian.PutUint16(header[4:6], uint16(n))
+		header[6] = typ
+		if _, err := rw.w.Write(header); err != nil {
+			return err
+		}
+		if _, err := rw.w.Write(record[:n]); err != nil {
+			return err
+		}
+		rw.offset += headerSize + n
+		record = record[n:]
+		first = false
+
+		if last {
+			return nil
+		}
+	}
+}
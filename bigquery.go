@@ -0,0 +1,96 @@
+package ds2bq
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"google.golang.org/api/bigquery/v2"
+	"google.golang.org/api/googleapi"
+)
+
+func newBigQueryService(c context.Context) (*bigquery.Service, error) {
+	return bigquery.New(newGoogleClient(c, bigquery.BigqueryScope))
+}
+
+// jobError returns the error of DONE job, or nil if the job succeeded.
+func jobError(job *bigquery.Job) error {
+	if job.Status == nil || job.Status.ErrorResult == nil {
+		return nil
+	}
+	return fmt.Errorf("ds2bq: job %s failed: %s", job.JobReference.JobId, job.Status.ErrorResult.Message)
+}
+
+// isNotFound reports whether err is 404 error of Google APIs.
+func isNotFound(err error) bool {
+	if gerr, ok := err.(*googleapi.Error); ok {
+		return gerr.Code == http.StatusNotFound
+	}
+	return false
+}
+
+// isRetryableError reports whether the request of Google APIs may succeed by retrying.
+// Errors other than googleapi.Error, like network errors, are regarded as transient.
+func isRetryableError(err error) bool {
+	if gerr, ok := err.(*googleapi.Error); ok {
+		return gerr.Code == http.StatusTooManyRequests || gerr.Code >= http.StatusInternalServerError
+	}
+	return true
+}
+
+// insertJob inserts the job whose JobId is deterministic.
+// If the job already exists, it is inserted by the former try of the task, and the existing job is returned.
+func insertJob(c context.Context, bqs *bigquery.Service, job *bigquery.Job) (*bigquery.Job, error) {
+	ref := job.JobReference
+	inserted, err := bqs.Jobs.Insert(ref.ProjectId, job).Context(c).Do()
+	if gerr, ok := err.(*googleapi.Error); ok && gerr.Code == http.StatusConflict {
+		call := bqs.Jobs.Get(ref.ProjectId, ref.JobId).Context(c)
+		if ref.Location != "" {
+			call = call.Location(ref.Location)
+		}
+		return call.Do()
+	}
+	return inserted, err
+}
+
+// quoteTable returns the table name for standard SQL.
+func quoteTable(projectID, datasetID, tableID string) string {
+	return fmt.Sprintf("`%s.%s.%s`", projectID, datasetID, tableID)
+}
+
+// upsertView creates the view, or updates its query if already exists.
+// current is the view that exists, or nil.
+func upsertView(c context.Context, bqs *bigquery.Service, current *bigquery.Table, projectID, datasetID, viewID, query string, labels map[string]string) error {
+	table := &bigquery.Table{
+		TableReference: &bigquery.TableReference{
+			ProjectId: projectID,
+			DatasetId: datasetID,
+			TableId:   viewID,
+		},
+		View: &bigquery.ViewDefinition{
+			Query:           query,
+			UseLegacySql:    false,
+			ForceSendFields: []string{"UseLegacySql"},
+		},
+		Labels: labels,
+	}
+
+	if current == nil {
+		_, err := bqs.Tables.Insert(projectID, datasetID, table).Context(c).Do()
+		return err
+	}
+
+	_, err := bqs.Tables.Patch(projectID, datasetID, viewID, table).Context(c).Do()
+	return err
+}
+
+// getTable returns the table, or nil if not exists.
+func getTable(c context.Context, bqs *bigquery.Service, projectID, datasetID, tableID string) (*bigquery.Table, error) {
+	table, err := bqs.Tables.Get(projectID, datasetID, tableID).Context(c).Do()
+	if isNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return table, nil
+}
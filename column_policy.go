@@ -0,0 +1,310 @@
+package ds2bq
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"google.golang.org/api/bigquery/v2"
+	"google.golang.org/api/googleapi"
+)
+
+// ColumnPolicy is the rule of sensitive properties of a kind imported into BigQuery.
+//
+// Excluded properties are dropped by ProjectionFields of the load job if the properties of the kind are known
+// from the .backup_info file. Otherwise, and for hashed or masked properties, the backup is loaded into the raw table
+// and rewritten into the destination table by a query job, then the raw table is deleted.
+// Properties in the rule must exist in the backup, or the import fails.
+type ColumnPolicy struct {
+	// Exclude properties are not imported.
+	Exclude []string `json:"exclude"`
+	// Hash properties are replaced with hex encoded SHA-256 of Salt + value, or of value if Salt is empty.
+	Hash []string `json:"hash"`
+	// Mask properties are replaced with MaskValue.
+	Mask []string `json:"mask"`
+	// Salt of Hash. It is optional, but unsalted hashes of guessable values like emails can be reversed.
+	// The salt is passed to the rewrite job as a query parameter, so anyone who can get the jobs of the project
+	// can read it from the job configuration. Limit bigquery.jobs.get and bigquery.jobs.listAll accordingly.
+	Salt string `json:"salt"`
+	// MaskValue replaces Mask properties. default is "****".
+	MaskValue string `json:"maskValue"`
+	// RawDatasetID is the dataset of the raw table. default is the dataset of the load job + "_raw".
+	// It must be other than datasets of the watcher. Use a dataset that readers can not access,
+	// because the raw table has properties in cleartext until rewritten.
+	RawDatasetID string `json:"rawDataset"`
+}
+
+// ColumnPolicyError is the error that ColumnPolicy of the kind does not match its backup.
+// Retrying the import does not help until the policy is fixed.
+type ColumnPolicyError struct {
+	Kind string
+	Err  error
+}
+
+func (err *ColumnPolicyError) Error() string {
+	return err.Err.Error()
+}
+
+type gcsWatcherColumnPolicyOption struct {
+	KindName     string
+	ColumnPolicy *ColumnPolicy
+}
+
+func (o *gcsWatcherColumnPolicyOption) implements(s *gcsWatcherService) {
+	if s.ColumnPolicies == nil {
+		s.ColumnPolicies = make(map[string]*ColumnPolicy)
+	}
+	s.ColumnPolicies[o.KindName] = o.ColumnPolicy
+}
+
+// GCSWatcherWithColumnPolicy provides the rule of sensitive properties of the kind.
+func GCSWatcherWithColumnPolicy(kindName string, p *ColumnPolicy) GCSWatcherOption {
+	return &gcsWatcherColumnPolicyOption{
+		KindName:     kindName,
+		ColumnPolicy: p,
+	}
+}
+
+func (p *ColumnPolicy) names() []string {
+	var names []string
+	names = append(names, p.Exclude...)
+	names = append(names, p.Hash...)
+	names = append(names, p.Mask...)
+	return names
+}
+
+func (p *ColumnPolicy) validate() error {
+	seen := make(map[string]bool)
+	for _, name := range p.names() {
+		if name == "" || name == "__key__" {
+			return fmt.Errorf("ds2bq: property %q can not be in ColumnPolicy", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("ds2bq: property %s is in ColumnPolicy twice", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// rawDatasetID returns the dataset of the raw table for the load job into datasetID.
+func (p *ColumnPolicy) rawDatasetID(datasetID string) string {
+	if p.RawDatasetID != "" {
+		return p.RawDatasetID
+	}
+	return datasetID + "_raw"
+}
+
+// projectionFields returns ProjectionFields of the load job that excludes properties.
+// It returns an error if a property of the policy is not in the type info.
+func (p *ColumnPolicy) projectionFields(typeInfo *AEBackupEntityTypeInfo) ([]string, error) {
+	var properties []string
+	for _, prop := range typeInfo.Properties {
+		properties = append(properties, prop.Name)
+	}
+	for _, name := range p.names() {
+		if !containsString(properties, name) {
+			return nil, fmt.Errorf("ds2bq: property %s of ColumnPolicy is not found in kind %s", name, typeInfo.Kind)
+		}
+	}
+
+	var fields []string
+	for _, name := range properties {
+		if !containsString(p.Exclude, name) {
+			fields = append(fields, name)
+		}
+	}
+	return fields, nil
+}
+
+// needsRewrite reports whether the loaded table must be rewritten by a query job.
+func (p *ColumnPolicy) needsRewrite(projected bool) bool {
+	return len(p.Hash) != 0 || len(p.Mask) != 0 || (len(p.Exclude) != 0 && !projected)
+}
+
+// rewriteSQL returns the query that rewrites the raw table by the policy.
+// excluded reports whether Exclude properties are already dropped by ProjectionFields.
+func (p *ColumnPolicy) rewriteSQL(rawTable string, schema *bigquery.TableSchema, excluded bool) (string, error) {
+	fields := make(map[string]*bigquery.TableFieldSchema)
+	for _, f := range schema.Fields {
+		fields[f.Name] = f
+	}
+
+	var except []string
+	if !excluded {
+		for _, name := range p.Exclude {
+			if fields[name] == nil {
+				return "", fmt.Errorf("ds2bq: property %s of ColumnPolicy is not found in the table", name)
+			}
+			except = append(except, "`"+name+"`")
+		}
+	}
+
+	var replace []string
+	for _, rule := range []struct {
+		names []string
+		expr  func(v string, f *bigquery.TableFieldSchema) string
+	}{
+		{p.Hash, func(v string, f *bigquery.TableFieldSchema) string {
+			value := fmt.Sprintf("CAST(%s AS STRING)", v)
+			if f.Type == "RECORD" {
+				value = fmt.Sprintf("TO_JSON_STRING(%s)", v)
+			}
+			if p.Salt != "" {
+				value = fmt.Sprintf("CONCAT(@salt, %s)", value)
+			}
+			return fmt.Sprintf("TO_HEX(SHA256(%s))", value)
+		}},
+		{p.Mask, func(v string, f *bigquery.TableFieldSchema) string {
+			return fmt.Sprintf("IF(%s IS NULL, NULL, @mask)", v)
+		}},
+	} {
+		for _, name := range rule.names {
+			f := fields[name]
+			if f == nil {
+				return "", fmt.Errorf("ds2bq: property %s of ColumnPolicy is not found in the table", name)
+			}
+			column := "`" + name + "`"
+			if f.Mode == "REPEATED" {
+				replace = append(replace, fmt.Sprintf("ARRAY(SELECT %s FROM UNNEST(%s) AS v) AS %s", rule.expr("v", f), column, column))
+			} else {
+				replace = append(replace, fmt.Sprintf("%s AS %s", rule.expr(column, f), column))
+			}
+		}
+	}
+
+	sql := "SELECT *"
+	if len(except) != 0 {
+		sql += " EXCEPT(" + strings.Join(except, ", ") + ")"
+	}
+	if len(replace) != 0 {
+		sql += " REPLACE(" + strings.Join(replace, ", ") + ")"
+	}
+	return sql + " FROM " + rawTable, nil
+}
+
+func (p *ColumnPolicy) maskValue() string {
+	if p.MaskValue == "" {
+		return "****"
+	}
+	return p.MaskValue
+}
+
+// applyColumnPolicy configures the load job by the policy of the kind.
+// It returns the raw table that the backup is loaded into if the table is rewritten after the load.
+func (s *gcsWatcherService) applyColumnPolicy(c context.Context, req *GCSObjectToBQJobReq, load *bigquery.JobConfigurationLoad) (*bigquery.TableReference, error) {
+	p, ok := s.ColumnPolicies[req.KindName]
+	if !ok {
+		return nil, nil
+	}
+
+	projected := false
+	if len(p.names()) != 0 && strings.HasSuffix(req.FilePath, ".backup_info") {
+		b, err := OpenBackup(c, req)
+		if err != nil {
+			return nil, err
+		}
+		if b.TypeInfo != nil {
+			// every property of the policy is checked before loading, not only Exclude.
+			fields, err := p.projectionFields(b.TypeInfo)
+			if err != nil {
+				return nil, &ColumnPolicyError{Kind: req.KindName, Err: err}
+			}
+			if len(p.Exclude) != 0 {
+				load.ProjectionFields = fields
+				projected = true
+			}
+		}
+	}
+	if !p.needsRewrite(projected) {
+		return nil, nil
+	}
+
+	dst := load.DestinationTable
+	raw := &bigquery.TableReference{
+		ProjectId: dst.ProjectId,
+		DatasetId: p.rawDatasetID(dst.DatasetId),
+		TableId:   rawTableID(dst.TableId),
+	}
+	if raw.DatasetId == dst.DatasetId {
+		return nil, &ColumnPolicyError{Kind: req.KindName, Err: fmt.Errorf("ds2bq: raw dataset of kind %s must be other than %s", req.KindName, dst.DatasetId)}
+	}
+	load.DestinationTable = raw
+	load.TimePartitioning = nil
+	return raw, nil
+}
+
+// rawTableID returns the table ID of the raw table for the destination table.
+func rawTableID(tableID string) string {
+	return strings.Replace(tableID, "$", "_", 1) + "_raw"
+}
+
+// insertRewriteJob rewrites the raw table loaded by the job of req into the destination table.
+func (s *gcsWatcherService) insertRewriteJob(c context.Context, bqs *bigquery.Service, req *ImportJobStatusReq, p *ColumnPolicy) error {
+	raw, err := bqs.Tables.Get(req.ProjectID, req.RawDatasetID, req.RawTableID).Context(c).Do()
+	if err != nil {
+		return err
+	}
+	var sql string
+	if p == nil {
+		err = fmt.Errorf("ds2bq: ColumnPolicy of kind %s is not found", req.Import.KindName)
+	} else {
+		sql, err = p.rewriteSQL(quoteTable(req.ProjectID, req.RawDatasetID, req.RawTableID), raw.Schema, req.Projected)
+	}
+	if err != nil {
+		// the policy does not match the backup, retrying does not help.
+		err = &ColumnPolicyError{Kind: req.Import.KindName, Err: err}
+		logWarning(c, "ds2bq: failed to rewrite by ColumnPolicy", F(FieldKind, req.Import.KindName), F(FieldError, err))
+		deleteRawTable(c, bqs, req)
+		s.Observers.OnImportCompleted(c, req.Import, req.loadJobID(), err)
+		if req.BatchID != "" {
+			return s.failImportBatch(c, bqs, req, err)
+		}
+		return nil
+	}
+
+	params := []*bigquery.QueryParameter{
+		{Name: "mask", ParameterType: &bigquery.QueryParameterType{Type: "STRING"}, ParameterValue: &bigquery.QueryParameterValue{Value: p.maskValue()}},
+	}
+	if p.Salt != "" {
+		// the salt is visible in the job configuration, see ColumnPolicy.Salt.
+		params = append(params, &bigquery.QueryParameter{Name: "salt", ParameterType: &bigquery.QueryParameterType{Type: "STRING"}, ParameterValue: &bigquery.QueryParameterValue{Value: p.Salt}})
+	}
+	query := &bigquery.JobConfigurationQuery{
+		Query:           sql,
+		UseLegacySql:    googleapi.Bool(false),
+		QueryParameters: params,
+		DestinationTable: &bigquery.TableReference{
+			ProjectId: req.ProjectID,
+			DatasetId: req.DatasetID,
+			TableId:   req.TableID,
+		},
+		CreateDisposition: "CREATE_IF_NEEDED",
+		WriteDisposition:  "WRITE_TRUNCATE",
+	}
+	if strings.Contains(req.TableID, "$") {
+		query.TimePartitioning = &bigquery.TimePartitioning{Type: "DAY"}
+	}
+	job := &bigquery.Job{
+		JobReference:  req.stageJobReference(importStageRewrite),
+		Configuration: &bigquery.JobConfiguration{Query: query},
+	}
+	job, err = insertJob(c, bqs, job)
+	if err != nil {
+		return err
+	}
+	logInfo(c, "ds2bq: rewrite job submitted", F(FieldKind, req.Import.KindName), F(FieldJobID, job.JobReference.JobId), F("table", req.TableID))
+
+	next := req.next(importStageRewrite, job.JobReference)
+	next.RawDatasetID = req.RawDatasetID
+	next.RawTableID = req.RawTableID
+	return s.addImportJobStatusTask(c, next)
+}
+
+// deleteRawTable deletes the raw table that has properties in cleartext.
+func deleteRawTable(c context.Context, bqs *bigquery.Service, req *ImportJobStatusReq) {
+	err := bqs.Tables.Delete(req.ProjectID, req.RawDatasetID, req.RawTableID).Context(c).Do()
+	if err != nil && !isNotFound(err) {
+		logError(c, "ds2bq: failed to delete raw table", F(FieldKind, req.Import.KindName), F("table", req.RawDatasetID+"."+req.RawTableID), F(FieldError, err))
+	}
+}
@@ -0,0 +1,122 @@
+package ds2bq
+
+import (
+	"reflect"
+	"testing"
+
+	"google.golang.org/api/bigquery/v2"
+)
+
+func TestColumnPolicy_validate(t *testing.T) {
+	if err := (&ColumnPolicy{Exclude: []string{"Token"}, Hash: []string{"Email"}, Salt: "secret"}).validate(); err != nil {
+		t.Error(err)
+	}
+	if err := (&ColumnPolicy{Hash: []string{"Email"}}).validate(); err != nil {
+		t.Error(err)
+	}
+	if err := (&ColumnPolicy{Exclude: []string{"Email"}, Hash: []string{"Email"}}).validate(); err == nil {
+		t.Error("expected error")
+	}
+	if err := (&ColumnPolicy{Mask: []string{"__key__"}}).validate(); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestColumnPolicy_rawDatasetID(t *testing.T) {
+	if e, g := "datastore_imports_raw", (&ColumnPolicy{}).rawDatasetID("datastore_imports"); e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	if e, g := "datastore_raw", (&ColumnPolicy{RawDatasetID: "datastore_raw"}).rawDatasetID("datastore_imports"); e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+}
+
+func TestColumnPolicy_projectionFields(t *testing.T) {
+	typeInfo := &AEBackupEntityTypeInfo{
+		Kind: "User",
+		Properties: []*AEBackupEntityTypeInfoProperty{
+			{Name: "Name"},
+			{Name: "Email"},
+			{Name: "Token"},
+		},
+	}
+
+	fields, err := (&ColumnPolicy{Exclude: []string{"Token"}, Hash: []string{"Email"}}).projectionFields(typeInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := []string{"Name", "Email"}, fields; !reflect.DeepEqual(e, g) {
+		t.Errorf("expected %#v; got %#v", e, g)
+	}
+
+	_, err = (&ColumnPolicy{Exclude: []string{"Tokne"}}).projectionFields(typeInfo)
+	if err == nil {
+		t.Error("expected error")
+	}
+
+	_, err = (&ColumnPolicy{Hash: []string{"Emial"}, Salt: "secret"}).projectionFields(typeInfo)
+	if err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestColumnPolicy_rewriteSQL(t *testing.T) {
+	schema := &bigquery.TableSchema{
+		Fields: []*bigquery.TableFieldSchema{
+			{Name: "__key__", Type: "RECORD"},
+			{Name: "Email", Type: "STRING"},
+			{Name: "Phones", Type: "STRING", Mode: "REPEATED"},
+			{Name: "Address", Type: "RECORD"},
+			{Name: "Token", Type: "STRING"},
+		},
+	}
+	p := &ColumnPolicy{
+		Exclude: []string{"Token"},
+		Hash:    []string{"Email", "Address"},
+		Mask:    []string{"Phones"},
+		Salt:    "secret",
+	}
+
+	sql, err := p.rewriteSQL("`p.d.User_raw`", schema, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := "SELECT * EXCEPT(`Token`) REPLACE(" +
+		"TO_HEX(SHA256(CONCAT(@salt, CAST(`Email` AS STRING)))) AS `Email`, " +
+		"TO_HEX(SHA256(CONCAT(@salt, TO_JSON_STRING(`Address`)))) AS `Address`, " +
+		"ARRAY(SELECT IF(v IS NULL, NULL, @mask) FROM UNNEST(`Phones`) AS v) AS `Phones`" +
+		") FROM `p.d.User_raw`"
+	if sql != e {
+		t.Errorf("expected\n%s\ngot\n%s", e, sql)
+	}
+
+	sql, err = p.rewriteSQL("`p.d.User_raw`", schema, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := "SELECT * REPLACE(", sql[:len("SELECT * REPLACE(")]; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+
+	sql, err = (&ColumnPolicy{Hash: []string{"Email"}}).rewriteSQL("`p.d.User_raw`", schema, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := "SELECT * REPLACE(TO_HEX(SHA256(CAST(`Email` AS STRING))) AS `Email`) FROM `p.d.User_raw`", sql; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+
+	_, err = (&ColumnPolicy{Hash: []string{"Emial"}}).rewriteSQL("`p.d.User_raw`", schema, false)
+	if err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestRawTableID(t *testing.T) {
+	if e, g := "User_raw", rawTableID("User"); e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	if e, g := "User_20171114_raw", rawTableID("User$20171114"); e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+}
@@ -0,0 +1,916 @@
+package ds2bq
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the declarative configuration of ds2bq services, loaded from YAML or JSON file.
+//
+//	watcher:
+//	  bucket: foobar-datastore-backups
+//	  dataset: datastore_imports
+//	  queueName: datastore-to-bq
+//	  kinds: [Article, User]
+//	  latestView: _latest
+//	  columnPolicies:
+//	    User:
+//	      hash: [Email]
+//	      salt: ${EMAIL_SALT}
+//	management:
+//	  queueName: exec-rm-old-datastore-backups
+//	  expireAfter: 720h
+//	restore:
+//	  bucket: ${BACKUP_BUCKET:-foobar-datastore-backups}
+//	export:
+//	  bucket: foobar-datastore-backups
+//	  kinds: [Article, User]
+//
+// String values can refer environment variables by ${NAME}, or ${NAME:-default} for the default value.
+// Keys are the json tags of the fields.
+type Config struct {
+	Watcher    *WatcherConfig    `json:"watcher"`
+	Management *ManagementConfig `json:"management"`
+	Restore    *RestoreConfig    `json:"restore"`
+	Export     *ExportConfig     `json:"export"`
+}
+
+// WatcherConfig is the configuration of GCSWatcherService.
+type WatcherConfig struct {
+	OCNReceiveURL      string                   `json:"ocnReceiveURL"`
+	ObjectToBQJobURL   string                   `json:"objectToBQJobURL"`
+	ImportJobStatusURL string                   `json:"importJobStatusURL"`
+	QueueName          string                   `json:"queueName"`
+	Bucket             string                   `json:"bucket"`
+	Dataset            string                   `json:"dataset"`
+	StagingDataset     string                   `json:"stagingDataset"`
+	Kinds              []string                 `json:"kinds"`
+	DatedTable         string                   `json:"datedTable"`
+	PartitionedTable   bool                     `json:"partitionedTable"`
+	LatestView         string                   `json:"latestView"`
+	RowCountValidation *RowCountValidation      `json:"rowCountValidation"`
+	Transforms         map[string]*Transform    `json:"transforms"`
+	Histories          map[string]*History      `json:"histories"`
+	ColumnPolicies     map[string]*ColumnPolicy `json:"columnPolicies"`
+	RawHeaderLogging   bool                     `json:"rawHeaderLogging"`
+	Firestore          *FirestoreConfig         `json:"firestore"`
+	Provisioning       *ProvisioningConfig      `json:"datasetProvisioning"`
+	FreshnessTracking  bool                     `json:"freshnessTracking"`
+	WaitOverallExport  bool                     `json:"waitOverallExportMetadata"`
+	OCNJournalURL      string                   `json:"ocnJournalURL"`
+	PurgeOCNJournalURL string                   `json:"purgeOCNJournalURL"`
+	OCNJournal         *OCNJournalConfig        `json:"ocnJournal"`
+}
+
+// OCNJournalConfig is the configuration of OCNJournal.
+type OCNJournalConfig struct {
+	Retention Duration `json:"retention"`
+}
+
+// ProvisioningConfig is the configuration of DatasetProvisioning.
+type ProvisioningConfig struct {
+	Location               string            `json:"location"`
+	Description            string            `json:"description"`
+	Labels                 map[string]string `json:"labels"`
+	DefaultTableExpiration Duration          `json:"defaultTableExpiration"`
+	KMSKeyName             string            `json:"kmsKeyName"`
+}
+
+// FirestoreConfig is the configuration of FirestoreExport.
+type FirestoreConfig struct {
+	Prefix      string   `json:"prefix"`
+	Collections []string `json:"collections"`
+	Dataset     string   `json:"dataset"`
+}
+
+// ManagementConfig is the configuration of DatastoreManagementService.
+type ManagementConfig struct {
+	APIDeleteBackupsURL    string                      `json:"apiDeleteBackupsURL"`
+	DeleteOldBackupURL     string                      `json:"deleteOldBackupURL"`
+	DeleteUnitOfBackupURL  string                      `json:"deleteUnitOfBackupURL"`
+	BackupDeletionURL      string                      `json:"backupDeletionURL"`
+	ExpireOldTablesURL     string                      `json:"expireOldTablesURL"`
+	ReconcileBackupsURL    string                      `json:"reconcileBackupsURL"`
+	DeleteOrphanObjectsURL string                      `json:"deleteOrphanObjectsURL"`
+	VerifyBackupURL        string                      `json:"verifyBackupURL"`
+	CheckFreshnessURL      string                      `json:"checkFreshnessURL"`
+	QueueName              string                      `json:"queueName"`
+	ExpireAfter            *Duration                   `json:"expireAfter"`
+	RequireVerifiedBackup  bool                        `json:"requireVerifiedBackup"`
+	TableRetention         *TableRetentionConfig       `json:"tableRetention"`
+	BackupReconciliation   *BackupReconciliationConfig `json:"backupReconciliation"`
+	Freshness              map[string]*FreshnessConfig `json:"freshness"`
+	FirestoreFreshness     map[string]*FreshnessConfig `json:"firestoreFreshness"`
+}
+
+// FreshnessConfig is the configuration of FreshnessSLO of the kind of Datastore, or the collection of Firestore.
+type FreshnessConfig struct {
+	MaxBackupAge Duration `json:"maxBackupAge"`
+	MaxImportAge Duration `json:"maxImportAge"`
+}
+
+// BackupReconciliationConfig is the configuration of BackupReconciliation.
+type BackupReconciliationConfig struct {
+	Bucket      string   `json:"bucket"`
+	Prefix      string   `json:"prefix"`
+	GracePeriod Duration `json:"gracePeriod"`
+}
+
+// TableRetentionConfig is the configuration of TableRetention.
+type TableRetentionConfig struct {
+	Project    string   `json:"project"`
+	Dataset    string   `json:"dataset"`
+	Kinds      []string `json:"kinds"`
+	DateLayout string   `json:"dateLayout"`
+	RetainFor  Duration `json:"retainFor"`
+	KeepLatest int      `json:"keepLatest"`
+	Expire     bool     `json:"expire"`
+	DryRun     bool     `json:"dryRun"`
+}
+
+// RestoreConfig is the configuration of DatastoreRestoreService, that restores managed exports by DatastoreExportService.
+type RestoreConfig struct {
+	APIBackupsURL      string `json:"apiBackupsURL"`
+	APIRestoresURL     string `json:"apiRestoresURL"`
+	OperationStatusURL string `json:"operationStatusURL"`
+	Bucket             string `json:"bucket"`
+	QueueName          string `json:"queueName"`
+}
+
+// ExportConfig is the configuration of DatastoreExportService and FirestoreExportService,
+// and the exports that they make.
+type ExportConfig struct {
+	// Project that is exported. default is the app ID.
+	Project string `json:"project"`
+	// Bucket and Prefix of the output like gs://bucket/prefix.
+	Bucket      string   `json:"bucket"`
+	Prefix      string   `json:"prefix"`
+	Kinds       []string `json:"kinds"`
+	Namespaces  []string `json:"namespaces"`
+	Collections []string `json:"collections"`
+}
+
+// OutputURLPrefix returns the outputGCSPrefix of Export.
+func (e *ExportConfig) OutputURLPrefix() string {
+	if e.Prefix == "" {
+		return "gs://" + e.Bucket
+	}
+	return "gs://" + e.Bucket + "/" + strings.Trim(e.Prefix, "/")
+}
+
+// EntityFilter returns the filter of kinds and namespaces of DatastoreExportService.
+func (e *ExportConfig) EntityFilter() *EntityFilter {
+	return &EntityFilter{
+		Kinds:        e.Kinds,
+		NamespaceIds: e.Namespaces,
+	}
+}
+
+// Duration is time.Duration in the format of time.ParseDuration like "720h".
+type Duration time.Duration
+
+// UnmarshalJSON parses the duration string.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"720h\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalJSON formats the duration string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// ConfigError is the error of Config at the key like watcher.transforms.Article.sql.
+type ConfigError struct {
+	Key     string
+	Message string
+}
+
+func (err *ConfigError) Error() string {
+	if err.Key == "" {
+		return "ds2bq: config: " + err.Message
+	}
+	return fmt.Sprintf("ds2bq: config: %s: %s", err.Key, err.Message)
+}
+
+func configError(key, format string, args ...interface{}) *ConfigError {
+	return &ConfigError{Key: key, Message: fmt.Sprintf(format, args...)}
+}
+
+// LoadConfig reads the configuration file. The format is JSON if the extension is .json, otherwise YAML.
+func LoadConfig(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	format := "yaml"
+	if filepath.Ext(path) == ".json" {
+		format = "json"
+	}
+	return ParseConfig(b, format)
+}
+
+// ParseConfig parses and validates the configuration. format is "yaml" or "json".
+func ParseConfig(b []byte, format string) (*Config, error) {
+	var tree interface{}
+	switch format {
+	case "json":
+		if err := json.Unmarshal(b, &tree); err != nil {
+			return nil, configError("", "%s", err)
+		}
+	case "yaml":
+		if err := yaml.Unmarshal(b, &tree); err != nil {
+			return nil, configError("", "%s", err)
+		}
+		var err error
+		tree, err = normalizeYAML(tree, "")
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("ds2bq: unknown config format %s", format)
+	}
+
+	tree, err := expandConfigEnv(tree, reflect.TypeOf(Config{}), "")
+	if err != nil {
+		return nil, err
+	}
+	if err := checkConfigKeys(tree, reflect.TypeOf(Config{}), ""); err != nil {
+		return nil, err
+	}
+
+	// the tree is valid JSON value after normalizeYAML.
+	b, err = json.Marshal(tree)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	if err := json.Unmarshal(b, cfg); err != nil {
+		if terr, ok := err.(*json.UnmarshalTypeError); ok {
+			return nil, configError(terr.Field, "%s can not be %s", terr.Type, terr.Value)
+		}
+		return nil, configError("", "%s", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func joinConfigKey(key, name string) string {
+	if key == "" {
+		return name
+	}
+	return key + "." + name
+}
+
+// normalizeYAML converts map[interface{}]interface{} of yaml.v2 into map[string]interface{}.
+func normalizeYAML(v interface{}, key string) (interface{}, error) {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, child := range v {
+			name, ok := k.(string)
+			if !ok {
+				return nil, configError(key, "key %v must be a string", k)
+			}
+			var err error
+			m[name], err = normalizeYAML(child, joinConfigKey(key, name))
+			if err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case []interface{}:
+		for i, child := range v {
+			var err error
+			v[i], err = normalizeYAML(child, fmt.Sprintf("%s[%d]", key, i))
+			if err != nil {
+				return nil, err
+			}
+		}
+		return v, nil
+	}
+	return v, nil
+}
+
+var configEnvPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandConfigEnv replaces ${NAME} and ${NAME:-default} in string values with environment variables.
+// The expanded value is converted into t, so that a bool or a number can also be given by an environment variable.
+func expandConfigEnv(v interface{}, t reflect.Type, key string) (interface{}, error) {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for name, child := range v {
+			var ft reflect.Type
+			if t != nil {
+				switch t.Kind() {
+				case reflect.Struct:
+					ft = configFields(t)[name]
+				case reflect.Map:
+					ft = t.Elem()
+				}
+			}
+			var err error
+			v[name], err = expandConfigEnv(child, ft, joinConfigKey(key, name))
+			if err != nil {
+				return nil, err
+			}
+		}
+		return v, nil
+	case []interface{}:
+		var et reflect.Type
+		if t != nil && t.Kind() == reflect.Slice {
+			et = t.Elem()
+		}
+		for i, child := range v {
+			var err error
+			v[i], err = expandConfigEnv(child, et, fmt.Sprintf("%s[%d]", key, i))
+			if err != nil {
+				return nil, err
+			}
+		}
+		return v, nil
+	case string:
+		if !configEnvPattern.MatchString(v) {
+			return v, nil
+		}
+		var err error
+		s := configEnvPattern.ReplaceAllStringFunc(v, func(ref string) string {
+			m := configEnvPattern.FindStringSubmatch(ref)
+			if value, ok := os.LookupEnv(m[1]); ok {
+				return value
+			}
+			if m[2] != "" {
+				return m[3]
+			}
+			if err == nil {
+				err = configError(key, "environment variable %s is not set", m[1])
+			}
+			return ""
+		})
+		if err != nil {
+			return nil, err
+		}
+		if t == nil || t == durationType {
+			return s, nil
+		}
+		switch t.Kind() {
+		case reflect.Bool:
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return nil, configError(key, "%q expanded from %s can not be bool", s, v)
+			}
+			return b, nil
+		case reflect.Int, reflect.Int64, reflect.Float64:
+			f, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return nil, configError(key, "%q expanded from %s can not be %s", s, v, t)
+			}
+			return f, nil
+		case reflect.String:
+			return s, nil
+		}
+		return nil, configError(key, "environment variable can not be used for %s", t)
+	}
+	return v, nil
+}
+
+// configFields returns types of the fields of t by json tag.
+func configFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" || f.PkgPath != "" {
+			continue
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+var durationType = reflect.TypeOf(Duration(0))
+
+// checkConfigKeys returns an error for the key that is not a json tag of the type, or the value that does not match the type.
+// Errors of encoding/json have only the last name of the key, so the tree is checked before it is decoded.
+func checkConfigKeys(v interface{}, t reflect.Type, key string) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if v == nil {
+		return nil
+	}
+	if t == durationType {
+		s, ok := v.(string)
+		if !ok {
+			return configError(key, "duration must be a string like \"720h\"")
+		}
+		if _, err := time.ParseDuration(s); err != nil {
+			return configError(key, "%s", err)
+		}
+		return nil
+	}
+
+	switch t.Kind() {
+	case reflect.String, reflect.Bool, reflect.Int, reflect.Int64, reflect.Float64:
+		if g := configValueType(v); g != configValueType(reflect.Zero(t).Interface()) {
+			return configError(key, "%s can not be %s", t, g)
+		}
+	case reflect.Struct:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return configError(key, "must be an object")
+		}
+		fields := configFields(t)
+		for _, name := range sortedConfigKeys(m) {
+			ft, ok := fields[name]
+			if !ok {
+				return configError(joinConfigKey(key, name), "unknown key")
+			}
+			if err := checkConfigKeys(m[name], ft, joinConfigKey(key, name)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return configError(key, "must be an object")
+		}
+		for _, name := range sortedConfigKeys(m) {
+			if err := checkConfigKeys(m[name], t.Elem(), joinConfigKey(key, name)); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		s, ok := v.([]interface{})
+		if !ok {
+			return configError(key, "must be a list")
+		}
+		for i, child := range s {
+			if err := checkConfigKeys(child, t.Elem(), fmt.Sprintf("%s[%d]", key, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// configValueType returns the type of the value in JSON like "string" or "number".
+func configValueType(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	case int, int64, uint64, float64:
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func sortedConfigKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Validate validates values of the configuration.
+func (cfg *Config) Validate() error {
+	if cfg.Watcher == nil && cfg.Management == nil && cfg.Restore == nil && cfg.Export == nil {
+		return configError("", "one of watcher, management, restore or export is required")
+	}
+
+	if w := cfg.Watcher; w != nil {
+		if w.Dataset == "" {
+			return configError("watcher.dataset", "required")
+		}
+		if len(w.Kinds) == 0 && w.Firestore == nil {
+			return configError("watcher.kinds", "required")
+		}
+		if f := w.Firestore; f != nil {
+			if f.Prefix == "" {
+				return configError("watcher.firestore.prefix", "required")
+			}
+			if len(f.Collections) == 0 {
+				return configError("watcher.firestore.collections", "required")
+			}
+		}
+		if w.DatedTable != "" && w.PartitionedTable {
+			return configError("watcher.datedTable", "can not be used with partitionedTable")
+		}
+		if v := w.RowCountValidation; v != nil && (v.Tolerance < 0 || v.Tolerance > 1) {
+			return configError("watcher.rowCountValidation.tolerance", "must be between 0 and 1")
+		}
+		if v := w.RowCountValidation; v != nil && v.Block && w.StagingDataset == "" {
+			return configError("watcher.stagingDataset", "required by watcher.rowCountValidation.block")
+		}
+		if j := w.OCNJournal; j != nil && j.Retention < 0 {
+			return configError("watcher.ocnJournal.retention", "must not be negative")
+		}
+		for _, kind := range sortedConfigKinds(w.Transforms) {
+			t := w.Transforms[kind]
+			if t == nil {
+				return configError("watcher.transforms."+kind, "required")
+			}
+			if err := t.parse(); err != nil {
+				return configError("watcher.transforms."+kind, "%s", strings.TrimPrefix(err.Error(), "ds2bq: "))
+			}
+		}
+		for _, kind := range sortedConfigKinds(w.Histories) {
+			if w.Histories[kind] == nil {
+				return configError("watcher.histories."+kind, "required")
+			}
+		}
+		for _, kind := range sortedConfigKinds(w.ColumnPolicies) {
+			p := w.ColumnPolicies[kind]
+			if p == nil {
+				return configError("watcher.columnPolicies."+kind, "required")
+			}
+			if err := p.validate(); err != nil {
+				return configError("watcher.columnPolicies."+kind, "%s", strings.TrimPrefix(err.Error(), "ds2bq: "))
+			}
+		}
+	}
+
+	if m := cfg.Management; m != nil {
+		if m.ExpireAfter != nil && *m.ExpireAfter < 0 {
+			return configError("management.expireAfter", "must not be negative")
+		}
+		if r := m.TableRetention; r != nil {
+			if r.Dataset == "" {
+				return configError("management.tableRetention.dataset", "required")
+			}
+			if len(r.Kinds) == 0 {
+				return configError("management.tableRetention.kinds", "required")
+			}
+			if r.RetainFor <= 0 {
+				return configError("management.tableRetention.retainFor", "required")
+			}
+		}
+		if r := m.BackupReconciliation; r != nil {
+			if r.Bucket == "" {
+				return configError("management.backupReconciliation.bucket", "required")
+			}
+			if r.GracePeriod < 0 {
+				return configError("management.backupReconciliation.gracePeriod", "must not be negative")
+			}
+		}
+		for _, freshness := range []struct {
+			key       string
+			configs   map[string]*FreshnessConfig
+			firestore bool
+		}{
+			{"management.freshness", m.Freshness, false},
+			{"management.firestoreFreshness", m.FirestoreFreshness, true},
+		} {
+			for _, kind := range sortedConfigKinds(freshness.configs) {
+				key := freshness.key + "." + kind
+				f := freshness.configs[kind]
+				switch {
+				case f == nil || (f.MaxBackupAge == 0 && f.MaxImportAge == 0):
+					return configError(key, "maxBackupAge or maxImportAge is required")
+				case f.MaxBackupAge < 0:
+					return configError(key+".maxBackupAge", "must not be negative")
+				case f.MaxImportAge < 0:
+					return configError(key+".maxImportAge", "must not be negative")
+				}
+				// imports, and backups by managed export are known only by the watcher.
+				tracked := cfg.Watcher != nil && cfg.Watcher.FreshnessTracking
+				switch {
+				case f.MaxImportAge > 0 && !tracked:
+					return configError("watcher.freshnessTracking", "required by %s.maxImportAge", key)
+				case f.MaxBackupAge > 0 && (cfg.Export != nil || freshness.firestore) && !tracked:
+					return configError("watcher.freshnessTracking", "required by %s.maxBackupAge of managed export", key)
+				}
+			}
+		}
+	}
+
+	if r := cfg.Restore; r != nil && r.Bucket == "" {
+		return configError("restore.bucket", "required")
+	}
+	if e := cfg.Export; e != nil && e.Bucket == "" {
+		return configError("export.bucket", "required")
+	}
+
+	return cfg.checkDuplicateURLs()
+}
+
+func sortedConfigKinds(m interface{}) []string {
+	var kinds []string
+	for _, k := range reflect.ValueOf(m).MapKeys() {
+		kinds = append(kinds, k.String())
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// checkDuplicateURLs returns an error if services serve the same URL, including default URLs.
+func (cfg *Config) checkDuplicateURLs() error {
+	type endpoint struct {
+		key string
+		url string
+	}
+	var endpoints []endpoint
+	if cfg.Watcher != nil {
+		s := newGCSWatcherService(cfg.GCSWatcherOptions()...)
+		endpoints = append(endpoints,
+			endpoint{"watcher.ocnReceiveURL", s.OCNReceiveURL},
+			endpoint{"watcher.objectToBQJobURL", s.GCSObjectToBQJobURL},
+			endpoint{"watcher.importJobStatusURL", s.ImportJobStatusURL},
+		)
+		if s.OCNJournal != nil {
+			endpoints = append(endpoints,
+				endpoint{"watcher.ocnJournalURL", s.APIOCNJournalURL},
+				endpoint{"watcher.purgeOCNJournalURL", s.PurgeOCNJournalURL},
+			)
+		}
+	}
+	if cfg.Management != nil {
+		s := newDatastoreManagementService(cfg.ManagementOptions()...)
+		endpoints = append(endpoints,
+			endpoint{"management.apiDeleteBackupsURL", s.APIDeleteBackupsURL},
+			endpoint{"management.deleteOldBackupURL", s.DeleteOldBackupURL},
+			endpoint{"management.deleteUnitOfBackupURL", s.DeleteUnitOfBackupURL},
+			endpoint{"management.backupDeletionURL", s.APIBackupDeletionURL},
+			endpoint{"management.verifyBackupURL", s.VerifyBackupURL},
+		)
+		if len(s.FreshnessSLOs) != 0 {
+			endpoints = append(endpoints, endpoint{"management.checkFreshnessURL", s.CheckFreshnessURL})
+		}
+		if s.TableRetention != nil {
+			endpoints = append(endpoints, endpoint{"management.expireOldTablesURL", s.ExpireOldTablesURL})
+		}
+		if s.BackupReconciliation != nil {
+			endpoints = append(endpoints,
+				endpoint{"management.reconcileBackupsURL", s.APIReconcileBackupsURL},
+				endpoint{"management.deleteOrphanObjectsURL", s.DeleteOrphanObjectsURL},
+			)
+		}
+	}
+	if cfg.Restore != nil {
+		s := newDatastoreRestoreService(cfg.RestoreOptions()...)
+		endpoints = append(endpoints,
+			endpoint{"restore.apiBackupsURL", s.APIBackupsURL},
+			endpoint{"restore.operationStatusURL", s.OperationStatusURL},
+			endpoint{"restore.apiRestoresURL", s.APIRestoresURL},
+		)
+	}
+
+	seen := make(map[string]string)
+	for _, e := range endpoints {
+		if key, ok := seen[e.url]; ok {
+			return configError(e.key, "URL %s is already used by %s", e.url, key)
+		}
+		seen[e.url] = e.key
+	}
+	return nil
+}
+
+// GCSWatcherOptions returns GCSWatcherOption of the watcher configuration.
+func (cfg *Config) GCSWatcherOptions() []GCSWatcherOption {
+	w := cfg.Watcher
+	if w == nil {
+		return nil
+	}
+
+	opts := []GCSWatcherOption{
+		GCSWatcherWithURLs(w.OCNReceiveURL, w.ObjectToBQJobURL),
+		GCSWatcherWithImportJobStatusURL(w.ImportJobStatusURL),
+		GCSWatcherWithOCNJournalURL(w.OCNJournalURL),
+		GCSWatcherWithOCNJournalPurgeURL(w.PurgeOCNJournalURL),
+		GCSWatcherWithDatasetID(w.Dataset),
+		GCSWatcherWithTargetKindNames(w.Kinds...),
+	}
+	if w.QueueName != "" {
+		opts = append(opts, GCSWatcherWithQueueName(w.QueueName))
+	}
+	if w.Bucket != "" {
+		opts = append(opts, GCSWatcherWithBackupBucketName(w.Bucket))
+	}
+	if w.StagingDataset != "" {
+		opts = append(opts, GCSWatcherWithStagingDataset(w.StagingDataset))
+	}
+	if w.DatedTable != "" {
+		opts = append(opts, GCSWatcherWithDatedTable(w.DatedTable))
+	}
+	if w.PartitionedTable {
+		opts = append(opts, GCSWatcherWithPartitionedTable())
+	}
+	if w.LatestView != "" {
+		opts = append(opts, GCSWatcherWithLatestView(w.LatestView))
+	}
+	if w.RowCountValidation != nil {
+		opts = append(opts, GCSWatcherWithRowCountValidation(w.RowCountValidation))
+	}
+	for kind, t := range w.Transforms {
+		opts = append(opts, GCSWatcherWithTransform(kind, t))
+	}
+	for kind, h := range w.Histories {
+		opts = append(opts, GCSWatcherWithHistory(kind, h))
+	}
+	for kind, p := range w.ColumnPolicies {
+		opts = append(opts, GCSWatcherWithColumnPolicy(kind, p))
+	}
+	if w.WaitOverallExport {
+		opts = append(opts, GCSWatcherWithOverallExportMetadata())
+	}
+	if w.FreshnessTracking {
+		opts = append(opts, GCSWatcherWithFreshnessTracking())
+	}
+	if w.RawHeaderLogging {
+		opts = append(opts, GCSWatcherWithRawHeaderLogging(true))
+	}
+	if j := w.OCNJournal; j != nil {
+		opts = append(opts, GCSWatcherWithOCNJournal(&OCNJournal{
+			Retention: time.Duration(j.Retention),
+		}))
+	}
+	if p := w.Provisioning; p != nil {
+		opts = append(opts, GCSWatcherWithDatasetProvisioning(&DatasetProvisioning{
+			Location:               p.Location,
+			Description:            p.Description,
+			Labels:                 p.Labels,
+			DefaultTableExpiration: time.Duration(p.DefaultTableExpiration),
+			KMSKeyName:             p.KMSKeyName,
+		}))
+	}
+	if f := w.Firestore; f != nil {
+		opts = append(opts, GCSWatcherWithFirestoreExport(&FirestoreExport{
+			Prefix:      f.Prefix,
+			Collections: f.Collections,
+			DatasetID:   f.Dataset,
+		}))
+	}
+	return opts
+}
+
+// ManagementOptions returns ManagementOption of the management configuration.
+func (cfg *Config) ManagementOptions() []ManagementOption {
+	m := cfg.Management
+	if m == nil {
+		return nil
+	}
+
+	opts := []ManagementOption{
+		ManagementWithURLs(m.APIDeleteBackupsURL, m.DeleteOldBackupURL, m.DeleteUnitOfBackupURL),
+		ManagementWithBackupDeletionURL(m.BackupDeletionURL),
+		ManagementWithTableRetentionURL(m.ExpireOldTablesURL),
+		ManagementWithBackupReconciliationURL(m.ReconcileBackupsURL, m.DeleteOrphanObjectsURL),
+		ManagementWithVerificationURL(m.VerifyBackupURL),
+		ManagementWithFreshnessURL(m.CheckFreshnessURL),
+	}
+	if m.QueueName != "" {
+		opts = append(opts, ManagementWithQueueName(m.QueueName))
+	}
+	if m.ExpireAfter != nil {
+		opts = append(opts, ManagementWithExpireDuration(time.Duration(*m.ExpireAfter)))
+	}
+	for _, kind := range sortedConfigKinds(m.Freshness) {
+		f := m.Freshness[kind]
+		opts = append(opts, ManagementWithFreshnessSLOs(&FreshnessSLO{
+			Kind:         kind,
+			MaxBackupAge: time.Duration(f.MaxBackupAge),
+			MaxImportAge: time.Duration(f.MaxImportAge),
+		}))
+	}
+	for _, collection := range sortedConfigKinds(m.FirestoreFreshness) {
+		f := m.FirestoreFreshness[collection]
+		opts = append(opts, ManagementWithFreshnessSLOs(&FreshnessSLO{
+			Source:       BackupSourceFirestoreExport,
+			Kind:         collection,
+			MaxBackupAge: time.Duration(f.MaxBackupAge),
+			MaxImportAge: time.Duration(f.MaxImportAge),
+		}))
+	}
+	if m.RequireVerifiedBackup {
+		opts = append(opts, ManagementWithVerifiedBackupRequired())
+	}
+	if r := m.TableRetention; r != nil {
+		opts = append(opts, ManagementWithTableRetention(&TableRetention{
+			ProjectID:  r.Project,
+			DatasetID:  r.Dataset,
+			Kinds:      r.Kinds,
+			DateLayout: r.DateLayout,
+			RetainFor:  time.Duration(r.RetainFor),
+			KeepLatest: r.KeepLatest,
+			Expire:     r.Expire,
+			DryRun:     r.DryRun,
+		}))
+	}
+	if r := m.BackupReconciliation; r != nil {
+		opts = append(opts, ManagementWithBackupReconciliation(&BackupReconciliation{
+			BucketName:  r.Bucket,
+			Prefix:      r.Prefix,
+			GracePeriod: time.Duration(r.GracePeriod),
+		}))
+	}
+	return opts
+}
+
+// RestoreOptions returns RestoreOption of the restore configuration.
+func (cfg *Config) RestoreOptions() []RestoreOption {
+	r := cfg.Restore
+	if r == nil {
+		return nil
+	}
+
+	opts := []RestoreOption{
+		RestoreWithURLs(r.APIBackupsURL, r.APIRestoresURL, r.OperationStatusURL),
+		RestoreWithBucketName(r.Bucket),
+	}
+	if r.QueueName != "" {
+		opts = append(opts, RestoreWithQueueName(r.QueueName))
+	}
+	return opts
+}
+
+// ExportOptions returns ExportOption of the export configuration.
+func (cfg *Config) ExportOptions() []ExportOption {
+	e := cfg.Export
+	if e == nil {
+		return nil
+	}
+
+	var opts []ExportOption
+	if e.Project != "" {
+		opts = append(opts, ExportWithProjectID(e.Project))
+	}
+	return opts
+}
+
+// NewGCSWatcherService returns GCSWatcherService of the configuration.
+// opts are applied after the configuration, e.g. GCSWatcherWithObserver.
+func (cfg *Config) NewGCSWatcherService(opts ...GCSWatcherOption) (GCSWatcherService, error) {
+	if cfg.Watcher == nil {
+		return nil, configError("watcher", "required")
+	}
+	return NewGCSWatcherService(append(cfg.GCSWatcherOptions(), opts...)...)
+}
+
+// NewDatastoreManagementService returns DatastoreManagementService of the configuration.
+// opts are applied after the configuration.
+func (cfg *Config) NewDatastoreManagementService(opts ...ManagementOption) (DatastoreManagementService, error) {
+	if cfg.Management == nil {
+		return nil, configError("management", "required")
+	}
+	return NewDatastoreManagementService(append(cfg.ManagementOptions(), opts...)...), nil
+}
+
+// NewDatastoreRestoreService returns DatastoreRestoreService of the configuration.
+// opts are applied after the configuration.
+func (cfg *Config) NewDatastoreRestoreService(opts ...RestoreOption) (DatastoreRestoreService, error) {
+	if cfg.Restore == nil {
+		return nil, configError("restore", "required")
+	}
+	return NewDatastoreRestoreService(append(cfg.RestoreOptions(), opts...)...)
+}
+
+// NewDatastoreExportService returns DatastoreExportService of the configuration.
+// opts are applied after the configuration.
+func (cfg *Config) NewDatastoreExportService(opts ...ExportOption) (DatastoreExportService, error) {
+	if cfg.Export == nil {
+		return nil, configError("export", "required")
+	}
+	return NewDatastoreExportService(append(cfg.ExportOptions(), opts...)...), nil
+}
+
+// NewFirestoreExportService returns FirestoreExportService of the configuration.
+// opts are applied after the configuration.
+func (cfg *Config) NewFirestoreExportService(opts ...ExportOption) (FirestoreExportService, error) {
+	if cfg.Export == nil {
+		return nil, configError("export", "required")
+	}
+	return NewFirestoreExportService(append(cfg.ExportOptions(), opts...)...), nil
+}
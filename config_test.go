@@ -0,0 +1,204 @@
+package ds2bq
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseConfig_YAML(t *testing.T) {
+	os.Setenv("DS2BQ_TEST_SALT", "secret")
+	defer os.Unsetenv("DS2BQ_TEST_SALT")
+	os.Setenv("DS2BQ_TEST_KEEP_LATEST", "3")
+	defer os.Unsetenv("DS2BQ_TEST_KEEP_LATEST")
+
+	cfg, err := ParseConfig([]byte(`
+watcher:
+  dataset: datastore_imports
+  kinds: [Article, User]
+  latestView: _latest
+  columnPolicies:
+    User:
+      hash: [Email]
+      salt: ${DS2BQ_TEST_SALT}
+management:
+  expireAfter: 720h
+  requireVerifiedBackup: ${DS2BQ_TEST_REQUIRE_VERIFIED:-true}
+  tableRetention:
+    dataset: datastore_imports
+    kinds: [Article]
+    retainFor: 2160h
+    keepLatest: ${DS2BQ_TEST_KEEP_LATEST}
+restore:
+  bucket: ${DS2BQ_TEST_BUCKET:-foobar-datastore-backups}
+export:
+  project: foobar
+  bucket: foobar-datastore-backups
+  prefix: daily/
+  kinds: [Article]
+`), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e, g := "datastore_imports", cfg.Watcher.Dataset; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	if e, g := 2, len(cfg.Watcher.Kinds); e != g {
+		t.Errorf("expected %d; got %d", e, g)
+	}
+	if e, g := "secret", cfg.Watcher.ColumnPolicies["User"].Salt; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	if e, g := 720*time.Hour, time.Duration(*cfg.Management.ExpireAfter); e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	if !cfg.Management.RequireVerifiedBackup {
+		t.Errorf("expected to require verified backup")
+	}
+	if e, g := 3, cfg.Management.TableRetention.KeepLatest; e != g {
+		t.Errorf("expected %d; got %d", e, g)
+	}
+	if e, g := "foobar-datastore-backups", cfg.Restore.Bucket; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+
+	s := newDatastoreManagementService(cfg.ManagementOptions()...)
+	if e, g := 720*time.Hour, s.ExpireAfter; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	if e, g := 2160*time.Hour, s.TableRetention.RetainFor; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+
+	if e, g := "gs://foobar-datastore-backups/daily", cfg.Export.OutputURLPrefix(); e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	if e, g := []string{"Article"}, cfg.Export.EntityFilter().Kinds; !reflect.DeepEqual(e, g) {
+		t.Errorf("expected %#v; got %#v", e, g)
+	}
+	export, err := cfg.NewDatastoreExportService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := "foobar", export.(*datastoreExportService).ProjectID; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+}
+
+func TestParseConfig_JSON(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`{"watcher": {"dataset": "datastore_imports", "kinds": ["Article"], "partitionedTable": true}}`), "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newGCSWatcherService(cfg.GCSWatcherOptions()...)
+	if e, g := "datastore_imports", s.DatasetID; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	if !s.PartitionedTable {
+		t.Errorf("expected partitioned table")
+	}
+}
+
+func TestParseConfig_Error(t *testing.T) {
+	for i, tc := range []struct {
+		config string
+		err    string
+	}{
+		{
+			`{}`,
+			"ds2bq: config: one of watcher, management, restore or export is required",
+		},
+		{
+			`{"watcher": {"kinds": ["Article"]}}`,
+			"ds2bq: config: watcher.dataset: required",
+		},
+		{
+			`{"watcher": {"dataset": "d", "kinds": ["Article"], "transforms": {"Article": {"sqll": "SELECT 1"}}}}`,
+			"ds2bq: config: watcher.transforms.Article.sqll: unknown key",
+		},
+		{
+			`{"watcher": {"dataset": "d", "kinds": "Article"}}`,
+			"ds2bq: config: watcher.kinds: must be a list",
+		},
+		{
+			`{"watcher": {"dataset": "d", "kinds": ["Article"], "partitionedTable": "yes"}}`,
+			"ds2bq: config: watcher.partitionedTable: bool can not be string",
+		},
+		{
+			`{"management": {"tableRetention": {"dataset": "d", "kinds": ["Article"], "retainFor": "24h", "keepLatest": "1"}}}`,
+			"ds2bq: config: management.tableRetention.keepLatest: int can not be string",
+		},
+		{
+			`{"watcher": {"dataset": "d", "kinds": ["Article"], "rowCountValidation": {"block": true}}}`,
+			"ds2bq: config: watcher.stagingDataset: required by watcher.rowCountValidation.block",
+		},
+		{
+			`{"management": {"expireAfter": 720}}`,
+			`ds2bq: config: management.expireAfter: duration must be a string like "720h"`,
+		},
+		{
+			`{"export": {"kinds": ["Article"]}}`,
+			"ds2bq: config: export.bucket: required",
+		},
+		{
+			`{"watcher": {"dataset": "${DS2BQ_TEST_UNSET}", "kinds": ["Article"]}}`,
+			"ds2bq: config: watcher.dataset: environment variable DS2BQ_TEST_UNSET is not set",
+		},
+		{
+			`{"management": {"requireVerifiedBackup": "${DS2BQ_TEST_UNSET:-yes}"}}`,
+			`ds2bq: config: management.requireVerifiedBackup: "yes" expanded from ${DS2BQ_TEST_UNSET:-yes} can not be bool`,
+		},
+		{
+			`{"management": {"tableRetention": "${DS2BQ_TEST_UNSET:-}"}}`,
+			"ds2bq: config: management.tableRetention: environment variable can not be used for ds2bq.TableRetentionConfig",
+		},
+		{
+			`{"management": {"tableRetention": {"retainFor": "24h"}}}`,
+			"ds2bq: config: management.tableRetention.dataset: required",
+		},
+		{
+			`{"management": {"tableRetention": {"dataset": "d", "retainFor": "24h"}}}`,
+			"ds2bq: config: management.tableRetention.kinds: required",
+		},
+		{
+			`{"management": {"backupReconciliation": {"bucket": "b", "gracePeriod": "-1h"}}}`,
+			"ds2bq: config: management.backupReconciliation.gracePeriod: must not be negative",
+		},
+		{
+			`{"management": {"freshness": {"Article": {}}}}`,
+			"ds2bq: config: management.freshness.Article: maxBackupAge or maxImportAge is required",
+		},
+		{
+			`{"management": {"freshness": {"Article": {"maxImportAge": "26h"}}}}`,
+			"ds2bq: config: watcher.freshnessTracking: required by management.freshness.Article.maxImportAge",
+		},
+		{
+			`{"management": {"freshness": {"Article": {"maxBackupAge": "26h"}}}, "export": {"bucket": "b"}}`,
+			"ds2bq: config: watcher.freshnessTracking: required by management.freshness.Article.maxBackupAge of managed export",
+		},
+		{
+			`{"management": {"firestoreFreshness": {"Article": {"maxBackupAge": "26h"}}}}`,
+			"ds2bq: config: watcher.freshnessTracking: required by management.firestoreFreshness.Article.maxBackupAge of managed export",
+		},
+		{
+			`{"watcher": {"dataset": "d", "kinds": ["Article"], "importJobStatusURL": "/tq/gcs/object-to-bq"}}`,
+			"ds2bq: config: watcher.importJobStatusURL: URL /tq/gcs/object-to-bq is already used by watcher.objectToBQJobURL",
+		},
+		{
+			`{"management": {"apiDeleteBackupsURL": "/api/restore"}, "restore": {"bucket": "b", "apiBackupsURL": "/api/restore"}}`,
+			"ds2bq: config: restore.apiBackupsURL: URL /api/restore is already used by management.apiDeleteBackupsURL",
+		},
+	} {
+		_, err := ParseConfig([]byte(tc.config), "json")
+		if err == nil {
+			t.Errorf("%02d: expected error", i)
+			continue
+		}
+		if e, g := tc.err, err.Error(); e != g {
+			t.Errorf("%02d: expected %s; got %s", i, e, g)
+		}
+	}
+}
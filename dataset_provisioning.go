@@ -0,0 +1,179 @@
+package ds2bq
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/bigquery/v2"
+	"google.golang.org/api/googleapi"
+)
+
+// DatasetProvisioning is the settings of datasets that the watcher creates before the first load if missing.
+type DatasetProvisioning struct {
+	// Location of the created dataset. default is the location of the backup bucket.
+	Location    string
+	Description string
+	Labels      map[string]string
+	// DefaultTableExpiration of tables in the dataset. default is no expiration.
+	DefaultTableExpiration time.Duration
+	// KMSKeyName is the Cloud KMS key of the default encryption like projects/p/locations/l/keyRings/r/cryptoKeys/k.
+	KMSKeyName string
+
+	mu      sync.Mutex
+	checked map[string]bool
+}
+
+// DatasetLocationError is the error that the dataset is not in the location of the backup bucket.
+// BigQuery can not load objects of the bucket into the dataset.
+type DatasetLocationError struct {
+	DatasetID        string
+	DatasetLocation  string
+	Bucket           string
+	ExpectedLocation string
+}
+
+func (err *DatasetLocationError) Error() string {
+	return fmt.Sprintf("ds2bq: dataset %s is in %s, but bucket %s is in %s", err.DatasetID, err.DatasetLocation, err.Bucket, err.ExpectedLocation)
+}
+
+type gcsWatcherDatasetProvisioningOption struct {
+	DatasetProvisioning *DatasetProvisioning
+}
+
+func (o *gcsWatcherDatasetProvisioningOption) implements(s *gcsWatcherService) {
+	s.DatasetProvisioning = o.DatasetProvisioning
+}
+
+// GCSWatcherWithDatasetProvisioning provides that datasets of load jobs are checked before the first load,
+// and created by the settings if missing.
+func GCSWatcherWithDatasetProvisioning(p *DatasetProvisioning) GCSWatcherOption {
+	return &gcsWatcherDatasetProvisioningOption{
+		DatasetProvisioning: p,
+	}
+}
+
+// ensureDataset checks the dataset, or creates it if not found.
+// Only the success is cached in the instance, so that the dataset moved or re-created after DatasetLocationError is checked again.
+func (p *DatasetProvisioning) ensureDataset(c context.Context, bqs *bigquery.Service, projectID, datasetID, bucket string) error {
+	key := projectID + "." + datasetID + "@" + bucket
+
+	p.mu.Lock()
+	ok := p.checked[key]
+	p.mu.Unlock()
+	if ok {
+		return nil
+	}
+
+	err := p.checkDataset(c, bqs, projectID, datasetID, bucket)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	if p.checked == nil {
+		p.checked = make(map[string]bool)
+	}
+	p.checked[key] = true
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *DatasetProvisioning) checkDataset(c context.Context, bqs *bigquery.Service, projectID, datasetID, bucket string) error {
+	sts, err := newStorageService(c)
+	if err != nil {
+		return err
+	}
+	b, err := sts.Buckets.Get(bucket).Context(c).Do()
+	if err != nil {
+		return err
+	}
+
+	ds, err := bqs.Datasets.Get(projectID, datasetID).Context(c).Do()
+	if isNotFound(err) {
+		location := p.Location
+		if location == "" {
+			location = b.Location
+		}
+		ds, err = bqs.Datasets.Insert(projectID, p.dataset(projectID, datasetID, location)).Context(c).Do()
+		if err == nil {
+			logInfo(c, "ds2bq: dataset created", F("dataset", datasetID), F("location", location))
+		} else if gerr, ok := err.(*googleapi.Error); ok && gerr.Code == http.StatusConflict {
+			// created by another request.
+			ds, err = bqs.Datasets.Get(projectID, datasetID).Context(c).Do()
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if !loadableLocation(ds.Location, b.Location) {
+		return &DatasetLocationError{
+			DatasetID:        datasetID,
+			DatasetLocation:  ds.Location,
+			Bucket:           bucket,
+			ExpectedLocation: b.Location,
+		}
+	}
+	return nil
+}
+
+func (p *DatasetProvisioning) dataset(projectID, datasetID, location string) *bigquery.Dataset {
+	ds := &bigquery.Dataset{
+		DatasetReference: &bigquery.DatasetReference{
+			ProjectId: projectID,
+			DatasetId: datasetID,
+		},
+		Location:                 location,
+		Description:              p.Description,
+		Labels:                   p.Labels,
+		DefaultTableExpirationMs: int64(p.DefaultTableExpiration / time.Millisecond),
+	}
+	if p.KMSKeyName != "" {
+		ds.DefaultEncryptionConfiguration = &bigquery.EncryptionConfiguration{KmsKeyName: p.KMSKeyName}
+	}
+	return ds
+}
+
+// loadableLocation reports whether BigQuery loads objects of the bucket into the dataset.
+// GCS returns upper case like ASIA-NORTHEAST1, and BigQuery returns lower case except multi-regions like US.
+// Datasets in US or EU multi-region load objects in regions of the multi-region too.
+func loadableLocation(datasetLocation, bucketLocation string) bool {
+	d, b := strings.ToUpper(datasetLocation), strings.ToUpper(bucketLocation)
+	switch {
+	case d == b:
+		return true
+	case d == "US":
+		return strings.HasPrefix(b, "US-")
+	case d == "EU":
+		return strings.HasPrefix(b, "EUROPE-")
+	}
+	return false
+}
+
+// provisionDatasets ensures datasets that the load job of req writes into.
+func (s *gcsWatcherService) provisionDatasets(c context.Context, bqs *bigquery.Service, projectID string, req *GCSObjectToBQJobReq, datasetIDs ...string) error {
+	if s.DatasetProvisioning == nil {
+		return nil
+	}
+	for _, datasetID := range datasetIDs {
+		if err := s.DatasetProvisioning.ensureDataset(c, bqs, projectID, datasetID, req.Bucket); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadDatasetIDs returns datasets that the import of req writes into by load and copy jobs.
+func (s *gcsWatcherService) loadDatasetIDs(req *GCSObjectToBQJobReq, datasetID string) []string {
+	datasetIDs := []string{datasetID}
+	if id := s.datasetIDOf(req.Source); s.StagingDatasetID != "" && !containsString(datasetIDs, id) {
+		datasetIDs = append(datasetIDs, id)
+	}
+	if p, ok := s.ColumnPolicies[req.KindName]; ok && !containsString(datasetIDs, p.rawDatasetID(datasetID)) {
+		datasetIDs = append(datasetIDs, p.rawDatasetID(datasetID))
+	}
+	return datasetIDs
+}
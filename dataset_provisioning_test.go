@@ -0,0 +1,79 @@
+package ds2bq
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadableLocation(t *testing.T) {
+	for i, tc := range []struct {
+		dataset string
+		bucket  string
+		want    bool
+	}{
+		{"US", "US", true},
+		{"asia-northeast1", "ASIA-NORTHEAST1", true},
+		{"US", "US-CENTRAL1", true},
+		{"EU", "EUROPE-WEST1", true},
+		{"US", "ASIA-NORTHEAST1", false},
+		{"asia-northeast1", "US", false},
+		{"us-central1", "US", false},
+	} {
+		if e, g := tc.want, loadableLocation(tc.dataset, tc.bucket); e != g {
+			t.Errorf("%02d: expected %v; got %v", i, e, g)
+		}
+	}
+}
+
+func TestDatasetProvisioning_dataset(t *testing.T) {
+	p := &DatasetProvisioning{
+		Description:            "imported from Datastore",
+		Labels:                 map[string]string{"team": "data"},
+		DefaultTableExpiration: 30 * 24 * time.Hour,
+		KMSKeyName:             "projects/p/locations/asia-northeast1/keyRings/r/cryptoKeys/k",
+	}
+	ds := p.dataset("p", "datastore_imports", "asia-northeast1")
+
+	if e, g := "datastore_imports", ds.DatasetReference.DatasetId; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	if e, g := "asia-northeast1", ds.Location; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	if e, g := int64(2592000000), ds.DefaultTableExpirationMs; e != g {
+		t.Errorf("expected %d; got %d", e, g)
+	}
+	if e, g := "data", ds.Labels["team"]; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	if e, g := p.KMSKeyName, ds.DefaultEncryptionConfiguration.KmsKeyName; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+
+	if ds := (&DatasetProvisioning{}).dataset("p", "d", "US"); ds.DefaultEncryptionConfiguration != nil {
+		t.Errorf("expected no encryption configuration")
+	}
+}
+
+func TestGCSWatcherService_loadDatasetIDs(t *testing.T) {
+	s := newGCSWatcherService(
+		GCSWatcherWithDatasetID("datastore_imports"),
+		GCSWatcherWithStagingDataset("datastore_staging"),
+		GCSWatcherWithColumnPolicy("User", &ColumnPolicy{Hash: []string{"Email"}, RawDatasetID: "datastore_raw"}),
+		GCSWatcherWithColumnPolicy("Order", &ColumnPolicy{Mask: []string{"Address"}}),
+	)
+
+	ids := s.loadDatasetIDs(&GCSObjectToBQJobReq{KindName: "User"}, "datastore_staging")
+	if e, g := "datastore_staging,datastore_imports,datastore_raw", strings.Join(ids, ","); e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	ids = s.loadDatasetIDs(&GCSObjectToBQJobReq{KindName: "Order"}, "datastore_staging")
+	if e, g := "datastore_staging,datastore_imports,datastore_staging_raw", strings.Join(ids, ","); e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	ids = s.loadDatasetIDs(&GCSObjectToBQJobReq{KindName: "Article"}, "datastore_staging")
+	if e, g := "datastore_staging,datastore_imports", strings.Join(ids, ","); e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+}
@@ -2,9 +2,11 @@ package ds2bq
 
 import (
 	"context"
+	"encoding/json"
 
 	"golang.org/x/oauth2/google"
 	dsapi "google.golang.org/api/datastore/v1beta1"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/appengine"
 )
 
@@ -21,34 +23,137 @@ type EntityFilter struct {
 // DatastoreExportService serves DatastoreExport API Function.
 type DatastoreExportService interface {
 	Export(c context.Context, outputGCSPrefix string, entityFilter *EntityFilter) (*dsapi.GoogleLongrunningOperation, error)
+	Import(c context.Context, projectID, inputURL string, entityFilter *EntityFilter) (*dsapi.GoogleLongrunningOperation, error)
+	Operation(c context.Context, name string) (*dsapi.GoogleLongrunningOperation, error)
+}
+
+// ExportOption provides option value of DatastoreExportService and FirestoreExportService.
+type ExportOption interface {
+	implements(s *exportSettings)
+}
+
+type exportSettings struct {
+	ProjectID string
+}
+
+func newExportSettings(opts ...ExportOption) exportSettings {
+	s := exportSettings{}
+	for _, opt := range opts {
+		opt.implements(&s)
+	}
+	return s
+}
+
+// projectID returns the project of the export, default is the app ID.
+func (s *exportSettings) projectID(c context.Context) string {
+	if s.ProjectID != "" {
+		return s.ProjectID
+	}
+	return appengine.AppID(c)
+}
+
+type exportProjectIDOption struct {
+	ProjectID string
+}
+
+func (o *exportProjectIDOption) implements(s *exportSettings) {
+	s.ProjectID = o.ProjectID
+}
+
+// ExportWithProjectID provides the project that is exported. default is the app ID.
+func ExportWithProjectID(projectID string) ExportOption {
+	return &exportProjectIDOption{
+		ProjectID: projectID,
+	}
 }
 
 // NewDatastoreExportService returns ready to use DatastoreExportService
-func NewDatastoreExportService() DatastoreExportService {
-	return &datastoreExportService{}
+func NewDatastoreExportService(opts ...ExportOption) DatastoreExportService {
+	return &datastoreExportService{exportSettings: newExportSettings(opts...)}
 }
 
-type datastoreExportService struct{}
+type datastoreExportService struct {
+	exportSettings
+}
 
 func (s *datastoreExportService) Export(c context.Context, outputGCSPrefix string, entityFilter *EntityFilter) (*dsapi.GoogleLongrunningOperation, error) {
-	client, err := google.DefaultClient(c, dsapi.DatastoreScope)
+	service, err := s.newService(c)
 	if err != nil {
 		return nil, err
 	}
 
-	service, err := dsapi.New(client)
+	eCall := service.Projects.Export(s.projectID(c), &dsapi.GoogleDatastoreAdminV1beta1ExportEntitiesRequest{
+		EntityFilter: &dsapi.GoogleDatastoreAdminV1beta1EntityFilter{
+			Kinds:           entityFilter.Kinds,
+			NamespaceIds:    entityFilter.NamespaceIds,
+			ForceSendFields: entityFilter.ForceSendFields,
+			NullFields:      entityFilter.NullFields,
+		},
+		OutputUrlPrefix: outputGCSPrefix,
+	})
+	return eCall.Do()
+}
+
+// Import imports entities of the managed export into the project.
+// inputURL is the URL of .overall_export_metadata file like gs://bucket/2017-11-14T06:47:01_23208/2017-11-14T06:47:01_23208.overall_export_metadata.
+// projectID is the target project, default is the project of the service.
+func (s *datastoreExportService) Import(c context.Context, projectID, inputURL string, entityFilter *EntityFilter) (*dsapi.GoogleLongrunningOperation, error) {
+	service, err := s.newService(c)
 	if err != nil {
 		return nil, err
 	}
 
-	eCall := service.Projects.Export(appengine.AppID(c), &dsapi.GoogleDatastoreAdminV1beta1ExportEntitiesRequest{
+	if projectID == "" {
+		projectID = s.projectID(c)
+	}
+	if entityFilter == nil {
+		entityFilter = &EntityFilter{}
+	}
+
+	iCall := service.Projects.Import(projectID, &dsapi.GoogleDatastoreAdminV1beta1ImportEntitiesRequest{
 		EntityFilter: &dsapi.GoogleDatastoreAdminV1beta1EntityFilter{
 			Kinds:           entityFilter.Kinds,
 			NamespaceIds:    entityFilter.NamespaceIds,
 			ForceSendFields: entityFilter.ForceSendFields,
 			NullFields:      entityFilter.NullFields,
 		},
-		OutputUrlPrefix: outputGCSPrefix,
+		InputUrl: inputURL,
 	})
-	return eCall.Do()
+	return iCall.Do()
+}
+
+// Operation returns the long-running operation of export or import.
+// name is like projects/my-project/operations/ASA1MTAwNDQxNAgadGx1YWZlZBIxbGFyZ... returned by Export or Import.
+func (s *datastoreExportService) Operation(c context.Context, name string) (*dsapi.GoogleLongrunningOperation, error) {
+	client, err := google.DefaultClient(c, dsapi.DatastoreScope)
+	if err != nil {
+		return nil, err
+	}
+
+	// v1beta1 has no operations API, so get the operation by v1 API.
+	resp, err := client.Get("https://datastore.googleapis.com/v1/" + name)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	err = googleapi.CheckResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	op := &dsapi.GoogleLongrunningOperation{}
+	err = json.NewDecoder(resp.Body).Decode(op)
+	if err != nil {
+		return nil, err
+	}
+	return op, nil
+}
+
+func (s *datastoreExportService) newService(c context.Context) (*dsapi.Service, error) {
+	client, err := google.DefaultClient(c, dsapi.DatastoreScope)
+	if err != nil {
+		return nil, err
+	}
+
+	return dsapi.New(client)
 }
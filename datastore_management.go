@@ -9,11 +9,13 @@ import (
 
 	"github.com/mjibson/goon"
 	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/log"
 	"google.golang.org/appengine/taskqueue"
 )
 
-func addDeleteOldBackupTasks(c context.Context, r *http.Request, req *ReqListBase, queueName, deleteBackupURL string, expireAfter time.Duration) error {
+// addDeleteOldBackupTasks adds tasks that remove expired backups.
+// If requireVerified is true, the backup is kept unless a newer backup is verified,
+// and tasks that verify completed backups are added for backups never verified.
+func addDeleteOldBackupTasks(c context.Context, r *http.Request, req *ReqListBase, queueName, deleteBackupURL, verifyBackupURL string, expireAfter time.Duration, requireVerified bool, metrics Metrics) error {
 	if expireAfter <= 0 {
 		// to do nothing
 		return nil
@@ -29,25 +31,31 @@ func addDeleteOldBackupTasks(c context.Context, r *http.Request, req *ReqListBas
 	}
 
 	g := goon.FromContext(c)
+	var newestVerified time.Time
+	if requireVerified {
+		err = addVerifyBackupTasks(c, queueName, verifyBackupURL, list, metrics)
+		if err != nil {
+			return err
+		}
+		newestVerified, err = store.NewestVerifiedBackupTime(c, BackupSourceDatastoreAdmin)
+		if err != nil {
+			return err
+		}
+	}
+
 	expireThreshold := time.Now().Add(-1 * expireAfter)
 	for _, backupInfo := range list {
 		if backupInfo.CompleteTime.Before(expireThreshold) {
 			key := g.Key(backupInfo)
-			log.Infof(c, "ds2bq: %s should be removed, %#v", key.String(), backupInfo)
-
-			u, err := url.Parse(deleteBackupURL)
-			if err != nil {
-				return err
-			}
-			vs := url.Values{}
-			vs.Add("key", key.Encode())
-			u.RawQuery = vs.Encode()
-			t := &taskqueue.Task{
-				Method: "DELETE",
-				Path:   u.String(),
+			if requireVerified && !backupInfo.CompleteTime.Before(newestVerified) {
+				logWarning(c, "ds2bq: backup is kept, no newer backup is verified", F(FieldBackupKey, key.String()), F("completeTime", backupInfo.CompleteTime), F("newestVerified", newestVerified))
+				continue
 			}
-			_, err = taskqueue.Add(c, t, queueName)
+			logInfo(c, "ds2bq: backup should be removed", F(FieldBackupKey, key.String()), F("completeTime", backupInfo.CompleteTime), F("kinds", backupInfo.Kinds))
+
+			err := addDeleteBackupTask(c, queueName, deleteBackupURL, key)
 			if err != nil {
+				metrics.TaskEnqueueFailed(c, queueName)
 				return err
 			}
 		}
@@ -66,6 +74,7 @@ func addDeleteOldBackupTasks(c context.Context, r *http.Request, req *ReqListBas
 		}
 		_, err = taskqueue.Add(c, t, queueName)
 		if err != nil {
+			metrics.TaskEnqueueFailed(c, queueName)
 			return err
 		}
 	}
@@ -73,21 +82,94 @@ func addDeleteOldBackupTasks(c context.Context, r *http.Request, req *ReqListBas
 	return nil
 }
 
-func deleteBackup(c context.Context, r *http.Request, req *AEBackupInformationDeleteReq, queueName string) error {
-	if !isInTaskqueue(r, queueName) {
-		_, err := delegateToTaskqueue(r, queueName)
+// addVerifyBackupTasks adds tasks that verify the completed backups never verified.
+func addVerifyBackupTasks(c context.Context, queueName, verifyBackupURL string, list []*AEBackupInformation, metrics Metrics) error {
+	g := goon.FromContext(c)
+	var keys []*datastore.Key
+	for _, backupInfo := range list {
+		if !backupInfo.CompleteTime.IsZero() {
+			keys = append(keys, g.Key(backupInfo))
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	store := &AEDatastoreStore{}
+	unverified, err := store.unverifiedBackupKeys(c, keys)
+	if err != nil {
+		return err
+	}
+	for _, key := range unverified {
+		u, err := url.Parse(verifyBackupURL)
+		if err != nil {
+			return err
+		}
+		vs := url.Values{}
+		vs.Add("key", key.Encode())
+		u.RawQuery = vs.Encode()
+		t := &taskqueue.Task{
+			Method: "POST",
+			Path:   u.String(),
+		}
+		_, err = taskqueue.Add(c, t, queueName)
 		if err != nil {
+			metrics.TaskEnqueueFailed(c, queueName)
 			return err
 		}
-		log.Infof(c, "ds2bq: this request was delegated to taskqueue")
+		logInfo(c, "ds2bq: backup verification is added", F(FieldBackupKey, key.String()))
+	}
+	return nil
+}
+
+// addDeleteBackupTask adds the task that removes the backup.
+func addDeleteBackupTask(c context.Context, queueName, deleteBackupURL string, key *datastore.Key) error {
+	u, err := url.Parse(deleteBackupURL)
+	if err != nil {
 		return err
 	}
+	vs := url.Values{}
+	vs.Add("key", key.Encode())
+	u.RawQuery = vs.Encode()
+	t := &taskqueue.Task{
+		Method: "DELETE",
+		Path:   u.String(),
+	}
+	_, err = taskqueue.Add(c, t, queueName)
+	return err
+}
 
+// deleteBackup removes batches of the backup, and adds the task that continues if entities are left.
+func deleteBackup(c context.Context, req *AEBackupInformationDeleteReq, queueName, deleteBackupURL string, observer Observer, metrics Metrics) (*BackupDeletion, error) {
 	key, err := datastore.DecodeKey(req.Key)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	store := &AEDatastoreStore{}
-	return store.DeleteAEBackupInformationAndRelatedData(c, key)
+	deletion, finished, err := store.deleteBackupBatches(c, key, backupDeletionBatchesPerTask)
+	if err != nil {
+		return nil, err
+	}
+
+	if deletion.State != BackupDeletionStateDone {
+		logInfo(c, "ds2bq: backup is partially removed", F(FieldBackupKey, key.String()), F("deleted", deletion.Deleted), F("batches", deletion.Batches))
+		err = addDeleteBackupTask(c, queueName, deleteBackupURL, key)
+		if err != nil {
+			metrics.TaskEnqueueFailed(c, queueName)
+			return nil, err
+		}
+		return deletion, nil
+	}
+	if !finished {
+		// retry of the finished task.
+		return deletion, nil
+	}
+
+	logInfo(c, "ds2bq: backup removed", F(FieldBackupKey, key.String()), F("deleted", deletion.Deleted), F("batches", deletion.Batches))
+	observer.OnBackupDeleted(c, key)
+	metrics.BackupDeleted(c)
+	metrics.EntitiesDeleted(c, deletion.Deleted)
+
+	return deletion, nil
 }
@@ -4,11 +4,9 @@ import (
 	"encoding/json"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
-
-	"google.golang.org/appengine"
-	"google.golang.org/appengine/log"
-	"google.golang.org/appengine/taskqueue"
 )
 
 // DecodeReqListBase decodes a ReqListBase from r.
@@ -22,6 +20,41 @@ func DecodeReqListBase(r io.Reader) (*ReqListBase, error) {
 	return req, nil
 }
 
+// DecodeReqListBaseFromRequest decodes a ReqListBase from query parameters and JSON body of r.
+// Tasks created by ds2bq carry parameters in query, so the body is optional.
+func DecodeReqListBaseFromRequest(r *http.Request) (*ReqListBase, error) {
+	req := &ReqListBase{}
+	if hasJSONBody(r) {
+		var err error
+		req, err = DecodeReqListBase(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Body.Close()
+	}
+
+	vs := r.URL.Query()
+	if v := vs.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		req.Limit = limit
+	}
+	if v := vs.Get("offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+		req.Offset = offset
+	}
+	if v := vs.Get("cursor"); v != "" {
+		req.Cursor = v
+	}
+
+	return req, nil
+}
+
 // DecodeAEBackupInformationDeleteReq decodes a AEBackupInformationDeleteReq from r.
 func DecodeAEBackupInformationDeleteReq(r io.Reader) (*AEBackupInformationDeleteReq, error) {
 	decoder := json.NewDecoder(r)
@@ -33,61 +66,180 @@ func DecodeAEBackupInformationDeleteReq(r io.Reader) (*AEBackupInformationDelete
 	return req, nil
 }
 
-// DeleteOldBackupAPIHandlerFunc returns a http.HandlerFunc that delegate to taskqueue.
-// The path is for DeleteOldBackupTask.
-func DeleteOldBackupAPIHandlerFunc(queueName, path string) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		c := appengine.NewContext(r)
-
-		task := &taskqueue.Task{
-			Method: "DELETE",
-			Path:   path,
+// DecodeAEBackupInformationDeleteReqFromRequest decodes a AEBackupInformationDeleteReq from query parameters and JSON body of r.
+func DecodeAEBackupInformationDeleteReqFromRequest(r *http.Request) (*AEBackupInformationDeleteReq, error) {
+	req := &AEBackupInformationDeleteReq{}
+	if hasJSONBody(r) {
+		var err error
+		req, err = DecodeAEBackupInformationDeleteReq(r.Body)
+		if err != nil {
+			return nil, err
 		}
-		_, err := taskqueue.Add(c, task, queueName)
+		defer r.Body.Close()
+	}
+
+	if v := r.URL.Query().Get("key"); v != "" {
+		req.Key = v
+	}
+
+	return req, nil
+}
+
+// DecodeBackupVerificationReq decodes a BackupVerificationReq from r.
+func DecodeBackupVerificationReq(r io.Reader) (*BackupVerificationReq, error) {
+	decoder := json.NewDecoder(r)
+	var req *BackupVerificationReq
+	err := decoder.Decode(&req)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// DecodeBackupVerificationReqFromRequest decodes a BackupVerificationReq from query parameters and JSON body of r.
+func DecodeBackupVerificationReqFromRequest(r *http.Request) (*BackupVerificationReq, error) {
+	req := &BackupVerificationReq{}
+	if hasJSONBody(r) {
+		var err error
+		req, err = DecodeBackupVerificationReq(r.Body)
 		if err != nil {
-			log.Errorf(c, "ds2bq: failed to add a task: %s", err)
-			return
+			return nil, err
 		}
+		defer r.Body.Close()
+	}
+
+	vs := r.URL.Query()
+	if v := vs.Get("key"); v != "" {
+		req.Key = v
 	}
+	if v := vs.Get("bucket"); v != "" {
+		req.Bucket = v
+	}
+	if v := vs.Get("prefix"); v != "" {
+		req.Prefix = v
+	}
+
+	return req, nil
 }
 
-// DeleteOldBackupTaskHandlerFunc returns a http.HandlerFunc that adds tasks to delete old AEBackupInformation.
-// The path is for DeleteBackupTask.
-func DeleteOldBackupTaskHandlerFunc(queueName, path string, expireAfter time.Duration) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		c := appengine.NewContext(r)
+// DecodeTableRetentionReq decodes a TableRetentionReq from r.
+func DecodeTableRetentionReq(r io.Reader) (*TableRetentionReq, error) {
+	decoder := json.NewDecoder(r)
+	var req *TableRetentionReq
+	err := decoder.Decode(&req)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
 
-		req, err := DecodeReqListBase(r.Body)
+// DecodeTableRetentionReqFromRequest decodes a TableRetentionReq from query parameters and JSON body of r.
+func DecodeTableRetentionReqFromRequest(r *http.Request) (*TableRetentionReq, error) {
+	req := &TableRetentionReq{}
+	if hasJSONBody(r) {
+		var err error
+		req, err = DecodeTableRetentionReq(r.Body)
 		if err != nil {
-			log.Errorf(c, "ds2bq: failed to decode request: %s", err)
-			return
+			return nil, err
 		}
 		defer r.Body.Close()
+	}
 
-		err = addDeleteOldBackupTasks(c, r, req, queueName, path, expireAfter)
+	if v := r.URL.Query().Get("dryRun"); v != "" {
+		dryRun, err := strconv.ParseBool(v)
 		if err != nil {
-			log.Errorf(c, "ds2bq: failed to delete old backup: %s", err)
-			return
+			return nil, err
 		}
+		req.DryRun = dryRun
 	}
+
+	return req, nil
 }
 
-// DeleteBackupTaskHandlerFunc returns a http.HandlerFunc that removes all child entities about AEBackupInformation or AEDatastoreAdminOperation kinds.
-func DeleteBackupTaskHandlerFunc(queueName string) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		c := appengine.NewContext(r)
+// DecodeReconcileBackupsReq decodes a ReconcileBackupsReq from r.
+func DecodeReconcileBackupsReq(r io.Reader) (*ReconcileBackupsReq, error) {
+	decoder := json.NewDecoder(r)
+	var req *ReconcileBackupsReq
+	err := decoder.Decode(&req)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
 
-		req, err := DecodeAEBackupInformationDeleteReq(r.Body)
+// DecodeReconcileBackupsReqFromRequest decodes a ReconcileBackupsReq from query parameters and JSON body of r.
+func DecodeReconcileBackupsReqFromRequest(r *http.Request) (*ReconcileBackupsReq, error) {
+	req := &ReconcileBackupsReq{}
+	if hasJSONBody(r) {
+		var err error
+		req, err = DecodeReconcileBackupsReq(r.Body)
 		if err != nil {
-			log.Errorf(c, "ds2bq: failed to decode request: %s", err)
-			return
+			return nil, err
 		}
 		defer r.Body.Close()
+	}
 
-		err = deleteBackup(c, r, req, queueName)
+	if v := r.URL.Query().Get("delete"); v != "" {
+		del, err := strconv.ParseBool(v)
 		if err != nil {
-			log.Warningf(c, "ds2bq: failed to delete appengine backup information: %s", err)
-			return
+			return nil, err
 		}
+		req.Delete = del
+	}
+	if v := r.URL.Query().Get("cursor"); v != "" {
+		req.Cursor = v
+	}
+
+	return req, nil
+}
+
+// DecodeOrphanObjectsDeleteReq decodes a OrphanObjectsDeleteReq from r.
+func DecodeOrphanObjectsDeleteReq(r io.Reader) (*OrphanObjectsDeleteReq, error) {
+	decoder := json.NewDecoder(r)
+	var req *OrphanObjectsDeleteReq
+	err := decoder.Decode(&req)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func hasJSONBody(r *http.Request) bool {
+	if r.Body == nil || r.ContentLength == 0 {
+		return false
+	}
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+}
+
+// DeleteOldBackupAPIHandlerFunc returns a http.HandlerFunc that delegate to taskqueue.
+// The path is for DeleteOldBackupTask.
+func DeleteOldBackupAPIHandlerFunc(queueName, path string) http.HandlerFunc {
+	s := newDatastoreManagementService(
+		ManagementWithURLs("", path, ""),
+		ManagementWithQueueName(queueName),
+	)
+	return s.servePostTQ
+}
+
+// DeleteOldBackupTaskHandlerFunc returns a http.HandlerFunc that adds tasks to delete old AEBackupInformation.
+// The path is for DeleteBackupTask.
+func DeleteOldBackupTaskHandlerFunc(queueName, path string, expireAfter time.Duration) http.HandlerFunc {
+	s := newDatastoreManagementService(
+		ManagementWithURLs("", "", path),
+		ManagementWithQueueName(queueName),
+		ManagementWithExpireDuration(expireAfter),
+	)
+	return s.servePostDeleteList
+}
+
+// DeleteBackupTaskHandlerFunc returns a http.HandlerFunc that removes all child entities about AEBackupInformation or AEDatastoreAdminOperation kinds.
+// Continuation tasks are posted to the path of the request, that is the path this handler is registered.
+func DeleteBackupTaskHandlerFunc(queueName string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := newDatastoreManagementService(
+			ManagementWithURLs("", "", r.URL.Path),
+			ManagementWithQueueName(queueName),
+		)
+		s.serveDeleteAEBackupInformation(w, r)
 	}
 }
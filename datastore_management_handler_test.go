@@ -0,0 +1,63 @@
+package ds2bq
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDecodeReqListBaseFromRequest(t *testing.T) {
+	for i, tc := range []struct {
+		target      string
+		contentType string
+		body        string
+		exp         ReqListBase
+	}{
+		{"/tq/delete-old-backups", "", "", ReqListBase{}},
+		{"/tq/delete-old-backups?limit=20&offset=5&cursor=abc", "", "", ReqListBase{Limit: 20, Offset: 5, Cursor: "abc"}},
+		{"/tq/delete-old-backups", "application/json", `{"limit":30,"cursor":"def"}`, ReqListBase{Limit: 30, Cursor: "def"}},
+		{"/tq/delete-old-backups?cursor=ghi", "application/json;charset=utf-8", `{"limit":30,"cursor":"def"}`, ReqListBase{Limit: 30, Cursor: "ghi"}},
+	} {
+		r := httptest.NewRequest("DELETE", tc.target, bytes.NewReader([]byte(tc.body)))
+		if tc.contentType != "" {
+			r.Header.Set("Content-Type", tc.contentType)
+		}
+
+		req, err := DecodeReqListBaseFromRequest(r)
+		if err != nil {
+			t.Fatalf("%02d: %s", i, err)
+		}
+		if *req != tc.exp {
+			t.Errorf("%02d: DecodeReqListBaseFromRequest(%s)\n => %#v, want %#v", i, tc.target, *req, tc.exp)
+		}
+	}
+}
+
+func TestDecodeAEBackupInformationDeleteReqFromRequest(t *testing.T) {
+	r := httptest.NewRequest("DELETE", "/tq/delete-backup?key=agtzfnN0Zy1jaGFvc3I", nil)
+
+	req, err := DecodeAEBackupInformationDeleteReqFromRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := "agtzfnN0Zy1jaGFvc3I", req.Key; e != g {
+		t.Errorf("expected key %s; got %s", e, g)
+	}
+}
+
+func TestDecodeTableRetentionReqFromRequest(t *testing.T) {
+	r := httptest.NewRequest("GET", "/tq/expire-old-tables?dryRun=true", nil)
+
+	req, err := DecodeTableRetentionReqFromRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !req.DryRun {
+		t.Error("expected dry run")
+	}
+
+	r = httptest.NewRequest("GET", "/tq/expire-old-tables?dryRun=maybe", nil)
+	if _, err := DecodeTableRetentionReqFromRequest(r); err == nil {
+		t.Error("expected error")
+	}
+}
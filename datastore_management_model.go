@@ -8,12 +8,17 @@ import (
 
 	"github.com/mjibson/goon"
 	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/log"
 )
 
 // AEDatastoreStore provides methods of Datastore backup information handling.
 type AEDatastoreStore struct{}
 
+// Statuses of AEDatastoreAdminOperation that is not finished.
+const (
+	aeOperationStatusCreated = "Created"
+	aeOperationStatusActive  = "Active"
+)
+
 // AEDatastoreAdminOperation mapped to _AE_DatastoreAdmin_Operation kind.
 // +qbg
 type AEDatastoreAdminOperation struct {
@@ -109,12 +114,12 @@ func (store *AEDatastoreStore) GetAEDatastoreAdminOperation(c context.Context, i
 	entity := &AEDatastoreAdminOperation{ID: id}
 	err := g.Get(entity)
 	if err != nil {
-		log.Infof(c, "on Get AEDatastoreAdminOperation: %s", err.Error())
+		logInfo(c, "on Get AEDatastoreAdminOperation", F(FieldError, err))
 		return nil, err
 	}
 	err = entity.FetchChildren(c)
 	if err != nil {
-		log.Infof(c, "on AEDatastoreAdminOperation.FetchChildren: %s", err.Error())
+		logInfo(c, "on AEDatastoreAdminOperation.FetchChildren", F(FieldError, err))
 		return nil, err
 	}
 
@@ -154,12 +159,12 @@ func (store *AEDatastoreStore) GetAEBackupInformation(c context.Context, parentK
 	entity := &AEBackupInformation{ParentKey: parentKey, ID: id}
 	err := g.Get(entity)
 	if err != nil {
-		log.Infof(c, "on Get AEBackupInformation: %s", err.Error())
+		logInfo(c, "on Get AEBackupInformation", F(FieldError, err))
 		return nil, err
 	}
 	err = entity.FetchChildren(c)
 	if err != nil {
-		log.Infof(c, "on AEBackupInformation.FetchChildren: %s", err.Error())
+		logInfo(c, "on AEBackupInformation.FetchChildren", F(FieldError, err))
 		return nil, err
 	}
 
@@ -189,31 +194,26 @@ func (store *AEDatastoreStore) ListAEBackupInformation(c context.Context, req *R
 }
 
 // DeleteAEBackupInformationAndRelatedData removes all child entities about AEBackupInformation or AEDatastoreAdminOperation kinds.
+// Entities are removed in batches within the request. Large backups should be removed by the task of DatastoreManagementService,
+// that continues in the next task.
 func (store *AEDatastoreStore) DeleteAEBackupInformationAndRelatedData(c context.Context, key *datastore.Key) error {
-	g := goon.FromContext(c)
-
-	if key.Kind() != "_AE_Backup_Information" {
-		return fmt.Errorf("invalid kind: %s", key.Kind())
-	}
-
-	rootKey := key
-	if key.Parent() != nil {
-		rootKey = key.Parent()
-	}
-
-	log.Infof(c, "rootKey: %s", rootKey.String())
-
-	q := datastore.NewQuery("").Ancestor(rootKey).KeysOnly()
-	keys, err := g.GetAll(q, nil)
+	rootKey, err := backupRootKey(key)
 	if err != nil {
 		return err
 	}
 
-	for _, key := range keys {
-		log.Infof(c, "remove target key: %s", key.String())
-	}
+	logInfo(c, "ds2bq: remove backup", F(FieldBackupKey, key.String()), F("rootKey", rootKey.String()))
 
-	return g.DeleteMulti(keys)
+	cursor := ""
+	for {
+		cursor, _, err = store.deleteBackupBatch(c, rootKey, cursor, backupDeletionBatchSize)
+		if err != nil {
+			return err
+		}
+		if cursor == "" {
+			return nil
+		}
+	}
 }
 
 // FetchChildren gathering children and fills fields.
@@ -226,18 +226,18 @@ func (entity *AEDatastoreAdminOperation) FetchChildren(c context.Context) error
 		qb := newAEBackupInformationQueryBuilder().Ancestor(g.Key(entity))
 		_, err := g.GetAll(qb.Query(), &backupInfoList)
 		if err != nil {
-			log.Infof(c, "on AEBackupInformation#GetAll: %s", err.Error())
+			logInfo(c, "on AEBackupInformation#GetAll", F(FieldError, err))
 			return err
 		}
 		for _, backupInfo := range backupInfoList {
 			if backupInfo.ParentKey == nil || backupInfo.ParentKey.Incomplete() {
 				// TODO うまく処理できるようになおす
-				log.Infof(c, "on backupInfo.ParentKey == nil, %#v, %#v", entity, backupInfo)
+				logInfo(c, "on backupInfo.ParentKey == nil", F("operationID", entity.ID), F("backupID", backupInfo.ID), F("name", backupInfo.Name))
 				continue
 			}
 			err := backupInfo.FetchChildren(c)
 			if err != nil {
-				log.Infof(c, "on AEBackupInformation#FetchChildren: %s", err.Error())
+				logInfo(c, "on AEBackupInformation#FetchChildren", F(FieldError, err))
 				return err
 			}
 		}
@@ -276,13 +276,13 @@ func (entity *AEBackupInformation) FetchChildren(c context.Context) error {
 		qb := newAEBackupInformationKindFilesQueryBuilder().Ancestor(g.Key(entity))
 		_, err := g.GetAll(qb.Query(), &backupInfoKindFilesList)
 		if err != nil {
-			log.Infof(c, "on AEBackupInformationKindFiles#GetAll: %s", err.Error())
+			logInfo(c, "on AEBackupInformationKindFiles#GetAll", F(FieldError, err))
 			return err
 		}
 		for _, backupInfoKindFiles := range backupInfoKindFilesList {
 			err := backupInfoKindFiles.FetchChildren(c)
 			if err != nil {
-				log.Infof(c, "on AEBackupInformationKindFiles#FetchChildren: %s", err.Error())
+				logInfo(c, "on AEBackupInformationKindFiles#FetchChildren", F(FieldError, err))
 				return err
 			}
 		}
@@ -329,7 +329,7 @@ func (entity *AEBackupInformationKindTypeInfo) FetchChildren(c context.Context)
 	if err != nil {
 		g := goon.FromContext(c)
 		key := g.Key(entity)
-		log.Infof(c, "on AEBackupInformationKindTypeInfo#FetchChildren json.Unmarshal, key: %s, %s", key.String(), entity.EntityTypeInfo)
+		logInfo(c, "on AEBackupInformationKindTypeInfo#FetchChildren json.Unmarshal", F("key", key.String()), F("entityTypeInfo", entity.EntityTypeInfo), F(FieldError, err))
 		return err
 	}
 	entity.EntityTypeInfoJSON = entityTypeInfo
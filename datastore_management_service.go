@@ -7,6 +7,7 @@ import (
 
 	"github.com/favclip/ucon"
 	"github.com/favclip/ucon/swagger"
+	"google.golang.org/appengine"
 	"google.golang.org/appengine/taskqueue"
 )
 
@@ -73,31 +74,141 @@ func ManagementWithExpireDuration(expireAfter time.Duration) ManagementOption {
 	}
 }
 
+type managementObserverOption struct {
+	Observer Observer
+}
+
+func (o *managementObserverOption) implements(s *datastoreManagementService) {
+	s.Observers = append(s.Observers, o.Observer)
+}
+
+// ManagementWithObserver provides Observer that receives lifecycle events of cleanup.
+func ManagementWithObserver(observer Observer) ManagementOption {
+	return &managementObserverOption{
+		Observer: observer,
+	}
+}
+
+type managementMetricsOption struct {
+	Metrics Metrics
+}
+
+func (o *managementMetricsOption) implements(s *datastoreManagementService) {
+	s.Metrics = o.Metrics
+}
+
+// ManagementWithMetrics provides Metrics that records cleanup.
+func ManagementWithMetrics(metrics Metrics) ManagementOption {
+	return &managementMetricsOption{
+		Metrics: metrics,
+	}
+}
+
+type managementLoggerOption struct {
+	Logger Logger
+}
+
+func (o *managementLoggerOption) implements(s *datastoreManagementService) {
+	s.Logger = o.Logger
+}
+
+// ManagementWithLogger provides Logger.
+// default Logger writes to App Engine log.
+func ManagementWithLogger(logger Logger) ManagementOption {
+	return &managementLoggerOption{
+		Logger: logger,
+	}
+}
+
+type managementAuthorizerOption struct {
+	APIAuthorizer  Authorizer
+	TaskAuthorizer Authorizer
+}
+
+func (o *managementAuthorizerOption) implements(s *datastoreManagementService) {
+	if o.APIAuthorizer != nil {
+		s.APIAuthorizer = o.APIAuthorizer
+	}
+	if o.TaskAuthorizer != nil {
+		s.TaskAuthorizer = o.TaskAuthorizer
+	}
+}
+
+// ManagementWithAuthorizers provides Authorizer of the API endpoint and of the task endpoints.
+// nil means default. default allows administrators and cron to the API, and tasks of any queue to the task endpoints.
+// The endpoints that cron requests, DeleteOldBackupURL and ExpireOldTablesURL, allow both of them.
+func ManagementWithAuthorizers(api, task Authorizer) ManagementOption {
+	return &managementAuthorizerOption{
+		APIAuthorizer:  api,
+		TaskAuthorizer: task,
+	}
+}
+
 type datastoreManagementService struct {
 	QueueName   string
 	ExpireAfter time.Duration
+	Observers   observers
+	Metrics     Metrics
+	Logger      Logger
 
-	APIDeleteBackupsURL   string
-	DeleteOldBackupURL    string
-	DeleteUnitOfBackupURL string
+	TableRetention       *TableRetention
+	BackupReconciliation *BackupReconciliation
+	// RequireVerifiedBackup keeps old backups unless a newer backup is verified.
+	RequireVerifiedBackup bool
+	FreshnessSLOs         []*FreshnessSLO
+
+	APIAuthorizer  Authorizer
+	TaskAuthorizer Authorizer
+
+	APIDeleteBackupsURL    string
+	DeleteOldBackupURL     string
+	DeleteUnitOfBackupURL  string
+	APIBackupDeletionURL   string
+	ExpireOldTablesURL     string
+	APIReconcileBackupsURL string
+	DeleteOrphanObjectsURL string
+	VerifyBackupURL        string
+	CheckFreshnessURL      string
 }
 
 // DatastoreManagementService serves Datastore management APIs.
 type DatastoreManagementService interface {
 	SetupWithUconSwagger(swPlugin *swagger.Plugin)
+	SetupWithMux(mux ServeMux)
+	Handler() http.Handler
 	HandlePostTQ(c context.Context, req *Noop) (*Noop, error)
 	HandlePostDeleteList(c context.Context, r *http.Request, req *ReqListBase) (*Noop, error)
 	HandleDeleteAEBackupInformation(c context.Context, r *http.Request, req *AEBackupInformationDeleteReq) (*Noop, error)
+	HandleGetBackupDeletion(c context.Context, req *AEBackupInformationDeleteReq) (*BackupDeletion, error)
+	HandleExpireOldTables(c context.Context, req *TableRetentionReq) (*TableRetentionReport, error)
+	HandleReconcileBackups(c context.Context, req *ReconcileBackupsReq) (*BackupReconciliationReport, error)
+	HandleDeleteOrphanObjects(c context.Context, req *OrphanObjectsDeleteReq) (*Noop, error)
+	HandleVerifyBackup(c context.Context, req *BackupVerificationReq) (*BackupVerification, error)
+	HandleCheckFreshness(c context.Context, req *Noop) (*FreshnessReport, error)
 }
 
 // NewDatastoreManagementService returns ready to use DatastoreManagementService.
 func NewDatastoreManagementService(opts ...ManagementOption) DatastoreManagementService {
+	return newDatastoreManagementService(opts...)
+}
+
+func newDatastoreManagementService(opts ...ManagementOption) *datastoreManagementService {
 	s := &datastoreManagementService{
-		QueueName:             "exec-rm-old-datastore-backups",
-		ExpireAfter:           30 * 24 * time.Hour,
-		APIDeleteBackupsURL:   "/api/datastore-management/delete-old-backups",
-		DeleteOldBackupURL:    "/tq/datastore-management/delete-old-backups",
-		DeleteUnitOfBackupURL: "/tq/datastore-management/delete-backup",
+		QueueName:              "exec-rm-old-datastore-backups",
+		ExpireAfter:            30 * 24 * time.Hour,
+		APIDeleteBackupsURL:    "/api/datastore-management/delete-old-backups",
+		DeleteOldBackupURL:     "/tq/datastore-management/delete-old-backups",
+		DeleteUnitOfBackupURL:  "/tq/datastore-management/delete-backup",
+		APIBackupDeletionURL:   "/api/datastore-management/backup-deletion",
+		ExpireOldTablesURL:     "/tq/datastore-management/expire-old-tables",
+		APIReconcileBackupsURL: "/api/datastore-management/reconcile-backups",
+		DeleteOrphanObjectsURL: "/tq/datastore-management/delete-orphan-objects",
+		VerifyBackupURL:        "/tq/datastore-management/verify-backup",
+		CheckFreshnessURL:      "/tq/datastore-management/check-freshness",
+		Metrics:                NopMetrics{},
+		Logger:                 NewAppEngineLogger(),
+		APIAuthorizer:          defaultAPIAuthorizer(),
+		TaskAuthorizer:         defaultTaskAuthorizer(),
 	}
 
 	for _, opt := range opts {
@@ -111,33 +222,356 @@ func NewDatastoreManagementService(opts ...ManagementOption) DatastoreManagement
 func (s *datastoreManagementService) SetupWithUconSwagger(swPlugin *swagger.Plugin) {
 	tag := swPlugin.AddTag(&swagger.Tag{Name: "DatastoreManagement", Description: ""})
 
-	info := swagger.NewHandlerInfo(s.HandlePostTQ)
+	info := swagger.NewHandlerInfo(func(c context.Context, r *http.Request, req *Noop) (*Noop, error) {
+		if err := authorize(withLogger(c, s.Logger), r, s.APIAuthorizer); err != nil {
+			return nil, err
+		}
+		return s.HandlePostTQ(c, req)
+	})
 	ucon.Handle("DELETE", s.APIDeleteBackupsURL, info)
 	info.Description, info.Tags = "Remove old Datastore backups", []string{tag.Name}
 
-	ucon.HandleFunc("GET,DELETE", s.DeleteOldBackupURL, s.HandlePostDeleteList)
+	ucon.HandleFunc("GET,DELETE", s.DeleteOldBackupURL, func(c context.Context, r *http.Request, req *ReqListBase) (*Noop, error) {
+		if err := authorize(withLogger(c, s.Logger), r, s.cronAuthorizer()); err != nil {
+			return nil, err
+		}
+		return s.HandlePostDeleteList(c, r, req)
+	})
+
+	ucon.HandleFunc("GET,DELETE", s.DeleteUnitOfBackupURL, func(c context.Context, r *http.Request, req *AEBackupInformationDeleteReq) (*Noop, error) {
+		if err := authorize(withLogger(c, s.Logger), r, s.TaskAuthorizer); err != nil {
+			return nil, err
+		}
+		return s.HandleDeleteAEBackupInformation(c, r, req)
+	})
+
+	info = swagger.NewHandlerInfo(func(c context.Context, r *http.Request, req *AEBackupInformationDeleteReq) (*BackupDeletion, error) {
+		if err := authorize(withLogger(c, s.Logger), r, s.APIAuthorizer); err != nil {
+			return nil, err
+		}
+		return s.HandleGetBackupDeletion(c, req)
+	})
+	ucon.Handle("GET", s.APIBackupDeletionURL, info)
+	info.Description, info.Tags = "Get the progress of removing a Datastore backup", []string{tag.Name}
+
+	ucon.HandleFunc("GET,POST", s.VerifyBackupURL, func(c context.Context, r *http.Request, req *BackupVerificationReq) (*BackupVerification, error) {
+		if err := authorize(withLogger(c, s.Logger), r, s.cronAuthorizer()); err != nil {
+			return nil, err
+		}
+		return s.HandleVerifyBackup(c, req)
+	})
+
+	if s.TableRetention != nil {
+		ucon.HandleFunc("GET,DELETE", s.ExpireOldTablesURL, func(c context.Context, r *http.Request, req *TableRetentionReq) (*TableRetentionReport, error) {
+			if err := authorize(withLogger(c, s.Logger), r, s.cronAuthorizer()); err != nil {
+				return nil, err
+			}
+			return s.HandleExpireOldTables(c, req)
+		})
+	}
+
+	if len(s.FreshnessSLOs) != 0 {
+		ucon.HandleFunc("GET", s.CheckFreshnessURL, func(c context.Context, r *http.Request, req *Noop) (*FreshnessReport, error) {
+			if err := authorize(withLogger(c, s.Logger), r, s.cronAuthorizer()); err != nil {
+				return nil, err
+			}
+			return s.HandleCheckFreshness(c, req)
+		})
+	}
+
+	if s.BackupReconciliation != nil {
+		info := swagger.NewHandlerInfo(func(c context.Context, r *http.Request, req *ReconcileBackupsReq) (*BackupReconciliationReport, error) {
+			if err := authorize(withLogger(c, s.Logger), r, s.APIAuthorizer); err != nil {
+				return nil, err
+			}
+			return s.HandleReconcileBackups(c, req)
+		})
+		ucon.Handle("GET,DELETE", s.APIReconcileBackupsURL, info)
+		info.Description, info.Tags = "Report and remove orphans of Datastore backups", []string{tag.Name}
+
+		ucon.HandleFunc("POST", s.DeleteOrphanObjectsURL, func(c context.Context, r *http.Request, req *OrphanObjectsDeleteReq) (*Noop, error) {
+			if err := authorize(withLogger(c, s.Logger), r, s.TaskAuthorizer); err != nil {
+				return nil, err
+			}
+			return s.HandleDeleteOrphanObjects(c, req)
+		})
+	}
+}
+
+// SetupWithMux setup handlers to mux.
+func (s *datastoreManagementService) SetupWithMux(mux ServeMux) {
+	mux.Handle(s.APIDeleteBackupsURL, allowMethods("DELETE", s.servePostTQ))
+	mux.Handle(s.DeleteOldBackupURL, allowMethods("GET,DELETE", s.servePostDeleteList))
+	mux.Handle(s.DeleteUnitOfBackupURL, allowMethods("GET,DELETE", s.serveDeleteAEBackupInformation))
+	mux.Handle(s.APIBackupDeletionURL, allowMethods("GET", s.serveGetBackupDeletion))
+	mux.Handle(s.VerifyBackupURL, allowMethods("GET,POST", s.serveVerifyBackup))
+
+	if s.TableRetention != nil {
+		mux.Handle(s.ExpireOldTablesURL, allowMethods("GET,DELETE", s.serveExpireOldTables))
+	}
+	if len(s.FreshnessSLOs) != 0 {
+		mux.Handle(s.CheckFreshnessURL, allowMethods("GET", s.serveCheckFreshness))
+	}
+	if s.BackupReconciliation != nil {
+		mux.Handle(s.APIReconcileBackupsURL, allowMethods("GET,DELETE", s.serveReconcileBackups))
+		mux.Handle(s.DeleteOrphanObjectsURL, allowMethods("POST", s.serveDeleteOrphanObjects))
+	}
+}
+
+// Handler returns a http.Handler that serves all endpoints of the service.
+func (s *datastoreManagementService) Handler() http.Handler {
+	mux := http.NewServeMux()
+	s.SetupWithMux(mux)
+	return mux
+}
+
+// cronAuthorizer returns Authorizer of the endpoints that cron requests.
+func (s *datastoreManagementService) cronAuthorizer() Authorizer {
+	return AnyAuthorizer(s.TaskAuthorizer, s.APIAuthorizer)
+}
+
+// newContext returns App Engine context that carries Logger of the service.
+func (s *datastoreManagementService) newContext(r *http.Request) context.Context {
+	return withLogger(appengine.NewContext(r), s.Logger)
+}
+
+func (s *datastoreManagementService) servePostTQ(w http.ResponseWriter, r *http.Request) {
+	c := s.newContext(r)
+
+	if !serveAuthorized(c, w, r, s.APIAuthorizer) {
+		return
+	}
+
+	_, err := s.HandlePostTQ(c, &Noop{})
+	if err != nil {
+		logError(c, "ds2bq: failed to add a task", F(FieldError, err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *datastoreManagementService) servePostDeleteList(w http.ResponseWriter, r *http.Request) {
+	c := s.newContext(r)
+
+	if !serveAuthorized(c, w, r, s.cronAuthorizer()) {
+		return
+	}
+
+	req, err := DecodeReqListBaseFromRequest(r)
+	if err != nil {
+		logError(c, "ds2bq: failed to decode request", F(FieldError, err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err = s.HandlePostDeleteList(c, r, req)
+	if err != nil {
+		logError(c, "ds2bq: failed to delete old backup", F(FieldError, err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *datastoreManagementService) serveDeleteAEBackupInformation(w http.ResponseWriter, r *http.Request) {
+	c := s.newContext(r)
+
+	if !serveAuthorized(c, w, r, s.TaskAuthorizer) {
+		return
+	}
+
+	req, err := DecodeAEBackupInformationDeleteReqFromRequest(r)
+	if err != nil {
+		logError(c, "ds2bq: failed to decode request", F(FieldError, err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err = s.HandleDeleteAEBackupInformation(c, r, req)
+	if err != nil {
+		logWarning(c, "ds2bq: failed to delete appengine backup information", F(FieldError, err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *datastoreManagementService) serveGetBackupDeletion(w http.ResponseWriter, r *http.Request) {
+	c := s.newContext(r)
+
+	if !serveAuthorized(c, w, r, s.APIAuthorizer) {
+		return
+	}
+
+	req, err := DecodeAEBackupInformationDeleteReqFromRequest(r)
+	if err != nil {
+		logError(c, "ds2bq: failed to decode request", F(FieldError, err))
+		writeError(w, newHTTPError(http.StatusBadRequest, "%s", err))
+		return
+	}
+
+	resp, err := s.HandleGetBackupDeletion(c, req)
+	if err != nil {
+		logError(c, "ds2bq: failed to get backup deletion", F(FieldError, err))
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *datastoreManagementService) serveVerifyBackup(w http.ResponseWriter, r *http.Request) {
+	c := s.newContext(r)
+
+	if !serveAuthorized(c, w, r, s.cronAuthorizer()) {
+		return
+	}
+
+	req, err := DecodeBackupVerificationReqFromRequest(r)
+	if err != nil {
+		logError(c, "ds2bq: failed to decode request", F(FieldError, err))
+		writeError(w, newHTTPError(http.StatusBadRequest, "%s", err))
+		return
+	}
+
+	resp, err := s.HandleVerifyBackup(c, req)
+	if err != nil {
+		logError(c, "ds2bq: failed to verify backup", F(FieldError, err))
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// serveCheckFreshness responds 503 Service Unavailable with the report if any kind is out of the SLO.
+func (s *datastoreManagementService) serveCheckFreshness(w http.ResponseWriter, r *http.Request) {
+	c := s.newContext(r)
+
+	if !serveAuthorized(c, w, r, s.cronAuthorizer()) {
+		return
+	}
+
+	resp, err := s.HandleCheckFreshness(c, &Noop{})
+	if err != nil {
+		logError(c, "ds2bq: failed to check freshness", F(FieldError, err))
+		writeError(w, err)
+		return
+	}
+	status := http.StatusOK
+	if !resp.OK {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, resp)
+}
+
+func (s *datastoreManagementService) serveExpireOldTables(w http.ResponseWriter, r *http.Request) {
+	c := s.newContext(r)
+
+	if !serveAuthorized(c, w, r, s.cronAuthorizer()) {
+		return
+	}
+
+	req, err := DecodeTableRetentionReqFromRequest(r)
+	if err != nil {
+		logError(c, "ds2bq: failed to decode request", F(FieldError, err))
+		writeError(w, newHTTPError(http.StatusBadRequest, "%s", err))
+		return
+	}
+
+	resp, err := s.HandleExpireOldTables(c, req)
+	if err != nil {
+		logError(c, "ds2bq: failed to expire old tables", F(FieldError, err))
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *datastoreManagementService) serveReconcileBackups(w http.ResponseWriter, r *http.Request) {
+	c := s.newContext(r)
+
+	if !serveAuthorized(c, w, r, s.APIAuthorizer) {
+		return
+	}
+
+	req, err := DecodeReconcileBackupsReqFromRequest(r)
+	if err != nil {
+		logError(c, "ds2bq: failed to decode request", F(FieldError, err))
+		writeError(w, newHTTPError(http.StatusBadRequest, "%s", err))
+		return
+	}
 
-	ucon.HandleFunc("GET,DELETE", s.DeleteUnitOfBackupURL, s.HandleDeleteAEBackupInformation)
+	resp, err := s.HandleReconcileBackups(c, req)
+	if err != nil {
+		logError(c, "ds2bq: failed to reconcile backups", F(FieldError, err))
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *datastoreManagementService) serveDeleteOrphanObjects(w http.ResponseWriter, r *http.Request) {
+	c := s.newContext(r)
+
+	if !serveAuthorized(c, w, r, s.TaskAuthorizer) {
+		return
+	}
+
+	req, err := DecodeOrphanObjectsDeleteReq(r.Body)
+	if err != nil {
+		logError(c, "ds2bq: failed to decode request", F(FieldError, err))
+		writeError(w, newHTTPError(http.StatusBadRequest, "%s", err))
+		return
+	}
+	defer r.Body.Close()
+
+	resp, err := s.HandleDeleteOrphanObjects(c, req)
+	if err != nil {
+		logError(c, "ds2bq: failed to delete orphan objects", F(FieldError, err))
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
 }
 
 func (s *datastoreManagementService) HandlePostTQ(c context.Context, req *Noop) (*Noop, error) {
+	c = withLogger(c, s.Logger)
+
 	t := &taskqueue.Task{
 		Method: "DELETE",
 		Path:   s.DeleteOldBackupURL,
 	}
 	_, err := taskqueue.Add(c, t, s.QueueName)
 	if err != nil {
+		s.Metrics.TaskEnqueueFailed(c, s.QueueName)
 		return nil, err
 	}
 	return &Noop{}, nil
 }
 
 func (s *datastoreManagementService) HandlePostDeleteList(c context.Context, r *http.Request, req *ReqListBase) (*Noop, error) {
-	err := addDeleteOldBackupTasks(c, r, req, s.QueueName, s.DeleteUnitOfBackupURL, s.ExpireAfter)
+	c = withLogger(c, s.Logger)
+
+	if len(s.FreshnessSLOs) != 0 {
+		report, err := checkFreshness(c, s.FreshnessSLOs, s.Observers, false)
+		if err != nil {
+			return nil, err
+		}
+		if !report.OK {
+			logWarning(c, "ds2bq: removing old backups is paused, kinds are out of freshness SLO", F("kinds", report.staleKinds()))
+			return &Noop{}, nil
+		}
+	}
+
+	err := addDeleteOldBackupTasks(c, r, req, s.QueueName, s.DeleteUnitOfBackupURL, s.VerifyBackupURL, s.ExpireAfter, s.RequireVerifiedBackup, s.Metrics)
 	if err != nil {
 		return nil, err
 	}
 
+	store := &AEDatastoreStore{}
+	if n, err := store.PurgeBackupDeletions(c, time.Now()); err != nil {
+		logWarning(c, "ds2bq: failed to purge expired backup deletions", F(FieldError, err))
+	} else if n != 0 {
+		logInfo(c, "ds2bq: expired backup deletions purged", F("deletions", n))
+	}
+
 	return &Noop{}, nil
 }
 
@@ -146,11 +580,103 @@ type AEBackupInformationDeleteReq struct {
 	Key string `json:"key"`
 }
 
+// HandleDeleteAEBackupInformation removes entities of the backup in batches.
+// The rest is removed by the next task, the progress is returned by HandleGetBackupDeletion.
 func (s *datastoreManagementService) HandleDeleteAEBackupInformation(c context.Context, r *http.Request, req *AEBackupInformationDeleteReq) (*Noop, error) {
-	err := deleteBackup(c, r, req, s.QueueName)
+	c = withLogger(c, s.Logger)
+
+	_, err := deleteBackup(c, req, s.QueueName, s.DeleteUnitOfBackupURL, s.Observers, s.Metrics)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Noop{}, nil
+}
+
+// HandleGetBackupDeletion returns the progress of removing the backup of req.
+func (s *datastoreManagementService) HandleGetBackupDeletion(c context.Context, req *AEBackupInformationDeleteReq) (*BackupDeletion, error) {
+	c = withLogger(c, s.Logger)
+
+	if req.Key == "" {
+		return nil, newHTTPError(http.StatusBadRequest, "ds2bq: key is required")
+	}
+	store := &AEDatastoreStore{}
+	deletion, err := store.GetBackupDeletion(c, req.Key)
 	if err != nil {
 		return nil, err
 	}
+	if deletion == nil {
+		return nil, newHTTPError(http.StatusNotFound, "ds2bq: deletion of backup %s is not found", req.Key)
+	}
+	return deletion, nil
+}
+
+// HandleVerifyBackup checks files of the backup, and marks it verified or corrupt.
+func (s *datastoreManagementService) HandleVerifyBackup(c context.Context, req *BackupVerificationReq) (*BackupVerification, error) {
+	c = withLogger(c, s.Logger)
+
+	return verifyBackup(c, req)
+}
+
+// HandleCheckFreshness checks the last backup and the last import of kinds, and notifies kinds out of the SLO.
+func (s *datastoreManagementService) HandleCheckFreshness(c context.Context, req *Noop) (*FreshnessReport, error) {
+	c = withLogger(c, s.Logger)
+
+	if len(s.FreshnessSLOs) == 0 {
+		return nil, newHTTPError(http.StatusNotFound, "ds2bq: freshness SLO is not configured")
+	}
 
+	return checkFreshness(c, s.FreshnessSLOs, s.Observers, true)
+}
+
+// TableRetentionReq provides request of applying the retention policy of dated snapshot tables.
+type TableRetentionReq struct {
+	DryRun bool `json:"dryRun"`
+}
+
+func (s *datastoreManagementService) HandleExpireOldTables(c context.Context, req *TableRetentionReq) (*TableRetentionReport, error) {
+	c = withLogger(c, s.Logger)
+
+	if s.TableRetention == nil {
+		return nil, newHTTPError(http.StatusNotFound, "ds2bq: table retention is not configured")
+	}
+
+	return applyTableRetention(c, s.TableRetention, req.DryRun)
+}
+
+// ReconcileBackupsReq provides request of reconciliation between backup information and objects.
+// Orphans are only reported unless Delete is true.
+// A request reconciles a page of the objects from Cursor, the next page is requested with NextCursor of the report.
+type ReconcileBackupsReq struct {
+	Delete bool   `json:"delete"`
+	Cursor string `json:"cursor"`
+}
+
+// HandleReconcileBackups reports backup information whose files are missing, and objects that no backup information refers.
+func (s *datastoreManagementService) HandleReconcileBackups(c context.Context, req *ReconcileBackupsReq) (*BackupReconciliationReport, error) {
+	c = withLogger(c, s.Logger)
+
+	if s.BackupReconciliation == nil {
+		return nil, newHTTPError(http.StatusNotFound, "ds2bq: backup reconciliation is not configured")
+	}
+
+	return reconcileBackups(c, s.BackupReconciliation, req.Delete, req.Cursor, s.QueueName, s.DeleteUnitOfBackupURL, s.DeleteOrphanObjectsURL)
+}
+
+// HandleDeleteOrphanObjects deletes orphan objects reported by reconciliation.
+func (s *datastoreManagementService) HandleDeleteOrphanObjects(c context.Context, req *OrphanObjectsDeleteReq) (*Noop, error) {
+	c = withLogger(c, s.Logger)
+
+	if s.BackupReconciliation == nil {
+		return nil, newHTTPError(http.StatusNotFound, "ds2bq: backup reconciliation is not configured")
+	}
+	if req.BucketName != s.BackupReconciliation.BucketName {
+		return nil, newHTTPError(http.StatusBadRequest, "ds2bq: bucket %s is not reconciled", req.BucketName)
+	}
+
+	err := deleteObjects(c, req)
+	if err != nil {
+		return nil, err
+	}
 	return &Noop{}, nil
 }
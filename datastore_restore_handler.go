@@ -0,0 +1,28 @@
+package ds2bq
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// DecodeRestoreReq decodes a RestoreReq from r.
+func DecodeRestoreReq(r io.Reader) (*RestoreReq, error) {
+	decoder := json.NewDecoder(r)
+	var req *RestoreReq
+	err := decoder.Decode(&req)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// DecodeRestoreOperationStatusReq decodes a RestoreOperationStatusReq from r.
+func DecodeRestoreOperationStatusReq(r io.Reader) (*RestoreOperationStatusReq, error) {
+	decoder := json.NewDecoder(r)
+	var req *RestoreOperationStatusReq
+	err := decoder.Decode(&req)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
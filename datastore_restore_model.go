@@ -0,0 +1,167 @@
+package ds2bq
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/mjibson/goon"
+	dsapi "google.golang.org/api/datastore/v1beta1"
+	"google.golang.org/appengine/datastore"
+)
+
+// RestoreState is the state of RestoreOperation.
+type RestoreState string
+
+// RestoreState values.
+const (
+	// RestoreStatePending is waiting for the confirmation.
+	RestoreStatePending RestoreState = "pending"
+	// RestoreStateStarting is confirmed and the import is being requested.
+	RestoreStateStarting RestoreState = "starting"
+	RestoreStateRunning  RestoreState = "running"
+	RestoreStateDone     RestoreState = "done"
+	RestoreStateFailed   RestoreState = "failed"
+)
+
+// RestoreOperation is a restore of Datastore from a managed export, tracked until the import operation is done.
+type RestoreOperation struct {
+	Kind              string       `goon:"kind,DS2BQRestoreOperation" json:"-"`
+	ID                int64        `datastore:"-" goon:"id" json:"id,string"`
+	ProjectID         string       `json:"projectId"`
+	InputURL          string       `json:"inputUrl"`
+	Kinds             []string     `json:"kinds"`
+	NamespaceIDs      []string     `json:"namespaceIds"`
+	State             RestoreState `json:"state"`
+	ConfirmationToken string       `datastore:",noindex" json:"-"`
+	OperationName     string       `json:"operationName,omitempty"`
+	Error             string       `datastore:",noindex" json:"error,omitempty"`
+	EntitiesCompleted int64        `datastore:",noindex" json:"entitiesCompleted"`
+	EntitiesEstimated int64        `datastore:",noindex" json:"entitiesEstimated"`
+	CreatedAt         time.Time    `json:"createdAt"`
+	ExpiresAt         time.Time    `json:"expiresAt"`
+	UpdatedAt         time.Time    `json:"updatedAt"`
+}
+
+// restoreConfirmationTTL is the duration that the confirmation token of RestoreOperation is valid.
+const restoreConfirmationTTL = 10 * time.Minute
+
+func newConfirmationToken() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// confirm verifies the token and changes the state to starting.
+func (op *RestoreOperation) confirm(token string, now time.Time) error {
+	if op.State != RestoreStatePending {
+		return newHTTPError(http.StatusConflict, "restore %d is already %s", op.ID, op.State)
+	}
+	if now.After(op.ExpiresAt) {
+		return newHTTPError(http.StatusConflict, "confirmation token of restore %d is expired", op.ID)
+	}
+	if subtle.ConstantTimeCompare([]byte(op.ConfirmationToken), []byte(token)) != 1 {
+		return newHTTPError(http.StatusForbidden, "confirmation token of restore %d is invalid", op.ID)
+	}
+	op.State = RestoreStateStarting
+	op.UpdatedAt = now
+	return nil
+}
+
+// update reflects the long-running operation to RestoreOperation.
+func (op *RestoreOperation) update(lro *dsapi.GoogleLongrunningOperation, now time.Time) {
+	op.OperationName = lro.Name
+	op.UpdatedAt = now
+
+	var metadata struct {
+		ProgressEntities struct {
+			WorkCompleted int64 `json:"workCompleted,string"`
+			WorkEstimated int64 `json:"workEstimated,string"`
+		} `json:"progressEntities"`
+	}
+	if err := json.Unmarshal(lro.Metadata, &metadata); err == nil {
+		op.EntitiesCompleted = metadata.ProgressEntities.WorkCompleted
+		op.EntitiesEstimated = metadata.ProgressEntities.WorkEstimated
+	}
+
+	switch {
+	case !lro.Done:
+		op.State = RestoreStateRunning
+	case lro.Error != nil:
+		op.State = RestoreStateFailed
+		op.Error = lro.Error.Message
+	default:
+		op.State = RestoreStateDone
+	}
+}
+
+// PutRestoreOperation puts RestoreOperation.
+func (store *AEDatastoreStore) PutRestoreOperation(c context.Context, op *RestoreOperation) error {
+	g := goon.FromContext(c)
+	_, err := g.Put(op)
+	return err
+}
+
+// GetRestoreOperation returns RestoreOperation that specified by id.
+func (store *AEDatastoreStore) GetRestoreOperation(c context.Context, id int64) (*RestoreOperation, error) {
+	if id == 0 {
+		return nil, ErrInvalidID
+	}
+
+	g := goon.FromContext(c)
+	op := &RestoreOperation{ID: id}
+	err := g.Get(op)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, newHTTPError(http.StatusNotFound, "restore %d is not found", id)
+	} else if err != nil {
+		return nil, err
+	}
+	return op, nil
+}
+
+// ConfirmRestoreOperation verifies the confirmation token in transaction, so the restore starts only once.
+func (store *AEDatastoreStore) ConfirmRestoreOperation(c context.Context, id int64, token string, now time.Time) (*RestoreOperation, error) {
+	if id == 0 {
+		return nil, ErrInvalidID
+	}
+
+	g := goon.FromContext(c)
+	op := &RestoreOperation{ID: id}
+	err := g.RunInTransaction(func(tg *goon.Goon) error {
+		err := tg.Get(op)
+		if err == datastore.ErrNoSuchEntity {
+			return newHTTPError(http.StatusNotFound, "restore %d is not found", id)
+		} else if err != nil {
+			return err
+		}
+		err = op.confirm(token, now)
+		if err != nil {
+			return err
+		}
+		_, err = tg.Put(op)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return op, nil
+}
+
+// ListRestoreOperations returns RestoreOperations in order of creation, newest first.
+func (store *AEDatastoreStore) ListRestoreOperations(c context.Context, limit int) ([]*RestoreOperation, error) {
+	g := goon.FromContext(c)
+	q := datastore.NewQuery(g.Kind(&RestoreOperation{})).Order("-CreatedAt").Limit(limit)
+	var list []*RestoreOperation
+	_, err := g.GetAll(q, &list)
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
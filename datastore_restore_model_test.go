@@ -0,0 +1,87 @@
+package ds2bq
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	dsapi "google.golang.org/api/datastore/v1beta1"
+)
+
+func TestRestoreOperation_confirm(t *testing.T) {
+	now := time.Date(2017, 11, 14, 6, 47, 1, 0, time.UTC)
+	newOp := func() *RestoreOperation {
+		return &RestoreOperation{
+			ID:                1,
+			State:             RestoreStatePending,
+			ConfirmationToken: "token",
+			ExpiresAt:         now.Add(restoreConfirmationTTL),
+		}
+	}
+
+	op := newOp()
+	if err := op.confirm("token", now); err != nil {
+		t.Fatal(err)
+	}
+	if e, g := RestoreStateStarting, op.State; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+
+	// confirmed restore can not be confirmed again.
+	if err, ok := op.confirm("token", now).(*httpError); !ok || err.Code != http.StatusConflict {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	if err, ok := newOp().confirm("wrong", now).(*httpError); !ok || err.Code != http.StatusForbidden {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err, ok := newOp().confirm("", now).(*httpError); !ok || err.Code != http.StatusForbidden {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err, ok := newOp().confirm("token", now.Add(restoreConfirmationTTL+time.Second)).(*httpError); !ok || err.Code != http.StatusConflict {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestRestoreOperation_update(t *testing.T) {
+	op := &RestoreOperation{State: RestoreStateStarting}
+	op.update(&dsapi.GoogleLongrunningOperation{
+		Name:     "projects/example/operations/abc",
+		Metadata: []byte(`{"progressEntities":{"workCompleted":"10","workEstimated":"100"}}`),
+	}, time.Now())
+	if e, g := RestoreStateRunning, op.State; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	if e, g := int64(10), op.EntitiesCompleted; e != g {
+		t.Errorf("expected %d; got %d", e, g)
+	}
+	if e, g := int64(100), op.EntitiesEstimated; e != g {
+		t.Errorf("expected %d; got %d", e, g)
+	}
+
+	op.update(&dsapi.GoogleLongrunningOperation{Done: true, Error: &dsapi.Status{Message: "failed"}}, time.Now())
+	if e, g := RestoreStateFailed, op.State; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	if e, g := "failed", op.Error; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+}
+
+func TestDatastoreRestoreService_validateInputURL(t *testing.T) {
+	s := newDatastoreRestoreService(RestoreWithBucketName("backups"))
+
+	for _, test := range []struct {
+		url   string
+		valid bool
+	}{
+		{"gs://backups/2017-11-14T06:47:01_23208/2017-11-14T06:47:01_23208.overall_export_metadata", true},
+		{"gs://others/2017-11-14T06:47:01_23208/2017-11-14T06:47:01_23208.overall_export_metadata", false},
+		{"gs://backups/2017-11-14T06:47:01_23208/all_namespaces/kind_Article/all_namespaces_kind_Article.export_metadata", false},
+		{"", false},
+	} {
+		if err := s.validateInputURL(test.url); (err == nil) != test.valid {
+			t.Errorf("unexpected result %v for %s", err, test.url)
+		}
+	}
+}
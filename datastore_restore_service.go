@@ -0,0 +1,588 @@
+package ds2bq
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/favclip/ucon"
+	"github.com/favclip/ucon/swagger"
+	"google.golang.org/appengine"
+)
+
+// RestoreOption provides option value of DatastoreRestoreService.
+type RestoreOption interface {
+	implements(s *datastoreRestoreService)
+}
+
+type restoreURLOption struct {
+	APIBackupsURL      string
+	APIRestoresURL     string
+	OperationStatusURL string
+}
+
+func (o *restoreURLOption) implements(s *datastoreRestoreService) {
+	if v := o.APIBackupsURL; v != "" {
+		s.APIBackupsURL = v
+	}
+	if v := o.APIRestoresURL; v != "" {
+		s.APIRestoresURL = v
+	}
+	if v := o.OperationStatusURL; v != "" {
+		s.OperationStatusURL = v
+	}
+}
+
+// RestoreWithURLs provides API endpoint URL.
+func RestoreWithURLs(apiBackupsURL, apiRestoresURL, operationStatusURL string) RestoreOption {
+	return &restoreURLOption{
+		APIBackupsURL:      apiBackupsURL,
+		APIRestoresURL:     apiRestoresURL,
+		OperationStatusURL: operationStatusURL,
+	}
+}
+
+type restoreBucketNameOption struct {
+	BucketName string
+}
+
+func (o *restoreBucketNameOption) implements(s *datastoreRestoreService) {
+	s.BucketName = o.BucketName
+}
+
+// RestoreWithBucketName provides bucket name of managed exports to restore.
+func RestoreWithBucketName(bucketName string) RestoreOption {
+	return &restoreBucketNameOption{
+		BucketName: bucketName,
+	}
+}
+
+type restoreQueueNameOption struct {
+	QueueName string
+}
+
+func (o *restoreQueueNameOption) implements(s *datastoreRestoreService) {
+	s.QueueName = o.QueueName
+}
+
+// RestoreWithQueueName provides queue name of TaskQueue that tracks import operations.
+func RestoreWithQueueName(queueName string) RestoreOption {
+	return &restoreQueueNameOption{
+		QueueName: queueName,
+	}
+}
+
+type restoreLoggerOption struct {
+	Logger Logger
+}
+
+func (o *restoreLoggerOption) implements(s *datastoreRestoreService) {
+	s.Logger = o.Logger
+}
+
+// RestoreWithLogger provides Logger.
+// default Logger writes to App Engine log.
+func RestoreWithLogger(logger Logger) RestoreOption {
+	return &restoreLoggerOption{
+		Logger: logger,
+	}
+}
+
+type restoreAuthorizerOption struct {
+	APIAuthorizer  Authorizer
+	TaskAuthorizer Authorizer
+}
+
+func (o *restoreAuthorizerOption) implements(s *datastoreRestoreService) {
+	if o.APIAuthorizer != nil {
+		s.APIAuthorizer = o.APIAuthorizer
+	}
+	if o.TaskAuthorizer != nil {
+		s.TaskAuthorizer = o.TaskAuthorizer
+	}
+}
+
+// RestoreWithAuthorizers provides Authorizer of the API endpoints and of the taskqueue endpoint.
+// nil means default. default allows administrators to the APIs, and tasks of any queue to the taskqueue endpoint.
+func RestoreWithAuthorizers(api, task Authorizer) RestoreOption {
+	return &restoreAuthorizerOption{
+		APIAuthorizer:  api,
+		TaskAuthorizer: task,
+	}
+}
+
+type datastoreRestoreService struct {
+	BucketName string
+	QueueName  string
+	Logger     Logger
+	Export     DatastoreExportService
+
+	APIAuthorizer  Authorizer
+	TaskAuthorizer Authorizer
+
+	APIBackupsURL      string
+	APIRestoresURL     string
+	OperationStatusURL string
+}
+
+// DatastoreRestoreService serves APIs that restore Datastore from managed exports.
+// The APIs except the taskqueue endpoint are allowed only to administrators of the app by default.
+//
+// A restore needs two requests. The first request creates a pending restore and returns its confirmation token,
+// and the second request with the id and the token starts the import within 10 minutes.
+type DatastoreRestoreService interface {
+	SetupWithUconSwagger(swPlugin *swagger.Plugin)
+	SetupWithMux(mux ServeMux)
+	Handler() http.Handler
+	HandleListBackups(c context.Context, req *ReqListBase) (*RestorableBackupListResp, error)
+	HandleListRestores(c context.Context, req *ReqListBase) (*RestoreOperationListResp, error)
+	HandleRestore(c context.Context, req *RestoreReq) (*RestoreResp, error)
+	HandleOperationStatus(c context.Context, req *RestoreOperationStatusReq) (*Noop, error)
+}
+
+// NewDatastoreRestoreService returns ready to use DatastoreRestoreService.
+func NewDatastoreRestoreService(opts ...RestoreOption) (DatastoreRestoreService, error) {
+	s := newDatastoreRestoreService(opts...)
+
+	if s.BucketName == "" {
+		return nil, ErrInvalidState
+	}
+
+	return s, nil
+}
+
+func newDatastoreRestoreService(opts ...RestoreOption) *datastoreRestoreService {
+	s := &datastoreRestoreService{
+		QueueName:          "",
+		Logger:             NewAppEngineLogger(),
+		Export:             NewDatastoreExportService(),
+		APIBackupsURL:      "/api/datastore-restore/backups",
+		APIRestoresURL:     "/api/datastore-restore/restores",
+		OperationStatusURL: "/tq/datastore-restore/operation-status",
+		APIAuthorizer:      AdminAuthorizer(),
+		TaskAuthorizer:     defaultTaskAuthorizer(),
+	}
+
+	for _, opt := range opts {
+		opt.implements(s)
+	}
+
+	return s
+}
+
+// SetupWithUconSwagger setup handlers to ucon mux.
+func (s *datastoreRestoreService) SetupWithUconSwagger(swPlugin *swagger.Plugin) {
+	tag := swPlugin.AddTag(&swagger.Tag{Name: "DatastoreRestore", Description: ""})
+
+	info := swagger.NewHandlerInfo(func(c context.Context, r *http.Request, req *ReqListBase) (*RestorableBackupListResp, error) {
+		if err := authorize(withLogger(c, s.Logger), r, s.APIAuthorizer); err != nil {
+			return nil, err
+		}
+		return s.HandleListBackups(c, req)
+	})
+	ucon.Handle("GET", s.APIBackupsURL, info)
+	info.Description, info.Tags = "List managed exports to restore", []string{tag.Name}
+
+	info = swagger.NewHandlerInfo(func(c context.Context, r *http.Request, req *ReqListBase) (*RestoreOperationListResp, error) {
+		if err := authorize(withLogger(c, s.Logger), r, s.APIAuthorizer); err != nil {
+			return nil, err
+		}
+		return s.HandleListRestores(c, req)
+	})
+	ucon.Handle("GET", s.APIRestoresURL, info)
+	info.Description, info.Tags = "List restores", []string{tag.Name}
+
+	info = swagger.NewHandlerInfo(func(c context.Context, r *http.Request, req *RestoreReq) (*RestoreResp, error) {
+		if err := authorize(withLogger(c, s.Logger), r, s.APIAuthorizer); err != nil {
+			return nil, err
+		}
+		return s.HandleRestore(c, req)
+	})
+	ucon.Handle("POST", s.APIRestoresURL, info)
+	info.Description, info.Tags = "Request or confirm a restore", []string{tag.Name}
+
+	ucon.HandleFunc("POST", s.OperationStatusURL, func(c context.Context, r *http.Request, req *RestoreOperationStatusReq) (*Noop, error) {
+		if err := authorize(withLogger(c, s.Logger), r, s.TaskAuthorizer); err != nil {
+			return nil, err
+		}
+		return s.HandleOperationStatus(c, req)
+	})
+}
+
+// SetupWithMux setup handlers to mux.
+func (s *datastoreRestoreService) SetupWithMux(mux ServeMux) {
+	mux.Handle(s.APIBackupsURL, allowMethods("GET", s.serveListBackups))
+	mux.Handle(s.APIRestoresURL, allowMethods("GET,POST", s.serveRestores))
+	mux.Handle(s.OperationStatusURL, allowMethods("POST", s.serveOperationStatus))
+}
+
+// Handler returns a http.Handler that serves all endpoints of the service.
+func (s *datastoreRestoreService) Handler() http.Handler {
+	mux := http.NewServeMux()
+	s.SetupWithMux(mux)
+	return mux
+}
+
+// newContext returns App Engine context that carries Logger of the service.
+func (s *datastoreRestoreService) newContext(r *http.Request) context.Context {
+	return withLogger(appengine.NewContext(r), s.Logger)
+}
+
+func (s *datastoreRestoreService) serveListBackups(w http.ResponseWriter, r *http.Request) {
+	c := s.newContext(r)
+
+	if !serveAuthorized(c, w, r, s.APIAuthorizer) {
+		return
+	}
+
+	req, err := DecodeReqListBaseFromRequest(r)
+	if err != nil {
+		writeError(w, newHTTPError(http.StatusBadRequest, "%s", err))
+		return
+	}
+
+	resp, err := s.HandleListBackups(c, req)
+	if err != nil {
+		logError(c, "ds2bq: failed to list backups", F(FieldError, err))
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *datastoreRestoreService) serveRestores(w http.ResponseWriter, r *http.Request) {
+	c := s.newContext(r)
+
+	if !serveAuthorized(c, w, r, s.APIAuthorizer) {
+		return
+	}
+
+	if r.Method == "GET" {
+		req, err := DecodeReqListBaseFromRequest(r)
+		if err != nil {
+			writeError(w, newHTTPError(http.StatusBadRequest, "%s", err))
+			return
+		}
+
+		resp, err := s.HandleListRestores(c, req)
+		if err != nil {
+			logError(c, "ds2bq: failed to list restores", F(FieldError, err))
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	req, err := DecodeRestoreReq(r.Body)
+	if err != nil {
+		writeError(w, newHTTPError(http.StatusBadRequest, "%s", err))
+		return
+	}
+	defer r.Body.Close()
+
+	resp, err := s.HandleRestore(c, req)
+	if err != nil {
+		logError(c, "ds2bq: failed to restore", F(FieldError, err))
+		writeError(w, err)
+		return
+	}
+	if resp.Restore.State == RestoreStatePending {
+		writeJSON(w, http.StatusAccepted, resp)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *datastoreRestoreService) serveOperationStatus(w http.ResponseWriter, r *http.Request) {
+	c := s.newContext(r)
+
+	if !serveAuthorized(c, w, r, s.TaskAuthorizer) {
+		return
+	}
+
+	req, err := DecodeRestoreOperationStatusReq(r.Body)
+	if err != nil {
+		logError(c, "ds2bq: failed to decode request", F(FieldError, err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	_, err = s.HandleOperationStatus(c, req)
+	if err != nil {
+		logError(c, "ds2bq: failed to check restore operation", F(FieldError, err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// RestorableBackup is a managed export that can be restored.
+type RestorableBackup struct {
+	// InputURL is the URL of .overall_export_metadata file.
+	InputURL    string    `json:"inputUrl"`
+	TimeCreated time.Time `json:"timeCreated"`
+}
+
+// RestorableBackupListResp provides response of restorable backups.
+type RestorableBackupListResp struct {
+	List []*RestorableBackup `json:"list"`
+	RespListBase
+}
+
+// HandleListBackups lists managed exports in the bucket, newest first.
+// Exports are listed by the prefixes of them like 2017-11-14T06:47:01_23208/, not by all objects in the bucket.
+// Cursor is the prefix of the last export of the previous page.
+func (s *datastoreRestoreService) HandleListBackups(c context.Context, req *ReqListBase) (*RestorableBackupListResp, error) {
+	c = withLogger(c, s.Logger)
+
+	limit := req.Limit
+	if limit <= 0 {
+		limit = 10
+	}
+
+	sts, err := newStorageService(c)
+	if err != nil {
+		return nil, err
+	}
+	prefixes, err := listPrefixes(c, sts, s.BucketName, "")
+	if err != nil {
+		return nil, err
+	}
+	// prefixes start with the time of export, so reverse order is newest first.
+	sort.Sort(sort.Reverse(sort.StringSlice(prefixes)))
+
+	resp := &RestorableBackupListResp{List: []*RestorableBackup{}}
+	skip := req.Offset
+	for _, prefix := range prefixes {
+		if req.Cursor != "" && prefix >= req.Cursor {
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		if len(resp.List) == limit {
+			break
+		}
+
+		// the export that is running or failed has no .overall_export_metadata.
+		name := prefix + path.Base(prefix) + ".overall_export_metadata"
+		obj, err := sts.Objects.Get(s.BucketName, name).Context(c).Do()
+		if isNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		t, _ := time.Parse(time.RFC3339, obj.TimeCreated)
+		resp.List = append(resp.List, &RestorableBackup{
+			InputURL:    "gs://" + s.BucketName + "/" + name,
+			TimeCreated: t,
+		})
+		resp.Cursor = prefix
+	}
+
+	return resp, nil
+}
+
+// RestoreOperationListResp provides response of restores.
+type RestoreOperationListResp struct {
+	List []*RestoreOperation `json:"list"`
+	RespListBase
+}
+
+// HandleListRestores lists restores, newest first.
+func (s *datastoreRestoreService) HandleListRestores(c context.Context, req *ReqListBase) (*RestoreOperationListResp, error) {
+	c = withLogger(c, s.Logger)
+
+	limit := req.Limit
+	if limit <= 0 {
+		limit = 10
+	}
+	store := &AEDatastoreStore{}
+	list, err := store.ListRestoreOperations(c, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RestoreOperationListResp{List: list}, nil
+}
+
+// RestoreReq provides request of restore.
+// Without ID, it requests a new restore with InputURL, EntityFilter and ProjectID.
+// With ID and ConfirmationToken, it confirms and starts the requested restore.
+type RestoreReq struct {
+	ID                int64         `json:"id,string"`
+	ConfirmationToken string        `json:"confirmationToken"`
+	InputURL          string        `json:"inputUrl"`
+	EntityFilter      *EntityFilter `json:"entityFilter"`
+	ProjectID         string        `json:"projectId"`
+}
+
+// RestoreResp provides response of restore.
+type RestoreResp struct {
+	Restore *RestoreOperation `json:"restore"`
+	// ConfirmationToken is returned only when the restore is requested.
+	ConfirmationToken string `json:"confirmationToken,omitempty"`
+}
+
+// HandleRestore requests or confirms a restore.
+func (s *datastoreRestoreService) HandleRestore(c context.Context, req *RestoreReq) (*RestoreResp, error) {
+	c = withLogger(c, s.Logger)
+
+	if req.ID == 0 {
+		return s.requestRestore(c, req)
+	}
+	return s.confirmRestore(c, req)
+}
+
+func (s *datastoreRestoreService) requestRestore(c context.Context, req *RestoreReq) (*RestoreResp, error) {
+	if err := s.validateInputURL(req.InputURL); err != nil {
+		return nil, err
+	}
+
+	token, err := newConfirmationToken()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	op := &RestoreOperation{
+		ProjectID:         req.ProjectID,
+		InputURL:          req.InputURL,
+		State:             RestoreStatePending,
+		ConfirmationToken: token,
+		CreatedAt:         now,
+		ExpiresAt:         now.Add(restoreConfirmationTTL),
+		UpdatedAt:         now,
+	}
+	if op.ProjectID == "" {
+		op.ProjectID = appengine.AppID(c)
+	}
+	if req.EntityFilter != nil {
+		op.Kinds = req.EntityFilter.Kinds
+		op.NamespaceIDs = req.EntityFilter.NamespaceIds
+	}
+
+	store := &AEDatastoreStore{}
+	err = store.PutRestoreOperation(c, op)
+	if err != nil {
+		return nil, err
+	}
+	logInfo(c, "ds2bq: restore requested", F("restoreID", op.ID), F("inputUrl", op.InputURL), F("projectId", op.ProjectID), F("kinds", op.Kinds))
+
+	return &RestoreResp{Restore: op, ConfirmationToken: token}, nil
+}
+
+func (s *datastoreRestoreService) confirmRestore(c context.Context, req *RestoreReq) (*RestoreResp, error) {
+	store := &AEDatastoreStore{}
+	op, err := store.ConfirmRestoreOperation(c, req.ID, req.ConfirmationToken, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	filter := &EntityFilter{Kinds: op.Kinds, NamespaceIds: op.NamespaceIDs}
+	lro, err := s.Export.Import(c, op.ProjectID, op.InputURL, filter)
+	if err != nil {
+		op.State = RestoreStateFailed
+		op.Error = err.Error()
+		op.UpdatedAt = time.Now()
+		if perr := store.PutRestoreOperation(c, op); perr != nil {
+			logError(c, "ds2bq: failed to save restore", F("restoreID", op.ID), F(FieldError, perr))
+		}
+		return nil, err
+	}
+	op.update(lro, time.Now())
+	logInfo(c, "ds2bq: restore started", F("restoreID", op.ID), F("operation", op.OperationName))
+
+	// the task carries the operation, so the restore is tracked even if it is not saved below.
+	err = s.addOperationStatusTask(c, op)
+	if err != nil {
+		logError(c, "ds2bq: failed to add task of restore", F("restoreID", op.ID), F("operation", op.OperationName), F(FieldError, err))
+	}
+	for i := 0; i < restorePutAttempts; i++ {
+		err = store.PutRestoreOperation(c, op)
+		if err == nil {
+			break
+		}
+		logWarning(c, "ds2bq: failed to save restore", F("restoreID", op.ID), F("operation", op.OperationName), F(FieldError, err))
+	}
+
+	return &RestoreResp{Restore: op}, nil
+}
+
+// validateInputURL checks that the URL is .overall_export_metadata file in the bucket of the service.
+func (s *datastoreRestoreService) validateInputURL(inputURL string) error {
+	prefix := "gs://" + s.BucketName + "/"
+	if !strings.HasPrefix(inputURL, prefix) || !strings.HasSuffix(inputURL, ".overall_export_metadata") {
+		return newHTTPError(http.StatusBadRequest, "inputUrl must be .overall_export_metadata file in %s", prefix)
+	}
+	return nil
+}
+
+// restoreStatusInterval is the interval of polling import operation.
+const restoreStatusInterval = time.Minute
+
+// restorePutAttempts is the number of tries of saving the restore after its import started.
+const restorePutAttempts = 3
+
+// RestoreOperationStatusReq provides request of checking import operation of the restore.
+type RestoreOperationStatusReq struct {
+	ID int64 `json:"id,string"`
+	// OperationName is the import operation of the restore, used if the restore is not saved after the import started.
+	OperationName string `json:"operationName,omitempty"`
+}
+
+func (s *datastoreRestoreService) addOperationStatusTask(c context.Context, op *RestoreOperation) error {
+	req := &RestoreOperationStatusReq{ID: op.ID, OperationName: op.OperationName}
+	_, err := addJSONTask(c, "", s.OperationStatusURL, s.QueueName, req, restoreStatusInterval)
+	return err
+}
+
+// HandleOperationStatus updates the restore by its import operation, and checks again later until the operation is done.
+func (s *datastoreRestoreService) HandleOperationStatus(c context.Context, req *RestoreOperationStatusReq) (*Noop, error) {
+	c = withLogger(c, s.Logger)
+
+	store := &AEDatastoreStore{}
+	op, err := store.GetRestoreOperation(c, req.ID)
+	if err != nil {
+		return nil, err
+	}
+	if op.State == RestoreStateStarting && req.OperationName != "" {
+		// the import started, but the restore was not saved.
+		op.OperationName = req.OperationName
+		op.State = RestoreStateRunning
+	}
+	if op.State != RestoreStateRunning {
+		return &Noop{}, nil
+	}
+
+	lro, err := s.Export.Operation(c, op.OperationName)
+	if err != nil {
+		return nil, err
+	}
+	op.update(lro, time.Now())
+
+	err = store.PutRestoreOperation(c, op)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.State {
+	case RestoreStateRunning:
+		logInfo(c, "ds2bq: restore is running", F("restoreID", op.ID), F("completed", op.EntitiesCompleted), F("estimated", op.EntitiesEstimated))
+		err = s.addOperationStatusTask(c, op)
+		if err != nil {
+			return nil, err
+		}
+	case RestoreStateFailed:
+		logWarning(c, "ds2bq: restore failed", F("restoreID", op.ID), F(FieldError, op.Error))
+	default:
+		logInfo(c, "ds2bq: restore done", F("restoreID", op.ID), F("completed", op.EntitiesCompleted))
+	}
+
+	return &Noop{}, nil
+}
@@ -30,4 +30,17 @@ func init() {
 	targetKinds := []string{"Article", "User"}
 	http.HandleFunc(apiReceiveOCN, ds2bq.ReceiveOCNHandleFunc(bucketName, queueName, tqImportBigQuery, targetKinds)) // from GCS, This API must not requires admin role.
 	http.HandleFunc(tqImportBigQuery, ds2bq.ImportBigQueryHandleFunc(datasetID))
+
+	// or, with all service options
+	s, err := ds2bq.NewGCSWatcherService(
+		ds2bq.GCSWatcherWithURLs("/ds2bq/api/gcs/object-change-notification", "/ds2bq/tq/gcs/object-to-bq"),
+		ds2bq.GCSWatcherWithBackupBucketName(bucketName),
+		ds2bq.GCSWatcherWithDatasetID(datasetID),
+		ds2bq.GCSWatcherWithQueueName(queueName),
+		ds2bq.GCSWatcherWithTargetKindNames(targetKinds...),
+	)
+	if err != nil {
+		panic(err)
+	}
+	http.Handle("/ds2bq/", s.Handler())
 }
@@ -0,0 +1,157 @@
+package ds2bq
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"golang.org/x/oauth2/google"
+	dsapi "google.golang.org/api/datastore/v1beta1"
+	"google.golang.org/api/googleapi"
+)
+
+// https://cloud.google.com/firestore/docs/manage-data/export-import
+
+// ErrFirestoreAllCollections is returned for the export of all collections,
+// because BigQuery loads only exports of specified collection groups.
+var ErrFirestoreAllCollections = errors.New("ds2bq: export of all collections can not be loaded into BigQuery, specify collection IDs")
+
+// FirestoreExport is the Firestore exports in the backup bucket that the watcher imports.
+type FirestoreExport struct {
+	// Prefix of the objects of exports in the bucket like "firestore/", that tells Firestore exports apart
+	// from managed exports of Datastore. required.
+	Prefix string
+	// Collections are the collection groups to import.
+	Collections []string
+	// DatasetID is the dataset that collections are loaded into. default is the dataset of the watcher.
+	DatasetID string
+}
+
+type gcsWatcherFirestoreExportOption struct {
+	FirestoreExport *FirestoreExport
+}
+
+func (o *gcsWatcherFirestoreExportOption) implements(s *gcsWatcherService) {
+	s.FirestoreExport = o.FirestoreExport
+}
+
+// GCSWatcherWithFirestoreExport provides that exports of Firestore collection groups are imported too.
+func GCSWatcherWithFirestoreExport(e *FirestoreExport) GCSWatcherOption {
+	return &gcsWatcherFirestoreExportOption{
+		FirestoreExport: e,
+	}
+}
+
+func (e *FirestoreExport) validate() error {
+	if e.Prefix == "" {
+		return errors.New("ds2bq: Prefix of FirestoreExport is required")
+	}
+	if len(e.Collections) == 0 {
+		return errors.New("ds2bq: Collections of FirestoreExport is required")
+	}
+	return nil
+}
+
+// isAllKindsExport reports whether the object is the metadata of the export of all kinds or collections
+// like 2017-11-14T06:47:01_23208/all_namespaces/all_kinds/all_namespaces_all_kinds.export_metadata.
+func isAllKindsExport(name string) bool {
+	return strings.HasSuffix(name, ".export_metadata") && path.Base(path.Dir(name)) == "all_kinds"
+}
+
+// FirestoreExportService serves export of Firestore in native mode.
+type FirestoreExportService interface {
+	// Export exports the collection groups. collectionIDs are required, see ErrFirestoreAllCollections.
+	Export(c context.Context, outputGCSPrefix string, collectionIDs []string) (*dsapi.GoogleLongrunningOperation, error)
+	Operation(c context.Context, name string) (*dsapi.GoogleLongrunningOperation, error)
+}
+
+// NewFirestoreExportService returns ready to use FirestoreExportService.
+func NewFirestoreExportService(opts ...ExportOption) FirestoreExportService {
+	return &firestoreExportService{exportSettings: newExportSettings(opts...)}
+}
+
+type firestoreExportService struct {
+	exportSettings
+}
+
+func (s *firestoreExportService) Export(c context.Context, outputGCSPrefix string, collectionIDs []string) (*dsapi.GoogleLongrunningOperation, error) {
+	if len(collectionIDs) == 0 {
+		return nil, ErrFirestoreAllCollections
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"collectionIds":   collectionIDs,
+		"outputUriPrefix": outputGCSPrefix,
+	})
+	if err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("projects/%s/databases/(default)", s.projectID(c))
+	return s.do(c, "POST", name+":exportDocuments", body)
+}
+
+// Operation returns the long-running operation of export.
+// name is like projects/my-project/databases/(default)/operations/ASA1MTAwNDQxNAgadGx1YWZlZBIxbGFyZ... returned by Export.
+func (s *firestoreExportService) Operation(c context.Context, name string) (*dsapi.GoogleLongrunningOperation, error) {
+	return s.do(c, "GET", name, nil)
+}
+
+// do calls Firestore v1 API. The response of long-running operation is same as Datastore API.
+func (s *firestoreExportService) do(c context.Context, method, name string, body []byte) (*dsapi.GoogleLongrunningOperation, error) {
+	client, err := google.DefaultClient(c, dsapi.DatastoreScope)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(method, "https://firestore.googleapis.com/v1/"+name, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req.WithContext(c))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	err = googleapi.CheckResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	op := &dsapi.GoogleLongrunningOperation{}
+	err = json.NewDecoder(resp.Body).Decode(op)
+	if err != nil {
+		return nil, err
+	}
+	return op, nil
+}
+
+// targetNames returns collections of FirestoreExport for Firestore exports, or target kinds for the other sources.
+// Kinds and collections are kept apart, so that a kind is not imported because a collection has the same name.
+func (s *gcsWatcherService) targetNames(source string) []string {
+	if source == BackupSourceFirestoreExport && s.FirestoreExport != nil {
+		return s.FirestoreExport.Collections
+	}
+	return s.ImportTargetKindNames
+}
+
+// exportSource returns the source of the managed export that the object belongs to.
+func (s *gcsWatcherService) exportSource(name string) string {
+	if s.FirestoreExport != nil && strings.HasPrefix(name, s.FirestoreExport.Prefix) {
+		return BackupSourceFirestoreExport
+	}
+	return BackupSourceDatastoreExport
+}
+
+// datasetIDOf returns the dataset that backups of the source are imported into.
+func (s *gcsWatcherService) datasetIDOf(source string) string {
+	if e := s.FirestoreExport; e != nil && e.DatasetID != "" && source == BackupSourceFirestoreExport {
+		return e.DatasetID
+	}
+	return s.DatasetID
+}
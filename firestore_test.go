@@ -0,0 +1,79 @@
+package ds2bq
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFirestoreExportService_ExportAllCollections(t *testing.T) {
+	_, err := NewFirestoreExportService().Export(context.Background(), "gs://backup/firestore", nil)
+	if e, g := ErrFirestoreAllCollections, err; e != g {
+		t.Errorf("expected %v; got %v", e, g)
+	}
+}
+
+func TestGCSWatcherService_FirestoreExport(t *testing.T) {
+	s := newGCSWatcherService(
+		GCSWatcherWithDatasetID("datastore_imports"),
+		GCSWatcherWithTargetKindNames("Article"),
+		GCSWatcherWithFirestoreExport(&FirestoreExport{
+			Prefix:      "firestore/",
+			Collections: []string{"users"},
+			DatasetID:   "firestore_imports",
+		}),
+	)
+
+	obj := &GCSObject{
+		Bucket:      "backup",
+		Name:        "firestore/2019-01-01T00:00:00_12345/all_namespaces/kind_users/all_namespaces_kind_users.export_metadata",
+		TimeCreated: time.Date(2019, 1, 1, 0, 10, 0, 0, time.UTC),
+	}
+	if !containsString(s.targetNames(BackupSourceFirestoreExport), "users") {
+		t.Errorf("expected users to be a target")
+	}
+	if containsString(s.targetNames(BackupSourceDatastoreExport), "users") {
+		t.Errorf("expected users not to be a target kind")
+	}
+	if containsString(s.targetNames(BackupSourceFirestoreExport), "Article") {
+		t.Errorf("expected Article not to be a target collection")
+	}
+	if e, g := "firestore_imports", s.datasetIDOf(BackupSourceFirestoreExport); e != g {
+		t.Errorf("expected dataset %s; got %s", e, g)
+	}
+	if e, g := "datastore_imports", s.datasetIDOf(BackupSourceDatastoreExport); e != g {
+		t.Errorf("expected dataset %s; got %s", e, g)
+	}
+	if e, g := BackupSourceFirestoreExport, s.exportSource("firestore/2019-01-01T00:00:00_12345/2019-01-01T00:00:00_12345.overall_export_metadata"); e != g {
+		t.Errorf("expected source %s; got %s", e, g)
+	}
+	req := obj.toBQJobReq(s.kindExtractors())
+	if e, g := "users", req.KindName; e != g {
+		t.Errorf("expected kind %s; got %s", e, g)
+	}
+	if e, g := BackupSourceFirestoreExport, req.Source; e != g {
+		t.Errorf("expected source %s; got %s", e, g)
+	}
+
+	obj.Name = "2017-11-14T06:47:01_23208/all_namespaces/kind_Article/all_namespaces_kind_Article.export_metadata"
+	req = obj.toBQJobReq(s.kindExtractors())
+	if e, g := BackupSourceDatastoreExport, req.Source; e != g {
+		t.Errorf("expected source %s; got %s", e, g)
+	}
+}
+
+func TestFirestoreExport_validate(t *testing.T) {
+	for i, tc := range []struct {
+		export *FirestoreExport
+		ok     bool
+	}{
+		{&FirestoreExport{Prefix: "firestore/", Collections: []string{"users"}}, true},
+		{&FirestoreExport{Collections: []string{"users"}}, false},
+		{&FirestoreExport{Prefix: "firestore/"}, false},
+	} {
+		err := tc.export.validate()
+		if e, g := tc.ok, err == nil; e != g {
+			t.Errorf("%02d: expected %v; got %v", i, e, err)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package ds2bq
+
+import (
+	"context"
+	"time"
+
+	"github.com/mjibson/goon"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// freshnessBackupScanLimit is the number of the newest backup information scanned for the last backup of kinds.
+const freshnessBackupScanLimit = 1000
+
+// KindFreshness is the last backup and the last import of the kind tracked by GCSWatcherService.
+// LastImportTime is the time of the backup that is imported last, not the time of the import.
+// ID is made of the source and the kind by kindFreshnessID.
+type KindFreshness struct {
+	Kind           string    `goon:"kind,DS2BQKindFreshness" json:"-"`
+	ID             string    `datastore:"-" goon:"id" json:"id"`
+	Source         string    `json:"source"`
+	KindName       string    `json:"kind"`
+	LastBackupID   string    `json:"lastBackupId"`
+	LastBackupTime time.Time `json:"lastBackupTime"`
+	LastImportTime time.Time `json:"lastImportTime"`
+	UpdatedAt      time.Time `json:"updatedAt"`
+}
+
+// FreshnessSLO is the maximum age of the last backup and the last import of the kind.
+// Zero means the age is not checked.
+// Source is BackupSourceFirestoreExport for a collection of Firestore, or empty for a kind of Datastore.
+type FreshnessSLO struct {
+	Source       string
+	Kind         string
+	MaxBackupAge time.Duration
+	MaxImportAge time.Duration
+}
+
+// kindFreshnessID returns the ID of KindFreshness of the kind of the source.
+// Datastore Admin backups and managed exports of Datastore are tracked as the same kind,
+// and the ID is the kind alone, so that kinds tracked before Firestore are kept.
+func kindFreshnessID(source, kind string) string {
+	if source == BackupSourceFirestoreExport {
+		return source + "/" + kind
+	}
+	return kind
+}
+
+// KindFreshnessStatus is the freshness of the kind compared with FreshnessSLO.
+type KindFreshnessStatus struct {
+	Source         string    `json:"source,omitempty"`
+	Kind           string    `json:"kind"`
+	LastBackupTime time.Time `json:"lastBackupTime"`
+	LastImportTime time.Time `json:"lastImportTime"`
+	BackupStale    bool      `json:"backupStale"`
+	ImportStale    bool      `json:"importStale"`
+}
+
+// OK reports whether the kind is in the SLO.
+func (st *KindFreshnessStatus) OK() bool {
+	return !st.BackupStale && !st.ImportStale
+}
+
+// FreshnessReport is the result of checking freshness of all kinds.
+type FreshnessReport struct {
+	CheckedAt time.Time              `json:"checkedAt"`
+	OK        bool                   `json:"ok"`
+	Kinds     []*KindFreshnessStatus `json:"kinds"`
+}
+
+// staleKinds returns the kinds out of the SLO.
+func (r *FreshnessReport) staleKinds() []string {
+	var kinds []string
+	for _, st := range r.Kinds {
+		if !st.OK() {
+			kinds = append(kinds, kindFreshnessID(st.Source, st.Kind))
+		}
+	}
+	return kinds
+}
+
+type gcsWatcherFreshnessTrackingOption struct{}
+
+func (o *gcsWatcherFreshnessTrackingOption) implements(s *gcsWatcherService) {
+	s.FreshnessTracking = true
+}
+
+// GCSWatcherWithFreshnessTracking provides that the last backup and the last import of each kind are saved
+// for the freshness check of DatastoreManagementService.
+func GCSWatcherWithFreshnessTracking() GCSWatcherOption {
+	return &gcsWatcherFreshnessTrackingOption{}
+}
+
+type managementFreshnessSLOsOption struct {
+	FreshnessSLOs []*FreshnessSLO
+}
+
+func (o *managementFreshnessSLOsOption) implements(s *datastoreManagementService) {
+	s.FreshnessSLOs = append(s.FreshnessSLOs, o.FreshnessSLOs...)
+}
+
+// ManagementWithFreshnessSLOs provides SLOs of kinds of Datastore and collections of Firestore.
+// The endpoint that checks them is registered, and old backups are not removed while a kind is out of the SLO.
+// Imports are tracked by GCSWatcherWithFreshnessTracking.
+func ManagementWithFreshnessSLOs(slos ...*FreshnessSLO) ManagementOption {
+	return &managementFreshnessSLOsOption{
+		FreshnessSLOs: slos,
+	}
+}
+
+type managementFreshnessURLOption struct {
+	CheckFreshnessURL string
+}
+
+func (o *managementFreshnessURLOption) implements(s *datastoreManagementService) {
+	if v := o.CheckFreshnessURL; v != "" {
+		s.CheckFreshnessURL = v
+	}
+}
+
+// ManagementWithFreshnessURL provides endpoint URL that cron requests to check freshness of kinds.
+func ManagementWithFreshnessURL(checkFreshnessURL string) ManagementOption {
+	return &managementFreshnessURLOption{
+		CheckFreshnessURL: checkFreshnessURL,
+	}
+}
+
+// UpdateKindFreshness applies f to KindFreshness of the kind of the source in a transaction, creates it if not exists.
+func (store *AEDatastoreStore) UpdateKindFreshness(c context.Context, source, kind string, f func(kf *KindFreshness)) error {
+	g := goon.FromContext(c)
+	return g.RunInTransaction(func(tg *goon.Goon) error {
+		kf := &KindFreshness{ID: kindFreshnessID(source, kind)}
+		err := tg.Get(kf)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		f(kf)
+		if source == BackupSourceFirestoreExport {
+			kf.Source = source
+		}
+		kf.KindName = kind
+		kf.UpdatedAt = time.Now()
+		_, err = tg.Put(kf)
+		return err
+	}, nil)
+}
+
+// GetKindFreshness returns KindFreshness of the kinds of the SLOs. Kinds that are never tracked have zero times.
+func (store *AEDatastoreStore) GetKindFreshness(c context.Context, slos []*FreshnessSLO) ([]*KindFreshness, error) {
+	g := goon.FromContext(c)
+	list := make([]*KindFreshness, len(slos))
+	for i, slo := range slos {
+		list[i] = &KindFreshness{ID: kindFreshnessID(slo.Source, slo.Kind)}
+	}
+	err := g.GetMulti(list)
+	if merr, ok := err.(appengine.MultiError); ok {
+		for _, err := range merr {
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				return nil, err
+			}
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// trackBackup records the backup of the kind received by OCN.
+func (s *gcsWatcherService) trackBackup(c context.Context, req *GCSObjectToBQJobReq) {
+	if !s.FreshnessTracking {
+		return
+	}
+	store := &AEDatastoreStore{}
+	err := store.UpdateKindFreshness(c, req.Source, req.KindName, func(kf *KindFreshness) {
+		if t := req.snapshotTime(); t.After(kf.LastBackupTime) {
+			kf.LastBackupTime = t
+			kf.LastBackupID = req.BackupID
+		}
+	})
+	if err != nil {
+		logWarning(c, "ds2bq: failed to track backup", F("source", req.Source), F(FieldKind, req.KindName), F(FieldError, err))
+	}
+}
+
+// trackImport records the time of the backup whose import of the kind completed.
+func (s *gcsWatcherService) trackImport(c context.Context, req *GCSObjectToBQJobReq) {
+	if !s.FreshnessTracking {
+		return
+	}
+	store := &AEDatastoreStore{}
+	err := store.UpdateKindFreshness(c, req.Source, req.KindName, func(kf *KindFreshness) {
+		// the age of imported data is the age of the backup, an old backup imported late does not make the kind fresh.
+		if t := req.snapshotTime(); t.After(kf.LastImportTime) {
+			kf.LastImportTime = t
+		}
+	})
+	if err != nil {
+		logWarning(c, "ds2bq: failed to track import", F("source", req.Source), F(FieldKind, req.KindName), F(FieldError, err))
+	}
+}
+
+// lastAEBackupTimes returns CompleteTime of the newest Datastore Admin backup of each kind.
+func lastAEBackupTimes(c context.Context, kinds []string) (map[string]time.Time, error) {
+	g := goon.FromContext(c)
+
+	qb := newAEBackupInformationQueryBuilder()
+	qb.CompleteTime.Desc()
+	q := qb.Query().Limit(freshnessBackupScanLimit)
+
+	times := make(map[string]time.Time)
+	it := g.Run(q)
+	for len(times) < len(kinds) {
+		info := &AEBackupInformation{}
+		_, err := it.Next(info)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		for _, kind := range info.Kinds {
+			if _, ok := times[kind]; !ok && containsString(kinds, kind) {
+				times[kind] = info.CompleteTime
+			}
+		}
+	}
+	return times, nil
+}
+
+// evaluateFreshness compares the last backup and the last import of the kind with the SLO at now.
+// The kind that has never been backed up or imported is stale.
+func evaluateFreshness(slo *FreshnessSLO, lastBackup, lastImport, now time.Time) *KindFreshnessStatus {
+	return &KindFreshnessStatus{
+		Source:         slo.Source,
+		Kind:           slo.Kind,
+		LastBackupTime: lastBackup,
+		LastImportTime: lastImport,
+		BackupStale:    slo.MaxBackupAge > 0 && now.Sub(lastBackup) > slo.MaxBackupAge,
+		ImportStale:    slo.MaxImportAge > 0 && now.Sub(lastImport) > slo.MaxImportAge,
+	}
+}
+
+// checkFreshness returns the freshness of the kinds of the SLOs.
+// The last backup of a kind of Datastore is the newer of the Datastore Admin backup information and the tracked backup.
+// If notify is true, kinds out of the SLO are logged and notified to the observer.
+func checkFreshness(c context.Context, slos []*FreshnessSLO, observer Observer, notify bool) (*FreshnessReport, error) {
+	var kinds []string
+	for _, slo := range slos {
+		if slo.Source != BackupSourceFirestoreExport {
+			kinds = append(kinds, slo.Kind)
+		}
+	}
+
+	backupTimes, err := lastAEBackupTimes(c, kinds)
+	if err != nil {
+		return nil, err
+	}
+	store := &AEDatastoreStore{}
+	tracked, err := store.GetKindFreshness(c, slos)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	report := &FreshnessReport{CheckedAt: now, OK: true}
+	for i, slo := range slos {
+		var lastBackup time.Time
+		if slo.Source != BackupSourceFirestoreExport {
+			lastBackup = backupTimes[slo.Kind]
+		}
+		if tracked[i].LastBackupTime.After(lastBackup) {
+			lastBackup = tracked[i].LastBackupTime
+		}
+		st := evaluateFreshness(slo, lastBackup, tracked[i].LastImportTime, now)
+		report.Kinds = append(report.Kinds, st)
+		if st.OK() {
+			continue
+		}
+		report.OK = false
+		if notify {
+			logError(c, "ds2bq: kind is out of freshness SLO", F("source", st.Source), F(FieldKind, st.Kind), F("lastBackupTime", st.LastBackupTime), F("lastImportTime", st.LastImportTime), F("backupStale", st.BackupStale), F("importStale", st.ImportStale))
+			observer.OnFreshnessViolated(c, st)
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,78 @@
+package ds2bq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/favclip/testerator"
+)
+
+func TestEvaluateFreshness(t *testing.T) {
+	now := time.Date(2018, 1, 2, 0, 0, 0, 0, time.UTC)
+	slo := &FreshnessSLO{Kind: "Article", MaxBackupAge: 26 * time.Hour, MaxImportAge: 27 * time.Hour}
+
+	for i, tc := range []struct {
+		lastBackup  time.Time
+		lastImport  time.Time
+		backupStale bool
+		importStale bool
+	}{
+		{now.Add(-25 * time.Hour), now.Add(-26 * time.Hour), false, false},
+		{now.Add(-27 * time.Hour), now.Add(-26 * time.Hour), true, false},
+		{now.Add(-25 * time.Hour), now.Add(-28 * time.Hour), false, true},
+		{time.Time{}, time.Time{}, true, true},
+	} {
+		st := evaluateFreshness(slo, tc.lastBackup, tc.lastImport, now)
+		if e, g := tc.backupStale, st.BackupStale; e != g {
+			t.Errorf("%02d: expected %v; got %v", i, e, g)
+		}
+		if e, g := tc.importStale, st.ImportStale; e != g {
+			t.Errorf("%02d: expected %v; got %v", i, e, g)
+		}
+		if e, g := !tc.backupStale && !tc.importStale, st.OK(); e != g {
+			t.Errorf("%02d: expected %v; got %v", i, e, g)
+		}
+	}
+
+	st := evaluateFreshness(&FreshnessSLO{Kind: "User", MaxBackupAge: time.Hour}, now, time.Time{}, now)
+	if !st.OK() {
+		t.Errorf("expected import not to be checked")
+	}
+}
+
+func TestAEDatastoreStore_UpdateKindFreshness(t *testing.T) {
+	_, c, err := testerator.SpinUp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testerator.SpinDown()
+
+	backupTime := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := &AEDatastoreStore{}
+	for _, source := range []string{BackupSourceDatastoreExport, BackupSourceFirestoreExport} {
+		err := store.UpdateKindFreshness(c, source, "User", func(kf *KindFreshness) {
+			kf.LastBackupTime = backupTime
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		backupTime = backupTime.Add(time.Hour)
+	}
+
+	list, err := store.GetKindFreshness(c, []*FreshnessSLO{
+		{Kind: "User"},
+		{Source: BackupSourceFirestoreExport, Kind: "User"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := "User", list[0].ID; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	if e, g := "firestore_export/User", list[1].ID; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	if list[0].LastBackupTime.Equal(list[1].LastBackupTime) {
+		t.Errorf("expected the kind and the collection to be tracked apart")
+	}
+}
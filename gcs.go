@@ -0,0 +1,78 @@
+package ds2bq
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"google.golang.org/api/storage/v1"
+)
+
+func newStorageService(c context.Context) (*storage.Service, error) {
+	return storage.New(newGoogleClient(c, storage.DevstorageReadWriteScope))
+}
+
+// openObject returns the content of the GCS object.
+func openObject(c context.Context, sts *storage.Service, bucket, name string) (io.ReadCloser, error) {
+	resp, err := sts.Objects.Get(bucket, name).Context(c).Download()
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// listObjects returns the names of GCS objects that have the prefix.
+func listObjects(c context.Context, sts *storage.Service, bucket, prefix string) ([]string, error) {
+	var names []string
+	err := sts.Objects.List(bucket).Prefix(prefix).Pages(c, func(objs *storage.Objects) error {
+		for _, obj := range objs.Items {
+			names = append(names, obj.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// listPrefixes returns the prefixes of objects under prefix up to the next "/", like directories.
+func listPrefixes(c context.Context, sts *storage.Service, bucket, prefix string) ([]string, error) {
+	var prefixes []string
+	err := sts.Objects.List(bucket).Prefix(prefix).Delimiter("/").Fields("nextPageToken", "prefixes").Pages(c, func(objs *storage.Objects) error {
+		prefixes = append(prefixes, objs.Prefixes...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return prefixes, nil
+}
+
+// listDirectoryObjects returns the names of GCS objects in the directory like path/, not under sub directories.
+func listDirectoryObjects(c context.Context, sts *storage.Service, bucket, dir string) ([]string, error) {
+	var names []string
+	err := sts.Objects.List(bucket).Prefix(dir).Delimiter("/").Fields("nextPageToken", "items(name)").Pages(c, func(objs *storage.Objects) error {
+		for _, obj := range objs.Items {
+			names = append(names, obj.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// parseGSPath splits the path like /gs/bucket/object into bucket and object name.
+func parseGSPath(path string) (string, string, error) {
+	if !strings.HasPrefix(path, "/gs/") {
+		return "", "", fmt.Errorf("ds2bq: unexpected GCS path %s", path)
+	}
+	ss := strings.SplitN(strings.TrimPrefix(path, "/gs/"), "/", 2)
+	if len(ss) != 2 || ss[0] == "" || ss[1] == "" {
+		return "", "", fmt.Errorf("ds2bq: unexpected GCS path %s", path)
+	}
+	return ss[0], ss[1], nil
+}
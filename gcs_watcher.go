@@ -2,27 +2,22 @@ package ds2bq
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
 	"google.golang.org/api/bigquery/v2"
 	"google.golang.org/appengine"
-	"google.golang.org/appengine/log"
-	"google.golang.org/appengine/taskqueue"
-	"google.golang.org/appengine/urlfetch"
 )
 
-// ExtractKindName extracts kind name from the object name.
+// ExtractKindName extracts kind name from the object name by DefaultKindExtractors.
 func (obj *GCSObject) ExtractKindName() string {
-	if id := obj.extractKindNameForDatastoreAdmin(obj.Name); len(id) > 0 {
-		return id
-	}
-	if id := obj.extractKindNameForDatastoreExport(obj.Name); len(id) > 0 {
-		return id
+	if info, ok := DefaultKindExtractors().ExtractKind(obj.Name); ok {
+		return info.Kind
 	}
 	return ""
 }
@@ -59,52 +54,109 @@ func (obj *GCSObject) extractKindNameForDatastoreExport(name string) string {
 	if v := strings.LastIndex(name, "/"); v != -1 {
 		name = name[v:]
 	}
+	if !strings.HasPrefix(name, "/kind_") {
+		// all_kinds of the export without entity filter.
+		return ""
+	}
 
 	return name[len("/kind_"):]
 }
 
+// ExtractNamespaceName extracts namespace from the object name of managed export.
+// It returns empty for the default namespace, all namespaces or Datastore Admin backup.
+func (obj *GCSObject) ExtractNamespaceName() string {
+	for _, v := range strings.Split(obj.Name, "/") {
+		if strings.HasPrefix(v, "namespace_") {
+			return v[len("namespace_"):]
+		}
+	}
+	return ""
+}
+
 // IsRequiredKind reports whether the GCSObject is related required kind.
 func (obj *GCSObject) IsRequiredKind(requires []string) bool {
-	kindName := obj.ExtractKindName()
-	for _, k := range requires {
-		if k == kindName {
-			return true
-		}
+	return containsString(requires, obj.ExtractKindName())
+}
+
+// ImportDecision is the result of checking whether the object of OCN is imported.
+type ImportDecision struct {
+	Accepted bool `json:"accepted"`
+	// Reason is why the object is rejected, or empty if it is accepted.
+	Reason SkipReason `json:"reason,omitempty"`
+	// Kinds are the kind of the backup file, or kinds imported by the overall export metadata.
+	Kinds []string `json:"kinds,omitempty"`
+}
+
+// IsImportTarget returns the decision whether the GCSObject is an import target.
+func (obj *GCSObject) IsImportTarget(c context.Context, r *http.Request, bucketName string, kindNames []string) *ImportDecision {
+	return obj.decideImportTarget(c, r, bucketName, kindNames, DefaultKindExtractors())
+}
+
+func (obj *GCSObject) decideImportTarget(c context.Context, r *http.Request, bucketName string, kindNames []string, extractors KindExtractors) *ImportDecision {
+	reason := obj.checkImportTarget(r, bucketName, kindNames, extractors)
+	decision := &ImportDecision{Accepted: reason == "", Reason: reason}
+	if info, ok := extractors.ExtractKind(obj.Name); ok {
+		decision.Kinds = []string{info.Kind}
+	}
+
+	switch reason {
+	case "":
+		logInfo(c, "ds2bq: object should be imported", F(FieldBucket, obj.Bucket), F(FieldObject, obj.Name))
+	case SkipReasonUnexpectedBucket:
+		logInfo(c, "ds2bq: unexpected bucket", F(FieldBucket, obj.Bucket), F(FieldObject, obj.Name))
+	case SkipReasonUnexpectedState:
+		logInfo(c, "ds2bq: unexpected state", F(FieldBucket, obj.Bucket), F(FieldObject, obj.Name), F("state", NewGCSHeader(r).ResourceState))
+	case SkipReasonNotBackupFile:
+		logInfo(c, "ds2bq: this is not backup file", F(FieldBucket, obj.Bucket), F(FieldObject, obj.Name))
+	case SkipReasonNotLoadable:
+		logWarning(c, "ds2bq: export of all kinds can not be loaded into BigQuery, export with kinds or collection IDs", F(FieldBucket, obj.Bucket), F(FieldObject, obj.Name))
+	case SkipReasonNotRequiredKind:
+		logInfo(c, "ds2bq: not required kind", F(FieldBucket, obj.Bucket), F(FieldObject, obj.Name), F(FieldKind, decision.Kinds[0]))
 	}
-	return false
+	return decision
 }
 
-// IsImportTarget reports whether the GCSObject is an import target.
-func (obj *GCSObject) IsImportTarget(c context.Context, r *http.Request, bucketName string, kindNames []string) bool {
+// checkImportTarget returns the reason why the GCSObject is not an import target, or empty if it is.
+func (obj *GCSObject) checkImportTarget(r *http.Request, bucketName string, kindNames []string, extractors KindExtractors) SkipReason {
 	if bucketName != "" && obj.Bucket != bucketName {
-		log.Infof(c, "ds2bq: %s is unexpected bucket", obj.Bucket)
-		return false
+		return SkipReasonUnexpectedBucket
 	}
 	gcsHeader := NewGCSHeader(r)
 	if gcsHeader.ResourceState != "exists" {
-		log.Infof(c, "ds2bq: %s is unexpected state", gcsHeader.ResourceState)
-		return false
+		return SkipReasonUnexpectedState
+	}
+	if isAllKindsExport(obj.Name) {
+		return SkipReasonNotLoadable
 	}
-	if obj.ExtractKindName() == "" {
-		log.Infof(c, "ds2bq: this is not backup file: %s", obj.Name)
-		return false
+	info, ok := extractors.ExtractKind(obj.Name)
+	if !ok {
+		return SkipReasonNotBackupFile
 	}
-	if !obj.IsRequiredKind(kindNames) {
-		log.Infof(c, "ds2bq: %s is not required kind", obj.ExtractKindName())
-		return false
+	if !containsString(kindNames, info.Kind) {
+		return SkipReasonNotRequiredKind
 	}
-	log.Infof(c, "ds2bq: %s should imports", obj.Name)
-	return true
+	return ""
 }
 
 // ToBQJobReq creates a new GCSObjectToBQJobReq from the object.
 func (obj *GCSObject) ToBQJobReq() *GCSObjectToBQJobReq {
-	return &GCSObjectToBQJobReq{
+	return obj.toBQJobReq(DefaultKindExtractors())
+}
+
+func (obj *GCSObject) toBQJobReq(extractors KindExtractors) *GCSObjectToBQJobReq {
+	req := &GCSObjectToBQJobReq{
 		Bucket:      obj.Bucket,
 		FilePath:    obj.Name,
-		KindName:    obj.ExtractKindName(),
 		TimeCreated: obj.TimeCreated,
 	}
+	if info, ok := extractors.ExtractKind(obj.Name); ok {
+		req.KindName = info.Kind
+		req.Source = info.Source
+		req.Namespace = info.Namespace
+		req.BackupID = info.BackupID
+		req.BackupTime = info.BackupTime
+	}
+	return req
 }
 
 // GCSHeader is a header in OCN.
@@ -130,46 +182,124 @@ func NewGCSHeader(r *http.Request) *GCSHeader {
 
 // ReceiveOCN is Process payload of Object Change Notification
 func ReceiveOCN(c context.Context, obj *GCSObject, queueName, path string) error {
-	req := obj.ToBQJobReq()
-	b, err := json.MarshalIndent(req, "", "  ")
-	if err != nil {
-		return err
+	return receiveOCN(c, obj.ToBQJobReq(), queueName, path)
+}
+
+func receiveOCN(c context.Context, req *GCSObjectToBQJobReq, queueName, path string) error {
+	_, err := addJSONTask(c, "", path, queueName, req, 0)
+	return err
+}
+
+// Stages of import.
+const (
+	importStageLoad      = ""
+	importStageCopy      = "copy"
+	importStageRewrite   = "rewrite"
+	importStageHistory   = "history"
+	importStageTransform = "transform"
+	// importStageBatchTimeout checks the deadline of ImportBatch, it has no job.
+	importStageBatchTimeout = "batch_timeout"
+)
+
+// ImportJobStatusReq means request of checking status of BigQuery job in import.
+type ImportJobStatusReq struct {
+	Import    *GCSObjectToBQJobReq `json:"import"`
+	Stage     string               `json:"stage,omitempty"`
+	ProjectID string               `json:"projectID"`
+	JobID     string               `json:"jobID"`
+	LoadJobID string               `json:"loadJobID,omitempty"`
+	Location  string               `json:"location,omitempty"`
+	DatasetID string               `json:"datasetID"`
+	TableID   string               `json:"tableID"`
+	BatchID   string               `json:"batchID,omitempty"`
+	// RawDatasetID and RawTableID is the table that the load job loads into, and rewritten into TableID by ColumnPolicy.
+	RawDatasetID string `json:"rawDatasetID,omitempty"`
+	RawTableID   string `json:"rawTableID,omitempty"`
+	// Projected reports whether excluded properties of ColumnPolicy are dropped by the load job.
+	Projected bool `json:"projected,omitempty"`
+	// Attempts is the number of checks of the job that was not done.
+	Attempts int `json:"attempts,omitempty"`
+}
+
+// next returns ImportJobStatusReq of the job that continues in the stage.
+func (req *ImportJobStatusReq) next(stage string, jobRef *bigquery.JobReference) *ImportJobStatusReq {
+	return &ImportJobStatusReq{
+		Import:    req.Import,
+		Stage:     stage,
+		ProjectID: jobRef.ProjectId,
+		JobID:     jobRef.JobId,
+		LoadJobID: req.loadJobID(),
+		Location:  jobRef.Location,
+		DatasetID: req.DatasetID,
+		TableID:   req.TableID,
+		BatchID:   req.BatchID,
 	}
+}
 
-	h := make(http.Header)
-	h.Set("Content-Type", "application/json")
-	t := &taskqueue.Task{
-		Path:    path,
-		Payload: b,
-		Header:  h,
-		Method:  "POST",
+func (req *ImportJobStatusReq) loadJobID() string {
+	if req.LoadJobID != "" {
+		return req.LoadJobID
 	}
+	return req.JobID
+}
 
-	_, err = taskqueue.Add(c, t, queueName)
-	return err
+// stageJobReference returns the reference of the job of the stage derived from the load job,
+// so that a retried task does not run the stage twice.
+func (req *ImportJobStatusReq) stageJobReference(stage string) *bigquery.JobReference {
+	return &bigquery.JobReference{
+		ProjectId: req.ProjectID,
+		JobId:     req.loadJobID() + "_" + stage,
+		Location:  req.Location,
+	}
 }
 
-func insertImportJob(c context.Context, req *GCSObjectToBQJobReq, datasetID string) error {
-	log.Infof(c, "ds2bq: bucket: %s, filePath: %s, timeCreated: %s", req.Bucket, req.FilePath, req.TimeCreated)
+func (s *gcsWatcherService) insertImportJob(c context.Context, req *GCSObjectToBQJobReq) error {
+	fields := []Field{F(FieldBucket, req.Bucket), F(FieldObject, req.FilePath), F(FieldKind, req.KindName), F("timeCreated", req.TimeCreated)}
+	logInfo(c, "ds2bq: import object", fields...)
 
 	if req.Bucket == "" || req.FilePath == "" || req.KindName == "" {
-		log.Warningf(c, "ds2bq: unexpected parameters %#v", req)
+		logWarning(c, "ds2bq: unexpected parameters", fields...)
 		return nil
 	}
 
-	client := &http.Client{
-		Transport: &oauth2.Transport{
-			Source: google.AppEngineTokenSource(c, bigquery.BigqueryScope),
-			Base:   &urlfetch.Transport{Context: c},
-		},
+	datasetID := s.datasetIDOf(req.Source)
+	var batchID string
+	if s.StagingDatasetID != "" {
+		batch, err := s.prepareImportBatch(c, req)
+		if err != nil {
+			return err
+		}
+		if batch == nil {
+			return nil
+		}
+		datasetID = s.StagingDatasetID
+		batchID = batch.ID
 	}
 
-	bqs, err := bigquery.New(client)
+	bqs, err := newBigQueryService(c)
 	if err != nil {
 		return err
 	}
 
+	tableID := s.destinationTableID(req)
+	statusReq := &ImportJobStatusReq{
+		Import:    req,
+		ProjectID: appengine.AppID(c),
+		DatasetID: datasetID,
+		TableID:   tableID,
+		BatchID:   batchID,
+	}
+
+	err = s.provisionDatasets(c, bqs, appengine.AppID(c), req, s.loadDatasetIDs(req, datasetID)...)
+	if _, ok := err.(*DatasetLocationError); ok {
+		// every load into the dataset fails until the settings are fixed.
+		return s.failLoad(c, bqs, statusReq, err)
+	} else if err != nil {
+		return err
+	}
+
 	job := &bigquery.Job{
+		JobReference: loadJobReference(appengine.AppID(c), req, datasetID, tableID),
 		Configuration: &bigquery.JobConfiguration{
 			Load: &bigquery.JobConfigurationLoad{
 				SourceUris: []string{
@@ -178,19 +308,294 @@ func insertImportJob(c context.Context, req *GCSObjectToBQJobReq, datasetID stri
 				DestinationTable: &bigquery.TableReference{
 					ProjectId: appengine.AppID(c),
 					DatasetId: datasetID,
-					TableId:   req.KindName,
+					TableId:   tableID,
 				},
 				SourceFormat:     "DATASTORE_BACKUP",
 				WriteDisposition: "WRITE_TRUNCATE",
 			},
 		},
 	}
+	if s.PartitionedTable {
+		job.Configuration.Load.TimePartitioning = &bigquery.TimePartitioning{Type: "DAY"}
+	}
+	raw, err := s.applyColumnPolicy(c, req, job.Configuration.Load)
+	if _, ok := err.(*ColumnPolicyError); ok || (err != nil && !isRetryableError(err)) {
+		return s.failLoad(c, bqs, statusReq, err)
+	} else if err != nil {
+		logWarning(c, "ds2bq: failed to apply ColumnPolicy", append(fields, F(FieldError, err))...)
+		return err
+	}
+	job, err = insertJob(c, bqs, job)
+	if err != nil && isRetryableError(err) {
+		logWarning(c, "ds2bq: failed to insert load job, retrying", append(fields, F(FieldError, err))...)
+		return err
+	} else if err != nil {
+		return s.failLoad(c, bqs, statusReq, err)
+	}
+
+	jobRef := job.JobReference
+	logInfo(c, "ds2bq: load job submitted", append(fields, F(FieldJobID, jobRef.JobId), F("table", tableID))...)
+	s.Observers.OnImportSubmitted(c, req, jobRef.JobId)
+	s.Metrics.LoadJobSubmitted(c, req.KindName)
+
+	if !s.tracksImportJob() {
+		return nil
+	}
+
+	statusReq.ProjectID = jobRef.ProjectId
+	statusReq.JobID = jobRef.JobId
+	statusReq.Location = jobRef.Location
+	statusReq.Projected = len(job.Configuration.Load.ProjectionFields) != 0
+	if raw != nil {
+		statusReq.RawDatasetID = raw.DatasetId
+		statusReq.RawTableID = raw.TableId
+	}
+	return s.addImportJobStatusTask(c, statusReq)
+}
+
+// loadJobReference returns the reference of the load job of req into the table.
+// It is the same for the retried task, so that the task does not load the backup twice.
+func loadJobReference(projectID string, req *GCSObjectToBQJobReq, datasetID, tableID string) *bigquery.JobReference {
+	h := sha1.Sum([]byte(strings.Join([]string{req.Bucket, req.FilePath, req.TimeCreated.UTC().Format(time.RFC3339Nano), datasetID, tableID}, "\n")))
+	return &bigquery.JobReference{
+		ProjectId: projectID,
+		JobId:     "ds2bq_load_" + hex.EncodeToString(h[:]),
+	}
+}
+
+// failLoad reports the load of the import that does not succeed by retrying, and fails the batch of the import if staged.
+// The task is not retried unless failing the batch returns an error.
+func (s *gcsWatcherService) failLoad(c context.Context, bqs *bigquery.Service, req *ImportJobStatusReq, err error) error {
+	logError(c, "ds2bq: failed to load", F(FieldBucket, req.Import.Bucket), F(FieldObject, req.Import.FilePath), F(FieldKind, req.Import.KindName), F(FieldError, err))
+	s.Observers.OnImportCompleted(c, req.Import, "", err)
+	s.Metrics.LoadJobFailed(c, req.Import.KindName)
+	if req.BatchID != "" {
+		return s.failImportBatch(c, bqs, req, err)
+	}
+	return nil
+}
+
+// importJobStatusInterval is the interval of polling BigQuery load job.
+const importJobStatusInterval = 30 * time.Second
+
+// importJobStatusMaxAttempts is the number of polling before the job is regarded as failed, about 6 hours.
+const importJobStatusMaxAttempts = 720
+
+// tracksImportJob reports whether the service should wait for the completion of load job.
+func (s *gcsWatcherService) tracksImportJob() bool {
+	if _, ok := s.Metrics.(NopMetrics); !ok {
+		return true
+	}
+	if s.LatestViewSuffix != "" || len(s.Transforms) != 0 || len(s.Histories) != 0 || len(s.ColumnPolicies) != 0 || s.StagingDatasetID != "" || s.RowCountValidation != nil {
+		return true
+	}
+	return len(s.Observers) != 0
+}
+
+// ImportJobStatusResp means response of checking status of BigQuery job in import.
+type ImportJobStatusResp struct {
+	Kind     string          `json:"kind"`
+	Stage    string          `json:"stage"`
+	JobID    string          `json:"jobID"`
+	State    string          `json:"state"`
+	Error    string          `json:"error,omitempty"`
+	RowCount *RowCountResult `json:"rowCount,omitempty"`
+}
+
+func (s *gcsWatcherService) checkImportJob(c context.Context, req *ImportJobStatusReq) (*ImportJobStatusResp, error) {
+	bqs, err := newBigQueryService(c)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Stage == importStageBatchTimeout {
+		resp := &ImportJobStatusResp{Kind: req.Import.KindName, Stage: req.Stage}
+		return resp, s.expireImportBatch(c, bqs, req.BatchID)
+	}
+
+	call := bqs.Jobs.Get(req.ProjectID, req.JobID)
+	if req.Location != "" {
+		call = call.Location(req.Location)
+	}
+	job, err := call.Do()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &ImportJobStatusResp{
+		Kind:  req.Import.KindName,
+		Stage: req.Stage,
+		JobID: req.JobID,
+		State: job.Status.State,
+	}
+
+	switch {
+	case job.Status.State == "DONE":
+		err = jobError(job)
+	case req.Attempts < importJobStatusMaxAttempts:
+		logInfo(c, "ds2bq: job is not done", F(FieldKind, req.Import.KindName), F(FieldJobID, req.JobID), F("stage", req.Stage), F("state", job.Status.State))
+		req.Attempts++
+		return resp, s.addImportJobStatusTask(c, req)
+	default:
+		err = fmt.Errorf("ds2bq: job is not done after %d checks, state is %s", req.Attempts, job.Status.State)
+	}
+
+	if stats := job.Statistics; req.Stage == importStageLoad && stats != nil && stats.EndTime != 0 {
+		s.Metrics.LoadJobDuration(c, req.Import.KindName, time.Duration(stats.EndTime-stats.CreationTime)*time.Millisecond)
+	}
+
+	if err == nil && req.Stage == importStageLoad && s.RowCountValidation != nil {
+		resp.RowCount, err = s.validateRowCount(c, bqs, req, job)
+		if err != nil {
+			return resp, err
+		}
+		if !resp.RowCount.OK && s.RowCountValidation.Block {
+			err = &RowCountMismatchError{Result: resp.RowCount}
+		}
+	}
+	// the raw table is not used after the rewrite or the failure.
+	if req.RawTableID != "" && (req.Stage == importStageRewrite || err != nil) {
+		deleteRawTable(c, bqs, req)
+	}
+	if err != nil {
+		resp.Error = err.Error()
+		logWarning(c, "ds2bq: job failed", F(FieldKind, req.Import.KindName), F(FieldJobID, req.JobID), F("stage", req.Stage), F(FieldError, err))
+		s.Metrics.LoadJobFailed(c, req.Import.KindName)
+		s.Observers.OnImportCompleted(c, req.Import, req.loadJobID(), err)
+		if req.BatchID != "" && (req.Stage == importStageLoad || req.Stage == importStageRewrite || req.Stage == importStageCopy) {
+			return resp, s.failImportBatch(c, bqs, req, err)
+		}
+		return resp, nil
+	}
+
+	switch req.Stage {
+	case importStageLoad, importStageRewrite, importStageCopy:
+		if req.Stage == importStageLoad && req.RawTableID != "" {
+			return resp, s.insertRewriteJob(c, bqs, req, s.ColumnPolicies[req.Import.KindName])
+		}
+		if req.BatchID != "" {
+			done, err := s.completeBatchStage(c, bqs, req)
+			if err != nil || !done {
+				return resp, err
+			}
+		}
+		if s.LatestViewSuffix != "" {
+			err = s.updateLatestView(c, bqs, req)
+			if err != nil {
+				return resp, err
+			}
+		}
+		if h, ok := s.Histories[req.Import.KindName]; ok {
+			skipped, err := s.insertHistoryJob(c, bqs, req, h)
+			if err != nil || !skipped {
+				return resp, err
+			}
+		}
+		if t, ok := s.Transforms[req.Import.KindName]; ok {
+			return resp, s.insertTransformJob(c, bqs, req, t)
+		}
+	case importStageHistory:
+		logInfo(c, "ds2bq: history job done", F(FieldKind, req.Import.KindName), F(FieldJobID, req.JobID))
+		err = s.labelHistorySnapshot(c, bqs, req, s.Histories[req.Import.KindName])
+		if err != nil {
+			return resp, err
+		}
+		if t, ok := s.Transforms[req.Import.KindName]; ok {
+			return resp, s.insertTransformJob(c, bqs, req, t)
+		}
+	case importStageTransform:
+		logInfo(c, "ds2bq: transform job done", F(FieldKind, req.Import.KindName), F(FieldJobID, req.JobID))
+	}
+
+	s.Observers.OnImportCompleted(c, req.Import, req.loadJobID(), nil)
+	s.trackImport(c, req.Import)
+
+	return resp, nil
+}
+
+func (s *gcsWatcherService) addImportJobStatusTask(c context.Context, req *ImportJobStatusReq) error {
+	_, err := addJSONTask(c, "", s.ImportJobStatusURL, s.QueueName, req, importJobStatusInterval)
+	if err != nil {
+		s.Metrics.TaskEnqueueFailed(c, s.QueueName)
+		return err
+	}
+	return nil
+}
+
+// destinationTableID returns the table ID that the backup of req is loaded into.
+func (s *gcsWatcherService) destinationTableID(req *GCSObjectToBQJobReq) string {
+	switch {
+	case s.PartitionedTable:
+		return req.KindName + "$" + req.snapshotTime().UTC().Format("20060102")
+	case s.TableDateLayout != "":
+		return req.KindName + "_" + req.snapshotTime().UTC().Format(s.TableDateLayout)
+	default:
+		return req.KindName
+	}
+}
+
+// snapshotTimeLabel is the label of the latest view or the history table that holds the Unix time of the snapshot
+// that the view points or the history has merged.
+const snapshotTimeLabel = "ds2bq_snapshot_time"
 
-	_, err = bqs.Jobs.Insert(appengine.AppID(c), job).Do()
+// isNewerSnapshot reports whether the snapshot at t is newer than the snapshot in labels.
+// The table without the label is regarded as older.
+func isNewerSnapshot(labels map[string]string, t time.Time) bool {
+	v, err := strconv.ParseInt(labels[snapshotTimeLabel], 10, 64)
 	if err != nil {
-		log.Warningf(c, "ds2bq: unexpected error in HandleBackupToBQJob: %s", err)
+		return true
+	}
+	return !t.Before(time.Unix(v, 0))
+}
+
+// updateLatestView creates or updates the view that points the table loaded by req.
+// The view is not updated if it points a newer snapshot, so that a retried old import does not roll it back.
+func (s *gcsWatcherService) updateLatestView(c context.Context, bqs *bigquery.Service, req *ImportJobStatusReq) error {
+	viewID := req.Import.KindName + s.LatestViewSuffix
+	snapshot := req.Import.snapshotTime()
+
+	current, err := getTable(c, bqs, req.ProjectID, req.DatasetID, viewID)
+	if err != nil {
+		return err
+	}
+	if current != nil && !isNewerSnapshot(current.Labels, snapshot) {
+		logInfo(c, "ds2bq: latest view points a newer snapshot", F(FieldKind, req.Import.KindName), F("view", viewID), F("table", req.TableID))
 		return nil
 	}
 
+	table, filter, err := req.sourceTable()
+	if err != nil {
+		return err
+	}
+	query := fmt.Sprintf("SELECT * FROM %s WHERE %s", table, filter)
+
+	labels := map[string]string{snapshotTimeLabel: strconv.FormatInt(snapshot.Unix(), 10)}
+	if current != nil {
+		for k, v := range current.Labels {
+			if _, ok := labels[k]; !ok {
+				labels[k] = v
+			}
+		}
+	}
+	err = upsertView(c, bqs, current, req.ProjectID, req.DatasetID, viewID, query, labels)
+	if err != nil {
+		return err
+	}
+	logInfo(c, "ds2bq: latest view updated", F(FieldKind, req.Import.KindName), F("view", viewID), F("table", req.TableID))
+
 	return nil
 }
+
+// sourceTable returns the table name for standard SQL and the condition to select rows of the loaded backup.
+func (req *ImportJobStatusReq) sourceTable() (string, string, error) {
+	i := strings.Index(req.TableID, "$")
+	if i == -1 {
+		return quoteTable(req.ProjectID, req.DatasetID, req.TableID), "TRUE", nil
+	}
+
+	t, err := time.Parse("20060102", req.TableID[i+1:])
+	if err != nil {
+		return "", "", err
+	}
+	return quoteTable(req.ProjectID, req.DatasetID, req.TableID[:i]), fmt.Sprintf("_PARTITIONTIME = TIMESTAMP(%q)", t.Format("2006-01-02")), nil
+}
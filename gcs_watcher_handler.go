@@ -4,9 +4,8 @@ import (
 	"encoding/json"
 	"io"
 	"net/http"
-
-	"google.golang.org/appengine"
-	"google.golang.org/appengine/log"
+	"strconv"
+	"time"
 )
 
 // DecodeGCSObject decodes a GCSObject from r.
@@ -31,49 +30,73 @@ func DecodeGCSObjectToBQJobReq(r io.Reader) (*GCSObjectToBQJobReq, error) {
 	return req, nil
 }
 
-// ReceiveOCNHandleFunc returns a http.HandlerFunc that receives OCN.
-// The path is for
-func ReceiveOCNHandleFunc(bucketName, queueName, path string, kindNames []string) http.HandlerFunc {
-	// TODO: processWithContext
-	return func(w http.ResponseWriter, r *http.Request) {
-		c := appengine.NewContext(r)
+// DecodeImportJobStatusReq decodes a ImportJobStatusReq from r.
+func DecodeImportJobStatusReq(r io.Reader) (*ImportJobStatusReq, error) {
+	decoder := json.NewDecoder(r)
+	var req *ImportJobStatusReq
+	err := decoder.Decode(&req)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// DecodeOCNJournalReqFromRequest decodes a OCNJournalReq from query parameters of r.
+// since and until are RFC 3339 times.
+func DecodeOCNJournalReqFromRequest(r *http.Request) (*OCNJournalReq, error) {
+	req := &OCNJournalReq{}
 
-		obj, err := DecodeGCSObject(r.Body)
+	vs := r.URL.Query()
+	req.Bucket = vs.Get("bucket")
+	req.Kind = vs.Get("kind")
+	req.Reason = vs.Get("reason")
+	req.Cursor = vs.Get("cursor")
+	if v := vs.Get("accepted"); v != "" {
+		accepted, err := strconv.ParseBool(v)
 		if err != nil {
-			log.Errorf(c, "ds2bq: failed to decode request: %s", err)
-			return
+			return nil, err
 		}
-		defer r.Body.Close()
-
-		if !obj.IsImportTarget(c, r, bucketName, kindNames) {
-			return
+		req.Accepted = &accepted
+	}
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"since", &req.Since}, {"until", &req.Until}} {
+		if v := vs.Get(p.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, err
+			}
+			*p.dst = t
 		}
-
-		err = ReceiveOCN(c, obj, queueName, path)
+	}
+	if v := vs.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
 		if err != nil {
-			log.Errorf(c, "ds2bq: failed to receive OCN: %s", err)
-			return
+			return nil, err
 		}
+		req.Limit = limit
 	}
+
+	return req, nil
+}
+
+// ReceiveOCNHandleFunc returns a http.HandlerFunc that receives OCN.
+// The path is for ImportBigQueryHandleFunc.
+func ReceiveOCNHandleFunc(bucketName, queueName, path string, kindNames []string) http.HandlerFunc {
+	s := newGCSWatcherService(
+		GCSWatcherWithURLs("", path),
+		GCSWatcherWithQueueName(queueName),
+		GCSWatcherWithBackupBucketName(bucketName),
+		GCSWatcherWithTargetKindNames(kindNames...),
+	)
+	return s.serveOCN
 }
 
 // ImportBigQueryHandleFunc returns a http.HandlerFunc that imports GCSObject to BigQuery.
 func ImportBigQueryHandleFunc(datasetID string) http.HandlerFunc {
-	// TODO: processWithContext
-	return func(w http.ResponseWriter, r *http.Request) {
-		c := appengine.NewContext(r)
-
-		req, err := DecodeGCSObjectToBQJobReq(r.Body)
-		if err != nil {
-			log.Errorf(c, "ds2bq: failed to decode request: %s", err)
-			return
-		}
-		defer r.Body.Close()
-
-		err = insertImportJob(c, req, datasetID)
-		if err != nil {
-			log.Errorf(c, "ds2bq: failed to import BigQuery: %s", err)
-			return
-		}
-	}
+	s := newGCSWatcherService(
+		GCSWatcherWithDatasetID(datasetID),
+	)
+	return s.serveBackupToBQJob
 }
@@ -8,12 +8,7 @@ import (
 
 	"github.com/favclip/ucon"
 	"github.com/mjibson/goon"
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
-	"google.golang.org/api/bigquery/v2"
 	"google.golang.org/appengine"
-	"google.golang.org/appengine/log"
-	"google.golang.org/appengine/urlfetch"
 )
 
 // GCSWatcherOption provides option value of GCSWatcherService.
@@ -119,6 +114,161 @@ func GCSWatcherWithDatasetID(id string) GCSWatcherOption {
 	}
 }
 
+type gcsWatcherDatedTableOption struct {
+	TableDateLayout string
+}
+
+func (o *gcsWatcherDatedTableOption) implements(s *gcsWatcherService) {
+	s.TableDateLayout = o.TableDateLayout
+	if s.TableDateLayout == "" {
+		s.TableDateLayout = "20060102"
+	}
+}
+
+// GCSWatcherWithDatedTable provides that each backup is loaded into a dated snapshot table like Article_20171114.
+// layout is time.Format layout of backup time (UTC), default is "20060102".
+func GCSWatcherWithDatedTable(layout string) GCSWatcherOption {
+	return &gcsWatcherDatedTableOption{
+		TableDateLayout: layout,
+	}
+}
+
+type gcsWatcherPartitionedTableOption struct {
+}
+
+func (o *gcsWatcherPartitionedTableOption) implements(s *gcsWatcherService) {
+	s.PartitionedTable = true
+}
+
+// GCSWatcherWithPartitionedTable provides that each backup is loaded into a daily partition of the kind table like Article$20171114.
+func GCSWatcherWithPartitionedTable() GCSWatcherOption {
+	return &gcsWatcherPartitionedTableOption{}
+}
+
+type gcsWatcherLatestViewOption struct {
+	LatestViewSuffix string
+}
+
+func (o *gcsWatcherLatestViewOption) implements(s *gcsWatcherService) {
+	s.LatestViewSuffix = o.LatestViewSuffix
+	if s.LatestViewSuffix == "" {
+		s.LatestViewSuffix = "_latest"
+	}
+}
+
+// GCSWatcherWithLatestView provides that the view named kind + suffix like Article_latest points the table (or partition) loaded most recently.
+// The view is updated after the load job is done without errors. default suffix is "_latest".
+func GCSWatcherWithLatestView(suffix string) GCSWatcherOption {
+	return &gcsWatcherLatestViewOption{
+		LatestViewSuffix: suffix,
+	}
+}
+
+type gcsWatcherImportJobStatusURLOption struct {
+	ImportJobStatusURL string
+}
+
+func (o *gcsWatcherImportJobStatusURLOption) implements(s *gcsWatcherService) {
+	if v := o.ImportJobStatusURL; v != "" {
+		s.ImportJobStatusURL = v
+	}
+}
+
+// GCSWatcherWithImportJobStatusURL provides taskqueue endpoint URL that checks status of BigQuery load job.
+func GCSWatcherWithImportJobStatusURL(tqURL string) GCSWatcherOption {
+	return &gcsWatcherImportJobStatusURLOption{
+		ImportJobStatusURL: tqURL,
+	}
+}
+
+type gcsWatcherObserverOption struct {
+	Observer Observer
+}
+
+func (o *gcsWatcherObserverOption) implements(s *gcsWatcherService) {
+	s.Observers = append(s.Observers, o.Observer)
+}
+
+// GCSWatcherWithObserver provides Observer that receives lifecycle events of import.
+// The status of load job is tracked by taskqueue if any Observer is provided.
+func GCSWatcherWithObserver(observer Observer) GCSWatcherOption {
+	return &gcsWatcherObserverOption{
+		Observer: observer,
+	}
+}
+
+type gcsWatcherMetricsOption struct {
+	Metrics Metrics
+}
+
+func (o *gcsWatcherMetricsOption) implements(s *gcsWatcherService) {
+	s.Metrics = o.Metrics
+}
+
+// GCSWatcherWithMetrics provides Metrics that records notifications and imports.
+// The status of load job is tracked by taskqueue if Metrics is provided.
+func GCSWatcherWithMetrics(metrics Metrics) GCSWatcherOption {
+	return &gcsWatcherMetricsOption{
+		Metrics: metrics,
+	}
+}
+
+type gcsWatcherLoggerOption struct {
+	Logger Logger
+}
+
+func (o *gcsWatcherLoggerOption) implements(s *gcsWatcherService) {
+	s.Logger = o.Logger
+}
+
+// GCSWatcherWithLogger provides Logger.
+// default Logger writes to App Engine log.
+func GCSWatcherWithLogger(logger Logger) GCSWatcherOption {
+	return &gcsWatcherLoggerOption{
+		Logger: logger,
+	}
+}
+
+type gcsWatcherAuthorizerOption struct {
+	NotificationAuthorizer Authorizer
+	TaskAuthorizer         Authorizer
+}
+
+func (o *gcsWatcherAuthorizerOption) implements(s *gcsWatcherService) {
+	if o.NotificationAuthorizer != nil {
+		s.NotificationAuthorizer = o.NotificationAuthorizer
+	}
+	if o.TaskAuthorizer != nil {
+		s.TaskAuthorizer = o.TaskAuthorizer
+	}
+}
+
+// GCSWatcherWithAuthorizers provides Authorizer of the OCN receiver and of the task endpoints.
+// nil means default. default allows any request to the OCN receiver, and tasks of any queue to the task endpoints.
+// e.g. OIDCAuthorizer for OCN by Pub/Sub push.
+func GCSWatcherWithAuthorizers(notification, task Authorizer) GCSWatcherOption {
+	return &gcsWatcherAuthorizerOption{
+		NotificationAuthorizer: notification,
+		TaskAuthorizer:         task,
+	}
+}
+
+type gcsWatcherRawHeaderLoggingOption struct {
+	RawHeaderLogging bool
+}
+
+func (o *gcsWatcherRawHeaderLoggingOption) implements(s *gcsWatcherService) {
+	s.RawHeaderLogging = o.RawHeaderLogging
+}
+
+// GCSWatcherWithRawHeaderLogging provides whether all header values of OCN are logged.
+// default is false, values of headers which may contain secrets, e.g. X-Goog-Channel-Token, are redacted.
+func GCSWatcherWithRawHeaderLogging(raw bool) GCSWatcherOption {
+	return &gcsWatcherRawHeaderLoggingOption{
+		RawHeaderLogging: raw,
+	}
+}
+
 type gcsWatcherWithContext struct {
 	Func func(c context.Context) (GCSWatcherOption, error)
 }
@@ -140,47 +290,239 @@ type gcsWatcherService struct {
 	ImportTargetKinds     []interface{} // convert to ImportTargetKindNames using goon.
 	ImportTargetKindNames []string
 	DatasetID             string
+	StagingDatasetID      string
+	RowCountValidation    *RowCountValidation
+	TableDateLayout       string
+	PartitionedTable      bool
+	LatestViewSuffix      string
+	Transforms            map[string]*Transform
+	Histories             map[string]*History
+	ColumnPolicies        map[string]*ColumnPolicy
+	Sinks                 map[string][]Sink
+	KindExtractors        KindExtractors
+	FirestoreExport       *FirestoreExport
+	DatasetProvisioning   *DatasetProvisioning
+	Observers             observers
+	Metrics               Metrics
+	Logger                Logger
+	RawHeaderLogging      bool
+	FreshnessTracking     bool
+	// WaitOverallExportMetadata imports managed exports by the .overall_export_metadata, not by .export_metadata of kinds.
+	WaitOverallExportMetadata bool
+	OCNJournal                *OCNJournal
+
+	NotificationAuthorizer Authorizer
+	TaskAuthorizer         Authorizer
 
 	WithContextFuncs     []func(c context.Context) (GCSWatcherOption, error)
 	ProcessedWithContext bool
 
 	OCNReceiveURL       string
 	GCSObjectToBQJobURL string
+	ImportJobStatusURL  string
+	APIOCNJournalURL    string
+	PurgeOCNJournalURL  string
 }
 
 // GCSWatcherService serves GCS Object Change Notification receiving APIs.
 type GCSWatcherService interface {
 	SetupWithUcon()
+	SetupWithMux(mux ServeMux)
+	Handler() http.Handler
 	HandleOCN(c context.Context, r *http.Request, obj *GCSObject) error
 	HandleBackupToBQJob(c context.Context, req *GCSObjectToBQJobReq) error
+	HandleImportJobStatus(c context.Context, req *ImportJobStatusReq) (*ImportJobStatusResp, error)
+	HandleListOCNJournal(c context.Context, req *OCNJournalReq) (*OCNJournalList, error)
+	HandlePurgeOCNJournal(c context.Context, req *Noop) (*OCNJournalPurgeResult, error)
 }
 
 // NewGCSWatcherService returns ready to use GCSWatcherService.
 func NewGCSWatcherService(opts ...GCSWatcherOption) (GCSWatcherService, error) {
+	s := newGCSWatcherService(opts...)
+
+	if len(s.ImportTargetKinds) == 0 && len(s.ImportTargetKindNames) == 0 && s.FirestoreExport == nil {
+		return nil, ErrInvalidState
+	}
+	if s.FirestoreExport != nil {
+		if err := s.FirestoreExport.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if s.DatasetID == "" {
+		return nil, ErrInvalidState
+	}
+	if v := s.RowCountValidation; v != nil && v.Block && s.StagingDatasetID == "" {
+		return nil, fmt.Errorf("ds2bq: Block of RowCountValidation requires GCSWatcherWithStagingDataset")
+	}
+	for _, t := range s.Transforms {
+		if err := t.parse(); err != nil {
+			return nil, err
+		}
+	}
+	for kind, p := range s.ColumnPolicies {
+		if err := p.validate(); err != nil {
+			return nil, err
+		}
+		for _, id := range []string{s.DatasetID, s.StagingDatasetID, s.datasetIDOf(BackupSourceFirestoreExport)} {
+			if p.RawDatasetID != "" && p.RawDatasetID == id {
+				return nil, fmt.Errorf("ds2bq: raw dataset of kind %s must be other than %s", kind, id)
+			}
+		}
+	}
+
+	return s, nil
+}
+
+func newGCSWatcherService(opts ...GCSWatcherOption) *gcsWatcherService {
 	s := &gcsWatcherService{
 		QueueName:           "",
 		BackupBucketName:    "",
 		OCNReceiveURL:       "/api/gcs/object-change-notification",
 		GCSObjectToBQJobURL: "/tq/gcs/object-to-bq",
+		ImportJobStatusURL:  "/tq/gcs/import-job-status",
+		APIOCNJournalURL:    "/api/gcs/ocn-journal",
+		PurgeOCNJournalURL:  "/tq/gcs/purge-ocn-journal",
+		Metrics:             NopMetrics{},
+		Logger:              NewAppEngineLogger(),
+
+		NotificationAuthorizer: AllowAll(),
+		TaskAuthorizer:         defaultTaskAuthorizer(),
 	}
 
 	for _, opt := range opts {
 		opt.implements(s)
 	}
 
-	if len(s.ImportTargetKinds) == 0 && len(s.ImportTargetKindNames) == 0 {
-		return nil, ErrInvalidState
+	return s
+}
+
+func (s *gcsWatcherService) SetupWithUcon() {
+	// from GCS, This API must not requires admin role.
+	ucon.HandleFunc("GET,POST", s.OCNReceiveURL, func(c context.Context, r *http.Request, obj *GCSObject) error {
+		if err := authorize(withLogger(c, s.Logger), r, s.NotificationAuthorizer); err != nil {
+			return err
+		}
+		return s.HandleOCN(c, r, obj)
+	})
+	ucon.HandleFunc("GET,POST", s.GCSObjectToBQJobURL, func(c context.Context, r *http.Request, req *GCSObjectToBQJobReq) error {
+		if err := authorize(withLogger(c, s.Logger), r, s.TaskAuthorizer); err != nil {
+			return err
+		}
+		return s.HandleBackupToBQJob(c, req)
+	})
+	ucon.HandleFunc("GET,POST", s.ImportJobStatusURL, func(c context.Context, r *http.Request, req *ImportJobStatusReq) (*ImportJobStatusResp, error) {
+		if err := authorize(withLogger(c, s.Logger), r, s.TaskAuthorizer); err != nil {
+			return nil, err
+		}
+		return s.HandleImportJobStatus(c, req)
+	})
+	if s.OCNJournal != nil {
+		ucon.HandleFunc("GET", s.APIOCNJournalURL, func(c context.Context, r *http.Request, req *OCNJournalReq) (*OCNJournalList, error) {
+			if err := authorize(withLogger(c, s.Logger), r, s.OCNJournal.authorizer()); err != nil {
+				return nil, err
+			}
+			return s.HandleListOCNJournal(c, req)
+		})
+		ucon.HandleFunc("GET,POST", s.PurgeOCNJournalURL, func(c context.Context, r *http.Request, req *Noop) (*OCNJournalPurgeResult, error) {
+			if err := authorize(withLogger(c, s.Logger), r, s.purgeAuthorizer()); err != nil {
+				return nil, err
+			}
+			return s.HandlePurgeOCNJournal(c, req)
+		})
 	}
-	if s.DatasetID == "" {
-		return nil, ErrInvalidState
+}
+
+// SetupWithMux setup handlers to mux.
+func (s *gcsWatcherService) SetupWithMux(mux ServeMux) {
+	mux.Handle(s.OCNReceiveURL, allowMethods("GET,POST", s.serveOCN)) // from GCS, This API must not requires admin role.
+	mux.Handle(s.GCSObjectToBQJobURL, allowMethods("GET,POST", s.serveBackupToBQJob))
+	mux.Handle(s.ImportJobStatusURL, allowMethods("GET,POST", s.serveImportJobStatus))
+	if s.OCNJournal != nil {
+		mux.Handle(s.APIOCNJournalURL, allowMethods("GET", s.serveListOCNJournal))
+		mux.Handle(s.PurgeOCNJournalURL, allowMethods("GET,POST", s.servePurgeOCNJournal))
 	}
+}
 
-	return s, nil
+// Handler returns a http.Handler that serves all endpoints of the service.
+func (s *gcsWatcherService) Handler() http.Handler {
+	mux := http.NewServeMux()
+	s.SetupWithMux(mux)
+	return mux
 }
 
-func (s *gcsWatcherService) SetupWithUcon() {
-	ucon.HandleFunc("GET,POST", s.OCNReceiveURL, s.HandleOCN) // from GCS, This API must not requires admin role.
-	ucon.HandleFunc("GET,POST", s.GCSObjectToBQJobURL, s.HandleBackupToBQJob)
+// newContext returns App Engine context that carries Logger of the service.
+func (s *gcsWatcherService) newContext(r *http.Request) context.Context {
+	return withLogger(appengine.NewContext(r), s.Logger)
+}
+
+func (s *gcsWatcherService) serveOCN(w http.ResponseWriter, r *http.Request) {
+	c := s.newContext(r)
+
+	if !serveAuthorized(c, w, r, s.NotificationAuthorizer) {
+		return
+	}
+
+	obj, err := DecodeGCSObject(r.Body)
+	if err != nil {
+		logError(c, "ds2bq: failed to decode request", F(FieldError, err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	err = s.HandleOCN(c, r, obj)
+	if err != nil {
+		logError(c, "ds2bq: failed to receive OCN", F(FieldError, err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *gcsWatcherService) serveBackupToBQJob(w http.ResponseWriter, r *http.Request) {
+	c := s.newContext(r)
+
+	if !serveAuthorized(c, w, r, s.TaskAuthorizer) {
+		return
+	}
+
+	req, err := DecodeGCSObjectToBQJobReq(r.Body)
+	if err != nil {
+		logError(c, "ds2bq: failed to decode request", F(FieldError, err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	err = s.HandleBackupToBQJob(c, req)
+	if err != nil {
+		logError(c, "ds2bq: failed to import BigQuery", F(FieldError, err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *gcsWatcherService) serveImportJobStatus(w http.ResponseWriter, r *http.Request) {
+	c := s.newContext(r)
+
+	if !serveAuthorized(c, w, r, s.TaskAuthorizer) {
+		return
+	}
+
+	req, err := DecodeImportJobStatusReq(r.Body)
+	if err != nil {
+		logError(c, "ds2bq: failed to decode request", F(FieldError, err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	resp, err := s.HandleImportJobStatus(c, req)
+	if err != nil {
+		logError(c, "ds2bq: failed to check import job", F(FieldError, err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
 }
 
 // GCSObject is received json data from GCS OCN.
@@ -229,22 +571,67 @@ func (s *gcsWatcherService) convertKind(c context.Context) {
 }
 
 func (s *gcsWatcherService) HandleOCN(c context.Context, r *http.Request, obj *GCSObject) error {
+	c = withLogger(c, s.Logger)
+
 	if err := s.processWithContext(c); err != nil {
 		return err
 	}
 
-	for k, v := range r.Header {
-		log.Infof(c, "Header %s: %s", k, v)
+	var header interface{} = redactHeader(r.Header)
+	if s.RawHeaderLogging {
+		header = r.Header
 	}
-
-	log.Infof(c, "payload: %#v", obj)
+	logInfo(c, "ds2bq: receive OCN",
+		F(FieldBucket, obj.Bucket),
+		F(FieldObject, obj.Name),
+		F("generation", obj.Generation),
+		F("size", obj.Size),
+		F("timeCreated", obj.TimeCreated),
+		F("header", header),
+	)
+
+	s.Observers.OnNotification(c, obj)
+	s.Metrics.NotificationReceived(c, NewGCSHeader(r).ResourceState)
 
 	s.convertKind(c)
-	if !obj.IsImportTarget(c, r, s.BackupBucketName, s.ImportTargetKindNames) {
-		return nil
+	decision, err := s.importOCN(c, r, obj)
+	s.recordOCN(c, r, obj, decision, err)
+	return err
+}
+
+// importOCN enqueues the import if the object is an import target, and returns the decision.
+func (s *gcsWatcherService) importOCN(c context.Context, r *http.Request, obj *GCSObject) (*ImportDecision, error) {
+	extractors := s.kindExtractors()
+	if s.WaitOverallExportMetadata && isOverallExportMetadata(obj.Name) {
+		return s.receiveOverallExportMetadata(c, r, obj, s.targetNames(s.exportSource(obj.Name)), extractors)
+	}
+	var source string
+	if info, ok := extractors.ExtractKind(obj.Name); ok {
+		source = info.Source
 	}
+	kindNames := s.targetNames(source)
+	decision := obj.decideImportTarget(c, r, s.BackupBucketName, kindNames, extractors)
+	if !decision.Accepted {
+		s.Observers.OnSkipped(c, obj, decision.Reason)
+		s.Metrics.ObjectFiltered(c, decision.Reason)
+		return decision, nil
+	}
+
+	req := obj.toBQJobReq(extractors)
+	if s.WaitOverallExportMetadata && isExportSource(req.Source) {
+		logInfo(c, "ds2bq: import waits for overall export metadata", F(FieldBucket, obj.Bucket), F(FieldObject, obj.Name), F(FieldKind, req.KindName))
+		s.Observers.OnSkipped(c, obj, SkipReasonWaitingOverall)
+		s.Metrics.ObjectFiltered(c, SkipReasonWaitingOverall)
+		return &ImportDecision{Reason: SkipReasonWaitingOverall, Kinds: decision.Kinds}, nil
+	}
+	err := receiveOCN(c, req, s.QueueName, s.GCSObjectToBQJobURL)
+	if err != nil {
+		s.Metrics.TaskEnqueueFailed(c, s.QueueName)
+		return decision, err
+	}
+	s.trackBackup(c, req)
 
-	return ReceiveOCN(c, obj, s.QueueName, s.GCSObjectToBQJobURL)
+	return decision, nil
 }
 
 // GCSObjectToBQJobReq means request of OCN to BQ.
@@ -252,54 +639,37 @@ type GCSObjectToBQJobReq struct {
 	Bucket      string    `json:"bucket"`
 	FilePath    string    `json:"filePath"`
 	KindName    string    `json:"kindName"`
-	TimeCreated time.Time `json:"TimeCreated"`
+	Namespace   string    `json:"namespace,omitempty"`
+	Source      string    `json:"source,omitempty"`
+	BackupID    string    `json:"backupId,omitempty"`
+	TimeCreated time.Time `json:"TimeCreated"`          // the time the object is created.
+	BackupTime  time.Time `json:"backupTime,omitempty"` // the time of the backup if KindExtractor knows it.
 }
 
-func (s *gcsWatcherService) HandleBackupToBQJob(c context.Context, req *GCSObjectToBQJobReq) error {
-	if err := s.processWithContext(c); err != nil {
-		return err
+// snapshotTime returns the time of the backup, or the time the object is created if the backup time is unknown.
+func (req *GCSObjectToBQJobReq) snapshotTime() time.Time {
+	if !req.BackupTime.IsZero() {
+		return req.BackupTime
 	}
+	return req.TimeCreated
+}
 
-	log.Infof(c, "bucket: %s, filePath: %s, timeCreated: %s", req.Bucket, req.FilePath, req.TimeCreated)
+func (s *gcsWatcherService) HandleBackupToBQJob(c context.Context, req *GCSObjectToBQJobReq) error {
+	c = withLogger(c, s.Logger)
 
-	if req.Bucket == "" || req.FilePath == "" || req.KindName == "" {
-		log.Warningf(c, "unexpected parameters")
-		return nil
+	if err := s.processWithContext(c); err != nil {
+		return err
 	}
 
-	client := &http.Client{
-		Transport: &oauth2.Transport{
-			Source: google.AppEngineTokenSource(c, bigquery.BigqueryScope),
-			Base:   &urlfetch.Transport{Context: c},
-		},
-	}
+	return s.importBackup(c, req)
+}
 
-	bqs, err := bigquery.New(client)
-	if err != nil {
-		return err
-	}
+func (s *gcsWatcherService) HandleImportJobStatus(c context.Context, req *ImportJobStatusReq) (*ImportJobStatusResp, error) {
+	c = withLogger(c, s.Logger)
 
-	job := &bigquery.Job{
-		Configuration: &bigquery.JobConfiguration{
-			Load: &bigquery.JobConfigurationLoad{
-				SourceUris: []string{
-					fmt.Sprintf("gs://%s/%s", req.Bucket, req.FilePath),
-				},
-				DestinationTable: &bigquery.TableReference{
-					ProjectId: appengine.AppID(c),
-					DatasetId: s.DatasetID,
-					TableId:   req.KindName,
-				},
-				SourceFormat:     "DATASTORE_BACKUP",
-				WriteDisposition: "WRITE_TRUNCATE",
-			},
-		},
-	}
-	_, err = bqs.Jobs.Insert(appengine.AppID(c), job).Do()
-	if err != nil {
-		log.Warningf(c, "unexpected error in HandleBackupToBQJob: %s", err.Error())
-		return nil
+	if err := s.processWithContext(c); err != nil {
+		return nil, err
 	}
 
-	return nil
+	return s.checkImportJob(c, req)
 }
@@ -1,7 +1,11 @@
 package ds2bq
 
 import (
+	"net/http/httptest"
 	"testing"
+	"time"
+
+	"google.golang.org/api/bigquery/v2"
 )
 
 func TestGCSObject_ExtractKindName(t *testing.T) {
@@ -43,6 +47,7 @@ func TestGCSObject_extractKindNameForDatastoreExport(t *testing.T) {
 		{input: "2017-11-14T06:47:01_23208/all_namespaces/kind_Item/all_namespaces_kind_Item.export_metadata", want: "Item"},
 		{input: "2017-11-14T06:47:01_23208/2017-11-30T08:22:02_14720.overall_export_metadata", want: ""},
 		{input: "2017-11-14T06:47:01_23208/all_namespaces/kind_Item/output-95", want: ""},
+		{input: "2017-11-14T06:47:01_23208/all_namespaces/all_kinds/all_namespaces_all_kinds.export_metadata", want: ""},
 	}
 
 	for _, test := range tests {
@@ -51,3 +56,107 @@ func TestGCSObject_extractKindNameForDatastoreExport(t *testing.T) {
 		}
 	}
 }
+
+func TestGCSObject_checkImportTarget(t *testing.T) {
+	tests := []struct {
+		bucket string
+		name   string
+		state  string
+		want   SkipReason
+	}{
+		{bucket: "backup", name: "2017-11-14T06:47:01_23208/all_namespaces/kind_Item/all_namespaces_kind_Item.export_metadata", state: "exists", want: ""},
+		{bucket: "other", name: "2017-11-14T06:47:01_23208/all_namespaces/kind_Item/all_namespaces_kind_Item.export_metadata", state: "exists", want: SkipReasonUnexpectedBucket},
+		{bucket: "backup", name: "2017-11-14T06:47:01_23208/all_namespaces/kind_Item/all_namespaces_kind_Item.export_metadata", state: "not_exists", want: SkipReasonUnexpectedState},
+		{bucket: "backup", name: "2017-11-14T06:47:01_23208/all_namespaces/kind_Item/output-95", state: "exists", want: SkipReasonNotBackupFile},
+		{bucket: "backup", name: "2017-11-14T06:47:01_23208/all_namespaces/kind_User/all_namespaces_kind_User.export_metadata", state: "exists", want: SkipReasonNotRequiredKind},
+		{bucket: "backup", name: "2017-11-14T06:47:01_23208/all_namespaces/all_kinds/all_namespaces_all_kinds.export_metadata", state: "exists", want: SkipReasonNotLoadable},
+	}
+
+	for _, test := range tests {
+		o := &GCSObject{Bucket: test.bucket, Name: test.name}
+		r := httptest.NewRequest("POST", "/api/gcs/object-change-notification", nil)
+		r.Header.Set("X-Goog-Resource-State", test.state)
+		if e, g := test.want, o.checkImportTarget(r, "backup", []string{"Item"}, DefaultKindExtractors()); e != g {
+			t.Fatalf("expected reason %s; got %s", e, g)
+		}
+	}
+}
+
+func TestGCSWatcherService_destinationTableID(t *testing.T) {
+	req := &GCSObjectToBQJobReq{
+		KindName:    "Article",
+		TimeCreated: time.Date(2017, 11, 14, 6, 47, 1, 0, time.UTC),
+	}
+
+	tests := []struct {
+		opts []GCSWatcherOption
+		want string
+	}{
+		{opts: nil, want: "Article"},
+		{opts: []GCSWatcherOption{GCSWatcherWithDatedTable("")}, want: "Article_20171114"},
+		{opts: []GCSWatcherOption{GCSWatcherWithDatedTable("2006_01")}, want: "Article_2017_11"},
+		{opts: []GCSWatcherOption{GCSWatcherWithPartitionedTable()}, want: "Article$20171114"},
+	}
+
+	for _, test := range tests {
+		s := newGCSWatcherService(test.opts...)
+		if e, g := test.want, s.destinationTableID(req); e != g {
+			t.Fatalf("expected table %s; got %s", e, g)
+		}
+	}
+}
+
+func TestIsNewerSnapshot(t *testing.T) {
+	snapshot := time.Date(2017, 11, 14, 6, 47, 1, 0, time.UTC)
+	labels := map[string]string{snapshotTimeLabel: "1510642021"} // 2017-11-14T06:47:01Z
+
+	tests := []struct {
+		labels map[string]string
+		t      time.Time
+		want   bool
+	}{
+		{labels: nil, t: snapshot, want: true},
+		{labels: map[string]string{snapshotTimeLabel: "x"}, t: snapshot, want: true},
+		{labels: labels, t: snapshot, want: true},
+		{labels: labels, t: snapshot.Add(24 * time.Hour), want: true},
+		{labels: labels, t: snapshot.Add(-24 * time.Hour), want: false},
+	}
+
+	for i, test := range tests {
+		if e, g := test.want, isNewerSnapshot(test.labels, test.t); e != g {
+			t.Errorf("%d: expected %v; got %v", i, e, g)
+		}
+	}
+}
+
+func TestImportJobStatusReq_stageJobReference(t *testing.T) {
+	load := &ImportJobStatusReq{ProjectID: "p", JobID: "job_load", Location: "US"}
+	history := load.next(importStageHistory, &bigquery.JobReference{ProjectId: "p", JobId: "job_load_history", Location: "US"})
+
+	for _, req := range []*ImportJobStatusReq{load, history} {
+		ref := req.stageJobReference(importStageTransform)
+		if e, g := "job_load_transform", ref.JobId; e != g {
+			t.Errorf("expected %s; got %s", e, g)
+		}
+		if e, g := "US", ref.Location; e != g {
+			t.Errorf("expected %s; got %s", e, g)
+		}
+	}
+}
+
+func TestGCSObject_ExtractNamespaceName(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: "2017-11-14T06:47:01_23208/all_namespaces/kind_Item/all_namespaces_kind_Item.export_metadata", want: ""},
+		{input: "2017-11-14T06:47:01_23208/namespace_Tenant1/kind_Item/namespace_Tenant1_kind_Item.export_metadata", want: "Tenant1"},
+	}
+
+	for _, test := range tests {
+		o := &GCSObject{Name: test.input}
+		if e, g := test.want, o.ExtractNamespaceName(); e != g {
+			t.Fatalf("expected namespace %s; got %s", e, g)
+		}
+	}
+}
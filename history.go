@@ -0,0 +1,275 @@
+package ds2bq
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/bigquery/v2"
+	"google.golang.org/api/googleapi"
+)
+
+// History is the configuration of the history table of a kind, slowly changing dimension type 2.
+//
+// After each load of the kind, rows of the snapshot are merged into the history table by MERGE statement.
+// The history table has all columns of the snapshot and the columns below.
+//
+//	_key       STRING     identity of the entity, namespace and path of __key__.
+//	_hash      INT64      fingerprint of the change columns.
+//	valid_from TIMESTAMP  the backup time that the version appeared.
+//	valid_to   TIMESTAMP  the backup time that the version was changed or deleted. NULL for the current version.
+//	deleted    BOOL       true if the version was closed because the entity was deleted.
+type History struct {
+	// Columns that count as a change. default is all columns except __key__, __error__ and __has_error__.
+	Columns []string `json:"columns"`
+	// TableSuffix of the history table. default is "_history", like Article_history.
+	TableSuffix string `json:"tableSuffix"`
+}
+
+// historyColumns are columns added to the history table.
+var historyColumns = []*bigquery.TableFieldSchema{
+	{Name: "_key", Type: "STRING"},
+	{Name: "_hash", Type: "INTEGER"},
+	{Name: "valid_from", Type: "TIMESTAMP"},
+	{Name: "valid_to", Type: "TIMESTAMP"},
+	{Name: "deleted", Type: "BOOLEAN"},
+}
+
+type gcsWatcherHistoryOption struct {
+	KindName string
+	History  *History
+}
+
+func (o *gcsWatcherHistoryOption) implements(s *gcsWatcherService) {
+	if s.Histories == nil {
+		s.Histories = make(map[string]*History)
+	}
+	s.Histories[o.KindName] = o.History
+}
+
+// GCSWatcherWithHistory provides that the snapshot of the kind is merged into the history table after each load.
+func GCSWatcherWithHistory(kindName string, h *History) GCSWatcherOption {
+	return &gcsWatcherHistoryOption{
+		KindName: kindName,
+		History:  h,
+	}
+}
+
+func (h *History) tableID(kindName string) string {
+	if h.TableSuffix == "" {
+		return kindName + "_history"
+	}
+	return kindName + h.TableSuffix
+}
+
+// hashColumns returns the change columns in the columns of the snapshot.
+func (h *History) hashColumns(columns []string) ([]string, error) {
+	if len(h.Columns) == 0 {
+		var hashColumns []string
+		for _, name := range columns {
+			switch name {
+			case "__key__", "__error__", "__has_error__":
+				continue
+			}
+			hashColumns = append(hashColumns, name)
+		}
+		return hashColumns, nil
+	}
+
+	for _, name := range h.Columns {
+		if !containsString(columns, name) {
+			return nil, fmt.Errorf("ds2bq: history column %s is not found in the table", name)
+		}
+	}
+	return h.Columns, nil
+}
+
+// historyMergeSQL returns MERGE statement that merges the snapshot into the history table.
+// Changed rows are closed and their new versions are inserted by one statement,
+// the source has each snapshot row with its key to match the current version,
+// and the changed rows again without key to be inserted.
+func historyMergeSQL(historyTable, sourceTable, sourceFilter string, columns, hashColumns []string, backupTime time.Time) string {
+	quoted := make([]string, 0, len(columns))
+	values := make([]string, 0, len(columns))
+	for _, name := range columns {
+		quoted = append(quoted, "`"+name+"`")
+		values = append(values, "U.`"+name+"`")
+	}
+	hashed := make([]string, 0, len(hashColumns))
+	for _, name := range hashColumns {
+		hashed = append(hashed, "`"+name+"`")
+	}
+	t := fmt.Sprintf("TIMESTAMP(%q)", backupTime.UTC().Format("2006-01-02 15:04:05.999999-07:00"))
+
+	snapshot := fmt.Sprintf("SELECT TO_JSON_STRING(STRUCT(__key__.namespace AS namespace, __key__.path AS path)) AS _key, "+
+		"FARM_FINGERPRINT(TO_JSON_STRING(STRUCT(%s))) AS _hash, %s FROM %s WHERE %s",
+		strings.Join(hashed, ", "), strings.Join(quoted, ", "), sourceTable, sourceFilter)
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "MERGE %s H\n", historyTable)
+	fmt.Fprintf(buf, "USING (\n")
+	fmt.Fprintf(buf, "  SELECT S._key AS _merge_key, S.* FROM (%s) S\n", snapshot)
+	fmt.Fprintf(buf, "  UNION ALL\n")
+	fmt.Fprintf(buf, "  SELECT CAST(NULL AS STRING) AS _merge_key, S.* FROM (%s) S\n", snapshot)
+	fmt.Fprintf(buf, "  JOIN %s C ON C._key = S._key AND C.valid_to IS NULL AND C._hash != S._hash\n", historyTable)
+	fmt.Fprintf(buf, ") U\n")
+	fmt.Fprintf(buf, "ON H._key = U._merge_key AND H.valid_to IS NULL\n")
+	fmt.Fprintf(buf, "WHEN MATCHED AND H._hash != U._hash THEN\n")
+	fmt.Fprintf(buf, "  UPDATE SET valid_to = %s\n", t)
+	fmt.Fprintf(buf, "WHEN NOT MATCHED BY TARGET THEN\n")
+	fmt.Fprintf(buf, "  INSERT (%s, _key, _hash, valid_from, valid_to, deleted)\n", strings.Join(quoted, ", "))
+	fmt.Fprintf(buf, "  VALUES (%s, U._key, U._hash, %s, NULL, FALSE)\n", strings.Join(values, ", "), t)
+	fmt.Fprintf(buf, "WHEN NOT MATCHED BY SOURCE AND H.valid_to IS NULL THEN\n")
+	fmt.Fprintf(buf, "  UPDATE SET valid_to = %s, deleted = TRUE", t)
+	return buf.String()
+}
+
+// checkHistoryColumns returns an error if columns of the snapshot collide with columns added to the history table.
+func checkHistoryColumns(columns []string) error {
+	for _, f := range historyColumns {
+		if containsString(columns, f.Name) {
+			return fmt.Errorf("ds2bq: column %s of the snapshot collides with the column of the history table", f.Name)
+		}
+	}
+	if containsString(columns, "_merge_key") {
+		return errors.New("ds2bq: column _merge_key of the snapshot collides with the column of MERGE statement")
+	}
+	return nil
+}
+
+// ensureHistoryTable creates the history table from the schema of the snapshot,
+// or adds columns that appeared in the snapshot. It returns the history table.
+func ensureHistoryTable(c context.Context, bqs *bigquery.Service, projectID, datasetID, tableID string, schema *bigquery.TableSchema) (*bigquery.Table, error) {
+	table, err := bqs.Tables.Get(projectID, datasetID, tableID).Context(c).Do()
+	if isNotFound(err) {
+		fields := append(append([]*bigquery.TableFieldSchema{}, schema.Fields...), historyColumns...)
+		return bqs.Tables.Insert(projectID, datasetID, &bigquery.Table{
+			TableReference: &bigquery.TableReference{
+				ProjectId: projectID,
+				DatasetId: datasetID,
+				TableId:   tableID,
+			},
+			Schema: &bigquery.TableSchema{Fields: fields},
+		}).Context(c).Do()
+	} else if err != nil {
+		return nil, err
+	}
+
+	var added []*bigquery.TableFieldSchema
+	for _, f := range schema.Fields {
+		if !hasField(table.Schema, f.Name) {
+			// columns can be added only as NULLABLE.
+			if f.Mode == "REQUIRED" {
+				f.Mode = "NULLABLE"
+			}
+			added = append(added, f)
+		}
+	}
+	if len(added) == 0 {
+		return table, nil
+	}
+	return bqs.Tables.Patch(projectID, datasetID, tableID, &bigquery.Table{
+		Schema: &bigquery.TableSchema{Fields: append(table.Schema.Fields, added...)},
+	}).Context(c).Do()
+}
+
+func hasField(schema *bigquery.TableSchema, name string) bool {
+	if schema == nil {
+		return false
+	}
+	for _, f := range schema.Fields {
+		if f.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// insertHistoryJob merges the snapshot loaded by req into the history table.
+// It reports true if the history has merged a newer snapshot, then the import goes on without the history job.
+func (s *gcsWatcherService) insertHistoryJob(c context.Context, bqs *bigquery.Service, req *ImportJobStatusReq, h *History) (bool, error) {
+	tableID := req.TableID
+	if i := strings.Index(tableID, "$"); i != -1 {
+		tableID = tableID[:i]
+	}
+	table, err := bqs.Tables.Get(req.ProjectID, req.DatasetID, tableID).Context(c).Do()
+	if err != nil {
+		return false, err
+	}
+
+	var columns []string
+	for _, f := range table.Schema.Fields {
+		columns = append(columns, f.Name)
+	}
+	hashColumns, err := h.hashColumns(columns)
+	if err == nil {
+		err = checkHistoryColumns(columns)
+	}
+	if err != nil {
+		// the history does not match the snapshot, retrying does not help.
+		logWarning(c, "ds2bq: failed to merge into history", F(FieldKind, req.Import.KindName), F(FieldError, err))
+		s.Observers.OnImportCompleted(c, req.Import, req.loadJobID(), err)
+		return false, nil
+	}
+
+	historyID := h.tableID(req.Import.KindName)
+	history, err := ensureHistoryTable(c, bqs, req.ProjectID, req.DatasetID, historyID, table.Schema)
+	if err != nil {
+		return false, err
+	}
+	if !isNewerSnapshot(history.Labels, req.Import.snapshotTime()) {
+		logWarning(c, "ds2bq: history has merged a newer snapshot, skip merging", F(FieldKind, req.Import.KindName), F("table", historyID), F("snapshot", req.Import.snapshotTime()))
+		return true, nil
+	}
+
+	source, filter, err := req.sourceTable()
+	if err != nil {
+		return false, err
+	}
+	sql := historyMergeSQL(quoteTable(req.ProjectID, req.DatasetID, historyID), source, filter, columns, hashColumns, req.Import.snapshotTime())
+
+	job := &bigquery.Job{
+		JobReference: req.stageJobReference(importStageHistory),
+		Configuration: &bigquery.JobConfiguration{
+			Query: &bigquery.JobConfigurationQuery{
+				Query:        sql,
+				UseLegacySql: googleapi.Bool(false),
+			},
+		},
+	}
+	job, err = insertJob(c, bqs, job)
+	if err != nil {
+		return false, err
+	}
+	logInfo(c, "ds2bq: history job submitted", F(FieldKind, req.Import.KindName), F(FieldJobID, job.JobReference.JobId), F("table", historyID))
+
+	return false, s.addImportJobStatusTask(c, req.next(importStageHistory, job.JobReference))
+}
+
+// labelHistorySnapshot records the snapshot merged by the history job of req in the label of the history table.
+func (s *gcsWatcherService) labelHistorySnapshot(c context.Context, bqs *bigquery.Service, req *ImportJobStatusReq, h *History) error {
+	if h == nil {
+		return nil
+	}
+	historyID := h.tableID(req.Import.KindName)
+	history, err := bqs.Tables.Get(req.ProjectID, req.DatasetID, historyID).Context(c).Do()
+	if err != nil {
+		return err
+	}
+	if !isNewerSnapshot(history.Labels, req.Import.snapshotTime()) {
+		return nil
+	}
+
+	labels := map[string]string{snapshotTimeLabel: strconv.FormatInt(req.Import.snapshotTime().Unix(), 10)}
+	for k, v := range history.Labels {
+		if _, ok := labels[k]; !ok {
+			labels[k] = v
+		}
+	}
+	_, err = bqs.Tables.Patch(req.ProjectID, req.DatasetID, historyID, &bigquery.Table{Labels: labels}).Context(c).Do()
+	return err
+}
@@ -0,0 +1,79 @@
+package ds2bq
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHistory_hashColumns(t *testing.T) {
+	columns := []string{"__key__", "Title", "Body", "UpdatedAt", "__error__", "__has_error__"}
+
+	h := &History{}
+	hashColumns, err := h.hashColumns(columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := []string{"Title", "Body", "UpdatedAt"}, hashColumns; !reflect.DeepEqual(e, g) {
+		t.Errorf("expected %#v; got %#v", e, g)
+	}
+
+	h = &History{Columns: []string{"Title", "Body"}}
+	hashColumns, err = h.hashColumns(columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := []string{"Title", "Body"}, hashColumns; !reflect.DeepEqual(e, g) {
+		t.Errorf("expected %#v; got %#v", e, g)
+	}
+
+	h = &History{Columns: []string{"Unknown"}}
+	if _, err := h.hashColumns(columns); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestHistory_tableID(t *testing.T) {
+	if e, g := "Article_history", (&History{}).tableID("Article"); e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	if e, g := "Article_scd", (&History{TableSuffix: "_scd"}).tableID("Article"); e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+}
+
+func TestHistoryMergeSQL(t *testing.T) {
+	sql := historyMergeSQL("`p.d.Article_history`", "`p.d.Article`", "TRUE", []string{"__key__", "Title"}, []string{"Title"}, time.Date(2017, 11, 14, 6, 47, 1, 0, time.UTC))
+
+	snapshot := "SELECT TO_JSON_STRING(STRUCT(__key__.namespace AS namespace, __key__.path AS path)) AS _key, " +
+		"FARM_FINGERPRINT(TO_JSON_STRING(STRUCT(`Title`))) AS _hash, `__key__`, `Title` FROM `p.d.Article` WHERE TRUE"
+	e := "MERGE `p.d.Article_history` H\n" +
+		"USING (\n" +
+		"  SELECT S._key AS _merge_key, S.* FROM (" + snapshot + ") S\n" +
+		"  UNION ALL\n" +
+		"  SELECT CAST(NULL AS STRING) AS _merge_key, S.* FROM (" + snapshot + ") S\n" +
+		"  JOIN `p.d.Article_history` C ON C._key = S._key AND C.valid_to IS NULL AND C._hash != S._hash\n" +
+		") U\n" +
+		"ON H._key = U._merge_key AND H.valid_to IS NULL\n" +
+		"WHEN MATCHED AND H._hash != U._hash THEN\n" +
+		"  UPDATE SET valid_to = TIMESTAMP(\"2017-11-14 06:47:01+00:00\")\n" +
+		"WHEN NOT MATCHED BY TARGET THEN\n" +
+		"  INSERT (`__key__`, `Title`, _key, _hash, valid_from, valid_to, deleted)\n" +
+		"  VALUES (U.`__key__`, U.`Title`, U._key, U._hash, TIMESTAMP(\"2017-11-14 06:47:01+00:00\"), NULL, FALSE)\n" +
+		"WHEN NOT MATCHED BY SOURCE AND H.valid_to IS NULL THEN\n" +
+		"  UPDATE SET valid_to = TIMESTAMP(\"2017-11-14 06:47:01+00:00\"), deleted = TRUE"
+	if sql != e {
+		t.Errorf("expected\n%s\ngot\n%s", e, sql)
+	}
+}
+
+func TestCheckHistoryColumns(t *testing.T) {
+	if err := checkHistoryColumns([]string{"__key__", "Title", "key", "hash"}); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	for _, name := range []string{"_key", "_hash", "valid_from", "valid_to", "deleted", "_merge_key"} {
+		if err := checkHistoryColumns([]string{"__key__", "Title", name}); err == nil {
+			t.Errorf("expected error for %s", name)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package ds2bq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path"
+	"strings"
+	"time"
+
+	"google.golang.org/api/bigquery/v2"
+)
+
+// ErrImportBatchFailed is the error of the kind whose backup was loaded, but not copied because other kind of the backup failed.
+var ErrImportBatchFailed = errors.New("ds2bq: other kind of the backup failed to import")
+
+type gcsWatcherStagingDatasetOption struct {
+	StagingDatasetID string
+}
+
+func (o *gcsWatcherStagingDatasetOption) implements(s *gcsWatcherService) {
+	s.StagingDatasetID = o.StagingDatasetID
+}
+
+// GCSWatcherWithStagingDataset provides that all kinds of a backup are loaded into the staging dataset at first,
+// and copied into the dataset by copy jobs after every kind has been loaded successfully.
+// If any kind fails, tables of the dataset are not changed and the failure is recorded in ImportBatch.
+func GCSWatcherWithStagingDataset(datasetID string) GCSWatcherOption {
+	return &gcsWatcherStagingDatasetOption{
+		StagingDatasetID: datasetID,
+	}
+}
+
+// backupID returns the ID of the backup that the file belongs to.
+// It is the encoded key of _AE_Backup_Information for Datastore Admin backup,
+// or the path of export like 2017-11-14T06:47:01_23208 for managed export.
+func backupID(filePath string) string {
+	if strings.HasSuffix(filePath, ".backup_info") {
+		return strings.SplitN(path.Base(filePath), ".", 2)[0]
+	}
+
+	elems := strings.Split(filePath, "/")
+	for i, v := range elems {
+		if strings.HasPrefix(v, "all_namespaces") || strings.HasPrefix(v, "namespace_") {
+			return strings.Join(elems[:i], "/")
+		}
+	}
+	return path.Dir(filePath)
+}
+
+// errExportNotFinished is the error of the managed export whose .overall_export_metadata is not written yet.
+// The task is retried until all kinds of the export are written.
+var errExportNotFinished = errors.New("ds2bq: export is not finished")
+
+// ErrImportBatchTimeout is the error of the kind that was not imported until the deadline of the batch.
+var ErrImportBatchTimeout = errors.New("ds2bq: import batch timed out")
+
+// importBatchTimeout is the time from the creation of ImportBatch to its deadline.
+const importBatchTimeout = 24 * time.Hour
+
+// batchKinds returns kinds that the batch of the backup waits for.
+// They are the target kinds in .backup_info of Datastore Admin backup, or in .export_metadata files of managed export.
+func (s *gcsWatcherService) batchKinds(c context.Context, req *GCSObjectToBQJobReq, id string) ([]string, error) {
+	targets := s.targetNames(req.Source)
+
+	if !strings.HasSuffix(req.FilePath, ".backup_info") {
+		sts, err := newStorageService(c)
+		if err != nil {
+			return nil, err
+		}
+		names, err := listObjects(c, sts, req.Bucket, id+"/")
+		if err != nil {
+			return nil, err
+		}
+		return exportKinds(names, id, req.Source, targets, s.kindExtractors())
+	}
+
+	b, err := OpenBackup(c, req)
+	if err != nil {
+		return nil, err
+	}
+	var kinds []string
+	for _, kind := range b.Kinds {
+		if containsString(targets, kind) {
+			kinds = append(kinds, kind)
+		}
+	}
+	if len(kinds) == 0 {
+		return targets, nil
+	}
+	return kinds, nil
+}
+
+// exportKinds returns target kinds that have .export_metadata in objects of the export of id.
+// It returns errExportNotFinished if .overall_export_metadata of the export is not in objects.
+func exportKinds(names []string, id, source string, targets []string, extractors KindExtractors) ([]string, error) {
+	if !containsString(names, path.Join(id, path.Base(id)+".overall_export_metadata")) {
+		return nil, errExportNotFinished
+	}
+	var kinds []string
+	for _, name := range names {
+		info, ok := extractors.ExtractKind(name)
+		if !ok || info.Source != source || info.BackupID != id {
+			continue
+		}
+		if containsString(targets, info.Kind) && !containsString(kinds, info.Kind) {
+			kinds = append(kinds, info.Kind)
+		}
+	}
+	return kinds, nil
+}
+
+// prepareImportBatch returns ImportBatch of the backup of req, creates it if not exists.
+// It returns nil if the batch is already finished.
+func (s *gcsWatcherService) prepareImportBatch(c context.Context, req *GCSObjectToBQJobReq) (*ImportBatch, error) {
+	id := req.BackupID
+	if id == "" {
+		id = backupID(req.FilePath)
+	}
+	kinds, err := s.batchKinds(c, req, id)
+	if err != nil {
+		return nil, err
+	}
+
+	datasetID := s.datasetIDOf(req.Source)
+	store := &AEDatastoreStore{}
+	batch, created, err := store.GetOrCreateImportBatch(c, &ImportBatch{
+		ID:               datasetID + "/" + id,
+		BackupID:         id,
+		DatasetID:        datasetID,
+		StagingDatasetID: s.StagingDatasetID,
+		Kinds:            kinds,
+		State:            ImportBatchStateLoading,
+		Deadline:         time.Now().Add(importBatchTimeout),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		timeout := &ImportJobStatusReq{Import: req, Stage: importStageBatchTimeout, BatchID: batch.ID}
+		_, err = addJSONTask(c, "", s.ImportJobStatusURL, s.QueueName, timeout, importBatchTimeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if batch.State != ImportBatchStateLoading {
+		logWarning(c, "ds2bq: import batch is already finished", F(FieldKind, req.KindName), F("batchID", batch.ID), F("state", batch.State))
+		return nil, nil
+	}
+	if !time.Now().Before(batch.Deadline) {
+		logWarning(c, "ds2bq: import batch is past the deadline", F(FieldKind, req.KindName), F("batchID", batch.ID), F("deadline", batch.Deadline))
+		return nil, nil
+	}
+
+	return batch, nil
+}
+
+// expireImportBatch fails the batch if it is not done by the deadline, and deletes its staging tables.
+func (s *gcsWatcherService) expireImportBatch(c context.Context, bqs *bigquery.Service, id string) error {
+	store := &AEDatastoreStore{}
+	var expired bool
+	batch, err := store.UpdateImportBatch(c, id, func(batch *ImportBatch) error {
+		expired = batch.expire(time.Now())
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !expired {
+		return nil
+	}
+	logWarning(c, "ds2bq: import batch timed out", F("batchID", batch.ID), F("state", batch.State), F("failedKinds", batch.FailedKinds))
+
+	return cleanUpImportBatch(c, bqs, batch)
+}
+
+// failImportBatch records the failure of the job in the batch.
+func (s *gcsWatcherService) failImportBatch(c context.Context, bqs *bigquery.Service, req *ImportJobStatusReq, jobErr error) error {
+	store := &AEDatastoreStore{}
+	batch, err := store.UpdateImportBatch(c, req.BatchID, func(batch *ImportBatch) error {
+		batch.fail(req.Import.KindName, jobErr)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if batch.State == ImportBatchStatePartiallyCopied {
+		logError(c, "ds2bq: import batch failed in copying, the dataset is partially overwritten", F(FieldKind, req.Import.KindName), F("batchID", req.BatchID), F("copiedKinds", batch.CopiedKinds), F(FieldError, jobErr))
+	} else {
+		logWarning(c, "ds2bq: import batch failed", F(FieldKind, req.Import.KindName), F("batchID", req.BatchID), F(FieldError, jobErr))
+	}
+
+	if req.Stage != importStageCopy {
+		// the table of the kind is not in LoadedJobs.
+		deleteStagingTable(c, bqs, req)
+	}
+	return cleanUpImportBatch(c, bqs, batch)
+}
+
+// completeBatchStage records the job of the stage in the batch.
+// When all kinds are loaded into the staging dataset, it starts copy jobs into the dataset.
+// It reports whether the import of the kind continues as the table of the dataset is ready.
+func (s *gcsWatcherService) completeBatchStage(c context.Context, bqs *bigquery.Service, req *ImportJobStatusReq) (bool, error) {
+	store := &AEDatastoreStore{}
+
+	if req.Stage == importStageCopy {
+		batch, err := store.UpdateImportBatch(c, req.BatchID, func(batch *ImportBatch) error {
+			batch.copied(req.Import.KindName)
+			return nil
+		})
+		if err != nil {
+			return false, err
+		}
+		if batch.State == ImportBatchStateDone {
+			logInfo(c, "ds2bq: import batch done", F("batchID", batch.ID), F("kinds", batch.Kinds))
+		}
+		return true, cleanUpImportBatch(c, bqs, batch)
+	}
+
+	b, err := json.Marshal(req)
+	if err != nil {
+		return false, err
+	}
+	var ready bool
+	batch, err := store.UpdateImportBatch(c, req.BatchID, func(batch *ImportBatch) error {
+		ready = batch.loaded(req.Import.KindName, string(b))
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	switch {
+	case batch.State == ImportBatchStateFailed:
+		logWarning(c, "ds2bq: loaded into staging, but import batch failed", F(FieldKind, req.Import.KindName), F("batchID", batch.ID))
+		deleteStagingTable(c, bqs, req)
+		s.Observers.OnImportCompleted(c, req.Import, req.loadJobID(), ErrImportBatchFailed)
+	case ready:
+		return false, s.insertCopyJobs(c, bqs, batch)
+	default:
+		logInfo(c, "ds2bq: loaded into staging", F(FieldKind, req.Import.KindName), F("batchID", batch.ID), F("loaded", len(batch.LoadedKinds)), F("kinds", len(batch.Kinds)))
+	}
+
+	return false, nil
+}
+
+// insertCopyJobs copies all tables loaded into the staging dataset into the dataset.
+// When a copy job fails to insert, kinds that are not copied yet fail without copying.
+func (s *gcsWatcherService) insertCopyJobs(c context.Context, bqs *bigquery.Service, batch *ImportBatch) error {
+	logInfo(c, "ds2bq: copy staging tables", F("batchID", batch.ID), F("kinds", batch.Kinds))
+
+	var failed bool
+	for _, v := range batch.LoadedJobs {
+		req := &ImportJobStatusReq{}
+		err := json.Unmarshal([]byte(v), req)
+		if err != nil {
+			return err
+		}
+		if failed {
+			s.Observers.OnImportCompleted(c, req.Import, req.loadJobID(), ErrImportBatchFailed)
+			err = s.failImportBatch(c, bqs, req.next(importStageCopy, req.stageJobReference(importStageCopy)), ErrImportBatchFailed)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		job := &bigquery.Job{
+			JobReference: req.stageJobReference(importStageCopy),
+			Configuration: &bigquery.JobConfiguration{
+				Copy: &bigquery.JobConfigurationTableCopy{
+					SourceTable: &bigquery.TableReference{
+						ProjectId: req.ProjectID,
+						DatasetId: req.DatasetID,
+						TableId:   req.TableID,
+					},
+					DestinationTable: &bigquery.TableReference{
+						ProjectId: req.ProjectID,
+						DatasetId: batch.DatasetID,
+						TableId:   req.TableID,
+					},
+					CreateDisposition: "CREATE_IF_NEEDED",
+					WriteDisposition:  "WRITE_TRUNCATE",
+				},
+			},
+		}
+		job, err = insertJob(c, bqs, job)
+		if err != nil {
+			failed = true
+			s.Observers.OnImportCompleted(c, req.Import, req.loadJobID(), err)
+			err = s.failImportBatch(c, bqs, req.next(importStageCopy, req.stageJobReference(importStageCopy)), err)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		next := req.next(importStageCopy, job.JobReference)
+		next.DatasetID = batch.DatasetID
+		err = s.addImportJobStatusTask(c, next)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// cleanUpImportBatch deletes the tables loaded into the staging dataset after all jobs of the batch finished.
+func cleanUpImportBatch(c context.Context, bqs *bigquery.Service, batch *ImportBatch) error {
+	if !batch.finished() {
+		return nil
+	}
+	for _, v := range batch.LoadedJobs {
+		req := &ImportJobStatusReq{}
+		err := json.Unmarshal([]byte(v), req)
+		if err != nil {
+			return err
+		}
+		deleteStagingTable(c, bqs, req)
+	}
+	return nil
+}
+
+// deleteStagingTable deletes the table of the staging dataset that the job of req loaded into.
+func deleteStagingTable(c context.Context, bqs *bigquery.Service, req *ImportJobStatusReq) {
+	tableID := strings.SplitN(req.TableID, "$", 2)[0]
+	err := bqs.Tables.Delete(req.ProjectID, req.DatasetID, tableID).Context(c).Do()
+	if err != nil && !isNotFound(err) {
+		logError(c, "ds2bq: failed to delete staging table", F(FieldKind, req.Import.KindName), F("table", req.DatasetID+"."+tableID), F(FieldError, err))
+	}
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
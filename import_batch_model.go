@@ -0,0 +1,182 @@
+package ds2bq
+
+import (
+	"context"
+	"time"
+
+	"github.com/mjibson/goon"
+	"google.golang.org/appengine/datastore"
+)
+
+// ImportBatchState is the state of ImportBatch.
+type ImportBatchState string
+
+// ImportBatchState values.
+const (
+	ImportBatchStateLoading ImportBatchState = "loading"
+	ImportBatchStateCopying ImportBatchState = "copying"
+	ImportBatchStateDone    ImportBatchState = "done"
+	ImportBatchStateFailed  ImportBatchState = "failed"
+	// ImportBatchStatePartiallyCopied means a copy job failed after copying started,
+	// so the dataset may have tables of both this backup and the previous one.
+	ImportBatchStatePartiallyCopied ImportBatchState = "partially_copied"
+)
+
+// ImportBatch is the import of all kinds of a backup through the staging dataset.
+type ImportBatch struct {
+	Kind             string           `goon:"kind,DS2BQImportBatch" json:"-"`
+	ID               string           `datastore:"-" goon:"id" json:"id"`
+	BackupID         string           `json:"backupId"`
+	DatasetID        string           `json:"datasetId"`
+	StagingDatasetID string           `json:"stagingDatasetId"`
+	Kinds            []string         `json:"kinds"`
+	LoadedKinds      []string         `json:"loadedKinds"`
+	LoadedJobs       []string         `datastore:",noindex" json:"-"` // JSON of ImportJobStatusReq of LoadedKinds.
+	CopiedKinds      []string         `json:"copiedKinds"`
+	FailedKinds      []string         `json:"failedKinds"`
+	State            ImportBatchState `json:"state"`
+	Error            string           `datastore:",noindex" json:"error,omitempty"`
+	// Deadline is the time that the batch fails if it is not done.
+	Deadline  time.Time `json:"deadline"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// loaded records the kind loaded into the staging dataset.
+// It reports whether all kinds are loaded, then the state changes to copying.
+func (batch *ImportBatch) loaded(kind, job string) bool {
+	if batch.State != ImportBatchStateLoading {
+		return false
+	}
+	if !containsString(batch.LoadedKinds, kind) {
+		batch.LoadedKinds = append(batch.LoadedKinds, kind)
+		batch.LoadedJobs = append(batch.LoadedJobs, job)
+	}
+	for _, v := range batch.Kinds {
+		if !containsString(batch.LoadedKinds, v) {
+			return false
+		}
+	}
+	batch.State = ImportBatchStateCopying
+	return true
+}
+
+// copied records the kind copied into the dataset.
+func (batch *ImportBatch) copied(kind string) {
+	if !containsString(batch.CopiedKinds, kind) {
+		batch.CopiedKinds = append(batch.CopiedKinds, kind)
+	}
+	if batch.State == ImportBatchStateCopying && len(batch.CopiedKinds) == len(batch.LoadedKinds) {
+		batch.State = ImportBatchStateDone
+	}
+}
+
+// fail records the kind failed to import.
+// The failure in copying means that the dataset is partially overwritten.
+func (batch *ImportBatch) fail(kind string, err error) {
+	if !containsString(batch.FailedKinds, kind) {
+		batch.FailedKinds = append(batch.FailedKinds, kind)
+	}
+	switch batch.State {
+	case ImportBatchStateLoading:
+		batch.State = ImportBatchStateFailed
+	case ImportBatchStateCopying:
+		batch.State = ImportBatchStatePartiallyCopied
+	}
+	if batch.Error == "" {
+		batch.Error = kind + ": " + err.Error()
+	}
+}
+
+// expire fails kinds that are not loaded or copied yet, if the batch is not done by the deadline.
+// It reports whether the batch is expired.
+func (batch *ImportBatch) expire(now time.Time) bool {
+	if batch.Deadline.IsZero() || now.Before(batch.Deadline) {
+		return false
+	}
+	switch batch.State {
+	case ImportBatchStateLoading:
+		for _, kind := range batch.Kinds {
+			if !containsString(batch.LoadedKinds, kind) {
+				batch.fail(kind, ErrImportBatchTimeout)
+			}
+		}
+	case ImportBatchStateCopying:
+		for _, kind := range batch.LoadedKinds {
+			if !containsString(batch.CopiedKinds, kind) {
+				batch.fail(kind, ErrImportBatchTimeout)
+			}
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// finished reports whether no job of the batch is running, so that staging tables can be deleted.
+func (batch *ImportBatch) finished() bool {
+	switch batch.State {
+	case ImportBatchStateDone, ImportBatchStateFailed:
+		return true
+	case ImportBatchStatePartiallyCopied:
+		for _, kind := range batch.LoadedKinds {
+			if !containsString(batch.CopiedKinds, kind) && !containsString(batch.FailedKinds, kind) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// GetOrCreateImportBatch returns ImportBatch of the ID of batch, or puts batch if not exists.
+// It reports whether batch is created.
+func (store *AEDatastoreStore) GetOrCreateImportBatch(c context.Context, batch *ImportBatch) (*ImportBatch, bool, error) {
+	g := goon.FromContext(c)
+	var created bool
+	err := g.RunInTransaction(func(tg *goon.Goon) error {
+		current := &ImportBatch{ID: batch.ID}
+		err := tg.Get(current)
+		if err == nil {
+			batch = current
+			created = false
+			return nil
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		now := time.Now()
+		batch.CreatedAt = now
+		batch.UpdatedAt = now
+		_, err = tg.Put(batch)
+		created = true
+		return err
+	}, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	return batch, created, nil
+}
+
+// UpdateImportBatch updates ImportBatch by f in transaction.
+func (store *AEDatastoreStore) UpdateImportBatch(c context.Context, id string, f func(batch *ImportBatch) error) (*ImportBatch, error) {
+	g := goon.FromContext(c)
+	batch := &ImportBatch{ID: id}
+	err := g.RunInTransaction(func(tg *goon.Goon) error {
+		err := tg.Get(batch)
+		if err != nil {
+			return err
+		}
+		err = f(batch)
+		if err != nil {
+			return err
+		}
+		batch.UpdatedAt = time.Now()
+		_, err = tg.Put(batch)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
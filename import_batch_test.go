@@ -0,0 +1,139 @@
+package ds2bq
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBackupID(t *testing.T) {
+	for _, test := range []struct {
+		filePath string
+		want     string
+	}{
+		{"agtzfnN0Zy1jaGFvc3JACxIcX0FFX0RhdGFzdG9yZUFkbWluX09wZXJhdGlvbhjx52oMCxIWX0FFX0JhY2t1cF9JbmZvcm1hdGlvbhgBDA.Article.backup_info", "agtzfnN0Zy1jaGFvc3JACxIcX0FFX0RhdGFzdG9yZUFkbWluX09wZXJhdGlvbhjx52oMCxIWX0FFX0JhY2t1cF9JbmZvcm1hdGlvbhgBDA"},
+		{"daily/agtzfnN0Zy1jaGFvc3JA.User.backup_info", "agtzfnN0Zy1jaGFvc3JA"},
+		{"2017-11-14T06:47:01_23208/all_namespaces/kind_Item/all_namespaces_kind_Item.export_metadata", "2017-11-14T06:47:01_23208"},
+		{"exports/2017-11-14T06:47:01_23208/namespace_foo/kind_Item/namespace_foo_kind_Item.export_metadata", "exports/2017-11-14T06:47:01_23208"},
+	} {
+		if g := backupID(test.filePath); test.want != g {
+			t.Errorf("expected %s; got %s", test.want, g)
+		}
+	}
+}
+
+func TestImportBatch(t *testing.T) {
+	batch := &ImportBatch{Kinds: []string{"User", "Order"}, State: ImportBatchStateLoading}
+
+	if batch.loaded("User", "{}") {
+		t.Fatal("unexpected ready")
+	}
+	if batch.loaded("User", "{}") {
+		t.Fatal("unexpected ready")
+	}
+	if !batch.loaded("Order", "{}") {
+		t.Fatal("expected ready")
+	}
+	if e, g := ImportBatchStateCopying, batch.State; e != g {
+		t.Fatalf("expected %s; got %s", e, g)
+	}
+	if e, g := 2, len(batch.LoadedJobs); e != g {
+		t.Fatalf("expected %d; got %d", e, g)
+	}
+	// ready only once.
+	if batch.loaded("Order", "{}") {
+		t.Fatal("unexpected ready")
+	}
+
+	batch.copied("User")
+	if e, g := ImportBatchStateCopying, batch.State; e != g {
+		t.Fatalf("expected %s; got %s", e, g)
+	}
+	batch.copied("Order")
+	if e, g := ImportBatchStateDone, batch.State; e != g {
+		t.Fatalf("expected %s; got %s", e, g)
+	}
+}
+
+func TestImportBatch_fail(t *testing.T) {
+	batch := &ImportBatch{Kinds: []string{"User", "Order"}, State: ImportBatchStateLoading}
+
+	batch.loaded("User", "{}")
+	batch.fail("Order", errors.New("invalid"))
+	if e, g := ImportBatchStateFailed, batch.State; e != g {
+		t.Fatalf("expected %s; got %s", e, g)
+	}
+	if e, g := "Order: invalid", batch.Error; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	// the batch never gets ready after failure.
+	if batch.loaded("Order", "{}") {
+		t.Fatal("unexpected ready")
+	}
+}
+
+func TestImportBatch_failInCopying(t *testing.T) {
+	batch := &ImportBatch{Kinds: []string{"User", "Order"}, State: ImportBatchStateLoading}
+
+	batch.loaded("User", "{}")
+	batch.loaded("Order", "{}")
+	batch.copied("User")
+	batch.fail("Order", errors.New("invalid"))
+	if e, g := ImportBatchStatePartiallyCopied, batch.State; e != g {
+		t.Fatalf("expected %s; got %s", e, g)
+	}
+	if !batch.finished() {
+		t.Error("expected finished")
+	}
+}
+
+func TestImportBatch_expire(t *testing.T) {
+	deadline := time.Date(2017, 11, 15, 6, 47, 1, 0, time.UTC)
+	batch := &ImportBatch{Kinds: []string{"User", "Order"}, State: ImportBatchStateLoading, Deadline: deadline}
+
+	batch.loaded("User", "{}")
+	if batch.expire(deadline.Add(-time.Second)) {
+		t.Fatal("unexpected expired")
+	}
+	if !batch.expire(deadline) {
+		t.Fatal("expected expired")
+	}
+	if e, g := ImportBatchStateFailed, batch.State; e != g {
+		t.Fatalf("expected %s; got %s", e, g)
+	}
+	if e, g := []string{"Order"}, batch.FailedKinds; !reflect.DeepEqual(e, g) {
+		t.Errorf("expected %#v; got %#v", e, g)
+	}
+	if !batch.finished() {
+		t.Error("expected finished")
+	}
+	// a finished batch does not expire again.
+	if batch.expire(deadline) {
+		t.Error("unexpected expired")
+	}
+}
+
+func TestExportKinds(t *testing.T) {
+	id := "2017-11-14T06:47:01_23208"
+	names := []string{
+		id + "/all_namespaces/kind_Item/all_namespaces_kind_Item.export_metadata",
+		id + "/all_namespaces/kind_Item/output-0",
+		id + "/all_namespaces/kind_User/all_namespaces_kind_User.export_metadata",
+		id + "/all_namespaces/kind_Log/all_namespaces_kind_Log.export_metadata",
+	}
+	targets := []string{"Item", "User", "Order"}
+
+	if _, err := exportKinds(names, id, BackupSourceDatastoreExport, targets, DefaultKindExtractors()); err != errExportNotFinished {
+		t.Errorf("expected errExportNotFinished; got %v", err)
+	}
+
+	names = append(names, id+"/"+id+".overall_export_metadata")
+	kinds, err := exportKinds(names, id, BackupSourceDatastoreExport, targets, DefaultKindExtractors())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := []string{"Item", "User"}, kinds; !reflect.DeepEqual(e, g) {
+		t.Errorf("expected %#v; got %#v", e, g)
+	}
+}
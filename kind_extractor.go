@@ -0,0 +1,159 @@
+package ds2bq
+
+import (
+	"path"
+	"strings"
+	"time"
+)
+
+// BackupObjectInfo is the information of the backup extracted from the object name.
+type BackupObjectInfo struct {
+	Kind string
+	// Source is the product that made the backup like BackupSourceDatastoreExport.
+	Source string
+	// Namespace is empty for the default namespace, all namespaces or unknown.
+	Namespace string
+	// BackupID identifies the backup that the object belongs to. Objects of all kinds in a backup have the same ID.
+	BackupID string
+	// BackupTime is the time of the backup if the object name has it, or zero.
+	BackupTime time.Time
+}
+
+// Sources of backups.
+const (
+	BackupSourceDatastoreAdmin  = "datastore_admin"
+	BackupSourceDatastoreExport = "datastore_export"
+	BackupSourceFirestoreExport = "firestore_export"
+)
+
+// KindExtractor extracts the backup information from the name of the object.
+// It reports false if the object is not a backup file that it knows.
+type KindExtractor interface {
+	ExtractKind(name string) (*BackupObjectInfo, bool)
+}
+
+// KindExtractorFunc is an adapter to use a function as KindExtractor.
+type KindExtractorFunc func(name string) (*BackupObjectInfo, bool)
+
+// ExtractKind calls f(name).
+func (f KindExtractorFunc) ExtractKind(name string) (*BackupObjectInfo, bool) {
+	return f(name)
+}
+
+// KindExtractors is the registry of KindExtractor tried in order.
+type KindExtractors []KindExtractor
+
+// ExtractKind returns the result of the first extractor that knows the object.
+func (es KindExtractors) ExtractKind(name string) (*BackupObjectInfo, bool) {
+	for _, e := range es {
+		if info, ok := e.ExtractKind(name); ok && info.Kind != "" {
+			return info, true
+		}
+	}
+	return nil, false
+}
+
+// DefaultKindExtractors returns extractors of Datastore Admin backup and managed export.
+func DefaultKindExtractors() KindExtractors {
+	return KindExtractors{
+		DatastoreAdminKindExtractor(),
+		DatastoreExportKindExtractor(),
+	}
+}
+
+type gcsWatcherKindExtractorsOption struct {
+	KindExtractors []KindExtractor
+}
+
+func (o *gcsWatcherKindExtractorsOption) implements(s *gcsWatcherService) {
+	s.KindExtractors = append(s.KindExtractors, o.KindExtractors...)
+}
+
+// GCSWatcherWithKindExtractors provides extractors for custom object layouts.
+// They are tried in order before DefaultKindExtractors.
+func GCSWatcherWithKindExtractors(extractors ...KindExtractor) GCSWatcherOption {
+	return &gcsWatcherKindExtractorsOption{
+		KindExtractors: extractors,
+	}
+}
+
+// kindExtractors returns custom extractors, the extractor of FirestoreExport and DefaultKindExtractors in order.
+func (s *gcsWatcherService) kindExtractors() KindExtractors {
+	extractors := append(KindExtractors{}, s.KindExtractors...)
+	if s.FirestoreExport != nil {
+		extractors = append(extractors, FirestoreExportKindExtractor(s.FirestoreExport.Prefix))
+	}
+	return append(extractors, DefaultKindExtractors()...)
+}
+
+// DatastoreAdminKindExtractor returns KindExtractor of Datastore Admin backup
+// like agtzfnN0Zy1jaGFvc3JACxIcX0FFX0RhdGFzdG9yZUFkbWluX09wZXJhdGlvbhjx52oMCxIWX0FFX0JhY2t1cF9JbmZvcm1hdGlvbhgBDA.Article.backup_info.
+func DatastoreAdminKindExtractor() KindExtractor {
+	return KindExtractorFunc(func(name string) (*BackupObjectInfo, bool) {
+		kind := (&GCSObject{}).extractKindNameForDatastoreAdmin(name)
+		if kind == "" {
+			return nil, false
+		}
+		return &BackupObjectInfo{
+			Kind:     kind,
+			Source:   BackupSourceDatastoreAdmin,
+			BackupID: backupID(name),
+		}, true
+	})
+}
+
+// DatastoreExportKindExtractor returns KindExtractor of managed export
+// like 2017-11-14T06:47:01_23208/all_namespaces/kind_Item/all_namespaces_kind_Item.export_metadata.
+func DatastoreExportKindExtractor() KindExtractor {
+	return KindExtractorFunc(func(name string) (*BackupObjectInfo, bool) {
+		kind := (&GCSObject{}).extractKindNameForDatastoreExport(name)
+		if kind == "" {
+			return nil, false
+		}
+		id := backupID(name)
+		return &BackupObjectInfo{
+			Kind:       kind,
+			Source:     BackupSourceDatastoreExport,
+			Namespace:  (&GCSObject{Name: name}).ExtractNamespaceName(),
+			BackupID:   id,
+			BackupTime: exportTime(id),
+		}, true
+	})
+}
+
+// FirestoreExportKindExtractor returns KindExtractor of Firestore export of collection groups under the prefix
+// like firestore/2019-01-01T00:00:00_12345/all_namespaces/kind_users/all_namespaces_kind_users.export_metadata.
+// Its layout is the same as managed export of Datastore, so the prefix tells Firestore exports apart.
+// Collection groups have no namespace.
+func FirestoreExportKindExtractor(prefix string) KindExtractor {
+	return KindExtractorFunc(func(name string) (*BackupObjectInfo, bool) {
+		if !strings.HasPrefix(name, prefix) {
+			return nil, false
+		}
+		dir, file := path.Split(name)
+		collection := strings.TrimPrefix(path.Base(dir), "kind_")
+		if collection == path.Base(dir) || file != "all_namespaces_kind_"+collection+".export_metadata" {
+			return nil, false
+		}
+		id := backupID(name)
+		return &BackupObjectInfo{
+			Kind:       collection,
+			Source:     BackupSourceFirestoreExport,
+			BackupID:   id,
+			BackupTime: exportTime(id),
+		}, true
+	})
+}
+
+// exportTime returns the time of the default export prefix like 2017-11-14T06:47:01_23208, or zero.
+func exportTime(id string) time.Time {
+	base := path.Base(id)
+	if v := strings.LastIndex(base, "_"); v != -1 {
+		base = base[:v]
+	}
+	t, err := time.Parse("2006-01-02T15:04:05", base)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
@@ -0,0 +1,102 @@
+package ds2bq
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKindExtractors_ExtractKind(t *testing.T) {
+	custom := KindExtractorFunc(func(name string) (*BackupObjectInfo, bool) {
+		// exports/<date>/<Kind>.json
+		elems := strings.Split(name, "/")
+		if len(elems) != 3 || elems[0] != "exports" || !strings.HasSuffix(elems[2], ".json") {
+			return nil, false
+		}
+		date, err := time.Parse("20060102", elems[1])
+		if err != nil {
+			return nil, false
+		}
+		return &BackupObjectInfo{
+			Kind:       strings.TrimSuffix(elems[2], ".json"),
+			BackupID:   elems[0] + "/" + elems[1],
+			BackupTime: date,
+		}, true
+	})
+	extractors := append(KindExtractors{custom, FirestoreExportKindExtractor("firestore/")}, DefaultKindExtractors()...)
+
+	tests := []struct {
+		name string
+		want *BackupObjectInfo
+	}{
+		{
+			name: "agtzfnN0Zy1jaGFvc3JACxIcX0FFX0RhdGFzdG9yZUFkbWluX09wZXJhdGlvbhjx52oMCxIWX0FFX0JhY2t1cF9JbmZvcm1hdGlvbhgBDA.Article.backup_info",
+			want: &BackupObjectInfo{Kind: "Article", BackupID: "agtzfnN0Zy1jaGFvc3JACxIcX0FFX0RhdGFzdG9yZUFkbWluX09wZXJhdGlvbhjx52oMCxIWX0FFX0JhY2t1cF9JbmZvcm1hdGlvbhgBDA"},
+		},
+		{
+			name: "2017-11-14T06:47:01_23208/namespace_Tenant1/kind_Item/namespace_Tenant1_kind_Item.export_metadata",
+			want: &BackupObjectInfo{Kind: "Item", Namespace: "Tenant1", BackupID: "2017-11-14T06:47:01_23208", BackupTime: time.Date(2017, 11, 14, 6, 47, 1, 0, time.UTC)},
+		},
+		{
+			name: "firestore/2019-01-01T00:00:00_12345/all_namespaces/kind_users/all_namespaces_kind_users.export_metadata",
+			want: &BackupObjectInfo{Kind: "users", BackupID: "firestore/2019-01-01T00:00:00_12345", BackupTime: time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)},
+		},
+		{
+			name: "exports/20171114/Article.json",
+			want: &BackupObjectInfo{Kind: "Article", BackupID: "exports/20171114", BackupTime: time.Date(2017, 11, 14, 0, 0, 0, 0, time.UTC)},
+		},
+		{
+			name: "2017-11-14T06:47:01_23208/all_namespaces/kind_Item/output-95",
+		},
+	}
+
+	for _, test := range tests {
+		info, ok := extractors.ExtractKind(test.name)
+		if test.want == nil {
+			if ok {
+				t.Errorf("%s: expected not to be extracted; got %s", test.name, info.Kind)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("%s: expected to be extracted", test.name)
+			continue
+		}
+		if e, g := test.want.Kind, info.Kind; e != g {
+			t.Errorf("%s: expected kind %s; got %s", test.name, e, g)
+		}
+		if e, g := test.want.Namespace, info.Namespace; e != g {
+			t.Errorf("%s: expected namespace %s; got %s", test.name, e, g)
+		}
+		if e, g := test.want.BackupID, info.BackupID; e != g {
+			t.Errorf("%s: expected backup ID %s; got %s", test.name, e, g)
+		}
+		if e, g := test.want.BackupTime, info.BackupTime; !e.Equal(g) {
+			t.Errorf("%s: expected backup time %s; got %s", test.name, e, g)
+		}
+	}
+}
+
+func TestGCSObject_toBQJobReq(t *testing.T) {
+	o := &GCSObject{
+		Bucket:      "backup",
+		Name:        "2017-11-14T06:47:01_23208/all_namespaces/kind_Item/all_namespaces_kind_Item.export_metadata",
+		TimeCreated: time.Date(2017, 11, 14, 7, 0, 0, 0, time.UTC),
+	}
+	req := o.toBQJobReq(DefaultKindExtractors())
+	if e, g := "Item", req.KindName; e != g {
+		t.Errorf("expected kind %s; got %s", e, g)
+	}
+	if e, g := "2017-11-14T06:47:01_23208", req.BackupID; e != g {
+		t.Errorf("expected backup ID %s; got %s", e, g)
+	}
+	if e, g := time.Date(2017, 11, 14, 6, 47, 1, 0, time.UTC), req.BackupTime; !e.Equal(g) {
+		t.Errorf("expected time %s; got %s", e, g)
+	}
+	if e, g := o.TimeCreated, req.TimeCreated; !e.Equal(g) {
+		t.Errorf("expected time %s; got %s", e, g)
+	}
+	if e, g := req.BackupTime, req.snapshotTime(); !e.Equal(g) {
+		t.Errorf("expected time %s; got %s", e, g)
+	}
+}
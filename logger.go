@@ -0,0 +1,238 @@
+package ds2bq
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/appengine/log"
+)
+
+// Level is severity of log entry.
+type Level int
+
+// Levels of log entry.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarning
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarning:
+		return "WARNING"
+	case LevelError:
+		return "ERROR"
+	default:
+		return fmt.Sprintf("Level(%d)", int(l))
+	}
+}
+
+// Field is key/value pair attached to log entry.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F returns a Field.
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Keys of Field commonly used in ds2bq.
+const (
+	FieldBucket    = "bucket"
+	FieldObject    = "object"
+	FieldKind      = "kind"
+	FieldJobID     = "jobID"
+	FieldBackupKey = "backupKey"
+	FieldQueue     = "queue"
+	FieldError     = "error"
+)
+
+// Logger writes structured log entries.
+type Logger interface {
+	Log(c context.Context, level Level, msg string, fields ...Field)
+}
+
+// NewAppEngineLogger returns a Logger that writes to google.golang.org/appengine/log.
+// Fields are appended to the message as key=value.
+func NewAppEngineLogger() Logger {
+	return appEngineLogger{}
+}
+
+type appEngineLogger struct{}
+
+func (appEngineLogger) Log(c context.Context, level Level, msg string, fields ...Field) {
+	buf := bytes.NewBufferString(msg)
+	for _, f := range fields {
+		fmt.Fprintf(buf, " %s=%v", f.Key, f.Value)
+	}
+
+	switch level {
+	case LevelDebug:
+		log.Debugf(c, "%s", buf.String())
+	case LevelInfo:
+		log.Infof(c, "%s", buf.String())
+	case LevelWarning:
+		log.Warningf(c, "%s", buf.String())
+	default:
+		log.Errorf(c, "%s", buf.String())
+	}
+}
+
+// NewJSONLogger returns a Logger that writes an entry per line as JSON to w, e.g. os.Stdout.
+// The format is understood by Cloud Logging agents.
+func NewJSONLogger(w io.Writer) Logger {
+	return &jsonLogger{w: w}
+}
+
+type jsonLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *jsonLogger) Log(c context.Context, level Level, msg string, fields ...Field) {
+	buf := &bytes.Buffer{}
+	buf.WriteString("{")
+	writeJSONField(buf, "time", time.Now().Format(time.RFC3339Nano))
+	buf.WriteString(",")
+	writeJSONField(buf, "severity", level.String())
+	buf.WriteString(",")
+	writeJSONField(buf, "message", msg)
+	for _, f := range fields {
+		buf.WriteString(",")
+		writeJSONField(buf, f.Key, f.Value)
+	}
+	buf.WriteString("}\n")
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(buf.Bytes())
+}
+
+func writeJSONField(buf *bytes.Buffer, key string, value interface{}) {
+	if err, ok := value.(error); ok {
+		value = err.Error()
+	}
+	k, _ := json.Marshal(key)
+	v, err := json.Marshal(value)
+	if err != nil {
+		v, _ = json.Marshal(fmt.Sprintf("%v", value))
+	}
+	buf.Write(k)
+	buf.WriteString(":")
+	buf.Write(v)
+}
+
+// LogEntry is an entry recorded by LogRecorder.
+type LogEntry struct {
+	Level   Level
+	Message string
+	Fields  []Field
+}
+
+// Field returns value of the field named key, or nil.
+func (e *LogEntry) Field(key string) interface{} {
+	for _, f := range e.Fields {
+		if f.Key == key {
+			return f.Value
+		}
+	}
+	return nil
+}
+
+// LogRecorder is a Logger that records entries in memory for tests.
+type LogRecorder struct {
+	mu      sync.Mutex
+	entries []*LogEntry
+}
+
+// Log implements Logger.
+func (r *LogRecorder) Log(c context.Context, level Level, msg string, fields ...Field) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, &LogEntry{Level: level, Message: msg, Fields: fields})
+}
+
+// Entries returns recorded entries.
+func (r *LogRecorder) Entries() []*LogEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*LogEntry(nil), r.entries...)
+}
+
+type loggerKey struct{}
+
+// withLogger returns a context that carries l.
+func withLogger(c context.Context, l Logger) context.Context {
+	if l == nil {
+		return c
+	}
+	return context.WithValue(c, loggerKey{}, l)
+}
+
+// loggerFromContext returns the Logger in c, or the App Engine Logger.
+func loggerFromContext(c context.Context) Logger {
+	if l, ok := c.Value(loggerKey{}).(Logger); ok {
+		return l
+	}
+	return appEngineLogger{}
+}
+
+func logDebug(c context.Context, msg string, fields ...Field) {
+	loggerFromContext(c).Log(c, LevelDebug, msg, fields...)
+}
+
+func logInfo(c context.Context, msg string, fields ...Field) {
+	loggerFromContext(c).Log(c, LevelInfo, msg, fields...)
+}
+
+func logWarning(c context.Context, msg string, fields ...Field) {
+	loggerFromContext(c).Log(c, LevelWarning, msg, fields...)
+}
+
+func logError(c context.Context, msg string, fields ...Field) {
+	loggerFromContext(c).Log(c, LevelError, msg, fields...)
+}
+
+// loggableHeaders are headers that do not contain secrets.
+var loggableHeaders = map[string]bool{
+	"Content-Type":              true,
+	"Content-Length":            true,
+	"User-Agent":                true,
+	"X-Goog-Channel-Id":         true,
+	"X-Goog-Channel-Expiration": true,
+	"X-Goog-Message-Number":     true,
+	"X-Goog-Resource-Id":        true,
+	"X-Goog-Resource-State":     true,
+	"X-Goog-Resource-Uri":       true,
+	"X-Appengine-Queuename":     true,
+	"X-Appengine-Taskname":      true,
+	"X-Appengine-Cron":          true,
+}
+
+// redactHeader returns a copy of h that values of unknown headers are replaced, e.g. X-Goog-Channel-Token and Authorization.
+func redactHeader(h http.Header) map[string]string {
+	m := make(map[string]string, len(h))
+	for k, vs := range h {
+		if loggableHeaders[http.CanonicalHeaderKey(k)] {
+			m[k] = strings.Join(vs, ", ")
+		} else {
+			m[k] = "REDACTED"
+		}
+	}
+	return m
+}
@@ -0,0 +1,67 @@
+package ds2bq
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestJSONLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := NewJSONLogger(buf)
+	l.Log(context.Background(), LevelWarning, "ds2bq: job failed", F(FieldKind, "Article"), F(FieldJobID, "job_1"), F(FieldError, errors.New("boom")))
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]string{
+		"severity": "WARNING",
+		"message":  "ds2bq: job failed",
+		"kind":     "Article",
+		"jobID":    "job_1",
+		"error":    "boom",
+	} {
+		if e, g := v, entry[k]; e != g {
+			t.Errorf("expected %s %v; got %v", k, e, g)
+		}
+	}
+}
+
+func TestLogRecorder(t *testing.T) {
+	r := &LogRecorder{}
+	c := withLogger(context.Background(), r)
+	logInfo(c, "ds2bq: receive OCN", F(FieldBucket, "backup"))
+
+	entries := r.Entries()
+	if len(entries) != 1 {
+		t.Fatalf("unexpected len %d", len(entries))
+	}
+	if e, g := LevelInfo, entries[0].Level; e != g {
+		t.Errorf("expected level %s; got %s", e, g)
+	}
+	if e, g := "backup", entries[0].Field(FieldBucket); e != g {
+		t.Errorf("expected bucket %v; got %v", e, g)
+	}
+}
+
+func TestRedactHeader(t *testing.T) {
+	h := http.Header{}
+	h.Set("X-Goog-Resource-State", "exists")
+	h.Set("X-Goog-Channel-Token", "secret")
+	h.Set("Authorization", "Bearer secret")
+
+	got := redactHeader(h)
+	if e, g := "exists", got["X-Goog-Resource-State"]; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	if e, g := "REDACTED", got["X-Goog-Channel-Token"]; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	if e, g := "REDACTED", got["Authorization"]; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+}
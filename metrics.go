@@ -0,0 +1,58 @@
+package ds2bq
+
+import (
+	"context"
+	"time"
+)
+
+// Metrics records counters and histograms about notifications, imports and cleanup.
+type Metrics interface {
+	// NotificationReceived counts OCN by X-Goog-Resource-State.
+	NotificationReceived(c context.Context, state string)
+	// ObjectFiltered counts objects that are not import target by reason.
+	ObjectFiltered(c context.Context, reason SkipReason)
+	// LoadJobSubmitted counts load jobs inserted to BigQuery by kind.
+	LoadJobSubmitted(c context.Context, kind string)
+	// LoadJobFailed counts load jobs that could not be inserted or finished with error by kind.
+	LoadJobFailed(c context.Context, kind string)
+	// LoadJobDuration records the duration between creation and end of the load job by kind.
+	LoadJobDuration(c context.Context, kind string, d time.Duration)
+	// RowCountMismatch counts imports whose row count deviates from the backup beyond the tolerance by kind.
+	RowCountMismatch(c context.Context, kind string)
+	// BackupDeleted counts removed backup information.
+	BackupDeleted(c context.Context)
+	// EntitiesDeleted records the number of entities removed with a backup information.
+	EntitiesDeleted(c context.Context, n int)
+	// TaskEnqueueFailed counts failures of adding task by queue name.
+	TaskEnqueueFailed(c context.Context, queueName string)
+}
+
+// NopMetrics is a Metrics that records nothing.
+type NopMetrics struct{}
+
+// NotificationReceived implements Metrics.
+func (NopMetrics) NotificationReceived(c context.Context, state string) {}
+
+// ObjectFiltered implements Metrics.
+func (NopMetrics) ObjectFiltered(c context.Context, reason SkipReason) {}
+
+// LoadJobSubmitted implements Metrics.
+func (NopMetrics) LoadJobSubmitted(c context.Context, kind string) {}
+
+// LoadJobFailed implements Metrics.
+func (NopMetrics) LoadJobFailed(c context.Context, kind string) {}
+
+// LoadJobDuration implements Metrics.
+func (NopMetrics) LoadJobDuration(c context.Context, kind string, d time.Duration) {}
+
+// RowCountMismatch implements Metrics.
+func (NopMetrics) RowCountMismatch(c context.Context, kind string) {}
+
+// BackupDeleted implements Metrics.
+func (NopMetrics) BackupDeleted(c context.Context) {}
+
+// EntitiesDeleted implements Metrics.
+func (NopMetrics) EntitiesDeleted(c context.Context, n int) {}
+
+// TaskEnqueueFailed implements Metrics.
+func (NopMetrics) TaskEnqueueFailed(c context.Context, queueName string) {}
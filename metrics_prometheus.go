@@ -0,0 +1,222 @@
+package ds2bq
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PrometheusMetrics is a Metrics that holds values in memory and exposes them in Prometheus text format.
+// Values are per instance, so scrape all instances or aggregate them on the Prometheus side.
+type PrometheusMetrics struct {
+	mu         sync.Mutex
+	counters   map[string]*promCounter
+	histograms map[string]*promHistogram
+}
+
+type promCounter struct {
+	help   string
+	label  string
+	values map[string]float64
+}
+
+type promHistogram struct {
+	help    string
+	label   string
+	buckets []float64
+	values  map[string]*promHistogramValue
+}
+
+type promHistogramValue struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewPrometheusMetrics returns ready to use PrometheusMetrics.
+func NewPrometheusMetrics() *PrometheusMetrics {
+	m := &PrometheusMetrics{
+		counters:   make(map[string]*promCounter),
+		histograms: make(map[string]*promHistogram),
+	}
+	m.counters["ds2bq_notifications_received_total"] = &promCounter{help: "Number of received object change notifications.", label: "state"}
+	m.counters["ds2bq_objects_filtered_total"] = &promCounter{help: "Number of objects that are not import target.", label: "reason"}
+	m.counters["ds2bq_load_jobs_submitted_total"] = &promCounter{help: "Number of load jobs inserted to BigQuery.", label: "kind"}
+	m.counters["ds2bq_load_jobs_failed_total"] = &promCounter{help: "Number of load jobs failed.", label: "kind"}
+	m.counters["ds2bq_row_count_mismatches_total"] = &promCounter{help: "Number of imports whose row count deviates from the backup.", label: "kind"}
+	m.counters["ds2bq_backups_deleted_total"] = &promCounter{help: "Number of removed backup informations."}
+	m.counters["ds2bq_task_enqueue_failures_total"] = &promCounter{help: "Number of failures of adding task.", label: "queue"}
+	m.histograms["ds2bq_load_job_duration_seconds"] = &promHistogram{
+		help:    "Duration between creation and end of load jobs.",
+		label:   "kind",
+		buckets: []float64{5, 10, 30, 60, 120, 300, 600, 1800, 3600},
+	}
+	m.histograms["ds2bq_entities_deleted"] = &promHistogram{
+		help:    "Number of entities removed with a backup information.",
+		buckets: []float64{10, 100, 1000, 10000, 100000},
+	}
+	for _, c := range m.counters {
+		c.values = make(map[string]float64)
+	}
+	for _, h := range m.histograms {
+		h.values = make(map[string]*promHistogramValue)
+	}
+	return m
+}
+
+func (m *PrometheusMetrics) inc(name, labelValue string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.counters[name].values[labelValue]++
+}
+
+func (m *PrometheusMetrics) observe(name, labelValue string, v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h := m.histograms[name]
+	hv, ok := h.values[labelValue]
+	if !ok {
+		hv = &promHistogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[labelValue] = hv
+	}
+	for i, le := range h.buckets {
+		if v <= le {
+			hv.counts[i]++
+		}
+	}
+	hv.sum += v
+	hv.count++
+}
+
+// NotificationReceived implements Metrics.
+func (m *PrometheusMetrics) NotificationReceived(c context.Context, state string) {
+	m.inc("ds2bq_notifications_received_total", state)
+}
+
+// ObjectFiltered implements Metrics.
+func (m *PrometheusMetrics) ObjectFiltered(c context.Context, reason SkipReason) {
+	m.inc("ds2bq_objects_filtered_total", string(reason))
+}
+
+// LoadJobSubmitted implements Metrics.
+func (m *PrometheusMetrics) LoadJobSubmitted(c context.Context, kind string) {
+	m.inc("ds2bq_load_jobs_submitted_total", kind)
+}
+
+// LoadJobFailed implements Metrics.
+func (m *PrometheusMetrics) LoadJobFailed(c context.Context, kind string) {
+	m.inc("ds2bq_load_jobs_failed_total", kind)
+}
+
+// LoadJobDuration implements Metrics.
+func (m *PrometheusMetrics) LoadJobDuration(c context.Context, kind string, d time.Duration) {
+	m.observe("ds2bq_load_job_duration_seconds", kind, d.Seconds())
+}
+
+// RowCountMismatch implements Metrics.
+func (m *PrometheusMetrics) RowCountMismatch(c context.Context, kind string) {
+	m.inc("ds2bq_row_count_mismatches_total", kind)
+}
+
+// BackupDeleted implements Metrics.
+func (m *PrometheusMetrics) BackupDeleted(c context.Context) {
+	m.inc("ds2bq_backups_deleted_total", "")
+}
+
+// EntitiesDeleted implements Metrics.
+func (m *PrometheusMetrics) EntitiesDeleted(c context.Context, n int) {
+	m.observe("ds2bq_entities_deleted", "", float64(n))
+}
+
+// TaskEnqueueFailed implements Metrics.
+func (m *PrometheusMetrics) TaskEnqueueFailed(c context.Context, queueName string) {
+	m.inc("ds2bq_task_enqueue_failures_total", queueName)
+}
+
+// ServeHTTP writes all values in Prometheus text exposition format.
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(m.exposition())
+}
+
+func (m *PrometheusMetrics) exposition() []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	buf := &bytes.Buffer{}
+	for _, name := range sortedKeys(m.counters) {
+		c := m.counters[name]
+		fmt.Fprintf(buf, "# HELP %s %s\n", name, c.help)
+		fmt.Fprintf(buf, "# TYPE %s counter\n", name)
+		for _, lv := range sortedKeys(c.values) {
+			fmt.Fprintf(buf, "%s%s %s\n", name, promLabels(c.label, lv, ""), formatPromValue(c.values[lv]))
+		}
+	}
+	for _, name := range sortedKeys(m.histograms) {
+		h := m.histograms[name]
+		fmt.Fprintf(buf, "# HELP %s %s\n", name, h.help)
+		fmt.Fprintf(buf, "# TYPE %s histogram\n", name)
+		for _, lv := range sortedKeys(h.values) {
+			hv := h.values[lv]
+			for i, le := range h.buckets {
+				fmt.Fprintf(buf, "%s_bucket%s %d\n", name, promLabels(h.label, lv, formatPromValue(le)), hv.counts[i])
+			}
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", name, promLabels(h.label, lv, "+Inf"), hv.count)
+			fmt.Fprintf(buf, "%s_sum%s %s\n", name, promLabels(h.label, lv, ""), formatPromValue(hv.sum))
+			fmt.Fprintf(buf, "%s_count%s %d\n", name, promLabels(h.label, lv, ""), hv.count)
+		}
+	}
+	return buf.Bytes()
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]*promCounter:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*promHistogram:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]float64:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*promHistogramValue:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func promLabels(label, value, le string) string {
+	var pairs []string
+	if label != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, label, promLabelValueEscaper.Replace(value)))
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf(`le="%s"`, le))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var promLabelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatPromValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
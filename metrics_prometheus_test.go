@@ -0,0 +1,36 @@
+package ds2bq
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusMetrics_exposition(t *testing.T) {
+	c := context.Background()
+
+	m := NewPrometheusMetrics()
+	m.NotificationReceived(c, "exists")
+	m.NotificationReceived(c, "exists")
+	m.ObjectFiltered(c, SkipReasonNotBackupFile)
+	m.LoadJobDuration(c, "Article", 20*time.Second)
+	m.TaskEnqueueFailed(c, `a"b`)
+
+	got := string(m.exposition())
+	for _, want := range []string{
+		"# TYPE ds2bq_notifications_received_total counter\n",
+		`ds2bq_notifications_received_total{state="exists"} 2` + "\n",
+		`ds2bq_objects_filtered_total{reason="not_backup_file"} 1` + "\n",
+		"# TYPE ds2bq_load_job_duration_seconds histogram\n",
+		`ds2bq_load_job_duration_seconds_bucket{kind="Article",le="10"} 0` + "\n",
+		`ds2bq_load_job_duration_seconds_bucket{kind="Article",le="30"} 1` + "\n",
+		`ds2bq_load_job_duration_seconds_bucket{kind="Article",le="+Inf"} 1` + "\n",
+		`ds2bq_load_job_duration_seconds_sum{kind="Article"} 20` + "\n",
+		`ds2bq_task_enqueue_failures_total{queue="a\"b"} 1` + "\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected %q in\n%s", want, got)
+		}
+	}
+}
@@ -4,11 +4,17 @@ package ds2bq
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"net/http"
+	"strings"
 
 	"github.com/mjibson/goon"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
 	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/urlfetch"
 )
 
 // ErrInvalidID is message of Invalid ID error.
@@ -69,7 +75,7 @@ func ExecQuery(c context.Context, q *datastore.Query, ldr QueryListLoader) error
 
 	q = q.KeysOnly()
 
-	log.Debugf(c, "%#v", q)
+	logDebug(c, "ds2bq: exec query", F("query", fmt.Sprintf("%#v", q)))
 
 	t := g.Run(q)
 
@@ -120,3 +126,73 @@ func ExecQuery(c context.Context, q *datastore.Query, ldr QueryListLoader) error
 
 	return nil
 }
+
+// ServeMux is an interface to register http.Handler, e.g. *http.ServeMux.
+type ServeMux interface {
+	Handle(pattern string, handler http.Handler)
+}
+
+// allowMethods returns a http.Handler that accepts only the methods listed in comma separated methods.
+func allowMethods(methods string, h http.HandlerFunc) http.Handler {
+	allowed := strings.Split(methods, ",")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, method := range allowed {
+			if r.Method == method {
+				h(w, r)
+				return
+			}
+		}
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	})
+}
+
+// newGoogleClient returns http.Client that calls Google APIs with the service account of the app.
+func newGoogleClient(c context.Context, scopes ...string) *http.Client {
+	return &http.Client{
+		Transport: &oauth2.Transport{
+			Source: google.AppEngineTokenSource(c, scopes...),
+			Base:   &urlfetch.Transport{Context: c},
+		},
+	}
+}
+
+// httpError is an error with HTTP status code. It satisfies ucon.HTTPErrorResponse.
+type httpError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func newHTTPError(code int, format string, args ...interface{}) *httpError {
+	return &httpError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (err *httpError) Error() string {
+	return err.Message
+}
+
+// StatusCode returns HTTP status code.
+func (err *httpError) StatusCode() int {
+	return err.Code
+}
+
+// ErrorMessage returns the response body.
+func (err *httpError) ErrorMessage() interface{} {
+	return err
+}
+
+// writeJSON writes v as JSON response.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes err as JSON response. The status code is 500 unless err is *httpError.
+func writeError(w http.ResponseWriter, err error) {
+	herr, ok := err.(*httpError)
+	if !ok {
+		herr = &httpError{Code: http.StatusInternalServerError, Message: err.Error()}
+	}
+	writeJSON(w, herr.Code, herr)
+}
@@ -0,0 +1,111 @@
+package ds2bq
+
+import (
+	"context"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// SkipReason means why the object of OCN is not imported.
+type SkipReason string
+
+// Reasons of skipping import.
+const (
+	SkipReasonUnexpectedBucket SkipReason = "unexpected_bucket"
+	SkipReasonUnexpectedState  SkipReason = "unexpected_state"
+	SkipReasonNotBackupFile    SkipReason = "not_backup_file"
+	SkipReasonNotRequiredKind  SkipReason = "not_required_kind"
+	SkipReasonNotLoadable      SkipReason = "not_loadable"
+	SkipReasonWaitingOverall   SkipReason = "waiting_overall_export_metadata"
+)
+
+// Observer receives lifecycle events of import and cleanup.
+// Methods are called synchronously in the request, so heavy work should be delegated to taskqueue.
+type Observer interface {
+	// OnNotification is called when OCN is received.
+	OnNotification(c context.Context, obj *GCSObject)
+	// OnSkipped is called when the object of OCN is not an import target.
+	OnSkipped(c context.Context, obj *GCSObject, reason SkipReason)
+	// OnImportSubmitted is called when the load job is inserted to BigQuery.
+	OnImportSubmitted(c context.Context, req *GCSObjectToBQJobReq, jobID string)
+	// OnImportCompleted is called when the load job finished. err is not nil if the job failed.
+	OnImportCompleted(c context.Context, req *GCSObjectToBQJobReq, jobID string, err error)
+	// OnRowCountValidated is called when the row count of the loaded table is compared with the backup.
+	OnRowCountValidated(c context.Context, req *GCSObjectToBQJobReq, result *RowCountResult)
+	// OnBackupDeleted is called when the backup information was removed.
+	OnBackupDeleted(c context.Context, key *datastore.Key)
+	// OnFreshnessViolated is called when the freshness check finds the kind out of the SLO.
+	OnFreshnessViolated(c context.Context, status *KindFreshnessStatus)
+}
+
+// NopObserver is an Observer that does nothing.
+// Embed it to implement a part of Observer.
+type NopObserver struct{}
+
+// OnNotification implements Observer.
+func (NopObserver) OnNotification(c context.Context, obj *GCSObject) {}
+
+// OnSkipped implements Observer.
+func (NopObserver) OnSkipped(c context.Context, obj *GCSObject, reason SkipReason) {}
+
+// OnImportSubmitted implements Observer.
+func (NopObserver) OnImportSubmitted(c context.Context, req *GCSObjectToBQJobReq, jobID string) {}
+
+// OnImportCompleted implements Observer.
+func (NopObserver) OnImportCompleted(c context.Context, req *GCSObjectToBQJobReq, jobID string, err error) {
+}
+
+// OnRowCountValidated implements Observer.
+func (NopObserver) OnRowCountValidated(c context.Context, req *GCSObjectToBQJobReq, result *RowCountResult) {
+}
+
+// OnBackupDeleted implements Observer.
+func (NopObserver) OnBackupDeleted(c context.Context, key *datastore.Key) {}
+
+// OnFreshnessViolated implements Observer.
+func (NopObserver) OnFreshnessViolated(c context.Context, status *KindFreshnessStatus) {}
+
+// observers notifies events to all registered Observer.
+type observers []Observer
+
+func (os observers) OnNotification(c context.Context, obj *GCSObject) {
+	for _, o := range os {
+		o.OnNotification(c, obj)
+	}
+}
+
+func (os observers) OnSkipped(c context.Context, obj *GCSObject, reason SkipReason) {
+	for _, o := range os {
+		o.OnSkipped(c, obj, reason)
+	}
+}
+
+func (os observers) OnImportSubmitted(c context.Context, req *GCSObjectToBQJobReq, jobID string) {
+	for _, o := range os {
+		o.OnImportSubmitted(c, req, jobID)
+	}
+}
+
+func (os observers) OnImportCompleted(c context.Context, req *GCSObjectToBQJobReq, jobID string, err error) {
+	for _, o := range os {
+		o.OnImportCompleted(c, req, jobID, err)
+	}
+}
+
+func (os observers) OnRowCountValidated(c context.Context, req *GCSObjectToBQJobReq, result *RowCountResult) {
+	for _, o := range os {
+		o.OnRowCountValidated(c, req, result)
+	}
+}
+
+func (os observers) OnBackupDeleted(c context.Context, key *datastore.Key) {
+	for _, o := range os {
+		o.OnBackupDeleted(c, key)
+	}
+}
+
+func (os observers) OnFreshnessViolated(c context.Context, status *KindFreshnessStatus) {
+	for _, o := range os {
+		o.OnFreshnessViolated(c, status)
+	}
+}
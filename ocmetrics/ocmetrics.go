@@ -0,0 +1,117 @@
+// Package ocmetrics provides ds2bq.Metrics implementation that records values by OpenCensus.
+//
+// Register views and an exporter (Stackdriver, Prometheus, OpenTelemetry bridge, ...) on application side.
+//
+//	if err := view.Register(ocmetrics.Views()...); err != nil {
+//		panic(err)
+//	}
+//	s, err := ds2bq.NewGCSWatcherService(
+//		ds2bq.GCSWatcherWithMetrics(ocmetrics.New()),
+//		...
+//	)
+package ocmetrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/favclip/ds2bq"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+// Measures recorded by Metrics.
+var (
+	NotificationsReceived = stats.Int64("ds2bq/notifications_received", "Number of received object change notifications", "1")
+	ObjectsFiltered       = stats.Int64("ds2bq/objects_filtered", "Number of objects that are not import target", "1")
+	LoadJobsSubmitted     = stats.Int64("ds2bq/load_jobs_submitted", "Number of load jobs inserted to BigQuery", "1")
+	LoadJobsFailed        = stats.Int64("ds2bq/load_jobs_failed", "Number of load jobs failed", "1")
+	LoadJobDuration       = stats.Float64("ds2bq/load_job_duration", "Duration between creation and end of load jobs", "ms")
+	RowCountMismatches    = stats.Int64("ds2bq/row_count_mismatches", "Number of imports whose row count deviates from the backup", "1")
+	BackupsDeleted        = stats.Int64("ds2bq/backups_deleted", "Number of removed backup informations", "1")
+	EntitiesDeleted       = stats.Int64("ds2bq/entities_deleted", "Number of entities removed with a backup information", "1")
+	TaskEnqueueFailures   = stats.Int64("ds2bq/task_enqueue_failures", "Number of failures of adding task", "1")
+)
+
+// Tag keys recorded by Metrics.
+var (
+	KeyState  = mustNewKey("state")
+	KeyReason = mustNewKey("reason")
+	KeyKind   = mustNewKey("kind")
+	KeyQueue  = mustNewKey("queue")
+)
+
+func mustNewKey(name string) tag.Key {
+	k, err := tag.NewKey(name)
+	if err != nil {
+		panic(err)
+	}
+	return k
+}
+
+// Views returns views for all measures.
+func Views() []*view.View {
+	return []*view.View{
+		{Measure: NotificationsReceived, TagKeys: []tag.Key{KeyState}, Aggregation: view.Count()},
+		{Measure: ObjectsFiltered, TagKeys: []tag.Key{KeyReason}, Aggregation: view.Count()},
+		{Measure: LoadJobsSubmitted, TagKeys: []tag.Key{KeyKind}, Aggregation: view.Count()},
+		{Measure: LoadJobsFailed, TagKeys: []tag.Key{KeyKind}, Aggregation: view.Count()},
+		{Measure: LoadJobDuration, TagKeys: []tag.Key{KeyKind}, Aggregation: view.Distribution(5e3, 1e4, 3e4, 6e4, 1.2e5, 3e5, 6e5, 1.8e6, 3.6e6)},
+		{Measure: RowCountMismatches, TagKeys: []tag.Key{KeyKind}, Aggregation: view.Count()},
+		{Measure: BackupsDeleted, Aggregation: view.Count()},
+		{Measure: EntitiesDeleted, Aggregation: view.Distribution(10, 100, 1000, 10000, 100000)},
+		{Measure: TaskEnqueueFailures, TagKeys: []tag.Key{KeyQueue}, Aggregation: view.Count()},
+	}
+}
+
+// New returns ds2bq.Metrics that records to OpenCensus.
+func New() ds2bq.Metrics {
+	return metrics{}
+}
+
+type metrics struct{}
+
+func record(c context.Context, key tag.Key, value string, m stats.Measurement) {
+	c, err := tag.New(c, tag.Upsert(key, value))
+	if err != nil {
+		return
+	}
+	stats.Record(c, m)
+}
+
+func (metrics) NotificationReceived(c context.Context, state string) {
+	record(c, KeyState, state, NotificationsReceived.M(1))
+}
+
+func (metrics) ObjectFiltered(c context.Context, reason ds2bq.SkipReason) {
+	record(c, KeyReason, string(reason), ObjectsFiltered.M(1))
+}
+
+func (metrics) LoadJobSubmitted(c context.Context, kind string) {
+	record(c, KeyKind, kind, LoadJobsSubmitted.M(1))
+}
+
+func (metrics) LoadJobFailed(c context.Context, kind string) {
+	record(c, KeyKind, kind, LoadJobsFailed.M(1))
+}
+
+func (metrics) LoadJobDuration(c context.Context, kind string, d time.Duration) {
+	record(c, KeyKind, kind, LoadJobDuration.M(float64(d)/float64(time.Millisecond)))
+}
+
+func (metrics) RowCountMismatch(c context.Context, kind string) {
+	record(c, KeyKind, kind, RowCountMismatches.M(1))
+}
+
+func (metrics) BackupDeleted(c context.Context) {
+	stats.Record(c, BackupsDeleted.M(1))
+}
+
+func (metrics) EntitiesDeleted(c context.Context, n int) {
+	stats.Record(c, EntitiesDeleted.M(int64(n)))
+}
+
+func (metrics) TaskEnqueueFailed(c context.Context, queueName string) {
+	record(c, KeyQueue, queueName, TaskEnqueueFailures.M(1))
+}
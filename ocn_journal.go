@@ -0,0 +1,369 @@
+package ds2bq
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/mjibson/goon"
+	"google.golang.org/appengine/datastore"
+)
+
+// ocnJournalPurgeBatchSize is the number of expired entries removed in a batch of the purge.
+const ocnJournalPurgeBatchSize = 500
+
+// ocnJournalPurgeMaxBatches is the number of batches of the purge in a request, the rest is removed by the next request.
+const ocnJournalPurgeMaxBatches = 20
+
+// ocnJournalScanLimit is the number of entries scanned to find entries that match the filter in a request.
+const ocnJournalScanLimit = 5000
+
+// OCNJournal is the settings of the journal that saves recent notifications and decisions of them.
+type OCNJournal struct {
+	// Retention of entries. default is 7 days.
+	Retention time.Duration
+	// Authorizer of the endpoint that lists entries. default allows administrators.
+	Authorizer Authorizer
+}
+
+// OCNJournalEntry is the notification received by GCSWatcherService and the decision of import.
+type OCNJournalEntry struct {
+	Kind          string    `goon:"kind,DS2BQOCNJournal" json:"-"`
+	ID            int64     `datastore:"-" goon:"id" json:"id"`
+	ReceivedAt    time.Time `json:"receivedAt"`
+	ExpireAt      time.Time `json:"expireAt"`
+	Bucket        string    `json:"bucket"`
+	Object        string    `json:"object"`
+	Generation    string    `datastore:",noindex" json:"generation"`
+	Size          int64     `datastore:",noindex" json:"size"`
+	TimeCreated   time.Time `datastore:",noindex" json:"timeCreated"`
+	Md5Hash       string    `datastore:",noindex" json:"md5Hash"`
+	Crc32c        string    `datastore:",noindex" json:"crc32c"`
+	ResourceState string    `json:"resourceState"`
+	Header        string    `datastore:",noindex" json:"header"` // JSON of the header, values are redacted unless RawHeaderLogging.
+	Accepted      bool      `json:"accepted"`
+	Reason        string    `json:"reason,omitempty"`
+	Kinds         []string  `json:"kinds,omitempty"`
+	Error         string    `datastore:",noindex" json:"error,omitempty"`
+}
+
+// OCNJournalReq provides filters of listing the journal. Zero values match all entries.
+type OCNJournalReq struct {
+	Bucket   string    `json:"bucket"`
+	Kind     string    `json:"kind"`
+	Reason   string    `json:"reason"`
+	Accepted *bool     `json:"accepted"`
+	Since    time.Time `json:"since"`
+	Until    time.Time `json:"until"`
+	Limit    int       `json:"limit"`
+	Cursor   string    `json:"cursor"`
+}
+
+// OCNJournalList is the entries of the journal in order of the newest.
+// Cursor continues the scan if it is not empty, it is empty if no entry is left.
+type OCNJournalList struct {
+	Entries []*OCNJournalEntry `json:"entries"`
+	Cursor  string             `json:"cursor,omitempty"`
+}
+
+// OCNJournalPurgeResult is the result of removing expired entries of the journal.
+// Remaining is true if expired entries are left for the next request.
+type OCNJournalPurgeResult struct {
+	Deleted   int  `json:"deleted"`
+	Remaining bool `json:"remaining"`
+}
+
+type gcsWatcherOCNJournalOption struct {
+	OCNJournal *OCNJournal
+}
+
+func (o *gcsWatcherOCNJournalOption) implements(s *gcsWatcherService) {
+	s.OCNJournal = o.OCNJournal
+}
+
+// GCSWatcherWithOCNJournal provides that notifications and decisions of them are saved for the retention.
+// The endpoint that lists them is registered only if this option is used.
+func GCSWatcherWithOCNJournal(j *OCNJournal) GCSWatcherOption {
+	return &gcsWatcherOCNJournalOption{
+		OCNJournal: j,
+	}
+}
+
+type gcsWatcherOCNJournalURLOption struct {
+	APIOCNJournalURL string
+}
+
+func (o *gcsWatcherOCNJournalURLOption) implements(s *gcsWatcherService) {
+	if v := o.APIOCNJournalURL; v != "" {
+		s.APIOCNJournalURL = v
+	}
+}
+
+// GCSWatcherWithOCNJournalURL provides API endpoint URL that lists the journal.
+func GCSWatcherWithOCNJournalURL(apiOCNJournalURL string) GCSWatcherOption {
+	return &gcsWatcherOCNJournalURLOption{
+		APIOCNJournalURL: apiOCNJournalURL,
+	}
+}
+
+type gcsWatcherOCNJournalPurgeURLOption struct {
+	PurgeOCNJournalURL string
+}
+
+func (o *gcsWatcherOCNJournalPurgeURLOption) implements(s *gcsWatcherService) {
+	if v := o.PurgeOCNJournalURL; v != "" {
+		s.PurgeOCNJournalURL = v
+	}
+}
+
+// GCSWatcherWithOCNJournalPurgeURL provides endpoint URL that removes expired entries of the journal.
+// The endpoint should be requested by cron.
+func GCSWatcherWithOCNJournalPurgeURL(purgeOCNJournalURL string) GCSWatcherOption {
+	return &gcsWatcherOCNJournalPurgeURLOption{
+		PurgeOCNJournalURL: purgeOCNJournalURL,
+	}
+}
+
+func (j *OCNJournal) retention() time.Duration {
+	if j.Retention <= 0 {
+		return 7 * 24 * time.Hour
+	}
+	return j.Retention
+}
+
+func (j *OCNJournal) authorizer() Authorizer {
+	if j.Authorizer == nil {
+		return AdminAuthorizer()
+	}
+	return j.Authorizer
+}
+
+// matches reports whether the entry matches the filters of req.
+func (req *OCNJournalReq) matches(e *OCNJournalEntry) bool {
+	switch {
+	case req.Bucket != "" && e.Bucket != req.Bucket:
+		return false
+	case req.Kind != "" && !containsString(e.Kinds, req.Kind):
+		return false
+	case req.Reason != "" && e.Reason != req.Reason:
+		return false
+	case req.Accepted != nil && e.Accepted != *req.Accepted:
+		return false
+	case !req.Since.IsZero() && e.ReceivedAt.Before(req.Since):
+		return false
+	case !req.Until.IsZero() && !e.ReceivedAt.Before(req.Until):
+		return false
+	}
+	return true
+}
+
+// PutOCNJournalEntry saves the entry. Expired entries are removed by PurgeOCNJournal.
+func (store *AEDatastoreStore) PutOCNJournalEntry(c context.Context, e *OCNJournalEntry) error {
+	g := goon.FromContext(c)
+	_, err := g.Put(e)
+	return err
+}
+
+// PurgeOCNJournal removes entries expired at now in batches up to ocnJournalPurgeMaxBatches.
+func (store *AEDatastoreStore) PurgeOCNJournal(c context.Context, now time.Time) (*OCNJournalPurgeResult, error) {
+	g := goon.FromContext(c)
+
+	result := &OCNJournalPurgeResult{}
+	for i := 0; i < ocnJournalPurgeMaxBatches; i++ {
+		q := datastore.NewQuery(g.Kind(&OCNJournalEntry{})).Filter("ExpireAt <", now).KeysOnly().Limit(ocnJournalPurgeBatchSize)
+		keys, err := g.GetAll(q, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) == 0 {
+			return result, nil
+		}
+		err = g.DeleteMulti(keys)
+		if err != nil {
+			return nil, err
+		}
+		result.Deleted += len(keys)
+		if len(keys) < ocnJournalPurgeBatchSize {
+			return result, nil
+		}
+	}
+	result.Remaining = true
+	return result, nil
+}
+
+// ListOCNJournal returns entries that match req in order of the newest.
+// Since and Until are applied to the query, other filters are applied to scanned entries,
+// so it scans up to ocnJournalScanLimit entries without composite indexes.
+func (store *AEDatastoreStore) ListOCNJournal(c context.Context, req *OCNJournalReq) (*OCNJournalList, error) {
+	if req.Limit <= 0 || req.Limit > 1000 {
+		req.Limit = 100
+	}
+
+	g := goon.FromContext(c)
+	q := datastore.NewQuery(g.Kind(&OCNJournalEntry{})).Order("-ReceivedAt")
+	if !req.Since.IsZero() {
+		q = q.Filter("ReceivedAt >=", req.Since)
+	}
+	if !req.Until.IsZero() {
+		q = q.Filter("ReceivedAt <", req.Until)
+	}
+	if req.Cursor != "" {
+		cur, err := datastore.DecodeCursor(req.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		q = q.Start(cur)
+	}
+
+	list := &OCNJournalList{Entries: []*OCNJournalEntry{}}
+	it := g.Run(q)
+	for scanned := 0; ; scanned++ {
+		if len(list.Entries) == req.Limit || scanned == ocnJournalScanLimit {
+			cur, err := it.Cursor()
+			if err != nil {
+				return nil, err
+			}
+			// the cursor is returned only if an entry is left.
+			_, err = it.Next(&OCNJournalEntry{})
+			if err == datastore.Done {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			list.Cursor = cur.String()
+			break
+		}
+		e := &OCNJournalEntry{}
+		_, err := it.Next(e)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if req.matches(e) {
+			list.Entries = append(list.Entries, e)
+		}
+	}
+	return list, nil
+}
+
+// newOCNJournalEntry returns the entry of the notification.
+func newOCNJournalEntry(r *http.Request, obj *GCSObject, header interface{}, decision *ImportDecision, err error, now time.Time, retention time.Duration) *OCNJournalEntry {
+	e := &OCNJournalEntry{
+		ReceivedAt:    now,
+		ExpireAt:      now.Add(retention),
+		Bucket:        obj.Bucket,
+		Object:        obj.Name,
+		Generation:    obj.Generation,
+		Size:          obj.Size,
+		TimeCreated:   obj.TimeCreated,
+		Md5Hash:       obj.Md5Hash,
+		Crc32c:        obj.Crc32c,
+		ResourceState: NewGCSHeader(r).ResourceState,
+	}
+	if b, err := json.Marshal(header); err == nil {
+		e.Header = string(b)
+	}
+	if decision != nil {
+		e.Accepted = decision.Accepted
+		e.Reason = string(decision.Reason)
+		e.Kinds = decision.Kinds
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	return e
+}
+
+// recordOCN saves the notification and the decision into the journal if configured.
+// Failures are logged, the notification is processed anyway.
+func (s *gcsWatcherService) recordOCN(c context.Context, r *http.Request, obj *GCSObject, decision *ImportDecision, err error) {
+	if s.OCNJournal == nil {
+		return
+	}
+
+	var header interface{} = redactHeader(r.Header)
+	if s.RawHeaderLogging {
+		header = r.Header
+	}
+	e := newOCNJournalEntry(r, obj, header, decision, err, time.Now(), s.OCNJournal.retention())
+
+	store := &AEDatastoreStore{}
+	if err := store.PutOCNJournalEntry(c, e); err != nil {
+		logWarning(c, "ds2bq: failed to record OCN journal", F(FieldBucket, obj.Bucket), F(FieldObject, obj.Name), F(FieldError, err))
+	}
+}
+
+// HandleListOCNJournal returns entries of the journal that match req.
+func (s *gcsWatcherService) HandleListOCNJournal(c context.Context, req *OCNJournalReq) (*OCNJournalList, error) {
+	c = withLogger(c, s.Logger)
+
+	if s.OCNJournal == nil {
+		return nil, newHTTPError(http.StatusNotFound, "ds2bq: OCN journal is not configured")
+	}
+
+	store := &AEDatastoreStore{}
+	return store.ListOCNJournal(c, req)
+}
+
+// HandlePurgeOCNJournal removes expired entries of the journal.
+func (s *gcsWatcherService) HandlePurgeOCNJournal(c context.Context, req *Noop) (*OCNJournalPurgeResult, error) {
+	c = withLogger(c, s.Logger)
+
+	if s.OCNJournal == nil {
+		return nil, newHTTPError(http.StatusNotFound, "ds2bq: OCN journal is not configured")
+	}
+
+	store := &AEDatastoreStore{}
+	result, err := store.PurgeOCNJournal(c, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	logInfo(c, "ds2bq: expired OCN journal entries removed", F("deleted", result.Deleted), F("remaining", result.Remaining))
+	return result, nil
+}
+
+// purgeAuthorizer returns Authorizer of the endpoint that purges the journal, that allows cron and tasks.
+func (s *gcsWatcherService) purgeAuthorizer() Authorizer {
+	return AnyAuthorizer(CronAuthorizer(), s.TaskAuthorizer)
+}
+
+func (s *gcsWatcherService) servePurgeOCNJournal(w http.ResponseWriter, r *http.Request) {
+	c := s.newContext(r)
+
+	if !serveAuthorized(c, w, r, s.purgeAuthorizer()) {
+		return
+	}
+
+	resp, err := s.HandlePurgeOCNJournal(c, &Noop{})
+	if err != nil {
+		logError(c, "ds2bq: failed to purge OCN journal", F(FieldError, err))
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *gcsWatcherService) serveListOCNJournal(w http.ResponseWriter, r *http.Request) {
+	c := s.newContext(r)
+
+	if !serveAuthorized(c, w, r, s.OCNJournal.authorizer()) {
+		return
+	}
+
+	req, err := DecodeOCNJournalReqFromRequest(r)
+	if err != nil {
+		logError(c, "ds2bq: failed to decode request", F(FieldError, err))
+		writeError(w, newHTTPError(http.StatusBadRequest, "%s", err))
+		return
+	}
+
+	resp, err := s.HandleListOCNJournal(c, req)
+	if err != nil {
+		logError(c, "ds2bq: failed to list OCN journal", F(FieldError, err))
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
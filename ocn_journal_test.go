@@ -0,0 +1,127 @@
+package ds2bq
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/favclip/testerator"
+)
+
+func TestNewOCNJournalEntry(t *testing.T) {
+	r := httptest.NewRequest("POST", "/api/gcs/object-change-notification", nil)
+	r.Header.Set("X-Goog-Resource-State", "exists")
+	obj := &GCSObject{
+		Bucket: "backup",
+		Name:   "2017-11-14T06:47:01_23208/all_namespaces/kind_Item/all_namespaces_kind_Item.export_metadata",
+		Size:   100,
+	}
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	decision := &ImportDecision{Accepted: true, Kinds: []string{"Item"}}
+
+	entry := newOCNJournalEntry(r, obj, redactHeader(r.Header), decision, errors.New("failed"), now, 24*time.Hour)
+	if e, g := now.Add(24*time.Hour), entry.ExpireAt; !e.Equal(g) {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	if e, g := "exists", entry.ResourceState; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	if e, g := `{"X-Goog-Resource-State":"exists"}`, entry.Header; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	if !entry.Accepted {
+		t.Errorf("expected to be accepted")
+	}
+	if e, g := "failed", entry.Error; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+}
+
+func TestOCNJournalReq_matches(t *testing.T) {
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	entry := &OCNJournalEntry{
+		ReceivedAt: now,
+		Bucket:     "backup",
+		Reason:     string(SkipReasonNotRequiredKind),
+		Kinds:      []string{"User"},
+	}
+	accepted, rejected := true, false
+
+	tests := []struct {
+		req  *OCNJournalReq
+		want bool
+	}{
+		{req: &OCNJournalReq{}, want: true},
+		{req: &OCNJournalReq{Bucket: "backup", Kind: "User"}, want: true},
+		{req: &OCNJournalReq{Bucket: "other"}, want: false},
+		{req: &OCNJournalReq{Kind: "Item"}, want: false},
+		{req: &OCNJournalReq{Reason: string(SkipReasonNotRequiredKind), Accepted: &rejected}, want: true},
+		{req: &OCNJournalReq{Accepted: &accepted}, want: false},
+		{req: &OCNJournalReq{Since: now, Until: now.Add(time.Hour)}, want: true},
+		{req: &OCNJournalReq{Until: now}, want: false},
+	}
+	for i, test := range tests {
+		if e, g := test.want, test.req.matches(entry); e != g {
+			t.Errorf("%02d: expected %v; got %v", i, e, g)
+		}
+	}
+}
+
+func TestAEDatastoreStore_OCNJournal(t *testing.T) {
+	_, c, err := testerator.SpinUp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testerator.SpinDown()
+
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := &AEDatastoreStore{}
+	for i := 0; i < 3; i++ {
+		e := &OCNJournalEntry{
+			ReceivedAt: now.Add(time.Duration(-i) * time.Hour),
+			ExpireAt:   now.Add(time.Duration(1-i) * time.Hour),
+			Bucket:     "backup",
+		}
+		if err := store.PutOCNJournalEntry(c, e); err != nil {
+			t.Fatalf("#%d: %s", i, err)
+		}
+	}
+
+	list, err := store.ListOCNJournal(c, &OCNJournalReq{Until: now, Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := 1, len(list.Entries); e != g {
+		t.Fatalf("expected %d; got %d", e, g)
+	}
+	if e, g := now.Add(-time.Hour), list.Entries[0].ReceivedAt; !e.Equal(g) {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	if list.Cursor == "" {
+		t.Fatalf("expected cursor")
+	}
+
+	// the last page has no cursor.
+	list, err = store.ListOCNJournal(c, &OCNJournalReq{Until: now, Limit: 1, Cursor: list.Cursor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := 1, len(list.Entries); e != g {
+		t.Fatalf("expected %d; got %d", e, g)
+	}
+	if list.Cursor != "" {
+		t.Errorf("expected no cursor; got %s", list.Cursor)
+	}
+
+	result, err := store.PurgeOCNJournal(c, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := 1, result.Deleted; e != g {
+		t.Errorf("expected %d; got %d", e, g)
+	}
+	if result.Remaining {
+		t.Errorf("expected no remaining entries")
+	}
+}
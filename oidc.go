@@ -0,0 +1,239 @@
+package ds2bq
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/appengine/urlfetch"
+)
+
+// googleJWKSURL is the JWKS of Google-signed ID tokens.
+const googleJWKSURL = "https://www.googleapis.com/oauth2/v3/certs"
+
+// oidcLeeway is the acceptable clock skew of exp and iat.
+const oidcLeeway = time.Minute
+
+// OIDCVerifier verifies Google-signed OIDC ID tokens.
+type OIDCVerifier struct {
+	// Audience is the expected aud claim, e.g. the URL of the endpoint. required.
+	Audience string
+	// ServiceAccounts are the expected email claim. If empty, any account is allowed.
+	ServiceAccounts []string
+	// Issuers are the expected iss claim. default is https://accounts.google.com and accounts.google.com.
+	Issuers []string
+	// JWKSURL is the URL of the JWKS. default is the JWKS of Google.
+	JWKSURL string
+	// JWKS is the JWKS JSON used instead of fetching JWKSURL, e.g. for tests.
+	JWKS []byte
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+	expiresAt time.Time
+}
+
+// OIDCClaims are claims of the verified ID token.
+type OIDCClaims struct {
+	Issuer        string `json:"iss"`
+	Subject       string `json:"sub"`
+	Audience      string `json:"aud"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	IssuedAt      int64  `json:"iat"`
+	ExpiresAt     int64  `json:"exp"`
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwks struct {
+	Keys []struct {
+		Kid string `json:"kid"`
+		Kty string `json:"kty"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	} `json:"keys"`
+}
+
+// Verify verifies the signature and claims of the ID token.
+func (v *OIDCVerifier) Verify(c context.Context, token string) (*OIDCClaims, error) {
+	if v.Audience == "" {
+		return nil, errors.New("ds2bq: Audience of OIDCVerifier is required")
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("ds2bq: malformed token")
+	}
+	header := &jwtHeader{}
+	if err := decodeJWTPart(parts[0], header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("ds2bq: unsupported alg %s", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("ds2bq: malformed signature: %s", err)
+	}
+
+	key, err := v.key(c, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, h[:], sig); err != nil {
+		return nil, errors.New("ds2bq: invalid signature")
+	}
+
+	claims := &OIDCClaims{}
+	if err := decodeJWTPart(parts[1], claims); err != nil {
+		return nil, err
+	}
+	if err := v.verifyClaims(claims, time.Now()); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (v *OIDCVerifier) verifyClaims(claims *OIDCClaims, now time.Time) error {
+	issuers := v.Issuers
+	if len(issuers) == 0 {
+		issuers = []string{"https://accounts.google.com", "accounts.google.com"}
+	}
+	if !containsString(issuers, claims.Issuer) {
+		return fmt.Errorf("ds2bq: unexpected issuer %s", claims.Issuer)
+	}
+	if claims.Audience != v.Audience {
+		return fmt.Errorf("ds2bq: unexpected audience %s", claims.Audience)
+	}
+	if now.Add(-oidcLeeway).Unix() >= claims.ExpiresAt {
+		return errors.New("ds2bq: token is expired")
+	}
+	if now.Add(oidcLeeway).Unix() < claims.IssuedAt {
+		return errors.New("ds2bq: token is issued in the future")
+	}
+	if len(v.ServiceAccounts) != 0 {
+		if !claims.EmailVerified || !containsString(v.ServiceAccounts, claims.Email) {
+			return fmt.Errorf("ds2bq: unexpected account %s", claims.Email)
+		}
+	}
+	return nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("ds2bq: malformed token: %s", err)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("ds2bq: malformed token: %s", err)
+	}
+	return nil
+}
+
+// key returns the public key of kid. Keys are cached until max-age of the JWKS response,
+// and fetched again for unknown kid at most once a minute because Google rotates keys.
+func (v *OIDCVerifier) key(c context.Context, kid string) (*rsa.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	now := time.Now()
+	if key, ok := v.keys[kid]; ok && (v.JWKS != nil || now.Before(v.expiresAt)) {
+		return key, nil
+	}
+	if v.keys == nil || (v.JWKS == nil && now.Sub(v.fetchedAt) > time.Minute) {
+		if err := v.loadKeys(c, now); err != nil {
+			return nil, err
+		}
+	}
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("ds2bq: unknown key %s", kid)
+}
+
+func (v *OIDCVerifier) loadKeys(c context.Context, now time.Time) error {
+	set := &jwks{}
+	maxAge := time.Hour
+	if v.JWKS != nil {
+		if err := json.Unmarshal(v.JWKS, set); err != nil {
+			return err
+		}
+		return v.setKeys(set, now, maxAge)
+	}
+
+	u := v.JWKSURL
+	if u == "" {
+		u = googleJWKSURL
+	}
+	resp, err := urlfetch.Client(c).Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("ds2bq: failed to fetch JWKS: %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(set); err != nil {
+		return err
+	}
+	if d, ok := cacheMaxAge(resp.Header.Get("Cache-Control")); ok {
+		maxAge = d
+	}
+	return v.setKeys(set, now, maxAge)
+}
+
+func (v *OIDCVerifier) setKeys(set *jwks, now time.Time, maxAge time.Duration) error {
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return err
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	v.keys = keys
+	v.fetchedAt = now
+	v.expiresAt = now.Add(maxAge)
+	return nil
+}
+
+// cacheMaxAge returns max-age of Cache-Control header.
+func cacheMaxAge(cacheControl string) (time.Duration, bool) {
+	for _, v := range strings.Split(cacheControl, ",") {
+		v = strings.TrimSpace(v)
+		if !strings.HasPrefix(v, "max-age=") {
+			continue
+		}
+		var sec int64
+		if _, err := fmt.Sscanf(v, "max-age=%d", &sec); err != nil {
+			return 0, false
+		}
+		return time.Duration(sec) * time.Second, true
+	}
+	return 0, false
+}
@@ -0,0 +1,156 @@
+package ds2bq
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testOIDCKey signs ID tokens like Google for tests.
+type testOIDCKey struct {
+	kid string
+	key *rsa.PrivateKey
+}
+
+func newTestOIDCKey(t *testing.T, kid string) *testOIDCKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testOIDCKey{kid: kid, key: key}
+}
+
+func (k *testOIDCKey) jwks(t *testing.T) []byte {
+	b, err := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kid": k.kid,
+				"kty": "RSA",
+				"alg": "RS256",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(k.key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.key.E)).Bytes()),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func (k *testOIDCKey) sign(t *testing.T, claims *OIDCClaims) string {
+	encode := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := encode(&jwtHeader{Alg: "RS256", Kid: k.kid}) + "." + encode(claims)
+	h := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, k.key, crypto.SHA256, h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func testOIDCClaims() *OIDCClaims {
+	now := time.Now()
+	return &OIDCClaims{
+		Issuer:        "https://accounts.google.com",
+		Subject:       "1234567890",
+		Audience:      "https://example.appspot.com/tq/gcs/object-to-bq",
+		Email:         "scheduler@example.iam.gserviceaccount.com",
+		EmailVerified: true,
+		IssuedAt:      now.Unix(),
+		ExpiresAt:     now.Add(time.Hour).Unix(),
+	}
+}
+
+func TestOIDCVerifier_Verify(t *testing.T) {
+	key := newTestOIDCKey(t, "key1")
+	other := newTestOIDCKey(t, "key1")
+
+	for i, tc := range []struct {
+		key    *testOIDCKey
+		modify func(claims *OIDCClaims)
+		ok     bool
+	}{
+		{key, func(claims *OIDCClaims) {}, true},
+		{key, func(claims *OIDCClaims) { claims.Issuer = "accounts.google.com" }, true},
+		{key, func(claims *OIDCClaims) { claims.Issuer = "https://example.com" }, false},
+		{key, func(claims *OIDCClaims) { claims.Audience = "https://example.com" }, false},
+		{key, func(claims *OIDCClaims) { claims.ExpiresAt = time.Now().Add(-time.Hour).Unix() }, false},
+		{key, func(claims *OIDCClaims) { claims.IssuedAt = time.Now().Add(time.Hour).Unix() }, false},
+		{key, func(claims *OIDCClaims) { claims.Email = "other@example.iam.gserviceaccount.com" }, false},
+		{key, func(claims *OIDCClaims) { claims.EmailVerified = false }, false},
+		{other, func(claims *OIDCClaims) {}, false},
+		{newTestOIDCKey(t, "key2"), func(claims *OIDCClaims) {}, false},
+	} {
+		v := &OIDCVerifier{
+			Audience:        "https://example.appspot.com/tq/gcs/object-to-bq",
+			ServiceAccounts: []string{"scheduler@example.iam.gserviceaccount.com"},
+			JWKS:            key.jwks(t),
+		}
+		claims := testOIDCClaims()
+		tc.modify(claims)
+
+		got, err := v.Verify(context.Background(), tc.key.sign(t, claims))
+		if tc.ok && err != nil {
+			t.Errorf("%02d: unexpected error %s", i, err)
+		} else if !tc.ok && err == nil {
+			t.Errorf("%02d: expected error", i)
+		}
+		if tc.ok && err == nil {
+			if e, g := claims.Email, got.Email; e != g {
+				t.Errorf("%02d: expected %s; got %s", i, e, g)
+			}
+		}
+	}
+}
+
+func TestOIDCVerifier_Verify_malformed(t *testing.T) {
+	key := newTestOIDCKey(t, "key1")
+	v := &OIDCVerifier{
+		Audience: "https://example.appspot.com/tq/gcs/object-to-bq",
+		JWKS:     key.jwks(t),
+	}
+
+	token := key.sign(t, testOIDCClaims())
+	parts := strings.Split(token, ".")
+	for i, token := range []string{
+		"",
+		"a.b",
+		parts[0] + "." + parts[1] + ".",
+		parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"aud":"x"}`)) + "." + parts[2],
+		base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"key1"}`)) + "." + parts[1] + ".",
+	} {
+		_, err := v.Verify(context.Background(), token)
+		if err == nil {
+			t.Errorf("%02d: expected error", i)
+		}
+	}
+}
+
+func TestCacheMaxAge(t *testing.T) {
+	d, ok := cacheMaxAge("public, max-age=19666, must-revalidate, no-transform")
+	if !ok {
+		t.Fatal("expected max-age")
+	}
+	if e, g := 19666*time.Second, d; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	if _, ok := cacheMaxAge("no-cache"); ok {
+		t.Error("unexpected max-age")
+	}
+}
@@ -0,0 +1,159 @@
+package ds2bq
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"path"
+	"strings"
+
+	"google.golang.org/api/storage/v1"
+	"google.golang.org/appengine/taskqueue"
+)
+
+type gcsWatcherOverallExportMetadataOption struct{}
+
+func (o *gcsWatcherOverallExportMetadataOption) implements(s *gcsWatcherService) {
+	s.WaitOverallExportMetadata = true
+}
+
+// GCSWatcherWithOverallExportMetadata provides that managed exports are imported when the .overall_export_metadata is written,
+// that is the last object of the export that finished. OCN of .export_metadata of each kind is skipped,
+// and the kinds are imported together by the metadata files under the prefix of the export.
+func GCSWatcherWithOverallExportMetadata() GCSWatcherOption {
+	return &gcsWatcherOverallExportMetadataOption{}
+}
+
+// isOverallExportMetadata reports whether the object is the metadata of the whole managed export
+// like 2017-11-14T06:47:01_23208/2017-11-14T06:47:01_23208.overall_export_metadata.
+func isOverallExportMetadata(name string) bool {
+	return strings.HasSuffix(name, ".overall_export_metadata")
+}
+
+// isExportSource reports whether the source is managed export of Datastore or Firestore.
+func isExportSource(source string) bool {
+	return source == BackupSourceDatastoreExport || source == BackupSourceFirestoreExport
+}
+
+// exportKindDirs returns directories of kindNames in dirs like 2017-11-14T06:47:01_23208/all_namespaces/kind_Article/.
+func exportKindDirs(dirs []string, kindNames []string) []string {
+	var kindDirs []string
+	for _, dir := range dirs {
+		name := path.Base(dir)
+		if strings.HasPrefix(name, "kind_") && containsString(kindNames, strings.TrimPrefix(name, "kind_")) {
+			kindDirs = append(kindDirs, dir)
+		}
+	}
+	return kindDirs
+}
+
+// exportMetadataPrefix returns the prefix of .export_metadata in the kind directory,
+// like 2017-11-14T06:47:01_23208/all_namespaces/kind_Article/all_namespaces_kind_Article, so that output files are not listed.
+func exportMetadataPrefix(kindDir string) string {
+	dir := strings.TrimSuffix(kindDir, "/")
+	return dir + "/" + path.Base(path.Dir(dir)) + "_" + path.Base(dir)
+}
+
+// listExportMetadata returns names of .export_metadata of kindNames in the export of the overall export metadata.
+// Namespace and kind directories are listed with the delimiter, output files are not listed.
+func listExportMetadata(c context.Context, sts *storage.Service, overall *GCSObject, kindNames []string) ([]string, error) {
+	nsDirs, err := listPrefixes(c, sts, overall.Bucket, path.Dir(overall.Name)+"/")
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, nsDir := range nsDirs {
+		dirs, err := listPrefixes(c, sts, overall.Bucket, nsDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, kindDir := range exportKindDirs(dirs, kindNames) {
+			ns, err := listDirectoryObjects(c, sts, overall.Bucket, exportMetadataPrefix(kindDir))
+			if err != nil {
+				return nil, err
+			}
+			names = append(names, ns...)
+		}
+	}
+	return names, nil
+}
+
+// overallExportImports returns requests of the kinds in names of objects under the prefix of the overall export metadata.
+// Kinds not in kindNames are skipped.
+func overallExportImports(overall *GCSObject, names []string, kindNames []string, extractors KindExtractors) []*GCSObjectToBQJobReq {
+	var reqs []*GCSObjectToBQJobReq
+	for _, name := range names {
+		if !strings.HasSuffix(name, ".export_metadata") || isAllKindsExport(name) {
+			continue
+		}
+		obj := &GCSObject{
+			Bucket:      overall.Bucket,
+			Name:        name,
+			TimeCreated: overall.TimeCreated,
+		}
+		info, ok := extractors.ExtractKind(name)
+		if !ok || !containsString(kindNames, info.Kind) {
+			continue
+		}
+		reqs = append(reqs, obj.toBQJobReq(extractors))
+	}
+	return reqs
+}
+
+// overallExportTaskName returns the name of the task that imports the kind of the export.
+// The name is derived from the .export_metadata of the kind under the prefix of the export,
+// so that the redelivered OCN of the overall export metadata does not add the import again.
+func overallExportTaskName(req *GCSObjectToBQJobReq) string {
+	h := sha1.Sum([]byte(req.Bucket + "/" + req.FilePath))
+	return "ds2bq-export-" + hex.EncodeToString(h[:])
+}
+
+// receiveOverallExportMetadata enqueues imports of all target kinds of the export that the overall export metadata finished.
+func (s *gcsWatcherService) receiveOverallExportMetadata(c context.Context, r *http.Request, obj *GCSObject, kindNames []string, extractors KindExtractors) (*ImportDecision, error) {
+	var reason SkipReason
+	switch {
+	case s.BackupBucketName != "" && obj.Bucket != s.BackupBucketName:
+		reason = SkipReasonUnexpectedBucket
+	case NewGCSHeader(r).ResourceState != "exists":
+		reason = SkipReasonUnexpectedState
+	}
+	if reason != "" {
+		logInfo(c, "ds2bq: overall export metadata is skipped", F(FieldBucket, obj.Bucket), F(FieldObject, obj.Name), F("reason", reason))
+		s.Observers.OnSkipped(c, obj, reason)
+		s.Metrics.ObjectFiltered(c, reason)
+		return &ImportDecision{Reason: reason}, nil
+	}
+
+	sts, err := newStorageService(c)
+	if err != nil {
+		return nil, err
+	}
+	names, err := listExportMetadata(c, sts, obj, kindNames)
+	if err != nil {
+		return nil, err
+	}
+
+	reqs := overallExportImports(obj, names, kindNames, extractors)
+	if len(reqs) == 0 {
+		logWarning(c, "ds2bq: export has no target kind", F(FieldBucket, obj.Bucket), F(FieldObject, obj.Name))
+		s.Observers.OnSkipped(c, obj, SkipReasonNotRequiredKind)
+		s.Metrics.ObjectFiltered(c, SkipReasonNotRequiredKind)
+		return &ImportDecision{Reason: SkipReasonNotRequiredKind}, nil
+	}
+
+	decision := &ImportDecision{Accepted: true}
+	for _, req := range reqs {
+		logInfo(c, "ds2bq: object should be imported", F(FieldBucket, req.Bucket), F(FieldObject, req.FilePath), F(FieldKind, req.KindName))
+		_, err := addJSONTask(c, overallExportTaskName(req), s.GCSObjectToBQJobURL, s.QueueName, req, 0)
+		if err == taskqueue.ErrTaskAlreadyAdded {
+			logInfo(c, "ds2bq: import of the kind is already added", F(FieldBucket, req.Bucket), F(FieldObject, req.FilePath), F(FieldKind, req.KindName))
+		} else if err != nil {
+			s.Metrics.TaskEnqueueFailed(c, s.QueueName)
+			return decision, err
+		}
+		s.trackBackup(c, req)
+		decision.Kinds = append(decision.Kinds, req.KindName)
+	}
+	return decision, nil
+}
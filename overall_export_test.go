@@ -0,0 +1,67 @@
+package ds2bq
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOverallExportImports(t *testing.T) {
+	overall := &GCSObject{
+		Bucket:      "backup",
+		Name:        "2017-11-14T06:47:01_23208/2017-11-14T06:47:01_23208.overall_export_metadata",
+		TimeCreated: time.Date(2017, 11, 14, 7, 0, 0, 0, time.UTC),
+	}
+	names := []string{
+		"2017-11-14T06:47:01_23208/2017-11-14T06:47:01_23208.overall_export_metadata",
+		"2017-11-14T06:47:01_23208/all_namespaces/kind_Article/all_namespaces_kind_Article.export_metadata",
+		"2017-11-14T06:47:01_23208/all_namespaces/kind_Article/output-0",
+		"2017-11-14T06:47:01_23208/all_namespaces/kind_User/all_namespaces_kind_User.export_metadata",
+		"2017-11-14T06:47:01_23208/all_namespaces/kind_Item/all_namespaces_kind_Item.export_metadata",
+	}
+
+	reqs := overallExportImports(overall, names, []string{"Article", "Item"}, DefaultKindExtractors())
+	if e, g := 2, len(reqs); e != g {
+		t.Fatalf("expected %d; got %d", e, g)
+	}
+	for i, kind := range []string{"Article", "Item"} {
+		if e, g := kind, reqs[i].KindName; e != g {
+			t.Errorf("expected %s; got %s", e, g)
+		}
+		if e, g := BackupSourceDatastoreExport, reqs[i].Source; e != g {
+			t.Errorf("expected %s; got %s", e, g)
+		}
+		if e, g := "2017-11-14T06:47:01_23208", reqs[i].BackupID; e != g {
+			t.Errorf("expected %s; got %s", e, g)
+		}
+	}
+
+	if overallExportTaskName(reqs[0]) == overallExportTaskName(reqs[1]) {
+		t.Errorf("expected task names of kinds to differ")
+	}
+	if e, g := overallExportTaskName(reqs[0]), overallExportTaskName(overallExportImports(overall, names, []string{"Article"}, DefaultKindExtractors())[0]); e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+
+	if !isOverallExportMetadata(overall.Name) {
+		t.Errorf("expected overall export metadata: %s", overall.Name)
+	}
+	if isOverallExportMetadata(names[1]) {
+		t.Errorf("expected not overall export metadata: %s", names[1])
+	}
+}
+
+func TestExportKindDirs(t *testing.T) {
+	dirs := []string{
+		"2017-11-14T06:47:01_23208/all_namespaces/kind_Article/",
+		"2017-11-14T06:47:01_23208/all_namespaces/kind_User/",
+		"2017-11-14T06:47:01_23208/all_namespaces/kind_ArticleComment/",
+	}
+
+	kindDirs := exportKindDirs(dirs, []string{"Article"})
+	if e, g := 1, len(kindDirs); e != g {
+		t.Fatalf("expected %d; got %d", e, g)
+	}
+	if e, g := "2017-11-14T06:47:01_23208/all_namespaces/kind_Article/all_namespaces_kind_Article", exportMetadataPrefix(kindDirs[0]); e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+}
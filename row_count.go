@@ -0,0 +1,215 @@
+package ds2bq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/favclip/ds2bq/backupfile"
+	"google.golang.org/api/bigquery/v2"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// RowCountValidation is the configuration of comparing row count of the loaded table with the backup.
+type RowCountValidation struct {
+	// Tolerance is the acceptable ratio of the difference to the expected count. e.g. 0.01 accepts 1% difference.
+	// Statistics of Datastore are updated about once a day, so use some tolerance for __Stat_Kind__.
+	Tolerance float64 `json:"tolerance"`
+	// CountBackupFiles counts entities in the output files of the backup instead of using __Stat_Kind__.
+	// It is exact, but reads all output files of the backup. The validation is skipped if it takes longer than countBackupEntitiesTimeout.
+	CountBackupFiles bool `json:"countBackupFiles"`
+	// Block stops the import of the kind on mismatch. The latest view and transform are not updated,
+	// and the staging tables are not copied. It requires GCSWatcherWithStagingDataset,
+	// otherwise the mismatched rows are already in the destination table.
+	Block bool `json:"block"`
+}
+
+type gcsWatcherRowCountValidationOption struct {
+	RowCountValidation *RowCountValidation
+}
+
+func (o *gcsWatcherRowCountValidationOption) implements(s *gcsWatcherService) {
+	s.RowCountValidation = o.RowCountValidation
+}
+
+// GCSWatcherWithRowCountValidation provides that the row count of the loaded table is compared with the backup after the load job.
+func GCSWatcherWithRowCountValidation(v *RowCountValidation) GCSWatcherOption {
+	return &gcsWatcherRowCountValidationOption{
+		RowCountValidation: v,
+	}
+}
+
+// countBackupEntitiesTimeout is the time to count entities in the output files, shorter than the deadline of the task.
+const countBackupEntitiesTimeout = 5 * time.Minute
+
+// errCountBackupEntitiesTimeout stops counting entities in the output files.
+var errCountBackupEntitiesTimeout = errors.New("ds2bq: counting entities of the backup timed out")
+
+// Sources of the expected count of RowCountResult.
+const (
+	RowCountSourceStatistics  = "statistics"
+	RowCountSourceBackupFiles = "backup_files"
+)
+
+// RowCountResult is the result of comparing row count of the loaded table with the backup.
+type RowCountResult struct {
+	Kind      string  `json:"kind"`
+	Table     string  `json:"table"`
+	Source    string  `json:"source"`
+	Expected  int64   `json:"expected"`
+	Actual    int64   `json:"actual"`
+	Deviation float64 `json:"deviation"`
+	Tolerance float64 `json:"tolerance"`
+	OK        bool    `json:"ok"`
+	// Skipped is true if the expected count is unknown, e.g. no statistics of the kind or too many entities to count.
+	Skipped bool `json:"skipped,omitempty"`
+}
+
+// RowCountMismatchError is the error of the import whose row count deviates beyond the tolerance.
+type RowCountMismatchError struct {
+	Result *RowCountResult
+}
+
+func (err *RowCountMismatchError) Error() string {
+	r := err.Result
+	return fmt.Sprintf("ds2bq: row count of %s is %d, expected %d by %s (deviation %.4f > tolerance %.4f)", r.Table, r.Actual, r.Expected, r.Source, r.Deviation, r.Tolerance)
+}
+
+// compare sets Deviation and OK.
+func (r *RowCountResult) compare() {
+	expected := r.Expected
+	if expected == 0 {
+		expected = 1
+	}
+	r.Deviation = math.Abs(float64(r.Actual-r.Expected)) / float64(expected)
+	r.OK = r.Deviation <= r.Tolerance
+}
+
+// validateRowCount compares row count of the table loaded by the job with the backup.
+func (s *gcsWatcherService) validateRowCount(c context.Context, bqs *bigquery.Service, req *ImportJobStatusReq, job *bigquery.Job) (*RowCountResult, error) {
+	v := s.RowCountValidation
+	result := &RowCountResult{
+		Kind:      req.Import.KindName,
+		Table:     req.DatasetID + "." + req.TableID,
+		Tolerance: v.Tolerance,
+	}
+
+	actual, err := loadedRows(bqs, req, job)
+	if err != nil {
+		return nil, err
+	}
+	result.Actual = actual
+
+	if v.CountBackupFiles {
+		result.Source = RowCountSourceBackupFiles
+		result.Expected, result.Skipped, err = countBackupEntities(c, req.Import, countBackupEntitiesTimeout)
+	} else {
+		result.Source = RowCountSourceStatistics
+		result.Expected, result.Skipped, err = statKindCount(c, req.Import.KindName, req.Import.Namespace)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fields := []Field{F(FieldKind, result.Kind), F("table", result.Table), F("source", result.Source), F("expected", result.Expected), F("actual", result.Actual)}
+	switch {
+	case result.Skipped:
+		result.OK = true
+		logWarning(c, "ds2bq: row count is not validated, expected count is unknown", fields...)
+	default:
+		result.compare()
+		if result.OK {
+			logInfo(c, "ds2bq: row count validated", fields...)
+		} else {
+			logWarning(c, "ds2bq: row count mismatch", append(fields, F("deviation", result.Deviation), F("tolerance", result.Tolerance))...)
+			s.Metrics.RowCountMismatch(c, result.Kind)
+		}
+	}
+	s.Observers.OnRowCountValidated(c, req.Import, result)
+
+	return result, nil
+}
+
+// loadedRows returns numRows of the destination table, or the raw table of ColumnPolicy.
+// For a partition, it returns output rows of the load job because numRows of the table is the sum of all partitions.
+func loadedRows(bqs *bigquery.Service, req *ImportJobStatusReq, job *bigquery.Job) (int64, error) {
+	if _, filter, err := req.sourceTable(); err != nil {
+		return 0, err
+	} else if filter != "TRUE" {
+		if job.Statistics == nil || job.Statistics.Load == nil {
+			return 0, fmt.Errorf("ds2bq: no statistics of job %s", req.JobID)
+		}
+		return job.Statistics.Load.OutputRows, nil
+	}
+
+	datasetID, tableID := req.DatasetID, req.TableID
+	if req.RawTableID != "" {
+		datasetID, tableID = req.RawDatasetID, req.RawTableID
+	}
+	table, err := bqs.Tables.Get(req.ProjectID, datasetID, tableID).Do()
+	if err != nil {
+		return 0, err
+	}
+	return int64(table.NumRows), nil
+}
+
+// statKindCount returns count of the kind in __Stat_Kind__, or __Stat_Ns_Kind__ for the namespace.
+// It reports true if the statistics do not exist.
+func statKindCount(c context.Context, kind, namespace string) (int64, bool, error) {
+	statKind := "__Stat_Kind__"
+	if namespace != "" {
+		var err error
+		c, err = appengine.Namespace(c, namespace)
+		if err != nil {
+			return 0, false, err
+		}
+		statKind = "__Stat_Ns_Kind__"
+	}
+
+	q := datastore.NewQuery(statKind).Filter("kind_name =", kind).Limit(1)
+	var stats []datastore.PropertyList
+	_, err := q.GetAll(c, &stats)
+	if err != nil {
+		return 0, false, err
+	}
+	if len(stats) == 0 {
+		return 0, true, nil
+	}
+	for _, p := range stats[0] {
+		if p.Name == "count" {
+			if v, ok := p.Value.(int64); ok {
+				return v, false, nil
+			}
+		}
+	}
+	return 0, true, nil
+}
+
+// countBackupEntities counts entities in the output files of the backup.
+// It reports true if counting takes longer than timeout.
+func countBackupEntities(c context.Context, req *GCSObjectToBQJobReq, timeout time.Duration) (int64, bool, error) {
+	b, err := OpenBackup(c, req)
+	if err != nil {
+		return 0, false, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	var n int64
+	err = b.Each(c, func(e *backupfile.Entity) error {
+		n++
+		if n%1000 == 0 && time.Now().After(deadline) {
+			return errCountBackupEntitiesTimeout
+		}
+		return nil
+	})
+	if err == errCountBackupEntitiesTimeout {
+		logWarning(c, "ds2bq: too many entities to count in the backup", F(FieldKind, req.KindName), F("counted", n))
+		return 0, true, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	return n, false, nil
+}
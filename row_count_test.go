@@ -0,0 +1,41 @@
+package ds2bq
+
+import (
+	"testing"
+)
+
+func TestRowCountResult_compare(t *testing.T) {
+	for _, test := range []struct {
+		expected  int64
+		actual    int64
+		tolerance float64
+		ok        bool
+	}{
+		{expected: 100, actual: 100, tolerance: 0, ok: true},
+		{expected: 100, actual: 99, tolerance: 0.01, ok: true},
+		{expected: 100, actual: 98, tolerance: 0.01, ok: false},
+		{expected: 100, actual: 102, tolerance: 0.01, ok: false},
+		{expected: 0, actual: 0, tolerance: 0, ok: true},
+		{expected: 0, actual: 1, tolerance: 0.5, ok: false},
+	} {
+		r := &RowCountResult{Expected: test.expected, Actual: test.actual, Tolerance: test.tolerance}
+		r.compare()
+		if test.ok != r.OK {
+			t.Errorf("expected ok %t for %d/%d; got %t (deviation %f)", test.ok, test.actual, test.expected, r.OK, r.Deviation)
+		}
+	}
+}
+
+func TestRowCountMismatchError(t *testing.T) {
+	err := &RowCountMismatchError{Result: &RowCountResult{
+		Table:     "ds.Article",
+		Source:    RowCountSourceStatistics,
+		Expected:  100,
+		Actual:    50,
+		Deviation: 0.5,
+		Tolerance: 0.01,
+	}}
+	if e, g := "ds2bq: row count of ds.Article is 50, expected 100 by statistics (deviation 0.5000 > tolerance 0.0100)", err.Error(); e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+}
@@ -0,0 +1,186 @@
+package ds2bq
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/favclip/ds2bq/backupfile"
+)
+
+// Sink stores the backup of a kind notified by OCN.
+type Sink interface {
+	Import(c context.Context, req *GCSObjectToBQJobReq) error
+}
+
+// SinkParams is values available in templates of sinks.
+type SinkParams struct {
+	Kind       string
+	Namespace  string
+	BackupTime time.Time
+}
+
+func newSinkParams(req *GCSObjectToBQJobReq) *SinkParams {
+	return &SinkParams{
+		Kind:       req.KindName,
+		Namespace:  req.Namespace,
+		BackupTime: req.snapshotTime().UTC(),
+	}
+}
+
+type bigQuerySink struct {
+	s *gcsWatcherService
+	// inherits reports whether the sink uses the settings of GCSWatcherService that it is given to.
+	inherits bool
+}
+
+// BigQuerySink returns Sink that loads the backup into BigQuery by the load job.
+// It is the default Sink of GCSWatcherService. Given to GCSWatcherWithSink without opts,
+// it loads with the settings of the GCSWatcherService, otherwise with the settings of opts.
+func BigQuerySink(opts ...GCSWatcherOption) Sink {
+	return &bigQuerySink{
+		s:        newGCSWatcherService(opts...),
+		inherits: len(opts) == 0,
+	}
+}
+
+func (sink *bigQuerySink) Import(c context.Context, req *GCSObjectToBQJobReq) error {
+	return sink.s.insertImportJob(withLogger(c, sink.s.Logger), req)
+}
+
+type gcsWatcherSinkOption struct {
+	KindName string
+	Sinks    []Sink
+}
+
+func (o *gcsWatcherSinkOption) implements(s *gcsWatcherService) {
+	if s.Sinks == nil {
+		s.Sinks = make(map[string][]Sink)
+	}
+	sinks := make([]Sink, len(o.Sinks))
+	for i, sink := range o.Sinks {
+		if bq, ok := sink.(*bigQuerySink); ok && bq.inherits {
+			sink = &bigQuerySink{s: s}
+		}
+		sinks[i] = sink
+	}
+	s.Sinks[o.KindName] = sinks
+}
+
+// GCSWatcherWithSink provides sinks that the backup of the kind is stored into, instead of BigQuery.
+// Use BigQuerySink with other sinks to store the backup into BigQuery too.
+func GCSWatcherWithSink(kindName string, sinks ...Sink) GCSWatcherOption {
+	return &gcsWatcherSinkOption{
+		KindName: kindName,
+		Sinks:    sinks,
+	}
+}
+
+// sinks returns the sinks of the kind.
+func (s *gcsWatcherService) sinks(kindName string) []Sink {
+	if sinks, ok := s.Sinks[kindName]; ok {
+		return sinks
+	}
+	return []Sink{&bigQuerySink{s: s}}
+}
+
+// importBackup stores the backup of req into the sinks of the kind.
+// All sinks are tried, and the first error is returned so that the task is retried.
+func (s *gcsWatcherService) importBackup(c context.Context, req *GCSObjectToBQJobReq) error {
+	var firstErr error
+	for _, sink := range s.sinks(req.KindName) {
+		if _, ok := sink.(*bigQuerySink); ok {
+			// the load job reports to the observers and the metrics by itself.
+			err := sink.Import(c, req)
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		fields := []Field{F(FieldBucket, req.Bucket), F(FieldObject, req.FilePath), F(FieldKind, req.KindName), F("sink", fmt.Sprintf("%T", sink))}
+		logInfo(c, "ds2bq: import object into sink", fields...)
+		s.Observers.OnImportSubmitted(c, req, "")
+		s.Metrics.LoadJobSubmitted(c, req.KindName)
+
+		start := time.Now()
+		err := sink.Import(c, req)
+		if err != nil {
+			logWarning(c, "ds2bq: failed to import into sink", append(fields, F(FieldError, err))...)
+			s.Metrics.LoadJobFailed(c, req.KindName)
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else {
+			s.Metrics.LoadJobDuration(c, req.KindName, time.Since(start))
+		}
+		s.Observers.OnImportCompleted(c, req, "", err)
+	}
+
+	return firstErr
+}
+
+// entityJSON converts the entity into a JSON object like a row of BigQuery loaded from Datastore backup.
+func entityJSON(e *backupfile.Entity) map[string]interface{} {
+	m := make(map[string]interface{})
+	if e.Key != nil {
+		m["__key__"] = keyJSON(e.Key)
+	}
+	for _, p := range e.Properties {
+		v := valueJSON(p.Value)
+		if !p.Multiple {
+			m[p.Name] = v
+			continue
+		}
+		vs, _ := m[p.Name].([]interface{})
+		m[p.Name] = append(vs, v)
+	}
+	return m
+}
+
+func keyJSON(k *backupfile.Key) map[string]interface{} {
+	path := make([]string, 0, len(k.Path)*2)
+	for _, e := range k.Path {
+		path = append(path, strconv.Quote(e.Kind))
+		if e.Name != "" {
+			path = append(path, strconv.Quote(e.Name))
+		} else {
+			path = append(path, strconv.FormatInt(e.ID, 10))
+		}
+	}
+
+	m := map[string]interface{}{
+		"namespace": k.Namespace,
+		"app":       k.App,
+		"path":      strings.Join(path, ", "),
+		"kind":      k.Kind(),
+		"name":      nil,
+		"id":        nil,
+	}
+	if v := k.Name(); v != "" {
+		m["name"] = v
+	} else {
+		m["id"] = k.ID()
+	}
+	return m
+}
+
+func valueJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case *backupfile.Key:
+		return keyJSON(v)
+	case *backupfile.Entity:
+		return entityJSON(v)
+	case backupfile.GeoPoint:
+		return map[string]interface{}{"lat": v.Lat, "lng": v.Lng}
+	case backupfile.User:
+		return map[string]interface{}{"email": v.Email, "auth_domain": v.AuthDomain}
+	case []byte:
+		// the entity may share the buffer of the record.
+		return append([]byte(nil), v...)
+	default:
+		return v
+	}
+}
@@ -0,0 +1,89 @@
+package ds2bq
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"text/template"
+
+	"github.com/favclip/ds2bq/backupfile"
+	"google.golang.org/api/storage/v1"
+)
+
+// NDJSONSink writes entities of the backup to GCS as newline-delimited JSON.
+// Each line is an entity in the same shape as a row of BigQuery loaded from the backup.
+type NDJSONSink struct {
+	Bucket string
+
+	objectTmpl *template.Template
+}
+
+// NewNDJSONSink returns NDJSONSink that writes the object into the bucket.
+// object is text/template of the object name, SinkParams is passed to the template.
+// default is {{.Kind}}/{{.BackupTime.Format "20060102T150405Z"}}.ndjson
+func NewNDJSONSink(bucket, object string) (*NDJSONSink, error) {
+	if bucket == "" {
+		return nil, ErrInvalidState
+	}
+	if object == "" {
+		object = `{{.Kind}}/{{.BackupTime.Format "20060102T150405Z"}}.ndjson`
+	}
+	tmpl, err := template.New("object").Parse(object)
+	if err != nil {
+		return nil, err
+	}
+
+	return &NDJSONSink{
+		Bucket:     bucket,
+		objectTmpl: tmpl,
+	}, nil
+}
+
+// Import writes the entities of the backup of req.
+func (sink *NDJSONSink) Import(c context.Context, req *GCSObjectToBQJobReq) error {
+	name, err := sink.objectName(req)
+	if err != nil {
+		return err
+	}
+
+	b, err := OpenBackup(c, req)
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeNDJSON(c, pw, b))
+	}()
+
+	obj := &storage.Object{
+		Name:        name,
+		ContentType: "application/x-ndjson",
+	}
+	_, err = b.sts.Objects.Insert(sink.Bucket, obj).Media(pr).Context(c).Do()
+	pr.CloseWithError(err)
+	if err != nil {
+		return err
+	}
+	logInfo(c, "ds2bq: NDJSON written", F(FieldKind, req.KindName), F(FieldBucket, sink.Bucket), F(FieldObject, name))
+
+	return nil
+}
+
+func (sink *NDJSONSink) objectName(req *GCSObjectToBQJobReq) (string, error) {
+	buf := &bytes.Buffer{}
+	err := sink.objectTmpl.Execute(buf, newSinkParams(req))
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// writeNDJSON writes each entity of the backup as a line of JSON.
+func writeNDJSON(c context.Context, w io.Writer, b *Backup) error {
+	enc := json.NewEncoder(w)
+	return b.Each(c, func(e *backupfile.Entity) error {
+		return enc.Encode(entityJSON(e))
+	})
+}
@@ -0,0 +1,344 @@
+package ds2bq
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/favclip/ds2bq/backupfile"
+)
+
+// sqlMaxParameters is the max number of parameters in a statement, the limit of PostgreSQL and MySQL.
+const sqlMaxParameters = 65535
+
+// sqlSinkTimeout is the default of SQLSink.Timeout, shorter than the deadline of the task.
+const sqlSinkTimeout = 9 * time.Minute
+
+// SQLColumnType is the type of column of the table created by SQLSink.
+type SQLColumnType int
+
+// SQLColumnType values.
+const (
+	SQLColumnString SQLColumnType = iota
+	SQLColumnInteger
+	SQLColumnFloat
+	SQLColumnBoolean
+	SQLColumnTimestamp
+	SQLColumnBytes
+	// SQLColumnJSON holds repeated, embedded, geo point, user or mixed typed values as JSON text.
+	SQLColumnJSON
+)
+
+// SQLDialect absorbs differences of databases.
+type SQLDialect interface {
+	QuoteIdentifier(name string) string
+	// Placeholder returns the placeholder of n th (1-origin) parameter.
+	Placeholder(n int) string
+	ColumnType(t SQLColumnType) string
+}
+
+// PostgreSQLDialect is SQLDialect of PostgreSQL.
+type PostgreSQLDialect struct{}
+
+// QuoteIdentifier implements SQLDialect.
+func (PostgreSQLDialect) QuoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// Placeholder implements SQLDialect.
+func (PostgreSQLDialect) Placeholder(n int) string {
+	return fmt.Sprintf("$%d", n)
+}
+
+// ColumnType implements SQLDialect.
+func (PostgreSQLDialect) ColumnType(t SQLColumnType) string {
+	switch t {
+	case SQLColumnInteger:
+		return "BIGINT"
+	case SQLColumnFloat:
+		return "DOUBLE PRECISION"
+	case SQLColumnBoolean:
+		return "BOOLEAN"
+	case SQLColumnTimestamp:
+		return "TIMESTAMP WITH TIME ZONE"
+	case SQLColumnBytes:
+		return "BYTEA"
+	case SQLColumnJSON:
+		return "JSONB"
+	default:
+		return "TEXT"
+	}
+}
+
+// MySQLDialect is SQLDialect of MySQL.
+type MySQLDialect struct{}
+
+// QuoteIdentifier implements SQLDialect.
+func (MySQLDialect) QuoteIdentifier(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+// Placeholder implements SQLDialect.
+func (MySQLDialect) Placeholder(n int) string {
+	return "?"
+}
+
+// ColumnType implements SQLDialect.
+func (MySQLDialect) ColumnType(t SQLColumnType) string {
+	switch t {
+	case SQLColumnInteger:
+		return "BIGINT"
+	case SQLColumnFloat:
+		return "DOUBLE"
+	case SQLColumnBoolean:
+		return "BOOLEAN"
+	case SQLColumnTimestamp:
+		return "DATETIME(6)"
+	case SQLColumnBytes:
+		return "LONGBLOB"
+	case SQLColumnJSON:
+		return "JSON"
+	default:
+		return "LONGTEXT"
+	}
+}
+
+// primitive types of AEBackupEntityTypeInfoProperty, EntitySchema.PrimitiveType of Datastore Admin.
+// other types are stored as string.
+const (
+	primitiveFloat     = 0
+	primitiveInteger   = 1
+	primitiveBoolean   = 2
+	primitiveDateTime  = 4
+	primitiveRating    = 5
+	primitiveBlob      = 14
+	primitiveShortBlob = 15
+	primitiveUser      = 16
+	primitiveGeoPoint  = 17
+)
+
+// sqlColumnType returns SQLColumnType of the property.
+func sqlColumnType(p *AEBackupEntityTypeInfoProperty) SQLColumnType {
+	if p.IsRepeated || len(p.EmbeddedEntities) != 0 || len(p.PrimitiveTypes) != 1 {
+		return SQLColumnJSON
+	}
+	switch p.PrimitiveTypes[0] {
+	case primitiveFloat:
+		return SQLColumnFloat
+	case primitiveInteger, primitiveRating:
+		return SQLColumnInteger
+	case primitiveBoolean:
+		return SQLColumnBoolean
+	case primitiveDateTime:
+		return SQLColumnTimestamp
+	case primitiveBlob, primitiveShortBlob:
+		return SQLColumnBytes
+	case primitiveUser, primitiveGeoPoint:
+		return SQLColumnJSON
+	default:
+		return SQLColumnString
+	}
+}
+
+// SQLSink stores entities of the backup into the table of database/sql.
+// The table is named TablePrefix + kind, and re-created from the type info of the backup at each import.
+// The key is stored in __key__ column as a string like /User,"alice"/Article,2.
+// Managed export has no type info, so SQLSink supports Datastore Admin backup only.
+type SQLSink struct {
+	DB          *sql.DB
+	Dialect     SQLDialect
+	TablePrefix string
+	// BatchSize is the number of rows in an INSERT statement. default is 100.
+	// It is reduced so that the parameters of a statement do not exceed the limit of the database.
+	BatchSize int
+	// Timeout of the import. The transaction is rolled back if it expires. default is 9 minutes.
+	Timeout time.Duration
+}
+
+type sqlColumn struct {
+	Name string
+	Type SQLColumnType
+}
+
+// Import re-creates the table and inserts the entities of the backup of req.
+func (sink *SQLSink) Import(c context.Context, req *GCSObjectToBQJobReq) error {
+	b, err := OpenBackup(c, req)
+	if err != nil {
+		return err
+	}
+	if b.TypeInfo == nil {
+		return fmt.Errorf("ds2bq: type info of %s is not found in %s", req.KindName, req.FilePath)
+	}
+
+	columns := []*sqlColumn{{Name: "__key__", Type: SQLColumnString}}
+	for _, p := range b.TypeInfo.Properties {
+		columns = append(columns, &sqlColumn{Name: p.Name, Type: sqlColumnType(p)})
+	}
+
+	timeout := sink.Timeout
+	if timeout <= 0 {
+		timeout = sqlSinkTimeout
+	}
+	c, cancel := context.WithTimeout(c, timeout)
+	defer cancel()
+
+	tx, err := sink.DB.BeginTx(c, nil)
+	if err != nil {
+		return err
+	}
+	err = sink.importInTx(c, tx, sink.TablePrefix+req.KindName, columns, b)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (sink *SQLSink) importInTx(c context.Context, tx *sql.Tx, table string, columns []*sqlColumn, b *Backup) error {
+	for _, query := range sink.createTableQueries(table, columns) {
+		_, err := tx.ExecContext(c, query)
+		if err != nil {
+			return err
+		}
+	}
+
+	batchSize := sink.BatchSize
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	if max := sqlMaxParameters / len(columns); batchSize > max {
+		batchSize = max
+	}
+
+	var rows [][]interface{}
+	var count int
+	flush := func() error {
+		if len(rows) == 0 {
+			return nil
+		}
+		query, args := sink.insertQuery(table, columns, rows)
+		_, err := tx.ExecContext(c, query, args...)
+		if err != nil {
+			return err
+		}
+		count += len(rows)
+		rows = rows[:0]
+		return nil
+	}
+
+	err := b.Each(c, func(e *backupfile.Entity) error {
+		row, err := sqlRow(columns, e)
+		if err != nil {
+			return err
+		}
+		rows = append(rows, row)
+		if len(rows) < batchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err != nil {
+		return err
+	}
+	err = flush()
+	if err != nil {
+		return err
+	}
+	logInfo(c, "ds2bq: rows inserted", F(FieldKind, b.Req.KindName), F("table", table), F("rows", count))
+
+	return nil
+}
+
+func (sink *SQLSink) createTableQueries(table string, columns []*sqlColumn) []string {
+	d := sink.Dialect
+	defs := make([]string, 0, len(columns))
+	for _, col := range columns {
+		defs = append(defs, d.QuoteIdentifier(col.Name)+" "+d.ColumnType(col.Type))
+	}
+	return []string{
+		"DROP TABLE IF EXISTS " + d.QuoteIdentifier(table),
+		"CREATE TABLE " + d.QuoteIdentifier(table) + " (" + strings.Join(defs, ", ") + ")",
+	}
+}
+
+func (sink *SQLSink) insertQuery(table string, columns []*sqlColumn, rows [][]interface{}) (string, []interface{}) {
+	d := sink.Dialect
+	names := make([]string, 0, len(columns))
+	for _, col := range columns {
+		names = append(names, d.QuoteIdentifier(col.Name))
+	}
+
+	args := make([]interface{}, 0, len(columns)*len(rows))
+	values := make([]string, 0, len(rows))
+	for _, row := range rows {
+		ps := make([]string, 0, len(row))
+		for _, v := range row {
+			args = append(args, v)
+			ps = append(ps, d.Placeholder(len(args)))
+		}
+		values = append(values, "("+strings.Join(ps, ", ")+")")
+	}
+
+	query := "INSERT INTO " + d.QuoteIdentifier(table) + " (" + strings.Join(names, ", ") + ") VALUES " + strings.Join(values, ", ")
+	return query, args
+}
+
+// sqlRow returns the values of columns of the entity.
+func sqlRow(columns []*sqlColumn, e *backupfile.Entity) ([]interface{}, error) {
+	m := entityJSON(e)
+	row := make([]interface{}, 0, len(columns))
+	if e.Key != nil {
+		row = append(row, e.Key.String())
+	} else {
+		row = append(row, nil)
+	}
+	for _, col := range columns[1:] {
+		v, ok := m[col.Name]
+		if !ok || v == nil {
+			row = append(row, nil)
+			continue
+		}
+		if col.Type == SQLColumnJSON {
+			b, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			row = append(row, string(b))
+			continue
+		}
+		row = append(row, sqlValue(col.Type, e.Property(col.Name).Value))
+	}
+	return row, nil
+}
+
+// sqlValue returns the value for the column, or nil if the type of the value does not match the column.
+func sqlValue(t SQLColumnType, v interface{}) interface{} {
+	var ok bool
+	switch t {
+	case SQLColumnInteger:
+		_, ok = v.(int64)
+	case SQLColumnFloat:
+		_, ok = v.(float64)
+	case SQLColumnBoolean:
+		_, ok = v.(bool)
+	case SQLColumnTimestamp:
+		_, ok = v.(time.Time)
+	case SQLColumnBytes:
+		if b, isBytes := v.([]byte); isBytes {
+			// rows are kept until the batch is inserted, and the entity may share the buffer of the record.
+			return append([]byte(nil), b...)
+		}
+	case SQLColumnString:
+		if k, isKey := v.(*backupfile.Key); isKey {
+			return k.String()
+		}
+		_, ok = v.(string)
+	}
+	if !ok {
+		return nil
+	}
+	return v
+}
@@ -0,0 +1,157 @@
+package ds2bq
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/favclip/ds2bq/backupfile"
+)
+
+func TestGCSWatcherService_sinks(t *testing.T) {
+	ndjson, err := NewNDJSONSink("lake", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newGCSWatcherService(GCSWatcherWithSink("Article", ndjson, BigQuerySink()))
+
+	isBigQuery := func(sink Sink) bool {
+		bq, ok := sink.(*bigQuerySink)
+		return ok && bq.s == s
+	}
+	if sinks := s.sinks("Article"); len(sinks) != 2 || sinks[0] != ndjson || !isBigQuery(sinks[1]) {
+		t.Errorf("unexpected sinks %#v", sinks)
+	}
+	if sinks := s.sinks("User"); len(sinks) != 1 || !isBigQuery(sinks[0]) {
+		t.Errorf("unexpected sinks %#v", sinks)
+	}
+
+	own := BigQuerySink(GCSWatcherWithDatasetID("other"))
+	s = newGCSWatcherService(GCSWatcherWithSink("Article", own))
+	if sinks := s.sinks("Article"); len(sinks) != 1 || sinks[0] != own || sinks[0].(*bigQuerySink).s.DatasetID != "other" {
+		t.Errorf("unexpected sinks %#v", sinks)
+	}
+}
+
+func TestNDJSONSink_objectName(t *testing.T) {
+	sink, err := NewNDJSONSink("lake", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := &GCSObjectToBQJobReq{KindName: "Article", TimeCreated: time.Date(2017, 11, 14, 15, 47, 1, 0, time.FixedZone("JST", 9*60*60))}
+	name, err := sink.objectName(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := "Article/20171114T064701Z.ndjson", name; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+}
+
+func testEntity() *backupfile.Entity {
+	return &backupfile.Entity{
+		Key: &backupfile.Key{App: "s~example", Path: []*backupfile.PathElement{{Kind: "User", Name: "alice"}, {Kind: "Article", ID: 2}}},
+		Properties: []*backupfile.Property{
+			{Name: "Title", Value: "Hello"},
+			{Name: "Views", Value: int64(20)},
+			{Name: "Tags", Value: "go", Multiple: true},
+			{Name: "Tags", Value: "datastore", Multiple: true},
+			{Name: "Location", Value: backupfile.GeoPoint{Lat: 35.6, Lng: 139.7}},
+			{Name: "Author", Value: &backupfile.Key{App: "s~example", Path: []*backupfile.PathElement{{Kind: "User", Name: "alice"}}}},
+			{Name: "Deleted", Value: nil},
+		},
+	}
+}
+
+func TestEntityJSON(t *testing.T) {
+	b, err := json.Marshal(entityJSON(testEntity()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := `{"Author":{"app":"s~example","id":null,"kind":"User","name":"alice","namespace":"","path":"\"User\", \"alice\""},` +
+		`"Deleted":null,"Location":{"lat":35.6,"lng":139.7},"Tags":["go","datastore"],"Title":"Hello","Views":20,` +
+		`"__key__":{"app":"s~example","id":2,"kind":"Article","name":null,"namespace":"","path":"\"User\", \"alice\", \"Article\", 2"}}`
+	if g := string(b); e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+}
+
+func TestSQLColumnType(t *testing.T) {
+	for _, test := range []struct {
+		prop *AEBackupEntityTypeInfoProperty
+		want SQLColumnType
+	}{
+		{&AEBackupEntityTypeInfoProperty{PrimitiveTypes: []int{primitiveInteger}}, SQLColumnInteger},
+		{&AEBackupEntityTypeInfoProperty{PrimitiveTypes: []int{primitiveFloat}}, SQLColumnFloat},
+		{&AEBackupEntityTypeInfoProperty{PrimitiveTypes: []int{primitiveDateTime}}, SQLColumnTimestamp},
+		{&AEBackupEntityTypeInfoProperty{PrimitiveTypes: []int{13}}, SQLColumnString},
+		{&AEBackupEntityTypeInfoProperty{PrimitiveTypes: []int{primitiveGeoPoint}}, SQLColumnJSON},
+		{&AEBackupEntityTypeInfoProperty{PrimitiveTypes: []int{3}, IsRepeated: true}, SQLColumnJSON},
+		{&AEBackupEntityTypeInfoProperty{PrimitiveTypes: []int{1, 3}}, SQLColumnJSON},
+	} {
+		if g := sqlColumnType(test.prop); test.want != g {
+			t.Errorf("expected %d for %v; got %d", test.want, test.prop.PrimitiveTypes, g)
+		}
+	}
+}
+
+func TestSQLRow_blobAndNoKey(t *testing.T) {
+	blob := []byte("blob")
+	e := &backupfile.Entity{
+		Properties: []*backupfile.Property{{Name: "Data", Value: blob}},
+	}
+	columns := []*sqlColumn{
+		{Name: "__key__", Type: SQLColumnString},
+		{Name: "Data", Type: SQLColumnBytes},
+	}
+
+	row, err := sqlRow(columns, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(blob, "xxxx")
+	if e, g := []interface{}{nil, []byte("blob")}, row; !reflect.DeepEqual(e, g) {
+		t.Errorf("expected %#v; got %#v", e, g)
+	}
+}
+
+func TestSQLSink_queries(t *testing.T) {
+	sink := &SQLSink{Dialect: PostgreSQLDialect{}, TablePrefix: "ds_"}
+	columns := []*sqlColumn{
+		{Name: "__key__", Type: SQLColumnString},
+		{Name: "Title", Type: SQLColumnString},
+		{Name: "Views", Type: SQLColumnInteger},
+		{Name: "Tags", Type: SQLColumnJSON},
+		{Name: "Author", Type: SQLColumnString},
+		{Name: "Location", Type: SQLColumnJSON},
+		{Name: "Deleted", Type: SQLColumnBoolean},
+		{Name: "Missing", Type: SQLColumnTimestamp},
+	}
+
+	queries := sink.createTableQueries("ds_Article", columns)
+	if e, g := []string{
+		`DROP TABLE IF EXISTS "ds_Article"`,
+		`CREATE TABLE "ds_Article" ("__key__" TEXT, "Title" TEXT, "Views" BIGINT, "Tags" JSONB, "Author" TEXT, "Location" JSONB, "Deleted" BOOLEAN, "Missing" TIMESTAMP WITH TIME ZONE)`,
+	}, queries; !reflect.DeepEqual(e, g) {
+		t.Errorf("expected %#v; got %#v", e, g)
+	}
+
+	row, err := sqlRow(columns, testEntity())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := []interface{}{`/User,"alice"/Article,2`, "Hello", int64(20), `["go","datastore"]`, `/User,"alice"`, `{"lat":35.6,"lng":139.7}`, nil, nil}, row; !reflect.DeepEqual(e, g) {
+		t.Errorf("expected %#v; got %#v", e, g)
+	}
+
+	query, args := sink.insertQuery("ds_Article", columns[:2], [][]interface{}{{"a", "x"}, {"b", "y"}})
+	if e, g := `INSERT INTO "ds_Article" ("__key__", "Title") VALUES ($1, $2), ($3, $4)`, query; e != g {
+		t.Errorf("expected %s; got %s", e, g)
+	}
+	if e, g := []interface{}{"a", "x", "b", "y"}, args; !reflect.DeepEqual(e, g) {
+		t.Errorf("expected %#v; got %#v", e, g)
+	}
+}
@@ -0,0 +1,259 @@
+package ds2bq
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/api/bigquery/v2"
+	"google.golang.org/appengine"
+)
+
+// TableRetention is the retention policy of dated snapshot tables like Article_20171114,
+// which are created by GCSWatcherWithDatedTable.
+type TableRetention struct {
+	// ProjectID of the dataset. default is the app ID.
+	ProjectID string
+	DatasetID string
+	// Kinds of the tables. required. Only tables named kind + "_" + date are targets.
+	Kinds []string
+	// DateLayout of the table suffix. default is "20060102", same as GCSWatcherWithDatedTable.
+	DateLayout string
+	// RetainFor is the age of the table by its date to be removed. required.
+	RetainFor time.Duration
+	// KeepLatest is the number of the newest tables of each kind that are always kept. default is 1.
+	KeepLatest int
+	// Expire sets expirationTime of the table instead of deleting it, then BigQuery deletes it.
+	Expire bool
+	// DryRun reports the tables to be removed without changing anything.
+	DryRun bool
+}
+
+// Actions of TableRetentionResult.
+const (
+	TableRetentionActionKeep   = "keep"
+	TableRetentionActionDelete = "delete"
+	TableRetentionActionExpire = "expire"
+)
+
+// TableRetentionResult is the action on a dated table.
+type TableRetentionResult struct {
+	TableID        string     `json:"tableId"`
+	Kind           string     `json:"kind"`
+	Date           time.Time  `json:"date"`
+	Action         string     `json:"action"`
+	ExpirationTime *time.Time `json:"expirationTime,omitempty"`
+	Error          string     `json:"error,omitempty"`
+}
+
+// TableRetentionReport is the result of applying TableRetention.
+type TableRetentionReport struct {
+	DatasetID string                  `json:"datasetId"`
+	DryRun    bool                    `json:"dryRun"`
+	Threshold time.Time               `json:"threshold"`
+	Tables    []*TableRetentionResult `json:"tables"`
+}
+
+type managementTableRetentionOption struct {
+	TableRetention *TableRetention
+}
+
+func (o *managementTableRetentionOption) implements(s *datastoreManagementService) {
+	s.TableRetention = o.TableRetention
+}
+
+// ManagementWithTableRetention provides the retention policy of dated snapshot tables.
+// The endpoint that applies it is registered only if this option is used.
+// The endpoint fails without removing any table if the policy is invalid, see TableRetention for required fields.
+func ManagementWithTableRetention(r *TableRetention) ManagementOption {
+	return &managementTableRetentionOption{
+		TableRetention: r,
+	}
+}
+
+type managementTableRetentionURLOption struct {
+	ExpireOldTablesURL string
+}
+
+func (o *managementTableRetentionURLOption) implements(s *datastoreManagementService) {
+	if v := o.ExpireOldTablesURL; v != "" {
+		s.ExpireOldTablesURL = v
+	}
+}
+
+// ManagementWithTableRetentionURL provides endpoint URL that applies the retention policy of dated snapshot tables.
+func ManagementWithTableRetentionURL(expireOldTablesURL string) ManagementOption {
+	return &managementTableRetentionURLOption{
+		ExpireOldTablesURL: expireOldTablesURL,
+	}
+}
+
+func (r *TableRetention) validate() error {
+	if r.DatasetID == "" {
+		return errors.New("ds2bq: DatasetID of TableRetention is required")
+	}
+	if len(r.Kinds) == 0 {
+		return errors.New("ds2bq: Kinds of TableRetention is required")
+	}
+	if r.RetainFor <= 0 {
+		return errors.New("ds2bq: RetainFor of TableRetention must be positive")
+	}
+	return nil
+}
+
+func (r *TableRetention) dateLayout() string {
+	if r.DateLayout == "" {
+		return "20060102"
+	}
+	return r.DateLayout
+}
+
+// parseTableID returns the kind and the date of the dated table.
+// It reports false if tableID is not a dated table of the target kinds.
+func (r *TableRetention) parseTableID(tableID string) (string, time.Time, bool) {
+	layout := r.dateLayout()
+	for _, kind := range r.Kinds {
+		if !strings.HasPrefix(tableID, kind+"_") {
+			continue
+		}
+		t, err := time.Parse(layout, tableID[len(kind)+1:])
+		if err == nil {
+			return kind, t, true
+		}
+	}
+	return "", time.Time{}, false
+}
+
+// plan returns actions on tables.
+func (r *TableRetention) plan(tables []*bigquery.TableListTables, now time.Time) []*TableRetentionResult {
+	keepLatest := r.KeepLatest
+	if keepLatest < 1 {
+		keepLatest = 1
+	}
+	threshold := now.Add(-r.RetainFor)
+
+	var results []*TableRetentionResult
+	expirations := make(map[*TableRetentionResult]int64)
+	for _, table := range tables {
+		if table.Type != "" && table.Type != "TABLE" {
+			continue
+		}
+		kind, date, ok := r.parseTableID(table.TableReference.TableId)
+		if !ok {
+			continue
+		}
+		result := &TableRetentionResult{
+			TableID: table.TableReference.TableId,
+			Kind:    kind,
+			Date:    date,
+			Action:  TableRetentionActionKeep,
+		}
+		results = append(results, result)
+		expirations[result] = table.ExpirationTime
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Kind != results[j].Kind {
+			return results[i].Kind < results[j].Kind
+		}
+		return results[i].Date.After(results[j].Date)
+	})
+
+	n := 0
+	for i, result := range results {
+		if i == 0 || results[i-1].Kind != result.Kind {
+			n = 0
+		}
+		n++
+		if n <= keepLatest {
+			continue
+		}
+
+		if !r.Expire {
+			if result.Date.Before(threshold) {
+				result.Action = TableRetentionActionDelete
+			}
+			continue
+		}
+
+		// expirationTime must be in the future.
+		expiration := result.Date.Add(r.RetainFor)
+		if expiration.Before(now) {
+			expiration = now.Add(time.Hour)
+		}
+		if current := expirations[result]; current != 0 && current <= toMillis(expiration) {
+			continue
+		}
+		result.Action = TableRetentionActionExpire
+		result.ExpirationTime = &expiration
+	}
+
+	return results
+}
+
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// applyTableRetention removes the dated tables beyond the retention policy.
+// Failures on each table are recorded in the report, not returned.
+func applyTableRetention(c context.Context, r *TableRetention, dryRun bool) (*TableRetentionReport, error) {
+	if err := r.validate(); err != nil {
+		return nil, err
+	}
+
+	projectID := r.ProjectID
+	if projectID == "" {
+		projectID = appengine.AppID(c)
+	}
+	now := time.Now()
+	report := &TableRetentionReport{
+		DatasetID: r.DatasetID,
+		DryRun:    dryRun || r.DryRun,
+		Threshold: now.Add(-r.RetainFor),
+	}
+
+	bqs, err := newBigQueryService(c)
+	if err != nil {
+		return nil, err
+	}
+
+	var tables []*bigquery.TableListTables
+	err = bqs.Tables.List(projectID, r.DatasetID).Pages(c, func(list *bigquery.TableList) error {
+		tables = append(tables, list.Tables...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report.Tables = r.plan(tables, now)
+	for _, result := range report.Tables {
+		if result.Action == TableRetentionActionKeep {
+			continue
+		}
+		fields := []Field{F(FieldKind, result.Kind), F("table", result.TableID), F("action", result.Action), F("dryRun", report.DryRun)}
+		if report.DryRun {
+			logInfo(c, "ds2bq: table should be removed", fields...)
+			continue
+		}
+
+		switch result.Action {
+		case TableRetentionActionDelete:
+			err = bqs.Tables.Delete(projectID, r.DatasetID, result.TableID).Context(c).Do()
+		case TableRetentionActionExpire:
+			_, err = bqs.Tables.Patch(projectID, r.DatasetID, result.TableID, &bigquery.Table{
+				ExpirationTime: toMillis(*result.ExpirationTime),
+			}).Context(c).Do()
+		}
+		if err != nil {
+			result.Error = err.Error()
+			logWarning(c, "ds2bq: failed to remove table", append(fields, F(FieldError, err))...)
+			continue
+		}
+		logInfo(c, "ds2bq: table removed", fields...)
+	}
+
+	return report, nil
+}
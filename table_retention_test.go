@@ -0,0 +1,114 @@
+package ds2bq
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/api/bigquery/v2"
+)
+
+func TestTableRetention_parseTableID(t *testing.T) {
+	for i, tc := range []struct {
+		retention *TableRetention
+		tableID   string
+		kind      string
+		date      string
+		ok        bool
+	}{
+		{&TableRetention{Kinds: []string{"Article"}}, "Article_20171114", "Article", "2017-11-14", true},
+		{&TableRetention{Kinds: []string{"User", "User_Profile"}}, "User_Profile_20171114", "User_Profile", "2017-11-14", true},
+		{&TableRetention{Kinds: []string{"Article"}}, "Article_latest", "", "", false},
+		{&TableRetention{Kinds: []string{"Article"}}, "Article", "", "", false},
+		{&TableRetention{Kinds: []string{"Article"}, DateLayout: "2006_01_02"}, "Article_2017_11_14", "Article", "2017-11-14", true},
+		{&TableRetention{}, "Article_20171114", "", "", false},
+		{&TableRetention{Kinds: []string{"User"}}, "Article_20171114", "", "", false},
+		{&TableRetention{Kinds: []string{"User"}}, "User_20171114", "User", "2017-11-14", true},
+	} {
+		kind, date, ok := tc.retention.parseTableID(tc.tableID)
+		if ok != tc.ok {
+			t.Errorf("%02d: expected %v; got %v", i, tc.ok, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if e, g := tc.kind, kind; e != g {
+			t.Errorf("%02d: expected %s; got %s", i, e, g)
+		}
+		if e, g := tc.date, date.Format("2006-01-02"); e != g {
+			t.Errorf("%02d: expected %s; got %s", i, e, g)
+		}
+	}
+}
+
+func TestTableRetention_plan(t *testing.T) {
+	table := func(tableID string) *bigquery.TableListTables {
+		return &bigquery.TableListTables{
+			TableReference: &bigquery.TableReference{TableId: tableID},
+			Type:           "TABLE",
+		}
+	}
+	tables := []*bigquery.TableListTables{
+		table("Article_20171101"),
+		table("Article_20171110"),
+		table("Article_20171114"),
+		table("User_20171101"),
+		{TableReference: &bigquery.TableReference{TableId: "Article_latest"}, Type: "VIEW"},
+	}
+	now := time.Date(2017, 11, 15, 0, 0, 0, 0, time.UTC)
+
+	r := &TableRetention{Kinds: []string{"Article", "User"}, RetainFor: 7 * 24 * time.Hour}
+	actions := make(map[string]string)
+	for _, result := range r.plan(tables, now) {
+		actions[result.TableID] = result.Action
+	}
+	for tableID, e := range map[string]string{
+		"Article_20171101": TableRetentionActionDelete,
+		"Article_20171110": TableRetentionActionKeep,
+		"Article_20171114": TableRetentionActionKeep,
+		"User_20171101":    TableRetentionActionKeep, // the latest of User
+	} {
+		if g := actions[tableID]; e != g {
+			t.Errorf("%s: expected %s; got %s", tableID, e, g)
+		}
+	}
+	if _, ok := actions["Article_latest"]; ok {
+		t.Error("unexpected view")
+	}
+
+	r = &TableRetention{RetainFor: 7 * 24 * time.Hour, Expire: true}
+	for _, result := range r.plan(tables, now) {
+		switch result.TableID {
+		case "Article_20171101":
+			if e, g := now.Add(time.Hour), *result.ExpirationTime; !e.Equal(g) {
+				t.Errorf("expected %s; got %s", e, g)
+			}
+		case "Article_20171110":
+			if e, g := time.Date(2017, 11, 17, 0, 0, 0, 0, time.UTC), *result.ExpirationTime; !e.Equal(g) {
+				t.Errorf("expected %s; got %s", e, g)
+			}
+		default:
+			if e, g := TableRetentionActionKeep, result.Action; e != g {
+				t.Errorf("%s: expected %s; got %s", result.TableID, e, g)
+			}
+		}
+	}
+}
+
+func TestTableRetention_validate(t *testing.T) {
+	for i, tc := range []struct {
+		retention *TableRetention
+		ok        bool
+	}{
+		{&TableRetention{DatasetID: "d", Kinds: []string{"Article"}, RetainFor: time.Hour}, true},
+		{&TableRetention{Kinds: []string{"Article"}, RetainFor: time.Hour}, false},
+		{&TableRetention{DatasetID: "d", RetainFor: time.Hour}, false},
+		{&TableRetention{DatasetID: "d", Kinds: []string{"Article"}}, false},
+		{&TableRetention{DatasetID: "d", Kinds: []string{"Article"}, RetainFor: -time.Hour}, false},
+	} {
+		err := tc.retention.validate()
+		if e, g := tc.ok, err == nil; e != g {
+			t.Errorf("%02d: expected %v; got %v", i, e, err)
+		}
+	}
+}
@@ -1,9 +1,11 @@
 package ds2bq
 
 import (
+	"context"
+	"encoding/json"
 	"net/http"
+	"time"
 
-	"google.golang.org/appengine"
 	"google.golang.org/appengine/taskqueue"
 )
 
@@ -11,28 +13,24 @@ func isInTaskqueue(r *http.Request, queueName string) bool {
 	return r.Header.Get("X-AppEngine-QueueName") == queueName
 }
 
-func delegateToTaskqueue(r *http.Request, queueName string) (*taskqueue.Task, error) {
-	var t *taskqueue.Task
-	switch r.Method {
-	case "POST", "PUT":
-		err := r.ParseForm()
-		if err != nil {
-			return nil, err
-		}
-		t = taskqueue.NewPOSTTask(r.URL.Path, r.Form)
-		// PUT
-		t.Method = r.Method
-	default:
-		t = &taskqueue.Task{
-			Method: r.Method,
-			Path:   r.URL.String(),
-		}
-	}
-
-	c := appengine.NewContext(r)
-	t, err := taskqueue.Add(c, t, queueName)
+// addJSONTask adds the task that posts v as JSON to path.
+// The name is optional. If it is given, the task is added only once and taskqueue.ErrTaskAlreadyAdded is returned for the name already added.
+func addJSONTask(c context.Context, name, path, queueName string, v interface{}, delay time.Duration) (*taskqueue.Task, error) {
+	b, err := json.MarshalIndent(v, "", "  ")
 	if err != nil {
 		return nil, err
 	}
-	return t, nil
+
+	h := make(http.Header)
+	h.Set("Content-Type", "application/json")
+	t := &taskqueue.Task{
+		Path:    path,
+		Payload: b,
+		Header:  h,
+		Method:  "POST",
+		Delay:   delay,
+		Name:    name,
+	}
+
+	return taskqueue.Add(c, t, queueName)
 }
@@ -0,0 +1,166 @@
+package ds2bq
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"text/template"
+	"time"
+
+	"google.golang.org/api/bigquery/v2"
+	"google.golang.org/api/googleapi"
+)
+
+// Transform is a SQL that runs as a BigQuery query job after the load job of the kind is done.
+type Transform struct {
+	// SQL is text/template of standard SQL. TransformParams is passed to the template.
+	// e.g. SELECT __key__.name AS id, * EXCEPT(__key__, __error__, __has_error__) FROM {{.SourceTable}} WHERE {{.SourceFilter}}
+	SQL string `json:"sql"`
+	// DatasetID of the destination table. default is the dataset of the load job.
+	DatasetID string `json:"dataset"`
+	// DestinationTable is text/template of the destination table ID. TransformParams is passed to the template.
+	// e.g. {{.Kind}}_flat
+	DestinationTable string `json:"destinationTable"`
+	// WriteDisposition of the query job. default is WRITE_TRUNCATE.
+	WriteDisposition string `json:"writeDisposition"`
+
+	parseOnce sync.Once
+	parseErr  error
+	sqlTmpl   *template.Template
+	tableTmpl *template.Template
+}
+
+// TransformParams is values available in templates of Transform.
+type TransformParams struct {
+	// SourceTable is the table loaded from the backup, like `project.dataset.Article`.
+	SourceTable string
+	// SourceFilter is the condition to select rows of the backup from SourceTable, TRUE or condition of _PARTITIONTIME.
+	SourceFilter string
+	ProjectID    string
+	DatasetID    string
+	TableID      string
+	Kind         string
+	Namespace    string
+	BackupTime   time.Time
+}
+
+type gcsWatcherTransformOption struct {
+	KindName  string
+	Transform *Transform
+}
+
+func (o *gcsWatcherTransformOption) implements(s *gcsWatcherService) {
+	if s.Transforms == nil {
+		s.Transforms = make(map[string]*Transform)
+	}
+	s.Transforms[o.KindName] = o.Transform
+}
+
+// GCSWatcherWithTransform provides the SQL that transforms the table loaded from backup of the kind.
+func GCSWatcherWithTransform(kindName string, t *Transform) GCSWatcherOption {
+	return &gcsWatcherTransformOption{
+		KindName:  kindName,
+		Transform: t,
+	}
+}
+
+// parse parses templates once, Build of the shared Transform may be called concurrently.
+func (t *Transform) parse() error {
+	t.parseOnce.Do(func() {
+		t.parseErr = t.parseTemplates()
+	})
+	return t.parseErr
+}
+
+func (t *Transform) parseTemplates() error {
+	if t.SQL == "" || t.DestinationTable == "" {
+		return fmt.Errorf("ds2bq: SQL and DestinationTable of Transform are required")
+	}
+	switch t.WriteDisposition {
+	case "", "WRITE_TRUNCATE", "WRITE_APPEND", "WRITE_EMPTY":
+	default:
+		return fmt.Errorf("ds2bq: unknown WriteDisposition %s", t.WriteDisposition)
+	}
+
+	sqlTmpl, err := template.New("sql").Parse(t.SQL)
+	if err != nil {
+		return err
+	}
+	tableTmpl, err := template.New("table").Parse(t.DestinationTable)
+	if err != nil {
+		return err
+	}
+	t.sqlTmpl, t.tableTmpl = sqlTmpl, tableTmpl
+	return nil
+}
+
+// Build returns the SQL and the destination table ID.
+func (t *Transform) Build(params *TransformParams) (string, string, error) {
+	if err := t.parse(); err != nil {
+		return "", "", err
+	}
+
+	sql := &bytes.Buffer{}
+	if err := t.sqlTmpl.Execute(sql, params); err != nil {
+		return "", "", err
+	}
+	table := &bytes.Buffer{}
+	if err := t.tableTmpl.Execute(table, params); err != nil {
+		return "", "", err
+	}
+	return sql.String(), table.String(), nil
+}
+
+func (s *gcsWatcherService) insertTransformJob(c context.Context, bqs *bigquery.Service, req *ImportJobStatusReq, t *Transform) error {
+	source, filter, err := req.sourceTable()
+	if err != nil {
+		return err
+	}
+	sql, tableID, err := t.Build(&TransformParams{
+		SourceTable:  source,
+		SourceFilter: filter,
+		ProjectID:    req.ProjectID,
+		DatasetID:    req.DatasetID,
+		TableID:      req.TableID,
+		Kind:         req.Import.KindName,
+		Namespace:    req.Import.Namespace,
+		BackupTime:   req.Import.snapshotTime(),
+	})
+	if err != nil {
+		return err
+	}
+
+	datasetID := t.DatasetID
+	if datasetID == "" {
+		datasetID = req.DatasetID
+	}
+	writeDisposition := t.WriteDisposition
+	if writeDisposition == "" {
+		writeDisposition = "WRITE_TRUNCATE"
+	}
+
+	job := &bigquery.Job{
+		JobReference: req.stageJobReference(importStageTransform),
+		Configuration: &bigquery.JobConfiguration{
+			Query: &bigquery.JobConfigurationQuery{
+				Query:        sql,
+				UseLegacySql: googleapi.Bool(false),
+				DestinationTable: &bigquery.TableReference{
+					ProjectId: req.ProjectID,
+					DatasetId: datasetID,
+					TableId:   tableID,
+				},
+				CreateDisposition: "CREATE_IF_NEEDED",
+				WriteDisposition:  writeDisposition,
+			},
+		},
+	}
+	job, err = insertJob(c, bqs, job)
+	if err != nil {
+		return err
+	}
+	logInfo(c, "ds2bq: transform job submitted", F(FieldKind, req.Import.KindName), F(FieldJobID, job.JobReference.JobId), F("table", tableID))
+
+	return s.addImportJobStatusTask(c, req.next(importStageTransform, job.JobReference))
+}
@@ -0,0 +1,65 @@
+package ds2bq
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTransform_Build(t *testing.T) {
+	tr := &Transform{
+		SQL:              "SELECT __key__.name AS id, '{{.Namespace}}' AS ns FROM {{.SourceTable}} WHERE {{.SourceFilter}}",
+		DestinationTable: `{{.Kind}}_flat_{{.BackupTime.Format "20060102"}}`,
+	}
+
+	sql, table, err := tr.Build(&TransformParams{
+		SourceTable:  "`p.d.Article`",
+		SourceFilter: "TRUE",
+		Kind:         "Article",
+		Namespace:    "ns1",
+		BackupTime:   time.Date(2017, 11, 14, 0, 0, 0, 0, time.UTC),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := "SELECT __key__.name AS id, 'ns1' AS ns FROM `p.d.Article` WHERE TRUE", sql; e != g {
+		t.Errorf("expected sql %s; got %s", e, g)
+	}
+	if e, g := "Article_flat_20171114", table; e != g {
+		t.Errorf("expected table %s; got %s", e, g)
+	}
+}
+
+func TestTransform_parse(t *testing.T) {
+	for _, tr := range []*Transform{
+		{SQL: "", DestinationTable: "t"},
+		{SQL: "SELECT 1", DestinationTable: "t", WriteDisposition: "WRITE_ANY"},
+		{SQL: "SELECT {{.Kind", DestinationTable: "t"},
+	} {
+		if err := tr.parse(); err == nil {
+			t.Errorf("expected error for %#v", tr)
+		}
+	}
+}
+
+func TestTransform_Build_concurrent(t *testing.T) {
+	tr := &Transform{
+		SQL:              "SELECT * FROM {{.SourceTable}}",
+		DestinationTable: "{{.Kind}}_flat",
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, table, err := tr.Build(&TransformParams{SourceTable: "`p.d.Article`", Kind: "Article"})
+			if err != nil {
+				t.Error(err)
+			} else if e, g := "Article_flat", table; e != g {
+				t.Errorf("expected table %s; got %s", e, g)
+			}
+		}()
+	}
+	wg.Wait()
+}